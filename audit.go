@@ -0,0 +1,48 @@
+package main
+
+// This file contains the audit trail endpoint:
+//
+//	GET /dict/:word/audit
+//
+// It returns the changes applied to the word by UpdateDict, the oldest
+// first, see dict.AuditTrail. Like the proposals it takes DICT_EDITOR_TOKEN
+// or DICT_ADMIN_TOKEN as bearer token.
+
+import (
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/harshjoeyit/word-dict/dict"
+)
+
+// registerAuditRoutes adds the audit endpoint if the tokens are configured
+func registerAuditRoutes(ge *gin.Engine) {
+	adminToken := os.Getenv("DICT_ADMIN_TOKEN")
+	if adminToken == "" {
+		log.Printf("DICT_ADMIN_TOKEN is not set, the audit trail is disabled")
+		return
+	}
+
+	ge.GET("/dict/:word/audit", requireToken(os.Getenv("DICT_EDITOR_TOKEN"), adminToken), auditHandler)
+}
+
+// auditHandler returns the audit trail of the word
+func auditHandler(c *gin.Context) {
+	word := c.Param("word")
+
+	records, err := dict.AuditTrail(word)
+	if err != nil {
+		log.Printf("error reading audit trail of %s: %v", word, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to read the audit trail",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"word":    word,
+		"records": records,
+	})
+}
@@ -0,0 +1,677 @@
+package main
+
+// This file contains the subcommands of the command line. Without a
+// subcommand the HTTP server is started.
+//
+//	word-dict inspect [-stats] [-limit n] [dict.dat]
+//	word-dict verify [dict.dat]
+//	word-dict repair [-o out.dat] [dict.dat]
+//	word-dict shard [-n 8] [-by range|hash] [-o manifest.json] [words.jsonl]
+//	word-dict keygen [-aes] [-o name]
+//	word-dict sign -key name.key [dict.dat|manifest.json]
+//	word-dict delta [-f changes.jsonl] [dict.dat]
+//	word-dict compact [dict.dat]
+//	word-dict apply-proposals
+//	word-dict history [-rebuild] [word]
+//	word-dict merge [-strategy prefer-left|prefer-right|concatenate|review] [-review conflicts.jsonl] [-o merged.dat] source...
+//	word-dict extract [-words words.txt] [-prefix p] [-from a] [-to b] [-tags t1,t2] [-o extract.dat] [dict.dat]
+//	word-dict import -format stardict|dictd|jsonl [-fields field=path,...] [-o dict.dat|words.jsonl] source
+//	word-dict export -format stardict|dictd|jsonl|csv [-o path] [dict.dat]
+//	word-dict migrate [-o out.dat] [dict.dat]
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/harshjoeyit/word-dict/dict"
+)
+
+// runCommand runs the subcommand args[0] with the rest of args
+func runCommand(args []string) error {
+	switch args[0] {
+	case "inspect":
+		return inspectCommand(args[1:])
+	case "verify":
+		return verifyCommand(args[1:])
+	case "repair":
+		return repairCommand(args[1:])
+	case "shard":
+		return shardCommand(args[1:])
+	case "keygen":
+		return keygenCommand(args[1:])
+	case "sign":
+		return signCommand(args[1:])
+	case "delta":
+		return deltaCommand(args[1:])
+	case "compact":
+		return compactCommand(args[1:])
+	case "apply-proposals":
+		return applyProposalsCommand(args[1:])
+	case "history":
+		return historyCommand(args[1:])
+	case "merge":
+		return mergeCommand(args[1:])
+	case "extract":
+		return extractCommand(args[1:])
+	case "import":
+		return importCommand(args[1:])
+	case "export":
+		return exportCommand(args[1:])
+	case "migrate":
+		return migrateCommand(args[1:])
+	}
+
+	return fmt.Errorf("unknown command %q, expected inspect, verify, repair, shard, keygen, sign, delta, compact, apply-proposals, history, merge, extract, import, export or migrate", args[0])
+}
+
+// pathArg returns the dictionary path given to a command, dict.dat by default
+func pathArg(fs *flag.FlagSet) string {
+	if fs.NArg() > 0 {
+		return fs.Arg(0)
+	}
+	return "dict.dat"
+}
+
+// encryptionOption returns the option with the key of encrypted
+// dictionaries from DICT_ENCRYPTION_KEY or DICT_ENCRYPTION_KEY_FILE
+func encryptionOption() (dict.Option, error) {
+	key, err := dict.EncryptionKeyFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("error reading encryption key: %v", err)
+	}
+
+	return dict.WithEncryptionKey(key), nil
+}
+
+// inspectCommand dumps the header, the sections and the index records of a
+// dictionary file, and optionally its statistics
+func inspectCommand(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	stats := fs.Bool("stats", false, "print the statistics of the dictionary")
+	limit := fs.Int("limit", 0, "number of index records to print, 0 prints all")
+	fs.Parse(args)
+
+	path := pathArg(fs)
+
+	err := dict.Inspect(os.Stdout, path, *limit)
+	if err != nil {
+		return err
+	}
+
+	if !*stats {
+		return nil
+	}
+
+	enc, err := encryptionOption()
+	if err != nil {
+		return err
+	}
+
+	d, err := dict.Open(path, enc)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	st, err := d.Stats()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("\nstats:\n")
+	fmt.Printf("entries:        %d\n", st.Entries)
+	fmt.Printf("index bytes:    %d\n", st.IndexBytes)
+	fmt.Printf("data bytes:     %d\n", st.DataBytes)
+	fmt.Printf("definitions:    min %d, max %d (%s), avg %.1f bytes\n", st.MinDefinition, st.MaxDefinition, st.LongestWord, st.AvgDefinition)
+
+	return nil
+}
+
+// verifyCommand checks a dictionary file against its checksums and reports
+// the corrupted ranges
+func verifyCommand(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fs.Parse(args)
+
+	path := pathArg(fs)
+
+	corrupt, err := dict.VerifyFile(path)
+	if err != nil {
+		return err
+	}
+
+	if len(corrupt) == 0 {
+		fmt.Printf("%s: ok\n", path)
+		return nil
+	}
+
+	for _, c := range corrupt {
+		fmt.Printf("%s: corrupted %s\n", path, c)
+	}
+
+	return fmt.Errorf("%d corrupted ranges in %s, see repair", len(corrupt), path)
+}
+
+// repairCommand rebuilds a dictionary file from its intact entries
+func repairCommand(args []string) error {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	out := fs.String("o", "", "path of the repaired dictionary, <path>.repaired by default")
+	fs.Parse(args)
+
+	path := pathArg(fs)
+	if *out == "" {
+		*out = path + ".repaired"
+	}
+
+	enc, err := encryptionOption()
+	if err != nil {
+		return err
+	}
+
+	kept, dropped, err := dict.Repair(path, *out, enc)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: kept %d entries, dropped %d corrupted entries\n", *out, kept, dropped)
+
+	return nil
+}
+
+// shardCommand splits the dictionary built from a source file into shards
+// described by a manifest. The keys come from the environment like for
+// BuildNewDict.
+func shardCommand(args []string) error {
+	fs := flag.NewFlagSet("shard", flag.ExitOnError)
+	n := fs.Int("n", 8, "number of shards")
+	by := fs.String("by", string(dict.PartitionRange), "partition of the keys, range or hash")
+	out := fs.String("o", "manifest.json", "path of the manifest, the shards are written next to it")
+	fs.Parse(args)
+
+	src := "words.jsonl"
+	if fs.NArg() > 0 {
+		src = fs.Arg(0)
+	} else if _, err := os.Stat(src); err != nil {
+		src = "words.dat"
+	}
+
+	encKey, err := dict.EncryptionKeyFromEnv()
+	if err != nil {
+		return fmt.Errorf("error reading encryption key: %v", err)
+	}
+
+	strip, err := dict.StripDiacriticsFromEnv()
+	if err != nil {
+		return err
+	}
+
+	opts := dict.BuildOptions{EncryptionKey: encKey, StripDiacritics: strip}
+	opts.SigningKey, err = dict.SigningKeyFromEnv()
+	if err != nil {
+		return fmt.Errorf("error reading signing key: %v", err)
+	}
+
+	err = dict.BuildSharded(src, *out, *n, dict.Partition(*by), opts)
+	if err != nil {
+		return err
+	}
+
+	m, err := dict.ReadManifest(*out)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range m.Shards {
+		fmt.Printf("%s: %d entries\n", s.Path, s.Entries)
+	}
+
+	return nil
+}
+
+// keygenCommand generates an Ed25519 key pair to sign dictionaries with:
+// <name>.key holds the base64 encoded seed of the private key and
+// <name>.pub the base64 encoded public key, to add to DICT_PUBLIC_KEYS.
+// With -aes it generates an encryption key into <name>.aes instead, for
+// DICT_ENCRYPTION_KEY_FILE.
+func keygenCommand(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	name := fs.String("o", "dict", "name of the key files")
+	aes := fs.Bool("aes", false, "generate an AES-256 encryption key")
+	fs.Parse(args)
+
+	if *aes {
+		key, err := dict.NewEncryptionKey()
+		if err != nil {
+			return err
+		}
+
+		err = os.WriteFile(*name+".aes", []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("key id %s: encryption key %s.aes\n", dict.EncryptionKeyID(key), *name)
+
+		return nil
+	}
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(*name+".key", []byte(base64.StdEncoding.EncodeToString(priv.Seed())+"\n"), 0600)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(*name+".pub", []byte(base64.StdEncoding.EncodeToString(pub)+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("key id %s: private key %s.key, public key %s.pub\n", dict.KeyID(pub), *name, *name)
+
+	return nil
+}
+
+// signCommand signs a dictionary file, writing the signature next to it,
+// or the manifest of a sharded dictionary along with the digests of its shards
+func signCommand(args []string) error {
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	keyPath := fs.String("key", "", "path of the private key, see keygen")
+	fs.Parse(args)
+
+	if *keyPath == "" {
+		return fmt.Errorf("missing -key")
+	}
+
+	priv, err := dict.ReadPrivateKey(*keyPath)
+	if err != nil {
+		return err
+	}
+
+	path := pathArg(fs)
+
+	if strings.HasSuffix(path, ".json") {
+		err = dict.SignManifest(path, priv)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s: signed with key %s\n", path, dict.KeyID(priv.Public().(ed25519.PublicKey)))
+		return nil
+	}
+
+	err = dict.SignFile(path, priv)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: signed with key %s\n", path+dict.SignatureExt, dict.KeyID(priv.Public().(ed25519.PublicKey)))
+
+	return nil
+}
+
+// deltaCommand writes the changes of a changes file as a new delta segment
+// of a dictionary, see dict.Change
+func deltaCommand(args []string) error {
+	fs := flag.NewFlagSet("delta", flag.ExitOnError)
+	changesPath := fs.String("f", "changes.jsonl", "path of the changes, one JSON change per line")
+	fs.Parse(args)
+
+	changes, err := dict.ReadChanges(*changesPath)
+	if err != nil {
+		return err
+	}
+
+	enc, err := encryptionOption()
+	if err != nil {
+		return err
+	}
+
+	segPath, err := dict.WriteSegment(pathArg(fs), changes, enc)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: %d changes\n", segPath, len(changes))
+
+	return nil
+}
+
+// compactCommand merges the delta segments of a dictionary into a new base file
+func compactCommand(args []string) error {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	fs.Parse(args)
+
+	path := pathArg(fs)
+
+	enc, err := encryptionOption()
+	if err != nil {
+		return err
+	}
+
+	err = dict.Compact(path, enc)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: compacted\n", path)
+
+	return nil
+}
+
+// applyProposalsCommand applies the approved proposals to the dictionary of
+// the current directory with UpdateDict
+func applyProposalsCommand(args []string) error {
+	fs := flag.NewFlagSet("apply-proposals", flag.ExitOnError)
+	fs.Parse(args)
+
+	store, err := dict.NewProposalStore()
+	if err != nil {
+		return err
+	}
+
+	n, err := dict.ApplyProposals(store)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("applied %d proposals\n", n)
+
+	return nil
+}
+
+// historyCommand prints the history of a word across the archived versions
+// of the dictionary, or rebuilds the history index from them
+func historyCommand(args []string) error {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	rebuild := fs.Bool("rebuild", false, "rebuild the history index from the archived versions")
+	fs.Parse(args)
+
+	if !*rebuild && fs.NArg() == 0 {
+		return fmt.Errorf("usage: history [-rebuild] [word]")
+	}
+
+	key, err := dict.EncryptionKeyFromEnv()
+	if err != nil {
+		return fmt.Errorf("error reading encryption key: %v", err)
+	}
+
+	if *rebuild {
+		err = dict.RebuildHistory("archive", key)
+		if err != nil {
+			return err
+		}
+		if fs.NArg() == 0 {
+			return nil
+		}
+	}
+
+	// The current entry comes from the shards if the dictionary is sharded
+	var d interface {
+		Lookup(word string) (*dict.Entry, bool)
+		Close()
+	}
+	if dict.ManifestExists() {
+		d, err = dict.OpenSharded("manifest.json", dict.WithEncryptionKey(key))
+	} else {
+		d, err = dict.Open("dict.dat", dict.WithEncryptionKey(key))
+	}
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	h, err := dict.NewHistory()
+	if err != nil {
+		return err
+	}
+
+	word := fs.Arg(0)
+	current, ok := d.Lookup(word)
+	if !ok {
+		current = nil
+	}
+
+	records, err := h.Word(word, current)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range records {
+		if r.Deleted {
+			fmt.Printf("%s\tdeleted\n", r.Version)
+			continue
+		}
+		fmt.Printf("%s\t%s\n", r.Version, r.Entry.Definition())
+	}
+
+	return nil
+}
+
+// mergeCommand merges the sorted sources, dict.dat or words.dat files, into
+// a new dictionary
+func mergeCommand(args []string) error {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	strategy := fs.String("strategy", string(dict.PreferLeft), "resolution of the conflicts, prefer-left, prefer-right, concatenate or review")
+	review := fs.String("review", "conflicts.jsonl", "file the conflicts are written to with the review strategy")
+	out := fs.String("o", "merged.dat", "path of the merged dictionary")
+	fs.Parse(args)
+
+	// The key decrypts the dictionaries merged and encrypts the merged one
+	encKey, err := dict.EncryptionKeyFromEnv()
+	if err != nil {
+		return fmt.Errorf("error reading encryption key: %v", err)
+	}
+
+	strip, err := dict.StripDiacriticsFromEnv()
+	if err != nil {
+		return err
+	}
+
+	opts := dict.MergeOptions{
+		Strategy:   dict.MergeStrategy(*strategy),
+		ReviewPath: *review,
+		Build:      dict.BuildOptions{EncryptionKey: encKey, StripDiacritics: strip},
+		Options:    []dict.Option{dict.WithEncryptionKey(encKey)},
+	}
+	opts.Build.SigningKey, err = dict.SigningKeyFromEnv()
+	if err != nil {
+		return fmt.Errorf("error reading signing key: %v", err)
+	}
+
+	conflicts, err := dict.Merge(fs.Args(), *out, opts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: merged %d sources, %d conflicts\n", *out, fs.NArg(), conflicts)
+	if opts.Strategy == dict.ReviewConflicts && conflicts > 0 {
+		fmt.Printf("conflicts written to %s\n", *review)
+	}
+
+	return nil
+}
+
+// extractCommand writes the entries of a dictionary selected by the words of
+// an allow-list file, one per line, a prefix, a key range or tags into a new
+// dictionary
+func extractCommand(args []string) error {
+	fs := flag.NewFlagSet("extract", flag.ExitOnError)
+	wordsPath := fs.String("words", "", "file of the words to extract, one per line")
+	prefix := fs.String("prefix", "", "extract the words starting with the prefix")
+	from := fs.String("from", "", "extract the words from this one on")
+	to := fs.String("to", "", "extract the words before this one")
+	tags := fs.String("tags", "", "extract the entries with one of the comma separated tags")
+	out := fs.String("o", "extract.dat", "path of the extracted dictionary")
+	fs.Parse(args)
+
+	path := pathArg(fs)
+
+	// The key decrypts the dictionary and encrypts the extract
+	encKey, err := dict.EncryptionKeyFromEnv()
+	if err != nil {
+		return fmt.Errorf("error reading encryption key: %v", err)
+	}
+
+	opts := dict.ExtractOptions{
+		Prefix:        *prefix,
+		From:          *from,
+		To:            *to,
+		EncryptionKey: encKey,
+	}
+	if *tags != "" {
+		opts.Tags = strings.Split(*tags, ",")
+	}
+	if *wordsPath != "" {
+		data, err := os.ReadFile(*wordsPath)
+		if err != nil {
+			return err
+		}
+		for _, w := range strings.Split(string(data), "\n") {
+			if w = strings.TrimSpace(w); w != "" {
+				opts.Words = append(opts.Words, w)
+			}
+		}
+	}
+	opts.SigningKey, err = dict.SigningKeyFromEnv()
+	if err != nil {
+		return fmt.Errorf("error reading signing key: %v", err)
+	}
+
+	n, err := dict.Extract(path, *out, opts, dict.WithEncryptionKey(encKey))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: extracted %d entries\n", *out, n)
+
+	return nil
+}
+
+// importCommand builds a dictionary, or a words.jsonl source file if the
+// output ends with .jsonl, from a dictionary in another format
+func importCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	format := fs.String("format", "", "format of the source, stardict, dictd or jsonl")
+	fields := fs.String("fields", "", "mapping of the fields of jsonl sources, e.g. definition=glosses,pronunciation=sounds.ipa")
+	out := fs.String("o", "dict.dat", "path of the built dictionary, or of a source file ending with .jsonl")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected the path of the source to import")
+	}
+
+	fm, err := dict.ParseFieldMap(*fields)
+	if err != nil {
+		return err
+	}
+	opts := dict.ImportOptions{Format: dict.ImportFormat(*format), Fields: &fm}
+
+	var stats dict.ImportStats
+	if strings.HasSuffix(*out, ".jsonl") {
+		stats, err = dict.ImportSource(fs.Arg(0), *out, opts)
+	} else {
+		var buildOpts dict.BuildOptions
+		buildOpts.EncryptionKey, err = dict.EncryptionKeyFromEnv()
+		if err != nil {
+			return fmt.Errorf("error reading encryption key: %v", err)
+		}
+		buildOpts.StripDiacritics, err = dict.StripDiacriticsFromEnv()
+		if err != nil {
+			return err
+		}
+		buildOpts.SigningKey, err = dict.SigningKeyFromEnv()
+		if err != nil {
+			return fmt.Errorf("error reading signing key: %v", err)
+		}
+
+		stats, err = dict.Import(fs.Arg(0), *out, opts, buildOpts)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: imported %d entries, skipped %d\n", *out, stats.Imported, stats.Skipped)
+
+	return nil
+}
+
+// exportCommand writes the entries of a dictionary in another format to the
+// output file, or to stdout without one. StarDict and dictd dictionaries
+// are written next to the output, or to stdout as a tar archive.
+func exportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "", "format of the export, stardict, dictd, jsonl or csv")
+	out := fs.String("o", "", "path of the export, stdout by default")
+	fs.Parse(args)
+
+	f, err := dict.ParseExportFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	opt, err := encryptionOption()
+	if err != nil {
+		return err
+	}
+
+	d, err := dict.Open(pathArg(fs), opt)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	if *out == "" {
+		_, err = dict.Export(context.Background(), os.Stdout, d, f, "dict")
+		return err
+	}
+
+	n, err := dict.ExportFile(context.Background(), *out, d, f)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: exported %d entries\n", *out, n)
+
+	return nil
+}
+
+// migrateCommand rewrites a dictionary of the legacy layout in the current
+// one, in place unless an output is given
+func migrateCommand(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	out := fs.String("o", "", "path of the migrated dictionary, the dictionary itself by default")
+	fs.Parse(args)
+
+	path := pathArg(fs)
+	if *out == "" {
+		*out = path
+	}
+
+	encKey, err := dict.EncryptionKeyFromEnv()
+	if err != nil {
+		return fmt.Errorf("error reading encryption key: %v", err)
+	}
+
+	signingKey, err := dict.SigningKeyFromEnv()
+	if err != nil {
+		return fmt.Errorf("error reading signing key: %v", err)
+	}
+
+	n, err := dict.Migrate(path, *out, encKey, signingKey, dict.WithEncryptionKey(encKey))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: migrated %d entries\n", *out, n)
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package dict
+
+// This file contains the audit trail of the changes applied by UpdateDict
+// and of the online edits folded by Editor.Fold.
+// Changelog entries can carry who made the change, why and when:
+//
+//	{"word":"abandon","senses":[...],"author":"ana","reason":"clearer","timestamp":"2024-05-01T10:00:00Z"}
+//
+// Every applied change is appended to the audit log audit.log, one JSON
+// encoded AuditRecord per line, along with the version of the dictionary it
+// was applied to - the name of the archive directory of that version. The
+// log is only ever appended to.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// auditFilename is the audit log in the root directory
+const auditFilename = "audit.log"
+
+// Audit is the optional metadata of a change
+type Audit struct {
+	Author string `json:"author,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// Timestamp is the time the change was made, the time it's applied if
+	// it's not set
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+}
+
+// AuditRecord is a change applied to the dictionary
+type AuditRecord struct {
+	// Key is the normalized key of the word, see NormalizeKey
+	Key       string     `json:"key"`
+	Word      string     `json:"word"`
+	Op        ProposalOp `json:"op"`
+	Author    string     `json:"author,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	Timestamp time.Time  `json:"timestamp"`
+	// Version is the archive directory of the dictionary the change was
+	// applied to, see archiveFiles
+	Version string `json:"version"`
+}
+
+// newAuditRecord returns the record of a change applied to the dictionary version
+func newAuditRecord(op ProposalOp, c *Change, flags uint16, version string, now time.Time) AuditRecord {
+	ts := now
+	if c.Timestamp != nil {
+		ts = c.Timestamp.UTC()
+	}
+
+	return AuditRecord{
+		Key:       NormalizeKey(c.Word, flags),
+		Word:      c.Word,
+		Op:        op,
+		Author:    c.Author,
+		Reason:    c.Reason,
+		Timestamp: ts,
+		Version:   version,
+	}
+}
+
+// appendAudit appends the records to the audit log at path and syncs it
+func appendAudit(path string, records []AuditRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening audit log: %v", err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for _, r := range records {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		w.Write(append(line, '\n'))
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return fmt.Errorf("error writing audit log: %v", err)
+	}
+
+	return f.Sync()
+}
+
+// AuditTrail returns the changes applied to the word, the oldest first. The
+// word is normalized like the keys of dict.dat.
+func AuditTrail(word string) ([]AuditRecord, error) {
+	flags, err := dictFlags()
+	if err != nil {
+		return nil, err
+	}
+
+	return readAuditTrail(auditFilename, NormalizeKey(word, flags))
+}
+
+// readAuditTrail returns the records of the key in the audit log at path
+func readAuditTrail(path, key string) ([]AuditRecord, error) {
+	records := []AuditRecord{}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening audit log: %v", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading audit log: %v", err)
+		}
+
+		var rec AuditRecord
+		err = json.Unmarshal(line, &rec)
+		if err != nil {
+			return nil, fmt.Errorf("%w: corrupt audit record at line %d: %v", ErrBadFormat, n, err)
+		}
+
+		if rec.Key == key {
+			records = append(records, rec)
+		}
+	}
+
+	return records, nil
+}
@@ -0,0 +1,56 @@
+package dict
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAuditTrail(t *testing.T) {
+	dir := t.TempDir()
+	buildBenchDict(t, dir, 100, BuildOptions{})
+	chdir(t, dir)
+
+	chglog := `{"word":"WORD000010","senses":[{"definition":"updated 10"}],"author":"ana","reason":"clearer","timestamp":"2024-05-01T10:00:00Z"}
+{"word":"word000020","deleted":true,"author":"ben"}
+{"word":"zebra","senses":[{"definition":"an animal"}]}
+`
+	if err := os.WriteFile(jsonlChglogFilename, []byte(chglog), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now().UTC().Add(-time.Second)
+	if err := UpdateDict(); err != nil {
+		t.Fatalf("UpdateDict() error = %v", err)
+	}
+
+	records, err := AuditTrail("Word000010")
+	if err != nil || len(records) != 1 {
+		t.Fatalf("AuditTrail(Word000010) = %+v, %v", records, err)
+	}
+	r := records[0]
+	if r.Word != "WORD000010" || r.Op != OpUpdate || r.Author != "ana" || r.Reason != "clearer" ||
+		!r.Timestamp.Equal(time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)) || r.Version == "" {
+		t.Errorf("AuditTrail(Word000010) = %+v", r)
+	}
+
+	// The version is the archive directory of the replaced dictionary
+	if _, err := os.Stat("archive/" + r.Version + "/" + dictFilename); err != nil {
+		t.Errorf("version %s is not archived: %v", r.Version, err)
+	}
+
+	records, _ = AuditTrail("word000020")
+	if len(records) != 1 || records[0].Op != OpDelete || records[0].Author != "ben" {
+		t.Errorf("AuditTrail(word000020) = %+v", records)
+	}
+
+	// Changes without a timestamp are stamped when applied
+	records, _ = AuditTrail("zebra")
+	if len(records) != 1 || records[0].Op != OpAdd || records[0].Timestamp.Before(before) {
+		t.Errorf("AuditTrail(zebra) = %+v", records)
+	}
+
+	if records, err := AuditTrail("word000030"); err != nil || len(records) != 0 {
+		t.Errorf("AuditTrail(word000030) = %+v, %v, want no records", records, err)
+	}
+}
@@ -0,0 +1,200 @@
+package dict
+
+// This file contains the block compressed layout of the data section.
+// Entries are grouped into blocks of roughly BuildOptions.BlockSize bytes and
+// every block is compressed on its own with flate, so a query only has to
+// fetch and decompress the block holding the entry.
+
+import (
+	"bytes"
+	"compress/flate"
+	"container/list"
+	"crypto/cipher"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// DefaultBlockSize is the uncompressed size blocks are filled up to
+	DefaultBlockSize = 32 * 1024
+	// maxBlockSize bounds the uncompressed size of a block. The build
+	// rejects larger block sizes and entries, and the readers larger blocks.
+	maxBlockSize = 64 << 20
+	// defaultBlockCacheSize is the number of decompressed blocks kept in memory
+	defaultBlockCacheSize = 64
+)
+
+// blockWriter groups the encoded entries into compressed blocks
+type blockWriter struct {
+	w         io.Writer
+	blockSize int
+	// aead encrypts the compressed blocks, nil unless encryption is enabled
+	aead cipher.AEAD
+
+	// buf holds the uncompressed entries of the current block
+	buf bytes.Buffer
+	// start is the offset of the current block in the uncompressed data
+	start int64
+	// offset is the number of compressed bytes written so far
+	offset int64
+	blocks []blockRef
+}
+
+func newBlockWriter(w io.Writer, blockSize int, aead cipher.AEAD) *blockWriter {
+	return &blockWriter{w: w, blockSize: blockSize, aead: aead}
+}
+
+// Write adds an encoded entry to the current block. Entries never straddle
+// blocks: the current block is flushed first if the entry does not fit.
+// An entry larger than the block size gets a block of its own.
+func (bw *blockWriter) Write(p []byte) (int, error) {
+	if len(p) > maxBlockSize {
+		return 0, fmt.Errorf("entry of %d bytes exceeds the maximum block size %d", len(p), maxBlockSize)
+	}
+
+	if bw.buf.Len() > 0 && bw.buf.Len()+len(p) > bw.blockSize {
+		if err := bw.Flush(); err != nil {
+			return 0, err
+		}
+	}
+
+	return bw.buf.Write(p)
+}
+
+// Flush compresses and writes the current block
+func (bw *blockWriter) Flush() error {
+	if bw.buf.Len() == 0 {
+		return nil
+	}
+
+	var compressed bytes.Buffer
+	fw, err := flate.NewWriter(&compressed, flate.BestCompression)
+	if err != nil {
+		return err
+	}
+	if _, err := fw.Write(bw.buf.Bytes()); err != nil {
+		return err
+	}
+	if err := fw.Close(); err != nil {
+		return err
+	}
+
+	data := compressed.Bytes()
+	if bw.aead != nil {
+		data, err = seal(bw.aead, data, uint64(bw.start))
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := bw.w.Write(data); err != nil {
+		return err
+	}
+
+	bw.blocks = append(bw.blocks, blockRef{
+		Start:   bw.start,
+		Offset:  bw.offset,
+		Size:    int64(len(data)),
+		RawSize: int64(bw.buf.Len()),
+	})
+
+	bw.start += int64(bw.buf.Len())
+	bw.offset += int64(len(data))
+	bw.buf.Reset()
+
+	return nil
+}
+
+// readBlock reads and decompresses a block of the file of the given size,
+// decrypting it first if aead is set
+func readBlock(r io.ReaderAt, size int64, b blockRef, aead cipher.AEAD) ([]byte, error) {
+	// Checked before allocating, the block refs come from the file
+	if b.Offset < 0 || b.Size < 0 || b.Size > size-b.Offset {
+		return nil, fmt.Errorf("%w: block at %d of size %d exceeds the file", ErrBadFormat, b.Offset, b.Size)
+	}
+	if b.RawSize < 0 || b.RawSize > maxBlockSize {
+		return nil, fmt.Errorf("%w: block at %d of %d uncompressed bytes", ErrBadFormat, b.Offset, b.RawSize)
+	}
+
+	compressed := make([]byte, b.Size)
+	_, err := r.ReadAt(compressed, b.Offset)
+	if err != nil {
+		return nil, fmt.Errorf("error reading block: %v", err)
+	}
+
+	if aead != nil {
+		compressed, err = open(aead, compressed, uint64(b.Start))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	data := make([]byte, b.RawSize)
+	fr := flate.NewReader(bytes.NewReader(compressed))
+	defer fr.Close()
+
+	_, err = io.ReadFull(fr, data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: error decompressing block: %v", ErrBadFormat, err)
+	}
+
+	return data, nil
+}
+
+// blockCache is a LRU cache of decompressed blocks keyed by block number.
+// It's safe for concurrent use.
+type blockCache struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[int]*list.Element
+}
+
+type cachedBlock struct {
+	n    int
+	data []byte
+}
+
+func newBlockCache(size int) *blockCache {
+	return &blockCache{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[int]*list.Element),
+	}
+}
+
+func (c *blockCache) get(n int) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[n]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+
+	return el.Value.(*cachedBlock).data, true
+}
+
+func (c *blockCache) add(n int, data []byte) {
+	if c.size <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[n]; ok {
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.items[n] = c.ll.PushFront(&cachedBlock{n: n, data: data})
+
+	if c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*cachedBlock).n)
+	}
+}
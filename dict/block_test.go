@@ -0,0 +1,112 @@
+package dict
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompressedDict(t *testing.T) {
+	dir := t.TempDir()
+	wordsPath := filepath.Join(dir, wordsFilename)
+
+	var sb strings.Builder
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&sb, "word%04d,definition number %d of a fairly repetitive dictionary\n", i, i)
+	}
+	if err := os.WriteFile(wordsPath, []byte(sb.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rawPath := filepath.Join(dir, "raw.dat")
+	if err := Build(wordsPath, rawPath, BuildOptions{}); err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+
+	compressedPath := filepath.Join(dir, "compressed.dat")
+	if err := Build(wordsPath, compressedPath, BuildOptions{Compress: true, BlockSize: 16 * 1024}); err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+
+	raw, _ := os.Stat(rawPath)
+	compressed, _ := os.Stat(compressedPath)
+	if compressed.Size() >= raw.Size() {
+		t.Errorf("compressed size %d is not smaller than raw size %d", compressed.Size(), raw.Size())
+	}
+
+	// A cache smaller than the number of blocks exercises the eviction
+	d, err := Open(compressedPath, WithBlockCacheSize(2))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer d.Close()
+
+	if len(d.rd.blocks) < 3 {
+		t.Fatalf("got %d blocks, want at least 3", len(d.rd.blocks))
+	}
+
+	for _, i := range []int{0, 1999, 1000, 3, 1998} {
+		word := fmt.Sprintf("word%04d", i)
+		expected := fmt.Sprintf("definition number %d of a fairly repetitive dictionary", i)
+
+		def, ok := d.QueryWord(word)
+		if !ok || def != expected {
+			t.Errorf("QueryWord(%s) = %q, %v, want %q", word, def, ok, expected)
+		}
+	}
+
+	if n := d.rd.cache.ll.Len(); n != 2 {
+		t.Errorf("cache holds %d blocks, want 2", n)
+	}
+
+	// Sequential reads decompress every block in order
+	er := d.entries()
+	count := 0
+	for {
+		e, err := er.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		if expected := fmt.Sprintf("word%04d", count); e.Word != expected {
+			t.Fatalf("entry %d is %s, want %s", count, e.Word, expected)
+		}
+		count++
+	}
+	if count != 2000 {
+		t.Errorf("read %d entries, want 2000", count)
+	}
+}
+
+func TestReadBlockBounds(t *testing.T) {
+	r := bytes.NewReader(make([]byte, 1024))
+
+	for _, b := range []blockRef{
+		{Offset: -1, Size: 10, RawSize: 10},
+		{Offset: 100, Size: -1, RawSize: 10},
+		{Offset: 100, Size: 1 << 62, RawSize: 10},
+		{Offset: 100, Size: 10, RawSize: -1},
+		{Offset: 100, Size: 10, RawSize: maxBlockSize + 1},
+	} {
+		if _, err := readBlock(r, int64(r.Len()), b, nil); !errors.Is(err, ErrBadFormat) {
+			t.Errorf("readBlock(%+v) error = %v, want %v", b, err, ErrBadFormat)
+		}
+	}
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, wordsFilename)
+	if err := os.WriteFile(src, []byte("apple,a fruit\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := Build(src, filepath.Join(dir, dictFilename), BuildOptions{Compress: true, BlockSize: maxBlockSize + 1})
+	if err == nil || !strings.Contains(err.Error(), "block size") {
+		t.Errorf("Build() with a block size above the maximum error = %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package dict
+
+// This file contains the Bloom filter over the keys of the dictionary.
+//
+// A lookup of a word that is not in the dictionary would otherwise cost
+// index reads in the low-memory mode, or range requests for the S3 backed
+// dictionary. The filter answers most of those misses from memory.
+// The bloom section is stored as:
+//
+//	<hash count (4 bytes)><bit count (8 bytes)><bits>
+//
+// Bit positions are derived from the 64 bit FNV-1a hash of the key with
+// double hashing, see bloomFilter.positions.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+const (
+	// DefaultBloomFPRate is the false-positive rate of the Bloom filter
+	DefaultBloomFPRate = 0.01
+
+	bloomHeaderSize = 12
+	// minBloomBits keeps the filter of tiny dictionaries usable
+	minBloomBits = 64
+)
+
+// bloomFilter is a Bloom filter over normalized keys
+type bloomFilter struct {
+	k    uint32
+	m    uint64
+	bits []byte
+}
+
+// newBloomFilter returns a filter sized for n keys at the false-positive rate p
+func newBloomFilter(n int, p float64) *bloomFilter {
+	// m = -n ln(p) / ln(2)^2 bits and k = m/n ln(2) hashes
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	if m < minBloomBits {
+		m = minBloomBits
+	}
+
+	k := uint32(1)
+	if n > 0 {
+		k = uint32(math.Max(1, math.Round(float64(m)/float64(n)*math.Ln2)))
+	}
+
+	return &bloomFilter{
+		k:    k,
+		m:    m,
+		bits: make([]byte, (m+7)/8),
+	}
+}
+
+// add adds the key to the filter
+func (bf *bloomFilter) add(key string) {
+	h1, h2 := bloomHash(key)
+	for i := uint64(0); i < uint64(bf.k); i++ {
+		p := (h1 + i*h2) % bf.m
+		bf.bits[p/8] |= 1 << (p % 8)
+	}
+}
+
+// mayContain reports false if the key is definitely not in the filter
+func (bf *bloomFilter) mayContain(key string) bool {
+	h1, h2 := bloomHash(key)
+	for i := uint64(0); i < uint64(bf.k); i++ {
+		p := (h1 + i*h2) % bf.m
+		if bf.bits[p/8]&(1<<(p%8)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// bloomHash returns the two hashes the bit positions are derived from. The
+// second one is a mix of the first, made odd so that it's never zero.
+func bloomHash(key string) (uint64, uint64) {
+	// FNV-1a, inlined to avoid converting the key to a []byte
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+
+	// Finalizer of MurmurHash3
+	h2 := h
+	h2 ^= h2 >> 33
+	h2 *= 0xff51afd7ed558ccd
+	h2 ^= h2 >> 33
+	h2 *= 0xc4ceb9fe1a85ec53
+	h2 ^= h2 >> 33
+
+	return h, h2 | 1
+}
+
+// encodeBloom serializes the filter into the bloom section
+func encodeBloom(bf *bloomFilter) []byte {
+	buf := make([]byte, bloomHeaderSize, bloomHeaderSize+len(bf.bits))
+	binary.BigEndian.PutUint32(buf, bf.k)
+	binary.BigEndian.PutUint64(buf[4:], bf.m)
+	return append(buf, bf.bits...)
+}
+
+// decodeBloom parses the bloom section
+func decodeBloom(buf []byte) (*bloomFilter, error) {
+	if len(buf) < bloomHeaderSize {
+		return nil, fmt.Errorf("%w: truncated bloom filter", ErrBadFormat)
+	}
+
+	bf := &bloomFilter{
+		k:    binary.BigEndian.Uint32(buf),
+		m:    binary.BigEndian.Uint64(buf[4:]),
+		bits: buf[bloomHeaderSize:],
+	}
+
+	if bf.k == 0 || bf.m == 0 || uint64(len(bf.bits)) != (bf.m+7)/8 {
+		return nil, fmt.Errorf("%w: corrupt bloom filter", ErrBadFormat)
+	}
+
+	return bf, nil
+}
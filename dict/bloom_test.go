@@ -0,0 +1,133 @@
+package dict
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	const n = 10000
+
+	for _, p := range []float64{0.1, 0.01, 0.001} {
+		t.Run(fmt.Sprintf("p=%v", p), func(t *testing.T) {
+			bf := newBloomFilter(n, p)
+			for i := 0; i < n; i++ {
+				bf.add(fmt.Sprintf("word%d", i))
+			}
+
+			// Round trip through the section encoding
+			bf, err := decodeBloom(encodeBloom(bf))
+			if err != nil {
+				t.Fatalf("decodeBloom() error = %v", err)
+			}
+
+			for i := 0; i < n; i++ {
+				if !bf.mayContain(fmt.Sprintf("word%d", i)) {
+					t.Fatalf("false negative for word%d", i)
+				}
+			}
+
+			fp := 0
+			for i := 0; i < n; i++ {
+				if bf.mayContain(fmt.Sprintf("missing%d", i)) {
+					fp++
+				}
+			}
+
+			if rate := float64(fp) / n; rate > 2*p {
+				t.Errorf("false-positive rate = %v, want about %v", rate, p)
+			}
+		})
+	}
+}
+
+func TestBloomSkipsMisses(t *testing.T) {
+	dir := t.TempDir()
+	wordsPath := filepath.Join(dir, wordsFilename)
+
+	var sb strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&sb, "word%04d,definition %d\n", i, i)
+	}
+	if err := os.WriteFile(wordsPath, []byte(sb.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		rate      float64
+		wantBloom bool
+	}{
+		{"default", 0, true},
+		{"strict", 0.0001, true},
+		{"disabled", -1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dictPath := filepath.Join(dir, tt.name+".dat")
+			if err := Build(wordsPath, dictPath, BuildOptions{BloomFPRate: tt.rate}); err != nil {
+				t.Fatalf("Build() error = %v", err)
+			}
+
+			f, err := os.Open(dictPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			fi, _ := f.Stat()
+
+			cr := &countingReaderAt{f: f}
+			rd, err := NewReader(cr, fi.Size(), WithLowMemory(true))
+			if err != nil {
+				t.Fatalf("NewReader() error = %v", err)
+			}
+
+			if (rd.bloom != nil) != tt.wantBloom {
+				t.Fatalf("bloom filter loaded = %v, want %v", rd.bloom != nil, tt.wantBloom)
+			}
+
+			// Misses are answered from memory, except for false positives
+			start := cr.n
+			misses := 0
+			for i := 0; i < 1000; i++ {
+				before := cr.n
+				if _, ok, err := rd.Lookup(fmt.Sprintf("word%04dx", i)); ok || err != nil {
+					t.Fatalf("Lookup(word%04dx) = %v, %v", i, ok, err)
+				}
+				if cr.n > before {
+					misses++
+				}
+			}
+
+			if tt.wantBloom && misses > 50 {
+				t.Errorf("%d of 1000 misses read the index", misses)
+			}
+			if !tt.wantBloom && cr.n == start {
+				t.Errorf("misses did not read the index without a bloom filter")
+			}
+
+			for i := 0; i < 1000; i++ {
+				word := fmt.Sprintf("word%04d", i)
+				if _, ok, err := rd.Lookup(word); !ok || err != nil {
+					t.Fatalf("Lookup(%s) = %v, %v", word, ok, err)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildInvalidBloomFPRate(t *testing.T) {
+	dir := t.TempDir()
+	wordsPath := filepath.Join(dir, wordsFilename)
+	if err := os.WriteFile(wordsPath, []byte("a,first letter\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Build(wordsPath, filepath.Join(dir, dictFilename), BuildOptions{BloomFPRate: 1}); err == nil {
+		t.Error("Build() with a false-positive rate of 1 succeeded")
+	}
+}
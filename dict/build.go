@@ -1,127 +1,621 @@
 package dict
 
 // This file contains the code to build a new dictionary
-// from the words.dat and index.dat files.
+// from the source file (words.jsonl or words.dat).
 
 import (
 	"bufio"
 	"bytes"
+	"crypto/cipher"
+	"crypto/ed25519"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"strings"
+	"path/filepath"
+	"sort"
+	"strconv"
 )
 
+// BuildOptions controls how a dictionary is built
+type BuildOptions struct {
+	// StripDiacritics removes accents from the lookup keys so that
+	// "cafe" also finds "café". It's recorded in the header so that
+	// queries are normalized the same way.
+	StripDiacritics bool
+	// Compress stores the entries in flate compressed blocks of
+	// BlockSize bytes, which shrinks dict.dat at the cost of decompressing a
+	// block per query. Decompressed blocks are cached by the readers.
+	Compress bool
+	// BlockSize is the uncompressed size of the blocks, 16-64 KB works well.
+	// Defaults to DefaultBlockSize, and is at most 64 MB, which bounds the
+	// size of the entries as well.
+	BlockSize int
+	// SparseInterval is the number of index entries between two keys of the
+	// sparse index used by the low-memory mode. Defaults to DefaultSparseInterval.
+	SparseInterval int
+	// BloomFPRate is the false-positive rate of the Bloom filter the readers
+	// use to answer misses without touching the index. Lower rates take more
+	// space, about 10 bits per word at 1%. Defaults to DefaultBloomFPRate,
+	// a negative rate leaves the filter out.
+	BloomFPRate float64
+	// PerfectHash adds a minimal perfect hash index, which the readers use
+	// instead of a map of the index. It cuts startup time and memory of
+	// large dictionaries.
+	PerfectHash bool
+	// FrontCoding stores each key of the index as the length of the prefix
+	// it shares with the previous key plus the remaining suffix, which
+	// shrinks the index the readers load at startup. The sparse index
+	// restart points start over with full keys.
+	FrontCoding bool
+	// EncryptionKey encrypts the blocks and the index with AES-GCM, see
+	// crypt.go. It's an AES key of 16, 24 or 32 bytes and implies Compress.
+	EncryptionKey []byte
+	// SigningKey signs the built dictionary, the signature is written next
+	// to it, see sign.go. Without it the dictionary is left unsigned.
+	SigningKey ed25519.PrivateKey
+}
+
+// buildOptions returns the options a dictionary with the given header flags
+// was built with, apart from the keys
+func buildOptions(flags uint16) BuildOptions {
+	return BuildOptions{
+		StripDiacritics: flags&FlagStripDiacritics != 0,
+		Compress:        flags&FlagCompressed != 0,
+		PerfectHash:     flags&FlagPerfectHash != 0,
+		FrontCoding:     flags&FlagFrontCoded != 0,
+	}
+}
+
+// StripDiacriticsFromEnv reports whether DICT_STRIP_DIACRITICS asks for the
+// keys of new dictionaries to be built without diacritics, see
+// BuildOptions.StripDiacritics. It's off when unset.
+func StripDiacriticsFromEnv() (bool, error) {
+	s := os.Getenv("DICT_STRIP_DIACRITICS")
+	if s == "" {
+		return false, nil
+	}
+
+	strip, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, fmt.Errorf("invalid DICT_STRIP_DIACRITICS %q, expected true or false", s)
+	}
+
+	return strip, nil
+}
+
 // BuildNewDict creates a new dict.data file using the
-// words.dat and index.dat files
+// words.jsonl (or words.dat) and index.dat files.
+// It's signed with the key in DICT_SIGNING_KEY_FILE and encrypted with the
+// key in DICT_ENCRYPTION_KEY (or DICT_ENCRYPTION_KEY_FILE) if set, and its
+// keys are stripped of diacritics if DICT_STRIP_DIACRITICS is set.
 func BuildNewDict() error {
-	// Open words.dat file for reading
-	wordsFile, err := os.OpenFile(wordsFilename, os.O_RDONLY, 0644)
+	key, err := SigningKeyFromEnv()
 	if err != nil {
-		return fmt.Errorf("error opening words.dat: %v", err)
+		return fmt.Errorf("error reading signing key: %v", err)
+	}
+
+	encKey, err := EncryptionKeyFromEnv()
+	if err != nil {
+		return fmt.Errorf("error reading encryption key: %v", err)
+	}
+
+	strip, err := StripDiacriticsFromEnv()
+	if err != nil {
+		return err
 	}
-	defer wordsFile.Close()
 
-	// Build index
+	return Build(sourceFilename(), dictFilename, BuildOptions{SigningKey: key, EncryptionKey: encKey, StripDiacritics: strip})
+}
+
+// Build creates the dictionary file at dictPath from the source file at wordsPath.
+// The source is either words.dat or words.jsonl, see source.go.
+// The intermediate index.dat file is written next to dictPath.
+func Build(wordsPath, dictPath string, opts BuildOptions) error {
+	flags, aead, err := prepareBuild(&opts)
+	if err != nil {
+		return err
+	}
+
+	// Open the source file for reading
+	wordsFile, err := os.OpenFile(wordsPath, os.O_RDONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %v", filepath.Base(wordsPath), err)
+	}
+	defer wordsFile.Close()
 
-	// Read line by line
-	scanner := bufio.NewScanner(wordsFile)
+	entries, err := collectEntries(newSourceReader(wordsFile, wordsPath), flags)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", filepath.Base(wordsPath), err)
+	}
 
-	// Offset in words.dat file
-	var currOffset int64 = 0
+	return writeDict(entries, dictPath, flags, opts, aead)
+}
 
-	var indexEntries []IndexEntry
+// prepareBuild fills in the defaults of the options and returns the header
+// flags of the dictionary they build, along with its cipher if it's encrypted
+func prepareBuild(opts *BuildOptions) (uint16, cipher.AEAD, error) {
+	var flags uint16
+	if opts.StripDiacritics {
+		flags |= FlagStripDiacritics
+	}
+	var aead cipher.AEAD
+	if opts.EncryptionKey != nil {
+		var err error
+		aead, err = newFileAEAD(opts.EncryptionKey)
+		if err != nil {
+			return 0, nil, err
+		}
 
-	for scanner.Scan() {
-		line := scanner.Text()
+		// Blocks are the unit of encryption
+		flags |= FlagEncrypted
+		opts.Compress = true
+	}
+	if opts.Compress {
+		flags |= FlagCompressed
+		if opts.BlockSize <= 0 {
+			opts.BlockSize = DefaultBlockSize
+		}
+		if opts.BlockSize > maxBlockSize {
+			return 0, nil, fmt.Errorf("invalid block size %d, expected at most %d", opts.BlockSize, maxBlockSize)
+		}
+	}
+	if opts.PerfectHash {
+		flags |= FlagPerfectHash
+	}
+	if opts.FrontCoding {
+		flags |= FlagFrontCoded
+	}
+	if opts.SparseInterval <= 0 {
+		opts.SparseInterval = DefaultSparseInterval
+	}
+	if opts.BloomFPRate == 0 {
+		opts.BloomFPRate = DefaultBloomFPRate
+	}
+	if opts.BloomFPRate >= 1 {
+		return 0, nil, fmt.Errorf("invalid bloom filter false-positive rate %v", opts.BloomFPRate)
+	}
 
-		parts := strings.Split(line, ",")
+	return flags, aead, nil
+}
 
-		word := parts[0]
-		definition := parts[1]
+// writeDict writes the dictionary file at dictPath from the entries sorted
+// by key, see Build. The intermediate index.dat file is written next to dictPath.
+func writeDict(entries []keyedEntry, dictPath string, flags uint16, opts BuildOptions, aead cipher.AEAD) error {
+	dw, err := newDictWriter(dictPath, flags, opts, aead)
+	if err != nil {
+		return err
+	}
+	defer dw.close()
 
-		// Create an index entry
-		idxe := IndexEntry{
-			Word:    word,
-			Offset:  currOffset,
-			DefSize: int16(len(definition)),
+	for _, ke := range entries {
+		err = dw.add(ke.key, ke.entry)
+		if err != nil {
+			return fmt.Errorf("error writing entries: %v", err)
 		}
+	}
+
+	return dw.finish()
+}
+
+// dictWriter writes a dictionary from entries added in key order. The
+// entries are written to a temporary data file as they are added, only
+// their index entries are kept until finish writes the index, so sorted
+// sources are built without holding their entries in memory.
+type dictWriter struct {
+	dictPath string
+	flags    uint16
+	opts     BuildOptions
+	aead     cipher.AEAD
+
+	dataFile *os.File
+	bufw     *bufio.Writer
+	w        io.Writer
+	// bw compresses the entries into blocks if enabled
+	bw *blockWriter
+
+	// Offset in the (uncompressed) data
+	offset       int64
+	indexEntries []IndexEntry
+}
+
+// newDictWriter creates the temporary data file of the dictionary at
+// dictPath, next to it. The options are the ones returned by prepareBuild.
+func newDictWriter(dictPath string, flags uint16, opts BuildOptions, aead cipher.AEAD) (*dictWriter, error) {
+	dataFile, err := os.CreateTemp(filepath.Dir(dictPath), "data-*.dat")
+	if err != nil {
+		return nil, fmt.Errorf("error creating data file: %v", err)
+	}
+
+	dw := &dictWriter{
+		dictPath: dictPath,
+		flags:    flags,
+		opts:     opts,
+		aead:     aead,
+		dataFile: dataFile,
+		bufw:     bufio.NewWriter(dataFile),
+	}
+
+	dw.w = dw.bufw
+	if opts.Compress {
+		dw.bw = newBlockWriter(dw.bufw, opts.BlockSize, aead)
+		dw.w = dw.bw
+	}
+
+	return dw, nil
+}
+
+// add writes the encoded entry to the data file and records its index
+// entry. Each entry is prefixed by its size as an uvarint so that the data
+// section can also be read sequentially. The keys must be added in
+// increasing order.
+func (dw *dictWriter) add(key string, e *Entry) error {
+	if n := len(dw.indexEntries); n > 0 && key <= dw.indexEntries[n-1].Key {
+		return fmt.Errorf("key '%s' is out of order after '%s'", key, dw.indexEntries[n-1].Key)
+	}
 
-		indexEntries = append(indexEntries, idxe)
+	data := encodeEntry(e)
+	prefix := binary.AppendUvarint(nil, uint64(len(data)))
 
-		// Update offset (current position + length of line + newline character)
-		currOffset += int64(len(line)) + 1 // +1 for newline character
+	// The entry is written at once so that it's never split across blocks
+	_, err := dw.w.Write(append(prefix, data...))
+	if err != nil {
+		return err
+	}
+
+	// Offsets are relative to the beginning of the (uncompressed) data
+	dw.indexEntries = append(dw.indexEntries, IndexEntry{
+		Key:    key,
+		Word:   e.Word,
+		Offset: dw.offset + int64(len(prefix)),
+		Size:   int64(len(data)),
+	})
+
+	// Update offset (current position + size prefix + entry)
+	dw.offset += int64(len(prefix) + len(data))
+
+	return nil
+}
+
+// finish flushes the entries, writes the index and merges both into the
+// dictionary file, which is signed with opts.SigningKey if set
+func (dw *dictWriter) finish() error {
+	var blocks []blockRef
+	if dw.bw != nil {
+		err := dw.bw.Flush()
+		if err != nil {
+			return fmt.Errorf("error writing entries: %v", err)
+		}
+		log.Printf("Compressed %d bytes of entries into %d blocks", dw.offset, len(dw.bw.blocks))
+		blocks = dw.bw.blocks
+	}
+
+	err := dw.bufw.Flush()
+	if err != nil {
+		return fmt.Errorf("error writing entries: %v", err)
 	}
 
 	// flush the index to index.dat file
 
-	err = flushIndex(indexEntries)
+	indexPath := filepath.Join(filepath.Dir(dw.dictPath), indexFilename)
+
+	dataInfo, err := dw.dataFile.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading data file: %v", err)
+	}
+
+	dataSums, err := dataChecksums(dw.dataFile, dataInfo.Size(), blocks)
+	if err != nil {
+		return fmt.Errorf("error computing checksums: %v", err)
+	}
+
+	err = flushIndex(indexPath, dw.indexEntries, blocks, dataSums, dw.flags, dw.opts, dw.aead)
 	if err != nil {
 		return fmt.Errorf("error flushing index: %v", err)
 	}
 
-	err = mergeFiles()
+	err = mergeFiles(dw.dataFile.Name(), indexPath, dw.dictPath)
 	if err != nil {
 		return fmt.Errorf("error merging files: %v", err)
 	}
 
+	// A signature of the previous dictionary would not match anymore
+	os.Remove(dw.dictPath + SignatureExt)
+
+	if dw.opts.SigningKey != nil {
+		err = SignFile(dw.dictPath, dw.opts.SigningKey)
+		if err != nil {
+			return fmt.Errorf("error signing dictionary: %v", err)
+		}
+	}
+
 	return nil
 }
 
-// flushIndex serializes the index entries and flushes to index.dat file
-func flushIndex(indexEntries []IndexEntry) error {
+// close removes the temporary data file
+func (dw *dictWriter) close() {
+	dw.dataFile.Close()
+	os.Remove(dw.dataFile.Name())
+}
+
+// keyedEntry is an entry along with its normalized key
+type keyedEntry struct {
+	key   string
+	entry *Entry
+}
+
+// collectEntries reads all entries from the source and returns them sorted by key.
+// Headwords sharing a key (e.g. "abandon" listed twice) are merged into a
+// single entry holding the senses of both.
+func collectEntries(sr entrySource, flags uint16) ([]keyedEntry, error) {
+	byKey := make(map[string]*Entry)
+
+	var entries []keyedEntry
+
+	for {
+		e, err := sr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Keys and headwords are stored with a 2 byte length in the index
+		key := NormalizeKey(e.Word, flags)
+		if len(e.Word) > maxWordLen || len(key) > maxWordLen {
+			log.Printf("Skipping word of %d bytes, longer than %d bytes", len(e.Word), maxWordLen)
+			continue
+		}
+		if prev, ok := byKey[key]; ok {
+			log.Printf("Merging duplicate headword '%s' into '%s'", e.Word, prev.Word)
+			prev.merge(e)
+			continue
+		}
+
+		byKey[key] = e
+		entries = append(entries, keyedEntry{key: key, entry: e})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+
+	return entries, nil
+}
+
+// flushIndex serializes the header, the section table and the index sections
+// and flushes them to index.dat file. The sections are: the index entries,
+// the sparse index, the Bloom filter, the block table (for compressed dictionaries),
+// the perfect hash index, the key and file ids of encrypted dictionaries and
+// the checksums of all of them along with the data. The index entries, the
+// sparse index, the Bloom filter and the hash index are encrypted with aead
+// if set, the first two in chunks, see crypt.go.
+func flushIndex(indexPath string, indexEntries []IndexEntry, blocks []blockRef, dataSums []checksumRange, flags uint16, opts BuildOptions, aead cipher.AEAD) error {
 	// Clean up the old index file
-	os.Remove(indexFilename)
+	os.Remove(indexPath)
 
-	indexFile, err := os.OpenFile(indexFilename, os.O_CREATE|os.O_WRONLY, 0644)
+	indexFile, err := os.OpenFile(indexPath, os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
 	defer indexFile.Close()
 
-	// Calculate the size of the index
-	totalIndexSize := calcIndexSize(indexEntries)
+	compressed := flags&FlagCompressed != 0
+	frontCoded := flags&FlagFrontCoded != 0
 
-	log.Println("Flushing index of size size:", totalIndexSize)
+	// restart reports whether the i-th entry is a restart point of the sparse index
+	restart := func(i int) bool {
+		return i%opts.SparseInterval == 0
+	}
 
-	var separator string = ":"
+	// Calculate the size of the index entries and their offsets in the
+	// index section, needed by the sparse index
+	var entriesSize int64
+	offsets := make([]int64, len(indexEntries))
+
+	if frontCoded {
+		for i, idxe := range indexEntries {
+			offsets[i] = entriesSize
+			if restart(i) {
+				entriesSize += frontCodedEntrySize(idxe, nil)
+			} else {
+				entriesSize += frontCodedEntrySize(idxe, &indexEntries[i-1])
+			}
+		}
+	} else {
+		entriesSize = calcIndexSize(indexEntries)
+		for i := 1; i < len(indexEntries); i++ {
+			offsets[i] = offsets[i-1] + indexEntrySize(indexEntries[i-1])
+		}
+	}
+
+	sparseBuf := encodeSparse(indexEntries, offsets, entriesSize, opts.SparseInterval)
+
+	sections := []section{
+		{Kind: sectionIndex, Size: entriesSize},
+		{Kind: sectionSparse, Size: int64(len(sparseBuf))},
+	}
+
+	if aead != nil {
+		sparseBuf, err = sealChunks(aead, sparseBuf, sectionSparse)
+		if err != nil {
+			return err
+		}
+
+		sections[0].Size = sealedChunksSize(aead, entriesSize)
+		sections[1].Size = int64(len(sparseBuf))
+	}
+
+	var bloomBuf []byte
+	if opts.BloomFPRate > 0 {
+		bf := newBloomFilter(len(indexEntries), opts.BloomFPRate)
+		for _, idxe := range indexEntries {
+			bf.add(idxe.Key)
+		}
+
+		bloomBuf = encodeBloom(bf)
+		if aead != nil {
+			bloomBuf, err = seal(aead, bloomBuf, uint64(sectionBloom))
+			if err != nil {
+				return err
+			}
+		}
+		sections = append(sections, section{Kind: sectionBloom, Size: int64(len(bloomBuf))})
+	}
+
+	if compressed {
+		sections = append(sections, section{Kind: sectionBlocks, Size: int64(len(blocks)) * blockRefSize})
+	}
+
+	var hashBuf []byte
+	if flags&FlagPerfectHash != 0 {
+		// Front coded entries are found from the restart point of their run
+		hashOffsets := offsets
+		if frontCoded {
+			hashOffsets = make([]int64, len(offsets))
+			for i := range offsets {
+				hashOffsets[i] = offsets[i-i%opts.SparseInterval]
+			}
+		}
+
+		hashBuf, err = encodeHashIndex(indexEntries, hashOffsets)
+		if err != nil {
+			return err
+		}
+		if aead != nil {
+			hashBuf, err = seal(aead, hashBuf, uint64(sectionHash))
+			if err != nil {
+				return err
+			}
+		}
+		sections = append(sections, section{Kind: sectionHash, Size: int64(len(hashBuf))})
+	}
+
+	if aead != nil {
+		sections = append(sections, section{Kind: sectionEncryption, Size: encryptionSectionSize})
+	}
+
+	// The checksums cover the header, the sections above and the data
+	sections = append(sections, section{
+		Kind: sectionChecksums,
+		Size: checksumSectionSize(1 + len(sections) + len(dataSums)),
+	})
+
+	// Sections follow the header and the section table in the order above.
+	// The end of the last one is the size of the index region.
+	sectionsOffset := HeaderSize + sectionTableSize(len(sections))
+	totalIndexSize := sectionsOffset
+	for i := range sections {
+		sections[i].Offset = totalIndexSize
+		totalIndexSize += sections[i].Size
+	}
+
+	log.Println("Flushing index of size size:", totalIndexSize)
 
 	var buf bytes.Buffer
 
-	for _, idxe := range indexEntries {
-		// In order to create dict file we have prepend indexFile to wordsFile
-		// hence the offset for each word in index file would be shifted by indexSize bytes
-		// so we need to update the offset of each word before flushing the index
-		idxe.Offset += totalIndexSize
+	for _, s := range sections {
+		switch s.Kind {
+		case sectionIndex:
+			// Encrypted entries are sealed in chunks, after being encoded into ibuf
+			ibuf := &buf
+			if aead != nil {
+				ibuf = new(bytes.Buffer)
+			}
+
+			var prev IndexEntry
+			for i, idxe := range indexEntries {
+				// In order to create dict file we have prepend indexFile to the data file
+				// hence the offset for each word in index file would be shifted by indexSize bytes
+				// so we need to update the offset of each word before flushing the index.
+				// Compressed entries point into the uncompressed data and stay as they are.
+				if !compressed {
+					idxe.Offset += totalIndexSize
+				}
+
+				switch {
+				case !frontCoded:
+					encodeIndexEntry(ibuf, idxe)
+				case restart(i):
+					encodeFrontCodedEntry(ibuf, idxe, nil)
+				default:
+					encodeFrontCodedEntry(ibuf, idxe, &prev)
+				}
+				prev = idxe
+			}
+
+			if aead != nil {
+				sealed, err := sealChunks(aead, ibuf.Bytes(), sectionIndex)
+				if err != nil {
+					return err
+				}
+				buf.Write(sealed)
+			}
+
+		case sectionSparse:
+			buf.Write(sparseBuf)
+
+		case sectionBloom:
+			buf.Write(bloomBuf)
+
+		case sectionBlocks:
+			// The blocks are shifted by the index size just like the entries above
+			shifted := make([]blockRef, len(blocks))
+			for i, b := range blocks {
+				b.Offset += totalIndexSize
+				shifted[i] = b
+			}
+
+			buf.Write(encodeBlockTable(shifted))
+
+		case sectionHash:
+			buf.Write(hashBuf)
+
+		case sectionEncryption:
+			buf.Write(encryptionSection(opts.EncryptionKey, aead))
+		}
+	}
+
+	// Write constant sized header to the beginning of the file
+	header := Header{
+		Version:   formatVersion,
+		Flags:     flags,
+		IndexSize: totalIndexSize,
+	}
 
-		// Write the word
-		buf.WriteString(idxe.Word)
-		buf.WriteString(separator)
+	headerBuf := append(encodeHeader(header), encodeSectionTable(sections)...)
 
-		// Write the offset
-		// buf.Write([]byte(fmt.Sprintf("%d", idxe.Offset))
-		binary.Write(&buf, binary.BigEndian, idxe.Offset)
-		buf.WriteString(separator)
+	sums := []checksumRange{{Kind: checksumHeader, Size: int64(len(headerBuf)), CRC: checksum(headerBuf)}}
+	for _, s := range sections {
+		if s.Kind == sectionChecksums {
+			continue
+		}
 
-		// Write the definition size
-		// buf.Write([]byte(fmt.Sprintf("%d", idxe.DefSize)))
-		binary.Write(&buf, binary.BigEndian, idxe.DefSize)
-		buf.WriteString("\n")
+		st := s.Offset - sectionsOffset
+		sums = append(sums, checksumRange{
+			Kind:   s.Kind,
+			Offset: s.Offset,
+			Size:   s.Size,
+			CRC:    checksum(buf.Bytes()[st : st+s.Size]),
+		})
+	}
+	for _, r := range dataSums {
+		r.Offset += totalIndexSize
+		sums = append(sums, r)
 	}
 
-	// Write constant sized index header to the beginning of the file
-	indexHeaderBuf := make([]byte, 8)
-	binary.BigEndian.PutUint64(indexHeaderBuf, uint64(totalIndexSize))
+	// The checksum section is the last one
+	buf.Write(encodeChecksums(sums))
 
-	_, err = indexFile.WriteAt(indexHeaderBuf, 0)
+	_, err = indexFile.WriteAt(headerBuf, 0)
 	if err != nil {
 		return err
 	}
 
-	// Write serialized index entries to the file
-	_, err = indexFile.WriteAt(buf.Bytes(), 8)
+	// Write serialized sections to the file
+	_, err = indexFile.WriteAt(buf.Bytes(), sectionsOffset)
 	if err != nil {
 		return err
 	}
@@ -129,52 +623,48 @@ func flushIndex(indexEntries []IndexEntry) error {
 	return nil
 }
 
-// calcIndexSize calculates the number of bytes needed to store the index
-// This includes the constant size header (8 bytes) + total size of all index entries
+// calcIndexSize calculates the number of bytes needed to store the index entries
+// i.e. the size of the index section
 func calcIndexSize(indexEntries []IndexEntry) int64 {
-	var indexSize int64 = 8 // 8 bytes for the header
+	var indexSize int64
 
 	for _, idxe := range indexEntries {
-		// len(word) bytes for word and 1 byte for separator
-		indexSize += int64(len(idxe.Word)) + 1
-		// 8 bytes for offset and 1 byte for separator
-		indexSize += 8 + 1
-		// 2 bytes for definition size and 1 byte for newline
-		indexSize += 2 + 1
+		indexSize += indexEntrySize(idxe)
 	}
 
 	return indexSize
 }
 
-// mergeFiles merges the words.dat and index.dat files into a single file - dict.dat
-func mergeFiles() error {
+// mergeFiles merges the data and index.dat files into a single file - dict.dat
+func mergeFiles(dataPath, indexPath, dictPath string) error {
 	// Clean up the old dict file
-	os.Remove(dictFilename)
+	os.Remove(dictPath)
 
-	// Open words.dat and index.dat files for reading
+	// Open data and index.dat files for reading
 
-	wordsFile, err := os.Open(wordsFilename)
+	dataFile, err := os.Open(dataPath)
 	if err != nil {
-		log.Fatalf("Error opening words.dat: %v", err)
+		return fmt.Errorf("error opening data file: %v", err)
 	}
-	defer wordsFile.Close()
+	defer dataFile.Close()
 
-	indexFile, err := os.Open(indexFilename)
+	indexFile, err := os.Open(indexPath)
 	if err != nil {
-		log.Fatalf("Error opening index.dat: %v", err)
+		return fmt.Errorf("error opening index.dat: %v", err)
 	}
 	defer indexFile.Close()
 
 	// Open the merged file for writing
-	dictFile, err := os.OpenFile(dictFilename, os.O_CREATE|os.O_WRONLY, 0644)
+	dictFile, err := os.OpenFile(dictPath, os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
+	defer dictFile.Close()
 
-	// Write the index file followed by word file to the dict file
+	// Write the index file followed by data file to the dict file
 
 	// Buffered Copying: io.Copy copies data from the source
-	// (indexFile and wordFile) to the destination (dictFile) in chunks
+	// (indexFile and dataFile) to the destination (dictFile) in chunks
 	// (typically 32KB by default, depending on the implementation).
 	// This means it does not read the entire file into memory at once.
 
@@ -183,9 +673,9 @@ func mergeFiles() error {
 		return fmt.Errorf("error copying index file to dict: %v", err)
 	}
 
-	_, err = io.Copy(dictFile, wordsFile)
+	_, err = io.Copy(dictFile, dataFile)
 	if err != nil {
-		return fmt.Errorf("error copying words file to dict: %v", err)
+		return fmt.Errorf("error copying data file to dict: %v", err)
 	}
 
 	return nil
@@ -1,6 +1,9 @@
 package dict
 
-import "testing"
+import (
+	"path/filepath"
+	"testing"
+)
 
 func TestCalcIndexSize(t *testing.T) {
 	tests := []struct {
@@ -11,22 +14,29 @@ func TestCalcIndexSize(t *testing.T) {
 		{
 			name:     "empty index",
 			index:    []IndexEntry{},
-			expected: int64(8),
+			expected: int64(0),
 		},
 		{
 			name: "single entry",
 			index: []IndexEntry{
-				{Word: "hello", Offset: 0, DefSize: 5},
+				{Key: "hello", Word: "Hello", Offset: 0, Size: 5},
 			},
-			expected: int64(8) + int64(len("hello")+1) + int64(8+1) + int64(2+1),
+			expected: int64(2+len("hello")) + int64(2+len("Hello")) + int64(8+1),
 		},
 		{
 			name: "multiple entries",
 			index: []IndexEntry{
-				{Word: "hello", Offset: 0, DefSize: 5},
-				{Word: "john", Offset: 10, DefSize: 5},
+				{Key: "hello", Word: "Hello", Offset: 0, Size: 5},
+				{Key: "john", Word: "john", Offset: 10, Size: 5},
 			},
-			expected: int64(8) + int64(len("hello")+1) + int64(8+1) + int64(2+1) + int64(len("john")+1) + int64(8+1) + int64(2+1),
+			expected: int64(2+len("hello")) + int64(2+len("Hello")) + int64(8+1) + int64(2+len("john")) + int64(2+len("john")) + int64(8+1),
+		},
+		{
+			name: "entry larger than 32KB",
+			index: []IndexEntry{
+				{Key: "big", Word: "big", Offset: 0, Size: 1 << 20},
+			},
+			expected: int64(2+len("big")) + int64(2+len("big")) + int64(8+3),
 		},
 	}
 
@@ -39,3 +49,26 @@ func TestCalcIndexSize(t *testing.T) {
 		})
 	}
 }
+
+func TestDictWriterOrder(t *testing.T) {
+	opts := BuildOptions{}
+	flags, aead, err := prepareBuild(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dw, err := newDictWriter(filepath.Join(t.TempDir(), dictFilename), flags, opts, aead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dw.close()
+
+	if err := dw.add("banana", &Entry{Word: "banana"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"banana", "apple"} {
+		if err := dw.add(key, &Entry{Word: key}); err == nil {
+			t.Errorf("add(%q) after banana succeeded, want an out of order error", key)
+		}
+	}
+}
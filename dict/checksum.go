@@ -0,0 +1,234 @@
+package dict
+
+// This file contains the checksums of dict.dat. The checksum section holds
+// the CRC32C of the header along with the section table, of every other
+// section and of every compressed block, or 64 KB chunk of raw data:
+//
+//	<range count (4 bytes)><range count x <kind (4 bytes)><offset (8 bytes)><size (8 bytes)><crc (4 bytes)>><crc (4 bytes)>
+//
+// kind is checksumHeader for the header, the section kind for sections and
+// checksumData for data chunks. The end of the last data chunk is the size
+// of the file, which detects truncated files without reading the data. The
+// last CRC is the one of the section itself, so that a damaged table is
+// reported rather than trusted.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+const (
+	// checksumChunkSize is the size of the chunks of raw data with a checksum
+	checksumChunkSize = 64 << 10
+	// checksumRangeSize is the size of a serialized checksumRange
+	// kind (4 bytes) + offset (8 bytes) + size (8 bytes) + crc (4 bytes)
+	checksumRangeSize = 24
+
+	checksumHeader uint32 = 0
+	checksumData   uint32 = math.MaxUint32
+)
+
+// ErrChecksum is returned when a part of a dictionary doesn't match its checksum
+var ErrChecksum = errors.New("checksum mismatch")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// checksumRange is the checksum of a byte range of dict.dat
+type checksumRange struct {
+	Kind   uint32
+	Offset int64
+	Size   int64
+	CRC    uint32
+}
+
+// checksumSectionSize returns the size of a checksum section of n ranges
+func checksumSectionSize(n int) int64 {
+	return 4 + int64(n)*checksumRangeSize + 4
+}
+
+// encodeChecksums serializes the checksum section
+func encodeChecksums(ranges []checksumRange) []byte {
+	buf := binary.BigEndian.AppendUint32(nil, uint32(len(ranges)))
+	for _, r := range ranges {
+		buf = binary.BigEndian.AppendUint32(buf, r.Kind)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(r.Offset))
+		buf = binary.BigEndian.AppendUint64(buf, uint64(r.Size))
+		buf = binary.BigEndian.AppendUint32(buf, r.CRC)
+	}
+	return binary.BigEndian.AppendUint32(buf, checksum(buf))
+}
+
+// decodeChecksums parses the checksum section. A section that doesn't match
+// its own checksum is rejected with ErrChecksum.
+func decodeChecksums(buf []byte) ([]checksumRange, error) {
+	if len(buf) < 8 {
+		return nil, fmt.Errorf("%w: truncated checksums", ErrBadFormat)
+	}
+
+	end := len(buf) - 4
+	if checksum(buf[:end]) != binary.BigEndian.Uint32(buf[end:]) {
+		return nil, fmt.Errorf("%w: %s", ErrChecksum, checksumName(sectionChecksums))
+	}
+
+	n := int(binary.BigEndian.Uint32(buf))
+	if int64(len(buf)) != checksumSectionSize(n) {
+		return nil, fmt.Errorf("%w: truncated checksums", ErrBadFormat)
+	}
+	buf = buf[4:]
+
+	ranges := make([]checksumRange, n)
+	for i := range ranges {
+		ranges[i] = checksumRange{
+			Kind:   binary.BigEndian.Uint32(buf),
+			Offset: int64(binary.BigEndian.Uint64(buf[4:])),
+			Size:   int64(binary.BigEndian.Uint64(buf[12:])),
+			CRC:    binary.BigEndian.Uint32(buf[20:]),
+		}
+		buf = buf[checksumRangeSize:]
+	}
+
+	return ranges, nil
+}
+
+// checksum returns the CRC32C of buf
+func checksum(buf []byte) uint32 {
+	return crc32.Checksum(buf, castagnoli)
+}
+
+// dataChecksums computes the checksums of the data of the given size: one
+// per compressed block, or one per checksumChunkSize bytes of raw data.
+// Offsets are relative to the data.
+func dataChecksums(r io.ReaderAt, size int64, blocks []blockRef) ([]checksumRange, error) {
+	var ranges []checksumRange
+	if blocks != nil {
+		for _, b := range blocks {
+			ranges = append(ranges, checksumRange{Kind: checksumData, Offset: b.Offset, Size: b.Size})
+		}
+	} else {
+		for st := int64(0); st < size; st += checksumChunkSize {
+			ranges = append(ranges, checksumRange{Kind: checksumData, Offset: st, Size: min(checksumChunkSize, size-st)})
+		}
+	}
+
+	buf := make([]byte, checksumChunkSize)
+	for i, cr := range ranges {
+		if int64(len(buf)) < cr.Size {
+			buf = make([]byte, cr.Size)
+		}
+
+		_, err := r.ReadAt(buf[:cr.Size], cr.Offset)
+		if err != nil {
+			return nil, err
+		}
+		ranges[i].CRC = checksum(buf[:cr.Size])
+	}
+
+	return ranges, nil
+}
+
+// Corruption is a byte range of a dictionary that doesn't match its checksum
+type Corruption struct {
+	// Name is "header", "data" or the name of the section
+	Name   string
+	Offset int64
+	Size   int64
+}
+
+func (c Corruption) String() string {
+	return fmt.Sprintf("%s [%d, %d)", c.Name, c.Offset, c.Offset+c.Size)
+}
+
+// checksumName returns the name of the range for a Corruption
+func checksumName(kind uint32) string {
+	switch kind {
+	case checksumHeader:
+		return "header"
+	case checksumData:
+		return "data"
+	}
+
+	if name, ok := sectionNames[kind]; ok {
+		return name + " section"
+	}
+
+	return fmt.Sprintf("section %d", kind)
+}
+
+// checkHeader compares the checksum of the header and the section table
+func (rd *Reader) checkHeader(buf []byte) error {
+	for _, r := range rd.sums {
+		if r.Kind == checksumHeader && r.CRC != checksum(buf) {
+			return fmt.Errorf("%w: header", ErrChecksum)
+		}
+	}
+
+	return nil
+}
+
+// checkSize compares the size of the dictionary with the end of its data
+func (rd *Reader) checkSize() error {
+	end := rd.header.IndexSize
+	for _, r := range rd.sums {
+		end = max(end, r.Offset+r.Size)
+	}
+
+	if rd.size < end {
+		return fmt.Errorf("%w: truncated to %d of %d bytes", ErrChecksum, rd.size, end)
+	}
+
+	return nil
+}
+
+// checkSection compares the checksum of a section that was read
+func (rd *Reader) checkSection(kind uint32, buf []byte) error {
+	for _, r := range rd.sums {
+		if r.Kind == kind && r.CRC != checksum(buf) {
+			return fmt.Errorf("%w: %s", ErrChecksum, checksumName(kind))
+		}
+	}
+
+	return nil
+}
+
+// Verify reads the whole dictionary and returns the ranges that don't match
+// their checksums, including the ones missing from a truncated file. A
+// damaged checksum section is returned alone, as the other ranges can't be
+// checked without it. Errors are only returned if the dictionary can't be
+// read.
+func (rd *Reader) Verify() ([]Corruption, error) {
+	if rd.sums == nil {
+		if s, ok := rd.section(sectionChecksums); ok {
+			return []Corruption{{Name: checksumName(s.Kind), Offset: s.Offset, Size: s.Size}}, nil
+		}
+
+		return nil, fmt.Errorf("%w: no checksums, rebuild the dictionary", ErrBadFormat)
+	}
+
+	var corrupt []Corruption
+
+	for _, r := range rd.sums {
+		c := Corruption{Name: checksumName(r.Kind), Offset: r.Offset, Size: r.Size}
+
+		// Checked before allocating, the sizes come from the file
+		if r.Offset < 0 || r.Size < 0 || r.Size > rd.size-r.Offset {
+			corrupt = append(corrupt, c)
+			continue
+		}
+
+		buf := make([]byte, r.Size)
+		_, err := rd.r.ReadAt(buf, r.Offset)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %v", c, err)
+		}
+
+		if checksum(buf) != r.CRC {
+			corrupt = append(corrupt, c)
+		}
+	}
+
+	return corrupt, nil
+}
@@ -0,0 +1,211 @@
+package dict
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// corruptFile writes a copy of the file at path with the byte at offset flipped
+func corruptFile(t *testing.T, path string, offset int64) string {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[offset] ^= 0xff
+
+	corruptPath := filepath.Join(t.TempDir(), "corrupt.dat")
+	if err := os.WriteFile(corruptPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return corruptPath
+}
+
+func TestChecksums(t *testing.T) {
+	dictPath := buildBenchDict(t, t.TempDir(), 5000, BuildOptions{})
+
+	corrupt, err := VerifyFile(dictPath)
+	if err != nil || len(corrupt) != 0 {
+		t.Fatalf("VerifyFile() = %v, %v, want no corruption", corrupt, err)
+	}
+
+	d, err := Open(dictPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, _ := d.rd.section(sectionIndex)
+	sums, _ := d.rd.section(sectionChecksums)
+	indexSize := d.Header().IndexSize
+	d.Close()
+
+	fi, _ := os.Stat(dictPath)
+
+	// Truncated files are detected at startup
+	data, _ := os.ReadFile(dictPath)
+	truncPath := filepath.Join(t.TempDir(), "truncated.dat")
+	os.WriteFile(truncPath, data[:len(data)-100], 0644)
+
+	if _, err := Open(truncPath); !errors.Is(err, ErrChecksum) {
+		t.Errorf("Open() of a truncated file error = %v, want %v", err, ErrChecksum)
+	}
+
+	// So is a corrupt index
+	if _, err := Open(corruptFile(t, dictPath, index.Offset+10)); !errors.Is(err, ErrChecksum) {
+		t.Errorf("Open() of a corrupt index error = %v, want %v", err, ErrChecksum)
+	}
+
+	// The data is only checked by Verify
+	dataPath := corruptFile(t, dictPath, indexSize+checksumChunkSize+10)
+	d, err = Open(dataPath)
+	if err != nil {
+		t.Fatalf("Open() of corrupt data error = %v", err)
+	}
+	d.Close()
+
+	corrupt, err = VerifyFile(dataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Corruption{Name: "data", Offset: indexSize + checksumChunkSize, Size: checksumChunkSize}
+	if len(corrupt) != 1 || corrupt[0] != want {
+		t.Errorf("VerifyFile() = %v, want %v", corrupt, want)
+	}
+
+	// A damaged checksum section is reported, not trusted: the size of the
+	// first range is read from byte 4+12 of the section
+	sumsPath := corruptFile(t, dictPath, sums.Offset+4+12)
+	if _, err := Open(sumsPath); !errors.Is(err, ErrChecksum) {
+		t.Errorf("Open() of corrupt checksums error = %v, want %v", err, ErrChecksum)
+	}
+	corrupt, err = VerifyFile(sumsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = Corruption{Name: "checksums section", Offset: sums.Offset, Size: sums.Size}
+	if len(corrupt) != 1 || corrupt[0] != want {
+		t.Errorf("VerifyFile() of corrupt checksums = %v, want %v", corrupt, want)
+	}
+
+	corrupt, err = VerifyFile(truncPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := (fi.Size() - indexSize - 1) / checksumChunkSize * checksumChunkSize
+	if len(corrupt) != 1 || corrupt[0].Offset != indexSize+last {
+		t.Errorf("VerifyFile() of a truncated file = %v, want the last chunk", corrupt)
+	}
+
+	// Ranges out of the file are corrupt, whatever their size
+	f, rd, err := openRaw(dictPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rd.sums = []checksumRange{{Kind: checksumData, Offset: -1, Size: 1}, {Kind: checksumData, Offset: indexSize, Size: 1 << 62}}
+	if corrupt, err := rd.Verify(); err != nil || len(corrupt) != 2 {
+		t.Errorf("Verify() of ranges out of the file = %v, %v, want 2 corruptions", corrupt, err)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	const n = 5000
+
+	for _, compress := range []bool{false, true} {
+		dictPath := buildBenchDict(t, t.TempDir(), n, BuildOptions{Compress: compress, BlockSize: 8192})
+
+		d, err := Open(dictPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index, _ := d.rd.section(sectionIndex)
+		indexSize := d.Header().IndexSize
+		d.Close()
+
+		fi, _ := os.Stat(dictPath)
+		dataSize := fi.Size() - indexSize
+
+		tests := []struct {
+			name   string
+			offset int64
+		}{
+			{"data", indexSize + dataSize/2},
+			{"index", index.Offset + 10},
+		}
+
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("compress=%v/%s", compress, tt.name), func(t *testing.T) {
+				corruptPath := corruptFile(t, dictPath, tt.offset)
+				outPath := filepath.Join(t.TempDir(), "repaired.dat")
+
+				kept, dropped, err := Repair(corruptPath, outPath)
+				if err != nil {
+					t.Fatalf("Repair() error = %v", err)
+				}
+
+				corrupt, err := VerifyFile(outPath)
+				if err != nil || len(corrupt) != 0 {
+					t.Fatalf("VerifyFile() of the repaired file = %v, %v", corrupt, err)
+				}
+
+				r, err := Open(outPath)
+				if err != nil {
+					t.Fatalf("Open() of the repaired file error = %v", err)
+				}
+				defer r.Close()
+
+				if r.Header().Flags != d.Header().Flags {
+					t.Errorf("repaired flags = %#x, want %#x", r.Header().Flags, d.Header().Flags)
+				}
+				if r.Len() != kept || kept == 0 {
+					t.Errorf("Repair() kept %d entries, the repaired dictionary has %d", kept, r.Len())
+				}
+
+				switch {
+				case tt.name == "index":
+					// All data is intact, but the raw data is only scanned
+					// up to the first corrupted chunk, which is none here
+					if kept != n || dropped != 0 {
+						t.Errorf("Repair() = %d, %d, want all entries", kept, dropped)
+					}
+				case kept+dropped != n || dropped == 0:
+					t.Errorf("Repair() = %d, %d, want %d entries", kept, dropped, n)
+				}
+
+				// The kept entries are intact
+				for i := 0; i < n; i++ {
+					word := fmt.Sprintf("word%06d", i)
+					if def, ok := r.QueryWord(word); ok && def != fmt.Sprintf("definition of the word number %d in the benchmark dictionary", i) {
+						t.Errorf("QueryWord(%s) = %q", word, def)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestReadEntryBounds(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		d, err := Open(buildBenchDict(t, t.TempDir(), 100, BuildOptions{Compress: compress}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+
+		size := d.rd.size
+		for _, idxe := range []IndexEntry{
+			{Word: "negative offset", Offset: -1, Size: 1},
+			{Word: "negative size", Offset: d.Header().IndexSize, Size: -1},
+			{Word: "past the end", Offset: size - 1, Size: 2},
+			{Word: "overflow", Offset: 1 << 62, Size: 1 << 62},
+		} {
+			if _, err := d.rd.readEntry(idxe); !errors.Is(err, ErrBadFormat) {
+				t.Errorf("compress=%v: readEntry(%s) error = %v, want %v", compress, idxe.Word, err, ErrBadFormat)
+			}
+		}
+	}
+}
@@ -0,0 +1,445 @@
+package dict
+
+// This file contains the encryption at rest of dictionaries, selected by
+// FlagEncrypted in the header.
+//
+// Encrypted dictionaries use the compressed block layout and every block is
+// sealed on its own with AES-GCM, so a query still fetches (or range
+// requests) and decrypts a single block. The sections holding the keys, the
+// index and the sparse index, are sealed in chunks of sectionChunkSize
+// bytes, so that the low-memory mode only fetches and decrypts the chunks a
+// lookup reads. The Bloom filter and the perfect hash index, which would
+// tell the keys apart otherwise, are sealed as a whole and decrypted when
+// the reader loads them. A sealed buffer is:
+//
+//	<nonce (12 bytes)><ciphertext><tag (16 bytes)>
+//
+// The random id of the file followed by the offset of a block in the
+// uncompressed data, the kind of a section, or the kind of a section along
+// with the offset of a chunk in it, is authenticated along with it so that
+// sealed buffers can't be swapped, within a file or between the files
+// encrypted with the same key. The encryption section holds the id of
+// the key, to tell a wrong key apart from a corrupt file, and the id of the
+// file. Checksums cover the sealed bytes, so encrypted dictionaries can be
+// verified without the key.
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	// keyIDSize is the size of the id of an encryption key
+	keyIDSize = 8
+	// fileIDSize is the size of the random id of an encrypted file
+	fileIDSize = 16
+	// encryptionSectionSize is the size of the encryption section, the key
+	// id followed by the file id
+	encryptionSectionSize = keyIDSize + fileIDSize
+	// sectionChunkSize is the plain size of the chunks the index and the
+	// sparse index are sealed in
+	sectionChunkSize = 1 << 10
+	// chunkCacheSize is the number of decrypted chunks kept in memory, which
+	// holds the chunks of the sparse index read by every lookup
+	chunkCacheSize = 64
+)
+
+// ErrEncrypted is returned when an encrypted dictionary is opened without its key
+var ErrEncrypted = errors.New("dictionary is encrypted")
+
+// WithEncryptionKey sets the AES key (16, 24 or 32 bytes) of encrypted
+// dictionaries. A nil key is ignored, so that the result of
+// EncryptionKeyFromEnv can be passed as is.
+func WithEncryptionKey(key []byte) Option {
+	return func(o *options) {
+		if key != nil {
+			o.encryptionKey = key
+		}
+	}
+}
+
+// newAEAD returns the AES-GCM cipher of the key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %v", err)
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// fileAEAD authenticates the id of a file along with the additional data of
+// every buffer sealed or opened with it, binding them to the file
+type fileAEAD struct {
+	cipher.AEAD
+	id []byte
+}
+
+func (a *fileAEAD) Seal(dst, nonce, plaintext, ad []byte) []byte {
+	return a.AEAD.Seal(dst, nonce, plaintext, append(a.id[:len(a.id):len(a.id)], ad...))
+}
+
+func (a *fileAEAD) Open(dst, nonce, ciphertext, ad []byte) ([]byte, error) {
+	return a.AEAD.Open(dst, nonce, ciphertext, append(a.id[:len(a.id):len(a.id)], ad...))
+}
+
+// newFileAEAD returns the cipher of the key bound to a new random file id
+func newFileAEAD(key []byte) (*fileAEAD, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, fileIDSize)
+	_, err = io.ReadFull(rand.Reader, id)
+	if err != nil {
+		return nil, fmt.Errorf("error generating file id: %v", err)
+	}
+
+	return &fileAEAD{AEAD: aead, id: id}, nil
+}
+
+// encryptionSection returns the content of the encryption section of a file
+// sealed with aead
+func encryptionSection(key []byte, aead cipher.AEAD) []byte {
+	return append(encryptionKeyID(key), aead.(*fileAEAD).id...)
+}
+
+// encryptionKeyID returns the id of an encryption key, the first 8 bytes of
+// the SHA-256 of the key
+func encryptionKeyID(key []byte) []byte {
+	sum := sha256.Sum256(key)
+	return sum[:keyIDSize]
+}
+
+// sealedSize returns the size of a sealed buffer of n bytes
+func sealedSize(aead cipher.AEAD, n int) int64 {
+	return int64(aead.NonceSize() + n + aead.Overhead())
+}
+
+// seal encrypts plain with a random nonce, authenticating ad along with it
+func seal(aead cipher.AEAD, plain []byte, ad uint64) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), sealedSize(aead, len(plain)))
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, fmt.Errorf("error generating nonce: %v", err)
+	}
+
+	return aead.Seal(nonce, nonce, plain, binary.BigEndian.AppendUint64(nil, ad)), nil
+}
+
+// open decrypts a sealed buffer
+func open(aead cipher.AEAD, sealed []byte, ad uint64) ([]byte, error) {
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("%w: truncated encrypted buffer", ErrBadFormat)
+	}
+
+	nonce := sealed[:aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, sealed[aead.NonceSize():], binary.BigEndian.AppendUint64(nil, ad))
+	if err != nil {
+		return nil, fmt.Errorf("%w: error decrypting: %v", ErrBadFormat, err)
+	}
+
+	return plain, nil
+}
+
+// encryptedSection reports whether sections of the kind are sealed in
+// encrypted dictionaries
+func encryptedSection(kind uint32) bool {
+	switch kind {
+	case sectionIndex, sectionSparse, sectionBloom, sectionHash:
+		return true
+	}
+
+	return false
+}
+
+// chunkedSection reports whether sections of the kind are sealed in chunks
+// of sectionChunkSize rather than as a whole
+func chunkedSection(kind uint32) bool {
+	return kind == sectionIndex || kind == sectionSparse
+}
+
+// chunkAD returns the additional data of the chunk at the offset of a
+// section of the kind. The kind takes the top byte, apart from the offsets
+// of the blocks.
+func chunkAD(kind uint32, offset int64) uint64 {
+	return uint64(kind)<<56 | uint64(offset)
+}
+
+// sealChunks seals the section of the kind in chunks of sectionChunkSize
+func sealChunks(aead cipher.AEAD, plain []byte, kind uint32) ([]byte, error) {
+	sealed := make([]byte, 0, sealedChunksSize(aead, int64(len(plain))))
+	for st := 0; st < len(plain); st += sectionChunkSize {
+		chunk, err := seal(aead, plain[st:min(st+sectionChunkSize, len(plain))], chunkAD(kind, int64(st)))
+		if err != nil {
+			return nil, err
+		}
+		sealed = append(sealed, chunk...)
+	}
+
+	return sealed, nil
+}
+
+// openChunks decrypts consecutive chunks of a section of the kind, the
+// first one being chunk number first
+func openChunks(aead cipher.AEAD, sealed []byte, kind uint32, first int64) ([]byte, error) {
+	size := sealedSize(aead, sectionChunkSize)
+
+	var plain []byte
+	for n := first; len(sealed) > 0; n++ {
+		chunk := sealed[:min(int64(len(sealed)), size)]
+		buf, err := open(aead, chunk, chunkAD(kind, n*sectionChunkSize))
+		if err != nil {
+			return nil, err
+		}
+
+		plain = append(plain, buf...)
+		sealed = sealed[len(chunk):]
+	}
+
+	return plain, nil
+}
+
+// sealedChunksSize returns the size of a section of n bytes sealed in chunks
+func sealedChunksSize(aead cipher.AEAD, n int64) int64 {
+	chunks := (n + sectionChunkSize - 1) / sectionChunkSize
+	return n + chunks*sealedSize(aead, 0)
+}
+
+// plainChunksSize returns the plain size of a section sealed in chunks
+func plainChunksSize(aead cipher.AEAD, size int64) (int64, error) {
+	chunk, overhead := sealedSize(aead, sectionChunkSize), sealedSize(aead, 0)
+
+	// Every chunk holds at least a byte
+	rest := size % chunk
+	if size < 0 || (rest > 0 && rest <= overhead) {
+		return 0, fmt.Errorf("%w: truncated encrypted section", ErrBadFormat)
+	}
+
+	plain := size / chunk * sectionChunkSize
+	if rest > 0 {
+		plain += rest - overhead
+	}
+
+	return plain, nil
+}
+
+// loadEncryption checks the key of an encrypted dictionary against the id
+// stored in the encryption section and sets up its cipher, bound to the id of
+// the file
+func (rd *Reader) loadEncryption(key []byte) error {
+	buf, err := rd.readSection(sectionEncryption)
+	if err != nil {
+		return err
+	}
+
+	if len(buf) != encryptionSectionSize {
+		return fmt.Errorf("%w: corrupt encryption section", ErrBadFormat)
+	}
+	buf, fileID := buf[:keyIDSize], buf[keyIDSize:]
+
+	if key == nil {
+		return fmt.Errorf("%w with key %x, set DICT_ENCRYPTION_KEY or DICT_ENCRYPTION_KEY_FILE", ErrEncrypted, buf)
+	}
+
+	if id := encryptionKeyID(key); !bytes.Equal(id, buf) {
+		return fmt.Errorf("%w with key %x, not with the given key %x", ErrEncrypted, buf, id)
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	rd.aead = &fileAEAD{AEAD: aead, id: fileID}
+	rd.key = key
+
+	return nil
+}
+
+// chunkedReader serves reads of the index and sparse sections of encrypted
+// dictionaries at the offsets of their plain bytes, fetching and decrypting
+// the chunks a read covers. The plain sections are smaller than the sealed
+// ones, so they fit where the sealed ones are stored. The other reads go
+// to r.
+type chunkedReader struct {
+	r    io.ReaderAt
+	aead cipher.AEAD
+	// sections are the sealed sections and plain their plain sizes
+	sections []section
+	plain    []int64
+	// cache holds the decrypted chunks keyed by section and chunk number
+	cache *blockCache
+}
+
+func newChunkedReader(r io.ReaderAt, aead cipher.AEAD) *chunkedReader {
+	return &chunkedReader{r: r, aead: aead, cache: newBlockCache(chunkCacheSize)}
+}
+
+func (cr *chunkedReader) ReadAt(p []byte, off int64) (int, error) {
+	for i, s := range cr.sections {
+		if off < s.Offset || off >= s.Offset+cr.plain[i] {
+			continue
+		}
+		if len(p) == 0 {
+			return 0, nil
+		}
+
+		rel := off - s.Offset
+		first, last := rel/sectionChunkSize, (min(rel+int64(len(p)), cr.plain[i])-1)/sectionChunkSize
+
+		plain, err := cr.chunks(i, first, last)
+		if err != nil {
+			return 0, err
+		}
+
+		n := copy(p, plain[rel-first*sectionChunkSize:])
+		if n < len(p) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+
+	return cr.r.ReadAt(p, off)
+}
+
+// chunks returns the decrypted chunks [first, last] of section i, from the
+// cache if possible. Otherwise the sealed chunks are fetched at once.
+func (cr *chunkedReader) chunks(i int, first, last int64) ([]byte, error) {
+	cacheKey := func(n int64) int {
+		return i<<48 | int(n)
+	}
+
+	var plain []byte
+	for n := first; n <= last; n++ {
+		chunk, ok := cr.cache.get(cacheKey(n))
+		if !ok {
+			plain = nil
+			break
+		}
+		plain = append(plain, chunk...)
+	}
+	if plain != nil {
+		return plain, nil
+	}
+
+	s := cr.sections[i]
+	size := sealedSize(cr.aead, sectionChunkSize)
+
+	sealed := make([]byte, min((last+1)*size, s.Size)-first*size)
+	_, err := cr.r.ReadAt(sealed, s.Offset+first*size)
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err = openChunks(cr.aead, sealed, s.Kind, first)
+	if err != nil {
+		return nil, err
+	}
+
+	for n := first; n <= last; n++ {
+		st := (n - first) * sectionChunkSize
+		cr.cache.add(cacheKey(n), plain[st:min(st+sectionChunkSize, int64(len(plain)))])
+	}
+
+	return plain, nil
+}
+
+// indexReader returns the reader of the index and sparse sections, along
+// with the sections. The sections of encrypted dictionaries are read through
+// a chunkedReader, so sortedIndex can read them like the plain ones.
+func (rd *Reader) indexReader() (io.ReaderAt, section, section, error) {
+	index, ok := rd.section(sectionIndex)
+	sparse, ok2 := rd.section(sectionSparse)
+	if !ok || !ok2 {
+		return nil, section{}, section{}, fmt.Errorf("%w: missing index sections", ErrBadFormat)
+	}
+
+	if rd.aead == nil {
+		return rd.r, index, sparse, nil
+	}
+
+	cr := newChunkedReader(rd.r, rd.aead)
+	for _, s := range []*section{&index, &sparse} {
+		plain, err := plainChunksSize(rd.aead, s.Size)
+		if err != nil {
+			return nil, section{}, section{}, err
+		}
+
+		cr.sections = append(cr.sections, *s)
+		cr.plain = append(cr.plain, plain)
+		s.Size = plain
+	}
+
+	return cr, index, sparse, nil
+}
+
+// NewEncryptionKey returns a random 32 byte AES-256 key
+func NewEncryptionKey() ([]byte, error) {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// ParseEncryptionKey parses a base64 encoded AES key of 16, 24 or 32 bytes
+func ParseEncryptionKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %v", err)
+	}
+
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("invalid encryption key: %d bytes, expected 16, 24 or 32", len(key))
+}
+
+// EncryptionKeyFromEnv returns the base64 encoded encryption key in
+// DICT_ENCRYPTION_KEY, or in the file DICT_ENCRYPTION_KEY_FILE. It returns
+// nil if neither is set.
+func EncryptionKeyFromEnv() ([]byte, error) {
+	if s := os.Getenv("DICT_ENCRYPTION_KEY"); s != "" {
+		return ParseEncryptionKey(s)
+	}
+
+	path := os.Getenv("DICT_ENCRYPTION_KEY_FILE")
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ParseEncryptionKey(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return key, nil
+}
+
+// EncryptionKeyID returns the hex encoded id of an encryption key, as
+// reported by the errors of encrypted dictionaries
+func EncryptionKeyID(key []byte) string {
+	return hex.EncodeToString(encryptionKeyID(key))
+}
@@ -0,0 +1,345 @@
+package dict
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptedDict(t *testing.T) {
+	key, err := NewEncryptionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range []BuildOptions{
+		{EncryptionKey: key, BlockSize: 4096},
+		{EncryptionKey: key, BlockSize: 4096, FrontCoding: true, PerfectHash: true},
+	} {
+		dictPath := buildBenchDict(t, t.TempDir(), 2000, opts)
+
+		// Neither the keys nor the definitions are stored in plain text
+		data, _ := os.ReadFile(dictPath)
+		for _, s := range []string{"word001234", "benchmark dictionary"} {
+			if bytes.Contains(data, []byte(s)) {
+				t.Errorf("encrypted dictionary contains %q", s)
+			}
+		}
+
+		if _, err := Open(dictPath); !errors.Is(err, ErrEncrypted) {
+			t.Errorf("Open() without the key error = %v, want %v", err, ErrEncrypted)
+		}
+
+		otherKey, _ := NewEncryptionKey()
+		if _, err := Open(dictPath, WithEncryptionKey(otherKey)); !errors.Is(err, ErrEncrypted) {
+			t.Errorf("Open() with the wrong key error = %v, want %v", err, ErrEncrypted)
+		}
+
+		for _, ropts := range [][]Option{
+			{WithEncryptionKey(key)},
+			{WithEncryptionKey(key), WithLowMemory(false)},
+			{WithEncryptionKey(key), WithLowMemory(true)},
+		} {
+			d, err := Open(dictPath, ropts...)
+			if err != nil {
+				t.Fatalf("Open() error = %v", err)
+			}
+
+			if d.Header().Flags&(FlagEncrypted|FlagCompressed) != FlagEncrypted|FlagCompressed {
+				t.Errorf("flags = %#x, want encrypted and compressed", d.Header().Flags)
+			}
+			if len(d.rd.blocks) < 3 {
+				t.Errorf("got %d blocks, want at least 3", len(d.rd.blocks))
+			}
+
+			for _, i := range []int{0, 1234, 1999} {
+				word := fmt.Sprintf("word%06d", i)
+				expected := fmt.Sprintf("definition of the word number %d in the benchmark dictionary", i)
+
+				def, ok := d.QueryWord(word)
+				if !ok || def != expected {
+					t.Errorf("QueryWord(%s) = %q, %v, want %q", word, def, ok, expected)
+				}
+			}
+
+			n := 0
+			err = d.Iterate(context.Background(), "word000100", "word000200", func(key string, e *Entry) bool {
+				n++
+				return true
+			})
+			if err != nil || n != 100 {
+				t.Errorf("Iterate() = %d entries, %v, want 100", n, err)
+			}
+
+			d.Close()
+		}
+
+		// Checksums cover the encrypted bytes, so the key isn't needed to verify
+		corrupt, err := VerifyFile(dictPath)
+		if err != nil || len(corrupt) != 0 {
+			t.Errorf("VerifyFile() = %v, %v, want no corruption", corrupt, err)
+		}
+	}
+}
+
+func TestEncryptedLowMemoryReads(t *testing.T) {
+	key, _ := NewEncryptionKey()
+	dictPath := buildBenchDict(t, t.TempDir(), 5000, BuildOptions{EncryptionKey: key})
+
+	f, err := os.Open(dictPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fi, _ := f.Stat()
+
+	cr := &countingReaderAt{f: f}
+	rd, err := NewReader(cr, fi.Size(), WithEncryptionKey(key), WithLowMemory(false))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+
+	// Only the chunks of the index a lookup reads are fetched and decrypted
+	index, _ := rd.section(sectionIndex)
+	if cr.n >= index.Size/10 {
+		t.Errorf("read %d bytes at startup, index is %d bytes", cr.n, index.Size)
+	}
+
+	for _, i := range []int{0, 2345, 4999} {
+		cr.n = 0
+		word := fmt.Sprintf("word%06d", i)
+		if def, ok, err := rd.Lookup(word); err != nil || !ok || def.Word != word {
+			t.Fatalf("Lookup(%s) = %v, %v, %v", word, def, ok, err)
+		}
+		if cr.n >= index.Size/10 {
+			t.Errorf("Lookup(%s) read %d bytes, index is %d bytes", word, cr.n, index.Size)
+		}
+	}
+
+	// A chunk moved within the section doesn't decrypt
+	size := sealedSize(rd.aead, sectionChunkSize)
+	data, _ := os.ReadFile(dictPath)
+	copy(data[index.Offset:], append([]byte(nil), data[index.Offset+size:index.Offset+2*size]...))
+	rd, err = NewReader(bytes.NewReader(data), int64(len(data)), WithEncryptionKey(key), WithLowMemory(false), withoutIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rd.readSection(sectionIndex); !errors.Is(err, ErrBadFormat) {
+		t.Errorf("readSection() of a moved chunk error = %v, want %v", err, ErrBadFormat)
+	}
+}
+
+func TestEncryptedBlocksAreAuthenticated(t *testing.T) {
+	key, _ := NewEncryptionKey()
+	dictPath := buildBenchDict(t, t.TempDir(), 2000, BuildOptions{EncryptionKey: key, BlockSize: 4096})
+
+	d, err := Open(dictPath, WithEncryptionKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := d.rd.blocks
+	d.Close()
+
+	// Swapping two blocks of the same size keeps the checksums of the ranges
+	// valid, but not the offsets authenticated along with the blocks
+	a, b := -1, -1
+	for i := range blocks {
+		for j := i + 1; j < len(blocks) && a < 0; j++ {
+			if blocks[i].Size == blocks[j].Size {
+				a, b = i, j
+			}
+		}
+	}
+
+	data, _ := os.ReadFile(dictPath)
+	if a < 0 {
+		// Fall back to a flipped byte, caught by the tag all the same
+		data[blocks[1].Offset+20] ^= 0xff
+		a = 1
+	} else {
+		ba := append([]byte(nil), data[blocks[a].Offset:blocks[a].Offset+blocks[a].Size]...)
+		copy(data[blocks[a].Offset:], data[blocks[b].Offset:blocks[b].Offset+blocks[b].Size])
+		copy(data[blocks[b].Offset:], ba)
+	}
+
+	tampered := filepath.Join(t.TempDir(), "tampered.dat")
+	os.WriteFile(tampered, data, 0644)
+
+	d, err = Open(tampered, WithEncryptionKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if _, err := d.rd.block(a); !errors.Is(err, ErrBadFormat) {
+		t.Errorf("block(%d) of a tampered dictionary error = %v, want %v", a, err, ErrBadFormat)
+	}
+}
+
+func TestEncryptedFilesAreBound(t *testing.T) {
+	key, _ := NewEncryptionKey()
+	opts := BuildOptions{EncryptionKey: key, BlockSize: 4096, PerfectHash: true}
+	path1 := buildBenchDict(t, t.TempDir(), 2000, opts)
+	path2 := buildBenchDict(t, t.TempDir(), 2000, opts)
+
+	d, err := Open(path2, WithEncryptionKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path2)
+
+	// The Bloom filter and the hash index are sealed, with the id of the file
+	plain, _ := newAEAD(key)
+	for _, kind := range []uint32{sectionBloom, sectionHash} {
+		s, _ := d.rd.section(kind)
+		sealed := data[s.Offset : s.Offset+s.Size]
+		if _, err := open(d.rd.aead, sealed, uint64(kind)); err != nil {
+			t.Errorf("open() of section %d error = %v", kind, err)
+		}
+		if _, err := open(plain, sealed, uint64(kind)); err == nil {
+			t.Errorf("section %d opened without the file id", kind)
+		}
+	}
+	indexSize := d.Header().IndexSize
+	d.Close()
+
+	// The same words give the same layout, but the blocks of one file don't
+	// open in the other
+	data1, _ := os.ReadFile(path1)
+	copy(data[indexSize:], data1[indexSize:])
+	tampered := filepath.Join(t.TempDir(), "tampered.dat")
+	os.WriteFile(tampered, data, 0644)
+
+	d, err = Open(tampered, WithEncryptionKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if _, err := d.rd.block(0); !errors.Is(err, ErrBadFormat) {
+		t.Errorf("block(0) of another file error = %v, want %v", err, ErrBadFormat)
+	}
+}
+
+func TestUpdateEncrypted(t *testing.T) {
+	key, _ := NewEncryptionKey()
+	dir := t.TempDir()
+	buildBenchDict(t, dir, 100, BuildOptions{EncryptionKey: key})
+	chdir(t, dir)
+	t.Setenv("DICT_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(key))
+
+	if err := os.WriteFile(jsonlChglogFilename, []byte(`{"word":"zebra","senses":[{"definition":"a striped animal"}]}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateDict(); err != nil {
+		t.Fatalf("UpdateDict() error = %v", err)
+	}
+
+	// Neither the source, nor the changelog, nor the history are left in plain text
+	versions, _ := archivedVersions(archiveDirname)
+	if len(versions) != 1 {
+		t.Fatalf("archivedVersions() = %v", versions)
+	}
+	for _, path := range []string{
+		wordsFilename,
+		jsonlWordsFilename,
+		jsonlChglogFilename,
+		filepath.Join(archiveDirname, versions[0], wordsFilename),
+		filepath.Join(archiveDirname, versions[0], jsonlChglogFilename),
+	} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s exists after the update", path)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(archiveDirname, historyFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"word000010", "benchmark dictionary"} {
+		if bytes.Contains(data, []byte(s)) {
+			t.Errorf("history contains %q", s)
+		}
+	}
+
+	d, err := Open(dictFilename, WithEncryptionKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if def, ok := d.QueryWord("zebra"); !ok || def != "a striped animal" {
+		t.Errorf("QueryWord(zebra) = %q, %v", def, ok)
+	}
+
+	h, err := NewHistory()
+	if err != nil {
+		t.Fatalf("NewHistory() error = %v", err)
+	}
+	current, _ := d.Lookup("word000010")
+	records, err := h.Word("word000010", current)
+	if err != nil || len(records) != 1 || records[0].Version != versions[0] {
+		t.Errorf("Word(word000010) = %+v, %v", records, err)
+	}
+
+	h, err = OpenHistory(filepath.Join(archiveDirname, historyFilename), 0)
+	if err == nil {
+		_, err = h.Word("word000010", nil)
+	}
+	if !errors.Is(err, ErrEncrypted) {
+		t.Errorf("history without the key error = %v, want %v", err, ErrEncrypted)
+	}
+}
+
+func TestRepairEncrypted(t *testing.T) {
+	key, _ := NewEncryptionKey()
+	dictPath := buildBenchDict(t, t.TempDir(), 2000, BuildOptions{EncryptionKey: key, BlockSize: 4096})
+	outPath := filepath.Join(t.TempDir(), "repaired.dat")
+
+	if _, _, err := Repair(dictPath, outPath); !errors.Is(err, ErrEncrypted) {
+		t.Errorf("Repair() without the key error = %v, want %v", err, ErrEncrypted)
+	}
+
+	kept, dropped, err := Repair(dictPath, outPath, WithEncryptionKey(key))
+	if err != nil || kept != 2000 || dropped != 0 {
+		t.Fatalf("Repair() = %d, %d, %v, want 2000 kept", kept, dropped, err)
+	}
+
+	// The repaired dictionary is encrypted with the same key
+	d, err := Open(outPath, WithEncryptionKey(key))
+	if err != nil {
+		t.Fatalf("Open() of the repaired dictionary error = %v", err)
+	}
+	defer d.Close()
+
+	if d.Header().Flags&FlagEncrypted == 0 {
+		t.Errorf("repaired dictionary is not encrypted")
+	}
+}
+
+func TestParseEncryptionKey(t *testing.T) {
+	for _, s := range []string{"", "not base64", "c2hvcnQ="} {
+		if _, err := ParseEncryptionKey(s); err == nil {
+			t.Errorf("ParseEncryptionKey(%q) succeeded", s)
+		}
+	}
+
+	t.Setenv("DICT_ENCRYPTION_KEY", "")
+	t.Setenv("DICT_ENCRYPTION_KEY_FILE", "")
+	if key, err := EncryptionKeyFromEnv(); key != nil || err != nil {
+		t.Errorf("EncryptionKeyFromEnv() without a key = %v, %v", key, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "dict.aes")
+	os.WriteFile(path, []byte("MDEyMzQ1Njc4OWFiY2RlZg==\n"), 0600)
+	t.Setenv("DICT_ENCRYPTION_KEY_FILE", path)
+
+	key, err := EncryptionKeyFromEnv()
+	if err != nil || string(key) != "0123456789abcdef" {
+		t.Errorf("EncryptionKeyFromEnv() = %q, %v", key, err)
+	}
+}
@@ -0,0 +1,313 @@
+package dict
+
+// This file contains the dictd format, a dictionary of two files:
+//
+//	<name>.index - "<word>\t<offset>\t<size>" for every entry, offset and
+//	               size as numbers in base 64
+//	<name>.dict - the text of the entries, optionally dictzip compressed
+//
+// The text of an entry usually starts with a line repeating the headword,
+// optionally followed by the pronunciation between slashes or brackets. The
+// paragraphs of the rest become the senses, their lines wrapped back into
+// one. The 00-database-* entries describe the dictionary and are left out.
+//
+// Exported dictionaries are laid out the same way, with a paragraph per sense
+// and one for the etymology, and have 00-database-utf8 and
+// 00-database-short entries.
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// dictdDigits are the digits of the base 64 numbers of a .index file
+const dictdDigits = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+// parseDictdNumber parses a base 64 number of a .index file
+func parseDictdNumber(s string) (int64, error) {
+	if s == "" || len(s) > 10 {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+
+	var n int64
+	for i := 0; i < len(s); i++ {
+		d := strings.IndexByte(dictdDigits, s[i])
+		if d < 0 {
+			return 0, fmt.Errorf("invalid number %q", s)
+		}
+		n = n*64 + int64(d)
+	}
+
+	return n, nil
+}
+
+// formatDictdNumber formats a number in the base 64 of a .index file
+func formatDictdNumber(n int64) string {
+	if n == 0 {
+		return dictdDigits[:1]
+	}
+
+	var buf []byte
+	for ; n > 0; n /= 64 {
+		buf = append(buf, dictdDigits[n%64])
+	}
+	slices.Reverse(buf)
+
+	return string(buf)
+}
+
+// openDictd reads the entries of the dictd dictionary of path in the order
+// of its .index file
+func (im *Importer) openDictd(path string) error {
+	base := basePath(path, ".index", ".dict.dz", ".dict")
+
+	index, err := os.Open(base + ".index")
+	if err != nil {
+		return fmt.Errorf("error opening %s.index: %v", filepath.Base(base), err)
+	}
+
+	data, closeData, err := openData(base)
+	if err != nil {
+		index.Close()
+		return err
+	}
+
+	im.close = func() {
+		index.Close()
+		closeData()
+	}
+
+	r := bufio.NewReader(index)
+
+	im.next = func() (*Entry, error) {
+		for {
+			line, err := r.ReadString('\n')
+			if err == io.EOF && line == "" {
+				return nil, io.EOF
+			}
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+
+			line = strings.TrimRight(line, "\r\n")
+			if line == "" {
+				continue
+			}
+
+			fields := strings.Split(line, "\t")
+			word := fields[0]
+			if strings.HasPrefix(word, "00-database-") || strings.HasPrefix(word, "00database") {
+				continue
+			}
+			if len(fields) < 3 {
+				im.skip(word, "malformed index line")
+				continue
+			}
+
+			offset, err := parseDictdNumber(fields[1])
+			if err == nil {
+				var size int64
+				size, err = parseDictdNumber(fields[2])
+				if err == nil {
+					raw := make([]byte, size)
+					_, err = data.ReadAt(raw, offset)
+					if err == nil {
+						e := dictdEntry(word, string(raw))
+						if len(e.Senses) == 0 {
+							im.skip(word, "no definition")
+							continue
+						}
+						return e, nil
+					}
+				}
+			}
+
+			im.skip(word, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// dictdEntry maps the text of an entry to an entry
+func dictdEntry(word, text string) *Entry {
+	e := &Entry{Word: word}
+
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+
+	// The headword line, along with the pronunciation
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	if len(lines) > 0 {
+		head := strings.TrimSpace(lines[0])
+		if len(head) >= len(word) && strings.EqualFold(head[:len(word)], word) {
+			rest := strings.TrimSpace(head[len(word):])
+			if len(rest) > 2 && (rest[0] == '/' && rest[len(rest)-1] == '/' || rest[0] == '[' && rest[len(rest)-1] == ']') {
+				e.Pronunciation = rest
+				lines = lines[1:]
+			} else if rest == "" {
+				lines = lines[1:]
+			}
+		}
+	}
+
+	// Paragraphs are separated by blank lines, their lines are wrapped
+	var paragraph []string
+	flush := func() {
+		if len(paragraph) > 0 {
+			e.Senses = append(e.Senses, Sense{Definition: strings.Join(paragraph, " ")})
+			paragraph = nil
+		}
+	}
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); line == "" {
+			flush()
+			continue
+		}
+		paragraph = append(paragraph, line)
+	}
+	flush()
+
+	e.numberSenses()
+
+	return e
+}
+
+// dictdRecord is an entry of a .index file
+type dictdRecord struct {
+	word   string
+	offset int64
+	size   int
+}
+
+// exportDictd writes the entries as a dictd dictionary
+func exportDictd(ctx context.Context, src Iterator, name string, create createFunc) (int, error) {
+	dictFile, err := create(name + ".dict")
+	if err != nil {
+		return 0, fmt.Errorf("error creating %s.dict: %v", name, err)
+	}
+	defer dictFile.Close()
+
+	w := bufio.NewWriter(dictFile)
+
+	var index []dictdRecord
+	var offset int64
+	write := func(word, text string) error {
+		_, err := w.WriteString(text)
+		if err != nil {
+			return err
+		}
+		index = append(index, dictdRecord{word: word, offset: offset, size: len(text)})
+		offset += int64(len(text))
+		return nil
+	}
+
+	// The entries describing the dictionary
+	err = write("00-database-utf8", "00-database-utf8\n")
+	if err == nil {
+		err = write("00-database-short", "00-database-short\n   "+strings.Join(strings.Fields(name), " ")+"\n")
+	}
+
+	n := 0
+	var werr error
+	if err == nil {
+		err = src.Iterate(ctx, "", "", func(key string, e *Entry) bool {
+			if strings.ContainsAny(e.Word, "\t\n") {
+				log.Printf("Skipping dictd entry '%s': invalid headword", e.Word)
+				return true
+			}
+
+			werr = write(e.Word, dictdText(e))
+			n++
+			return werr == nil
+		})
+	}
+	if err == nil {
+		err = werr
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = dictFile.Close()
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error exporting entries: %v", err)
+	}
+
+	// dictd binary searches the index, sorted case-insensitively on the
+	// letters, digits and spaces of the headwords rather than by key
+	slices.SortStableFunc(index, func(a, b dictdRecord) int {
+		if c := strings.Compare(dictdSortKey(a.word), dictdSortKey(b.word)); c != 0 {
+			return c
+		}
+		return strings.Compare(a.word, b.word)
+	})
+
+	indexFile, err := create(name + ".index")
+	if err != nil {
+		return 0, fmt.Errorf("error creating %s.index: %v", name, err)
+	}
+	defer indexFile.Close()
+
+	w = bufio.NewWriter(indexFile)
+	for _, r := range index {
+		_, err = fmt.Fprintf(w, "%s\t%s\t%s\n", r.word, formatDictdNumber(r.offset), formatDictdNumber(int64(r.size)))
+		if err != nil {
+			return 0, fmt.Errorf("error writing %s.index: %v", name, err)
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		err = indexFile.Close()
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error writing %s.index: %v", name, err)
+	}
+
+	return n, nil
+}
+
+// dictdText returns the text of an entry, the headword line followed by a
+// paragraph per sense and one for the etymology
+func dictdText(e *Entry) string {
+	var sb strings.Builder
+
+	sb.WriteString(e.Word)
+	if p := e.Pronunciation; p != "" {
+		if !strings.HasPrefix(p, "/") && !strings.HasPrefix(p, "[") {
+			p = "/" + p + "/"
+		}
+		sb.WriteString(" " + p)
+	}
+	sb.WriteString("\n")
+
+	for _, s := range e.Senses {
+		sb.WriteString("\n   " + senseText(s) + "\n")
+	}
+	if e.Etymology != "" {
+		sb.WriteString("\n   Etymology: " + strings.Join(strings.Fields(e.Etymology), " ") + "\n")
+	}
+
+	return sb.String()
+}
+
+// dictdSortKey returns the headword as compared by dictd, lowercase and
+// without the characters other than letters, digits and spaces
+func dictdSortKey(word string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsSpace(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, word)
+}
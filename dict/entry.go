@@ -0,0 +1,252 @@
+package dict
+
+// This file contains the structured entry model and its binary encoding
+// in the data section of dict.dat.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Entry is a headword along with all of its senses
+type Entry struct {
+	Word string `json:"word"`
+	// Pronunciation in IPA, e.g. /əˈbændən/
+	Pronunciation string  `json:"pronunciation,omitempty"`
+	Etymology     string  `json:"etymology,omitempty"`
+	Senses        []Sense `json:"senses"`
+	// Tags label the entry, e.g. "slang" or "medical", see Extract
+	Tags []string `json:"tags,omitempty"`
+}
+
+// Sense is one numbered meaning of a headword
+type Sense struct {
+	// Number is the 1-based position of the sense in the entry.
+	// It's derived from the order of the senses and not stored on disk.
+	Number       int      `json:"number,omitempty"`
+	PartOfSpeech string   `json:"pos,omitempty"`
+	Definition   string   `json:"definition"`
+	Examples     []string `json:"examples,omitempty"`
+}
+
+// Definition flattens the senses into a single definition string.
+// An entry with a single sense returns its definition as is, otherwise
+// the senses are numbered - "1. first; 2. second".
+func (e *Entry) Definition() string {
+	if len(e.Senses) == 1 {
+		return e.Senses[0].Definition
+	}
+
+	var sb strings.Builder
+	for i, s := range e.Senses {
+		if i > 0 {
+			sb.WriteString("; ")
+		}
+		sb.WriteString(strconv.Itoa(i + 1))
+		sb.WriteString(". ")
+		sb.WriteString(s.Definition)
+	}
+
+	return sb.String()
+}
+
+// merge appends the senses of other to e. Pronunciation and etymology are
+// only taken from other if e does not have them yet.
+func (e *Entry) merge(other *Entry) {
+	if e.Pronunciation == "" {
+		e.Pronunciation = other.Pronunciation
+	}
+	if e.Etymology == "" {
+		e.Etymology = other.Etymology
+	}
+	e.Senses = append(e.Senses, other.Senses...)
+	e.numberSenses()
+
+	for _, tag := range other.Tags {
+		if !slices.Contains(e.Tags, tag) {
+			e.Tags = append(e.Tags, tag)
+		}
+	}
+}
+
+// numberSenses assigns the 1-based sense numbers
+func (e *Entry) numberSenses() {
+	for i := range e.Senses {
+		e.Senses[i].Number = i + 1
+	}
+}
+
+// encodeEntry serializes an entry. Every string is prefixed by its length
+// as an uvarint and lists are prefixed by their number of items:
+// <word><pronunciation><etymology><senses count>
+// followed by <part of speech><definition><examples count><examples...> for each sense
+// and, for tagged entries only, <tags count><tags...>. Entries without tags
+// are encoded as they were before tags were added.
+func encodeEntry(e *Entry) []byte {
+	var buf []byte
+
+	buf = appendString(buf, e.Word)
+	buf = appendString(buf, e.Pronunciation)
+	buf = appendString(buf, e.Etymology)
+
+	buf = binary.AppendUvarint(buf, uint64(len(e.Senses)))
+	for _, s := range e.Senses {
+		buf = appendString(buf, s.PartOfSpeech)
+		buf = appendString(buf, s.Definition)
+
+		buf = binary.AppendUvarint(buf, uint64(len(s.Examples)))
+		for _, ex := range s.Examples {
+			buf = appendString(buf, ex)
+		}
+	}
+
+	if len(e.Tags) > 0 {
+		buf = binary.AppendUvarint(buf, uint64(len(e.Tags)))
+		for _, tag := range e.Tags {
+			buf = appendString(buf, tag)
+		}
+	}
+
+	return buf
+}
+
+// decodeEntry parses an entry serialized by encodeEntry
+func decodeEntry(buf []byte) (*Entry, error) {
+	d := entryDecoder{buf: buf}
+
+	e := &Entry{
+		Word:          d.string(),
+		Pronunciation: d.string(),
+		Etymology:     d.string(),
+	}
+
+	n := d.count()
+	for i := 0; i < n && d.err == nil; i++ {
+		s := Sense{
+			PartOfSpeech: d.string(),
+			Definition:   d.string(),
+		}
+
+		m := d.count()
+		for j := 0; j < m && d.err == nil; j++ {
+			s.Examples = append(s.Examples, d.string())
+		}
+
+		e.Senses = append(e.Senses, s)
+	}
+
+	// The tags are optional, see encodeEntry
+	if d.err == nil && len(d.buf) > 0 {
+		n := d.count()
+		for i := 0; i < n && d.err == nil; i++ {
+			e.Tags = append(e.Tags, d.string())
+		}
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	e.numberSenses()
+
+	return e, nil
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// entryDecoder reads the fields of an encoded entry and remembers the first error
+type entryDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *entryDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = fmt.Errorf("%w: corrupt entry", ErrBadFormat)
+		return 0
+	}
+	d.buf = d.buf[n:]
+
+	return v
+}
+
+func (d *entryDecoder) count() int {
+	n := d.uvarint()
+	// Every item takes at least one byte, anything larger is corrupt
+	if n > uint64(len(d.buf)) {
+		d.err = fmt.Errorf("%w: corrupt entry", ErrBadFormat)
+		return 0
+	}
+
+	return int(n)
+}
+
+func (d *entryDecoder) string() string {
+	return string(d.bytes())
+}
+
+// bytes returns the next length prefixed field as a slice of the buffer
+func (d *entryDecoder) bytes() []byte {
+	n := d.count()
+	if d.err != nil {
+		return nil
+	}
+
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+
+	return b
+}
+
+// skip skips the next length prefixed field
+func (d *entryDecoder) skip() {
+	d.bytes()
+}
+
+// entrySource reads entries one by one, returning io.EOF once they are all
+// read, see entryReader and sourceReader
+type entrySource interface {
+	Next() (*Entry, error)
+}
+
+// entryReader reads the length prefixed entries of the data section sequentially
+type entryReader struct {
+	r *bufio.Reader
+}
+
+func newEntryReader(r io.Reader) *entryReader {
+	return &entryReader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next entry or io.EOF once all entries are read
+func (er *entryReader) Next() (*Entry, error) {
+	size, err := binary.ReadUvarint(er.r)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("error reading entry size: %v", err)
+	}
+
+	buf := make([]byte, size)
+	_, err = io.ReadFull(er.r, buf)
+	if err != nil {
+		return nil, fmt.Errorf("error reading entry: %v", err)
+	}
+
+	return decodeEntry(buf)
+}
@@ -0,0 +1,144 @@
+package dict
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncodeDecodeEntry(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry Entry
+	}{
+		{
+			name:  "single sense",
+			entry: Entry{Word: "a", Senses: []Sense{{Number: 1, Definition: "first english alphabet"}}},
+		},
+		{
+			name: "structured",
+			entry: Entry{
+				Word:          "abandon",
+				Pronunciation: "/əˈbændən/",
+				Etymology:     "from Old French abandoner",
+				Senses: []Sense{
+					{Number: 1, PartOfSpeech: "verb", Definition: "to leave and never return to", Examples: []string{"they abandoned the car", "abandon ship"}},
+					{Number: 2, PartOfSpeech: "noun", Definition: "complete lack of inhibition"},
+				},
+			},
+		},
+		{
+			name:  "tagged",
+			entry: Entry{Word: "abaft", Senses: []Sense{{Number: 1, Definition: "toward the stern"}}, Tags: []string{"nautical", "archaic"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := decodeEntry(encodeEntry(&tt.entry))
+			if err != nil {
+				t.Fatalf("decodeEntry() error = %v", err)
+			}
+			if !reflect.DeepEqual(*result, tt.entry) {
+				t.Errorf("decodeEntry() = %+v, want %+v", *result, tt.entry)
+			}
+		})
+	}
+
+	// Truncated entries must fail instead of returning garbage
+	data := encodeEntry(&tests[1].entry)
+	if _, err := decodeEntry(data[:len(data)-3]); err == nil {
+		t.Errorf("decodeEntry() of truncated entry succeeded")
+	}
+}
+
+func TestEntryDefinition(t *testing.T) {
+	e := Entry{Word: "abandon", Senses: []Sense{{Definition: "to leave"}, {Definition: "to give up"}}}
+	if def := e.Definition(); def != "1. to leave; 2. to give up" {
+		t.Errorf("Definition() = %q", def)
+	}
+
+	e.Senses = e.Senses[:1]
+	if def := e.Definition(); def != "to leave" {
+		t.Errorf("Definition() = %q", def)
+	}
+}
+
+func TestBuildMergesDuplicateHeadwords(t *testing.T) {
+	dir := t.TempDir()
+	wordsPath := filepath.Join(dir, jsonlWordsFilename)
+	dictPath := filepath.Join(dir, dictFilename)
+
+	words := `{"word":"abandon","pronunciation":"/əˈbændən/","senses":[{"pos":"verb","definition":"to leave","examples":["abandon ship"]}]}
+{"word":"ability","senses":[{"pos":"noun","definition":"power or skill to do something"}]}
+{"word":"Abandon","etymology":"Old French","senses":[{"pos":"noun","definition":"lack of inhibition"}]}
+`
+	if err := os.WriteFile(wordsPath, []byte(words), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Build(wordsPath, dictPath, BuildOptions{}); err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+
+	d, err := Open(dictPath)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer d.Close()
+
+	e, ok := d.Lookup("abandon")
+	if !ok {
+		t.Fatalf("Lookup() did not find abandon")
+	}
+
+	expected := &Entry{
+		Word:          "abandon",
+		Pronunciation: "/əˈbændən/",
+		Etymology:     "Old French",
+		Senses: []Sense{
+			{Number: 1, PartOfSpeech: "verb", Definition: "to leave", Examples: []string{"abandon ship"}},
+			{Number: 2, PartOfSpeech: "noun", Definition: "lack of inhibition"},
+		},
+	}
+	if !reflect.DeepEqual(e, expected) {
+		t.Errorf("Lookup() = %+v, want %+v", e, expected)
+	}
+
+	if def, _ := d.QueryWord("ability"); def != "power or skill to do something" {
+		t.Errorf("QueryWord() = %q", def)
+	}
+}
+
+func TestQueryLargeDefinition(t *testing.T) {
+	dir := t.TempDir()
+	wordsPath := filepath.Join(dir, wordsFilename)
+	dictPath := filepath.Join(dir, dictFilename)
+
+	// Larger than both the old int16 size and the default bufio.Scanner token size
+	large := strings.Repeat("a long definition ", 10000)
+
+	words := "big," + large + "\nsmall,tiny\n"
+	if err := os.WriteFile(wordsPath, []byte(words), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Build(wordsPath, dictPath, BuildOptions{}); err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+
+	d, err := Open(dictPath)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer d.Close()
+
+	if def, ok := d.QueryWord("big"); !ok || def != large {
+		t.Errorf("QueryWord(big) returned %d bytes, want %d", len(def), len(large))
+	}
+	if def, ok := d.QueryWord("small"); !ok || def != "tiny" {
+		t.Errorf("QueryWord(small) = %q, %v", def, ok)
+	}
+}
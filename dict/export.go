@@ -0,0 +1,262 @@
+package dict
+
+// This file contains the exporters of dictionaries into other formats, see
+// import.go for the formats read back:
+//
+//  1. StarDict - <name>.ifo, <name>.idx and <name>.dict, see stardict.go
+//  2. dictd - <name>.index and <name>.dict, see dictd.go
+//  3. JSON lines, one entry per line like words.jsonl
+//  4. CSV, one row per sense
+//
+// The entries are walked in key order and written as they're read, so a
+// dictionary is exported without holding it in memory. StarDict and dictd
+// dictionaries are made of several files, which are written next to each
+// other or streamed as a tar archive.
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExportFormat is the format of an exported dictionary
+type ExportFormat string
+
+const (
+	ExportStarDict ExportFormat = "stardict"
+	ExportDictd    ExportFormat = "dictd"
+	ExportJSONL    ExportFormat = "jsonl"
+	ExportCSV      ExportFormat = "csv"
+)
+
+// ParseExportFormat returns the export format named s
+func ParseExportFormat(s string) (ExportFormat, error) {
+	switch f := ExportFormat(s); f {
+	case ExportStarDict, ExportDictd, ExportJSONL, ExportCSV:
+		return f, nil
+	}
+
+	return "", fmt.Errorf("%w %q, expected stardict, dictd, jsonl or csv", ErrUnknownFormat, s)
+}
+
+// Archive reports whether the format is made of several files, which Export
+// writes as a tar archive
+func (f ExportFormat) Archive() bool {
+	return f == ExportStarDict || f == ExportDictd
+}
+
+// Iterator walks a dictionary in key order, see Reader.Iterate. Dict,
+// ShardedDict and Editor are iterators.
+type Iterator interface {
+	Iterate(ctx context.Context, from, to string, fn func(key string, e *Entry) bool) error
+}
+
+// createFunc creates a file of an export
+type createFunc func(name string) (io.WriteCloser, error)
+
+// Export writes the entries of the dictionary to w in the format and
+// returns their number. StarDict and dictd dictionaries are written as a tar
+// archive of their files, whose base name, and the name of the dictionary,
+// is name.
+func Export(ctx context.Context, w io.Writer, src Iterator, format ExportFormat, name string) (int, error) {
+	switch format {
+	case ExportJSONL:
+		return exportJSONL(ctx, w, src)
+	case ExportCSV:
+		return exportCSV(ctx, w, src)
+	case ExportStarDict, ExportDictd:
+		tw := tar.NewWriter(w)
+		n, err := exportFiles(ctx, src, format, name, func(name string) (io.WriteCloser, error) {
+			return newTarFile(tw, name)
+		})
+		if err != nil {
+			return n, err
+		}
+		return n, tw.Close()
+	}
+
+	_, err := ParseExportFormat(string(format))
+	return 0, err
+}
+
+// ExportFile writes the entries of the dictionary into the file at path in
+// the format and returns their number. The files of StarDict and dictd
+// dictionaries are written next to each other, named after path without its
+// extension, e.g. export.ifo, export.idx and export.dict for export.ifo or
+// export.
+func ExportFile(ctx context.Context, path string, src Iterator, format ExportFormat) (int, error) {
+	if format.Archive() {
+		base := basePath(path, ".ifo", ".idx", ".index", ".dict")
+		return exportFiles(ctx, src, format, filepath.Base(base), func(name string) (io.WriteCloser, error) {
+			return os.Create(filepath.Join(filepath.Dir(base), name))
+		})
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, fmt.Errorf("error creating %s: %v", filepath.Base(path), err)
+	}
+
+	n, err := Export(ctx, f, src, format, "")
+	if err != nil {
+		f.Close()
+		return n, err
+	}
+
+	return n, f.Close()
+}
+
+// exportFiles writes the files of a StarDict or dictd dictionary
+func exportFiles(ctx context.Context, src Iterator, format ExportFormat, name string, create createFunc) (int, error) {
+	if name == "" {
+		name = "dict"
+	}
+
+	if format == ExportStarDict {
+		return exportStarDict(ctx, src, name, create)
+	}
+
+	return exportDictd(ctx, src, name, create)
+}
+
+// exportJSONL writes the entries as lines of words.jsonl
+func exportJSONL(ctx context.Context, w io.Writer, src Iterator) (int, error) {
+	bw := bufio.NewWriter(w)
+
+	n := 0
+	var werr error
+	err := src.Iterate(ctx, "", "", func(key string, e *Entry) bool {
+		werr = writeSourceEntry(bw, e)
+		n++
+		return werr == nil
+	})
+	if err == nil {
+		err = werr
+	}
+	if err != nil {
+		return n, fmt.Errorf("error exporting entries: %v", err)
+	}
+
+	return n, bw.Flush()
+}
+
+// csvHeader is the header row of CSV exports
+var csvHeader = []string{"word", "pronunciation", "etymology", "tags", "sense", "pos", "definition", "examples"}
+
+// exportCSV writes a row per sense of the entries, the tags and the examples
+// separated by "; "
+func exportCSV(ctx context.Context, w io.Writer, src Iterator) (int, error) {
+	cw := csv.NewWriter(w)
+
+	err := cw.Write(csvHeader)
+	if err != nil {
+		return 0, fmt.Errorf("error exporting entries: %v", err)
+	}
+
+	n := 0
+	var werr error
+	err = src.Iterate(ctx, "", "", func(key string, e *Entry) bool {
+		row := []string{e.Word, e.Pronunciation, e.Etymology, strings.Join(e.Tags, "; "), "", "", "", ""}
+		if len(e.Senses) == 0 {
+			werr = cw.Write(row)
+		}
+		for _, s := range e.Senses {
+			row[4] = strconv.Itoa(s.Number)
+			row[5] = s.PartOfSpeech
+			row[6] = s.Definition
+			row[7] = strings.Join(s.Examples, "; ")
+			if werr = cw.Write(row); werr != nil {
+				break
+			}
+		}
+		n++
+		return werr == nil
+	})
+	if err == nil {
+		err = werr
+	}
+	if err != nil {
+		return n, fmt.Errorf("error exporting entries: %v", err)
+	}
+
+	cw.Flush()
+
+	return n, cw.Error()
+}
+
+// senseText renders a sense as a line of text for the text formats,
+// e.g. (noun) a fruit, e.g. "an apple a day"
+func senseText(s Sense) string {
+	text := s.Definition
+	if s.PartOfSpeech != "" {
+		text = "(" + s.PartOfSpeech + ") " + text
+	}
+	if len(s.Examples) > 0 {
+		text += `, e.g. "` + strings.Join(s.Examples, `"; "`) + `"`
+	}
+
+	// Senses are separated by line breaks
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// tarFile is a file of a tar archive. Its content is written to a temp file
+// first, since its size goes before it in the archive.
+type tarFile struct {
+	tw     *tar.Writer
+	name   string
+	closed bool
+	*os.File
+}
+
+// newTarFile creates the file name of the tar archive
+func newTarFile(tw *tar.Writer, name string) (*tarFile, error) {
+	f, err := os.CreateTemp("", "dict-export-*")
+	if err != nil {
+		return nil, err
+	}
+
+	return &tarFile{tw: tw, name: name, File: f}, nil
+}
+
+// Close writes the file into the archive and removes its temp file. Closing
+// it again does nothing.
+func (tf *tarFile) Close() error {
+	if tf.closed {
+		return nil
+	}
+	tf.closed = true
+
+	defer os.Remove(tf.Name())
+	defer tf.File.Close()
+
+	size, err := tf.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = tf.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	err = tf.tw.WriteHeader(&tar.Header{
+		Name:    tf.name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tf.tw, tf.File)
+
+	return err
+}
@@ -0,0 +1,191 @@
+package dict
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, jsonlWordsFilename)
+	words := `{"word":"abandon","pronunciation":"/əˈbændən/","etymology":"From Old French","senses":[{"pos":"verb","definition":"to leave","examples":["they abandoned ship"]},{"pos":"noun","definition":"freedom from inhibitions"}],"tags":["common"]}
+{"word":"Apple","senses":[{"definition":"a fruit, \"round\""}]}
+{"word":"a-frame","senses":[{"definition":"a house\nshaped like an A"}]}
+{"word":"banana","pronunciation":"bəˈnɑːnə","senses":[{"definition":"a long fruit"}]}
+`
+	if err := os.WriteFile(src, []byte(words), 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, dictFilename)
+	if err := Build(src, path, BuildOptions{}); err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	d, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	ctx := context.Background()
+
+	t.Run("jsonl", func(t *testing.T) {
+		var buf bytes.Buffer
+		n, err := Export(ctx, &buf, d, ExportJSONL, "")
+		if err != nil || n != 4 {
+			t.Fatalf("Export() = %d, %v", n, err)
+		}
+
+		// The export is a source file of the same dictionary
+		out := filepath.Join(t.TempDir(), jsonlWordsFilename)
+		os.WriteFile(out, buf.Bytes(), 0644)
+		entries, stats := readImport(t, out, ImportOptions{Format: FormatJSONL})
+		if stats.Imported != 4 || stats.Skipped != 0 {
+			t.Fatalf("import stats = %+v", stats)
+		}
+		want, _ := d.Lookup("abandon")
+		if fmt.Sprintf("%+v", entries[1]) != fmt.Sprintf("%+v", want) {
+			t.Errorf("entry = %+v, want %+v", entries[1], want)
+		}
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		out := filepath.Join(t.TempDir(), "export.csv")
+		n, err := ExportFile(ctx, out, d, ExportCSV)
+		if err != nil || n != 4 {
+			t.Fatalf("ExportFile() = %d, %v", n, err)
+		}
+
+		f, err := os.Open(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		rows, err := csv.NewReader(f).ReadAll()
+		if err != nil {
+			t.Fatalf("reading CSV: %v", err)
+		}
+
+		// A row per sense after the header
+		if len(rows) != 6 || strings.Join(rows[0], ",") != strings.Join(csvHeader, ",") {
+			t.Fatalf("rows = %q", rows)
+		}
+		want := []string{"abandon", "/əˈbændən/", "From Old French", "common", "1", "verb", "to leave", "they abandoned ship"}
+		if fmt.Sprint(rows[2]) != fmt.Sprint(want) {
+			t.Errorf("row = %q, want %q", rows[2], want)
+		}
+		if rows[1][6] != "a house\nshaped like an A" || rows[4][6] != `a fruit, "round"` {
+			t.Errorf("quoted definitions = %q, %q", rows[1][6], rows[4][6])
+		}
+	})
+
+	t.Run("stardict", func(t *testing.T) {
+		out := filepath.Join(t.TempDir(), "export")
+		n, err := ExportFile(ctx, out, d, ExportStarDict)
+		if err != nil || n != 4 {
+			t.Fatalf("ExportFile() = %d, %v", n, err)
+		}
+
+		entries, stats := readImport(t, out+".ifo", ImportOptions{Format: FormatStarDict})
+		if stats.Imported != 4 || stats.Skipped != 0 {
+			t.Fatalf("import stats = %+v", stats)
+		}
+
+		// Sorted the way of StarDict, case-insensitive
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Word)
+		}
+		if fmt.Sprint(got) != "[a-frame abandon Apple banana]" {
+			t.Errorf("words = %v", got)
+		}
+
+		e := entries[1]
+		want := "[(verb) to leave, e.g. \"they abandoned ship\" (noun) freedom from inhibitions Etymology: From Old French]"
+		if e.Pronunciation != "/əˈbændən/" || fmt.Sprint(definitions(e)) != want {
+			t.Errorf("entry = %+v", e)
+		}
+		if fmt.Sprint(definitions(entries[0])) != "[a house shaped like an A]" {
+			t.Errorf("entry = %+v", entries[0])
+		}
+	})
+
+	t.Run("dictd", func(t *testing.T) {
+		out := filepath.Join(t.TempDir(), "export.index")
+		n, err := ExportFile(ctx, out, d, ExportDictd)
+		if err != nil || n != 4 {
+			t.Fatalf("ExportFile() = %d, %v", n, err)
+		}
+
+		index, _ := os.ReadFile(out)
+		if !strings.HasPrefix(string(index), "00-database-short\t") {
+			t.Errorf("index = %s", index)
+		}
+
+		entries, stats := readImport(t, out, ImportOptions{Format: FormatDictd})
+		if stats.Imported != 4 || stats.Skipped != 0 {
+			t.Fatalf("import stats = %+v", stats)
+		}
+		// Sorted the way of dictd, ignoring punctuation
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Word)
+		}
+		if fmt.Sprint(got) != "[abandon a-frame Apple banana]" {
+			t.Fatalf("words = %v", got)
+		}
+
+		if e := entries[0]; e.Pronunciation != "/əˈbændən/" || len(e.Senses) != 3 {
+			t.Errorf("entry = %+v", e)
+		}
+		if e := entries[3]; e.Pronunciation != "/bəˈnɑːnə/" || fmt.Sprint(definitions(e)) != "[a long fruit]" {
+			t.Errorf("entry = %+v", e)
+		}
+	})
+
+	t.Run("archive", func(t *testing.T) {
+		for _, format := range []ExportFormat{ExportStarDict, ExportDictd} {
+			var buf bytes.Buffer
+			n, err := Export(ctx, &buf, d, format, "words")
+			if err != nil || n != 4 {
+				t.Fatalf("Export(%s) = %d, %v", format, n, err)
+			}
+
+			var names []string
+			tr := tar.NewReader(&buf)
+			for {
+				h, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("reading archive of %s: %v", format, err)
+				}
+				names = append(names, h.Name)
+			}
+
+			want := "[words.dict words.idx words.ifo]"
+			if format == ExportDictd {
+				want = "[words.dict words.index]"
+			}
+			if fmt.Sprint(names) != want {
+				t.Errorf("Export(%s) files = %v, want %s", format, names, want)
+			}
+		}
+	})
+
+	if _, err := Export(ctx, io.Discard, d, "xdxf", ""); !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("Export() of an unknown format error = %v", err)
+	}
+	if _, err := ParseExportFormat("csv"); err != nil {
+		t.Errorf("ParseExportFormat(csv) error = %v", err)
+	}
+}
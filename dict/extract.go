@@ -0,0 +1,137 @@
+package dict
+
+// This file contains the extraction of a subset of a dictionary into a new
+// one, e.g. for mobile or per-customer bundles. The selected entries are
+// read from dict.dat in key order and streamed straight into the new
+// dictionary, with offsets of their own, without a source file in between
+// and without holding them in memory.
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ErrEmptyExtract is returned when no entry is selected
+var ErrEmptyExtract = errors.New("no entries selected")
+
+// ExtractOptions selects the entries of an extract. An entry is selected if
+// it matches all the criteria set, every entry if none is set.
+type ExtractOptions struct {
+	// Words is the allow-list of words, normalized like the keys
+	Words []string
+	// Prefix selects the words starting with it
+	Prefix string
+	// From and To select the words whose key is in [From, To), an empty
+	// bound leaves the range open
+	From, To string
+	// Tags selects the entries with at least one of the tags
+	Tags []string
+
+	// EncryptionKey encrypts the extract and SigningKey signs it, see
+	// BuildOptions. The extract is built with the layout of the dictionary
+	// otherwise.
+	EncryptionKey []byte
+	SigningKey    ed25519.PrivateKey
+}
+
+// Extract writes the entries of the dictionary at path selected by opts into
+// a new dictionary at outPath, and returns their number. The dictionary is
+// opened with openOpts, along with its delta segments.
+func Extract(path, outPath string, opts ExtractOptions, openOpts ...Option) (int, error) {
+	d, err := Open(path, openOpts...)
+	if err != nil {
+		return 0, err
+	}
+	defer d.Close()
+
+	flags := d.Header().Flags
+
+	words := make(map[string]bool, len(opts.Words))
+	for _, w := range opts.Words {
+		words[NormalizeKey(w, flags)] = true
+	}
+	prefix := NormalizeKey(opts.Prefix, flags)
+
+	from := opts.From
+	if prefix != "" && NormalizeKey(from, flags) < prefix {
+		from = prefix
+	}
+
+	buildOpts := buildOptions(flags)
+	buildOpts.EncryptionKey = opts.EncryptionKey
+	buildOpts.SigningKey = opts.SigningKey
+
+	flags, aead, err := prepareBuild(&buildOpts)
+	if err != nil {
+		return 0, err
+	}
+
+	// The extract is written in a temp directory, so that its index.dat
+	// doesn't replace the one next to outPath
+	tempDir, err := os.MkdirTemp(filepath.Dir(outPath), "tmp-dict-extract-*")
+	if err != nil {
+		return 0, fmt.Errorf("error creating temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	newPath := filepath.Join(tempDir, dictFilename)
+	dw, err := newDictWriter(newPath, flags, buildOpts, aead)
+	if err != nil {
+		return 0, err
+	}
+	defer dw.close()
+
+	// The entries are iterated in key order, so they're written as they're
+	// selected
+	n := 0
+	var writeErr error
+	err = d.Iterate(context.Background(), from, opts.To, func(key string, e *Entry) bool {
+		if prefix != "" && !strings.HasPrefix(key, prefix) {
+			// The keys past the prefix don't have it either
+			return key < prefix
+		}
+		if len(words) > 0 && !words[key] {
+			return true
+		}
+		if len(opts.Tags) > 0 && !slices.ContainsFunc(e.Tags, func(tag string) bool {
+			return slices.Contains(opts.Tags, tag)
+		}) {
+			return true
+		}
+
+		writeErr = dw.add(key, e)
+		n++
+		return writeErr == nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error reading %s: %v", filepath.Base(path), err)
+	}
+	if writeErr != nil {
+		return 0, fmt.Errorf("error building extract: %v", writeErr)
+	}
+
+	if n == 0 {
+		return 0, ErrEmptyExtract
+	}
+
+	err = dw.finish()
+	if err != nil {
+		return 0, fmt.Errorf("error building extract: %v", err)
+	}
+
+	err = moveDict(newPath, outPath)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("Extracted %d entries of %s into %s", n, filepath.Base(path), filepath.Base(outPath))
+
+	return n, nil
+}
@@ -0,0 +1,98 @@
+package dict
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExtract(t *testing.T) {
+	for _, opts := range []BuildOptions{{}, {Compress: true, BlockSize: 4096, PerfectHash: true, FrontCoding: true}} {
+		t.Run(fmt.Sprintf("compress=%v", opts.Compress), func(t *testing.T) {
+			dir := t.TempDir()
+			src := filepath.Join(dir, jsonlWordsFilename)
+			words := `{"word":"abaft","senses":[{"definition":"toward the stern"}],"tags":["nautical"]}
+{"word":"abandon","senses":[{"definition":"to leave"}]}
+{"word":"Abbey","senses":[{"definition":"a monastery"}],"tags":["religion"]}
+{"word":"banana","senses":[{"definition":"a fruit"}]}
+{"word":"binnacle","senses":[{"definition":"a compass housing"}],"tags":["nautical","archaic"]}
+`
+			if err := os.WriteFile(src, []byte(words), 0644); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(dir, dictFilename)
+			if err := Build(src, path, opts); err != nil {
+				t.Fatalf("Build() error = %v", err)
+			}
+
+			buildOpts := opts
+			flags, _, _ := prepareBuild(&buildOpts)
+
+			tests := []struct {
+				name string
+				opts ExtractOptions
+				want []string
+			}{
+				{"words", ExtractOptions{Words: []string{"ABANDON", "banana", "missing"}}, []string{"abandon", "banana"}},
+				{"prefix", ExtractOptions{Prefix: "Ab"}, []string{"abaft", "abandon", "abbey"}},
+				{"range", ExtractOptions{From: "abandon", To: "binnacle"}, []string{"abandon", "abbey", "banana"}},
+				{"tags", ExtractOptions{Tags: []string{"nautical", "religion"}}, []string{"abaft", "abbey", "binnacle"}},
+				{"combined", ExtractOptions{Prefix: "a", Tags: []string{"nautical"}}, []string{"abaft"}},
+			}
+			for _, tt := range tests {
+				outDir := t.TempDir()
+				out := filepath.Join(outDir, tt.name+".dat")
+
+				n, err := Extract(path, out, tt.opts)
+				if err != nil || n != len(tt.want) {
+					t.Fatalf("Extract(%s) = %d, %v, want %d entries", tt.name, n, err, len(tt.want))
+				}
+
+				// The extract is the only file left
+				if files, _ := os.ReadDir(outDir); len(files) != 1 {
+					t.Errorf("Extract(%s) left %d files", tt.name, len(files))
+				}
+
+				corrupt, err := VerifyFile(out)
+				if err != nil || len(corrupt) != 0 {
+					t.Errorf("VerifyFile(%s) = %v, %v", tt.name, corrupt, err)
+				}
+
+				d, err := Open(out)
+				if err != nil {
+					t.Fatalf("Open(%s) error = %v", tt.name, err)
+				}
+				if d.Header().Flags != flags {
+					t.Errorf("Extract(%s) flags = %d, want the layout of the source %d", tt.name, d.Header().Flags, flags)
+				}
+				if keys := iterateKeys(t, d, "", ""); fmt.Sprint(keys) != fmt.Sprint(tt.want) {
+					t.Errorf("Extract(%s) keys = %v, want %v", tt.name, keys, tt.want)
+				}
+				if e, ok := d.Lookup(tt.want[len(tt.want)-1]); !ok || e.Definition() == "" {
+					t.Errorf("Extract(%s) Lookup(%s) = %+v, %v", tt.name, tt.want[len(tt.want)-1], e, ok)
+				}
+				d.Close()
+			}
+
+			// Tags are kept
+			out := filepath.Join(t.TempDir(), dictFilename)
+			if _, err := Extract(path, out, ExtractOptions{Words: []string{"binnacle"}}); err != nil {
+				t.Fatal(err)
+			}
+			d, err := Open(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+			if e, ok := d.Lookup("binnacle"); !ok || fmt.Sprint(e.Tags) != "[nautical archaic]" {
+				t.Errorf("Lookup(binnacle) = %+v, %v", e, ok)
+			}
+
+			if _, err := Extract(path, out, ExtractOptions{Prefix: "z"}); !errors.Is(err, ErrEmptyExtract) {
+				t.Errorf("Extract() of no entries error = %v, want ErrEmptyExtract", err)
+			}
+		})
+	}
+}
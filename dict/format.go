@@ -0,0 +1,273 @@
+package dict
+
+// This file contains the on-disk layout of dict.dat:
+//
+//	<header><section table><sections...><entries>
+//
+// The fixed size header is followed by a table locating the sections of the
+// index region - the index entries, the sparse index, the Bloom filter, the
+// block table of compressed dictionaries, the perfect hash index, the key and
+// file ids of encrypted dictionaries and the checksums.
+// The encoded entries follow the index region.
+//
+// With FlagCompressed set the entries are stored in flate compressed blocks
+// instead, see block.go. With FlagEncrypted set the blocks are encrypted as
+// well, see crypt.go.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+const (
+	// magic identifies a dict.dat file written by this package
+	magic = "WDCT"
+	// formatVersion is the version of the layout written by BuildNewDict.
+	// The baseline layout, without a header, is legacy, see legacy.go.
+	formatVersion uint16 = 1
+	// HeaderSize is the constant size of the dict.dat header
+	// magic (4 bytes) + version (2 bytes) + flags (2 bytes) + index size (8 bytes)
+	HeaderSize = 16
+)
+
+// Header flags
+const (
+	// FlagStripDiacritics marks a dictionary whose keys were built with
+	// diacritics removed, so queries have to strip them as well
+	FlagStripDiacritics uint16 = 1 << iota
+	// FlagCompressed marks a dictionary whose entries are stored in
+	// compressed blocks. Entry offsets are then offsets in the
+	// uncompressed data, see blockRef.
+	FlagCompressed
+	// FlagPerfectHash marks a dictionary with a minimal perfect hash index,
+	// which the readers use instead of loading the index into a map
+	FlagPerfectHash
+	// FlagFrontCoded marks a dictionary whose index entries are front coded,
+	// see frontcode.go
+	FlagFrontCoded
+	// FlagEncrypted marks a dictionary whose blocks and index are encrypted,
+	// see crypt.go. It's always set along with FlagCompressed.
+	FlagEncrypted
+)
+
+// ErrBadFormat is returned when a file is not a dict.dat this package can read
+var ErrBadFormat = errors.New("unsupported dict format")
+
+// ErrLegacyFormat is returned along with ErrBadFormat for the dict.dat files
+// of the baseline layout where only the current one is read, see Migrate
+var ErrLegacyFormat = errors.New("legacy dict format")
+
+// Header is the constant sized header at the beginning of dict.dat
+type Header struct {
+	Version uint16
+	Flags   uint16
+	// IndexSize is the size of the header plus the index region,
+	// i.e. the offset of the first entry in the file
+	IndexSize int64
+}
+
+// encodeHeader serializes the header into HeaderSize bytes
+func encodeHeader(h Header) []byte {
+	buf := make([]byte, HeaderSize)
+	copy(buf, magic)
+	binary.BigEndian.PutUint16(buf[4:], h.Version)
+	binary.BigEndian.PutUint16(buf[6:], h.Flags)
+	binary.BigEndian.PutUint64(buf[8:], uint64(h.IndexSize))
+	return buf
+}
+
+// decodeHeader parses the header from the first HeaderSize bytes of dict.dat.
+// Files without the magic are taken for the baseline layout and rejected
+// with ErrLegacyFormat.
+func decodeHeader(buf []byte) (Header, error) {
+	if len(buf) < HeaderSize || string(buf[:4]) != magic {
+		return Header{}, fmt.Errorf("%w: %w, missing magic, migrate or rebuild the dictionary", ErrBadFormat, ErrLegacyFormat)
+	}
+
+	h := Header{
+		Version:   binary.BigEndian.Uint16(buf[4:]),
+		Flags:     binary.BigEndian.Uint16(buf[6:]),
+		IndexSize: int64(binary.BigEndian.Uint64(buf[8:])),
+	}
+
+	if h.Version != formatVersion {
+		return Header{}, fmt.Errorf("%w: version %d, expected %d", ErrBadFormat, h.Version, formatVersion)
+	}
+
+	if h.IndexSize < HeaderSize {
+		return Header{}, fmt.Errorf("%w: index size %d is smaller than the header", ErrBadFormat, h.IndexSize)
+	}
+
+	return h, nil
+}
+
+// Section kinds
+const (
+	// sectionIndex holds the index entries sorted by key
+	sectionIndex uint32 = iota + 1
+	// sectionSparse holds every n-th key of the index, see sparse.go
+	sectionSparse
+	// sectionBlocks holds the block table of compressed dictionaries
+	sectionBlocks
+	// sectionBloom holds the Bloom filter of the keys, see bloom.go
+	sectionBloom
+	// sectionHash holds the minimal perfect hash index, see mphf.go
+	sectionHash
+	// sectionChecksums holds the checksums of the file, see checksum.go
+	sectionChecksums
+	// sectionEncryption holds the key and file ids of encrypted dictionaries, see crypt.go
+	sectionEncryption
+)
+
+// section locates a section of the index region. Offsets are absolute.
+type section struct {
+	Kind   uint32
+	Offset int64
+	Size   int64
+}
+
+// sectionSize is the size of a serialized section - kind (4 bytes) +
+// offset (8 bytes) + size (8 bytes)
+const sectionSize = 20
+
+// sectionTableSize returns the size of a section table with n sections,
+// including its 4 byte count
+func sectionTableSize(n int) int64 {
+	return 4 + int64(n)*sectionSize
+}
+
+// encodeSectionTable serializes the section count followed by the sections
+func encodeSectionTable(sections []section) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(len(sections)))
+	for _, s := range sections {
+		binary.Write(&buf, binary.BigEndian, s.Kind)
+		binary.Write(&buf, binary.BigEndian, s.Offset)
+		binary.Write(&buf, binary.BigEndian, s.Size)
+	}
+	return buf.Bytes()
+}
+
+// decodeSectionTable parses the sections of a table of n sections
+func decodeSectionTable(buf []byte, n int) ([]section, error) {
+	if len(buf) < n*sectionSize {
+		return nil, fmt.Errorf("%w: truncated section table", ErrBadFormat)
+	}
+
+	sections := make([]section, n)
+	for i := range sections {
+		sections[i] = section{
+			Kind:   binary.BigEndian.Uint32(buf),
+			Offset: int64(binary.BigEndian.Uint64(buf[4:])),
+			Size:   int64(binary.BigEndian.Uint64(buf[12:])),
+		}
+		buf = buf[sectionSize:]
+	}
+
+	return sections, nil
+}
+
+// blockRef locates a compressed block of entries
+type blockRef struct {
+	// Start is the offset of the block in the uncompressed data
+	Start int64
+	// Offset is the offset of the compressed block in the file
+	Offset int64
+	// Size is the compressed size of the block
+	Size int64
+	// RawSize is the uncompressed size of the block
+	RawSize int64
+}
+
+// blockRefSize is the size of a serialized blockRef - 4 x 8 bytes
+const blockRefSize = 32
+
+// encodeBlockTable serializes the block refs
+func encodeBlockTable(blocks []blockRef) []byte {
+	var buf bytes.Buffer
+	for _, b := range blocks {
+		binary.Write(&buf, binary.BigEndian, b)
+	}
+	return buf.Bytes()
+}
+
+// decodeBlockTable parses the block refs
+func decodeBlockTable(buf []byte) ([]blockRef, error) {
+	if len(buf)%blockRefSize != 0 {
+		return nil, fmt.Errorf("%w: truncated block table", ErrBadFormat)
+	}
+
+	blocks := make([]blockRef, len(buf)/blockRefSize)
+	for i := range blocks {
+		blocks[i] = blockRef{
+			Start:   int64(binary.BigEndian.Uint64(buf)),
+			Offset:  int64(binary.BigEndian.Uint64(buf[8:])),
+			Size:    int64(binary.BigEndian.Uint64(buf[16:])),
+			RawSize: int64(binary.BigEndian.Uint64(buf[24:])),
+		}
+		buf = buf[blockRefSize:]
+	}
+
+	return blocks, nil
+}
+
+// maxWordLen is the longest key or headword an index entry can hold
+const maxWordLen = math.MaxUint16
+
+// encodeIndexEntry appends a serialized index entry to buf
+// Each entry is of the format:
+// <key len (2 bytes)><key><word len (2 bytes)><word><offset (8 bytes)><entry size (uvarint)>
+//
+// Keys and words are length prefixed so that they can contain any byte,
+// including ':' and newlines which previously acted as separators.
+// The entry size is an uvarint, so entries of any length can be stored.
+func encodeIndexEntry(buf *bytes.Buffer, idxe IndexEntry) {
+	binary.Write(buf, binary.BigEndian, uint16(len(idxe.Key)))
+	buf.WriteString(idxe.Key)
+	binary.Write(buf, binary.BigEndian, uint16(len(idxe.Word)))
+	buf.WriteString(idxe.Word)
+	binary.Write(buf, binary.BigEndian, idxe.Offset)
+	buf.Write(binary.AppendUvarint(nil, uint64(idxe.Size)))
+}
+
+// indexEntrySize returns the number of bytes encodeIndexEntry writes for idxe
+func indexEntrySize(idxe IndexEntry) int64 {
+	// 2 bytes for key length + key, 2 bytes for word length + word,
+	// 8 bytes for offset and 1 to 10 bytes for entry size
+	return 2 + int64(len(idxe.Key)) + 2 + int64(len(idxe.Word)) + 8 + uvarintSize(uint64(idxe.Size))
+}
+
+// uvarintSize returns the number of bytes v takes when encoded as an uvarint
+func uvarintSize(v uint64) int64 {
+	n := int64(1)
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
+
+// decodeIndex parses the serialized index entries and returns a map of
+// key to IndexEntry
+func decodeIndex(buf []byte, flags uint16) (map[string]IndexEntry, error) {
+	index := make(map[string]IndexEntry)
+
+	d := newIndexDecoder(buf, flags)
+	for {
+		e, ok := d.next()
+		if !ok {
+			break
+		}
+
+		index[string(e.key)] = e.entry()
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	return index, nil
+}
@@ -0,0 +1,222 @@
+package dict
+
+// This file contains the front coded layout of the index section, selected
+// by FlagFrontCoded in the header.
+//
+// Sorted keys share long prefixes ("abandon", "abandoned", "abandonment"),
+// so instead of the full key each entry stores the length of the prefix it
+// shares with the previous key and the remaining suffix. Every restart point
+// of the sparse index (see sparse.go) starts over with a full key, so a run
+// of entries can be decoded on its own:
+//
+//	<shared (uvarint)><suffix len (uvarint)><suffix><word len (uvarint)><word><offset><entry size (uvarint)>
+//
+// shared is 0 at restart points and the shared prefix length + 1 elsewhere.
+// The word length is 0 when the headword equals the key and its length + 1
+// otherwise. The offset is 8 bytes at restart points; elsewhere it's the gap
+// to the end of the previous entry as an uvarint, as entries are stored one
+// after the other in key order.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// encodeFrontCodedEntry appends idxe to buf, front coded against the previous entry
+func encodeFrontCodedEntry(buf *bytes.Buffer, idxe IndexEntry, prev *IndexEntry) {
+	shared := 0
+	if prev != nil {
+		shared = sharedPrefixLen(prev.Key, idxe.Key)
+		buf.Write(binary.AppendUvarint(nil, uint64(shared)+1))
+	} else {
+		buf.WriteByte(0)
+	}
+
+	suffix := idxe.Key[shared:]
+	buf.Write(binary.AppendUvarint(nil, uint64(len(suffix))))
+	buf.WriteString(suffix)
+
+	if idxe.Word == idxe.Key {
+		buf.WriteByte(0)
+	} else {
+		buf.Write(binary.AppendUvarint(nil, uint64(len(idxe.Word))+1))
+		buf.WriteString(idxe.Word)
+	}
+
+	if prev != nil {
+		buf.Write(binary.AppendUvarint(nil, uint64(idxe.Offset-(prev.Offset+prev.Size))))
+	} else {
+		binary.Write(buf, binary.BigEndian, idxe.Offset)
+	}
+
+	buf.Write(binary.AppendUvarint(nil, uint64(idxe.Size)))
+}
+
+// frontCodedEntrySize returns the number of bytes encodeFrontCodedEntry writes for idxe
+func frontCodedEntrySize(idxe IndexEntry, prev *IndexEntry) int64 {
+	var buf bytes.Buffer
+	encodeFrontCodedEntry(&buf, idxe, prev)
+	return int64(buf.Len())
+}
+
+// sharedPrefixLen returns the length of the common prefix of a and b
+func sharedPrefixLen(a, b string) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// rawIndexEntry is an index entry whose key and word point into the
+// serialized index or the buffer of an indexDecoder
+type rawIndexEntry struct {
+	key     []byte
+	word    []byte
+	offset  int64
+	size    int64
+	restart bool
+}
+
+// entry copies the raw entry into an IndexEntry
+func (e rawIndexEntry) entry() IndexEntry {
+	return IndexEntry{
+		Key:    string(e.key),
+		Word:   string(e.word),
+		Offset: e.offset,
+		Size:   e.size,
+	}
+}
+
+// indexDecoder decodes the entries of an index section, or a run of it
+// starting at a restart point, one after the other
+type indexDecoder struct {
+	buf        []byte
+	frontCoded bool
+	err        error
+
+	// key holds the key of the last front coded entry and is reused for the
+	// next one, the returned key is only valid until the next call
+	key []byte
+	// end is the end of the data of the last entry
+	end int64
+}
+
+func newIndexDecoder(buf []byte, flags uint16) *indexDecoder {
+	return &indexDecoder{buf: buf, frontCoded: flags&FlagFrontCoded != 0}
+}
+
+// next decodes the next entry. It returns false at the end of the buffer or
+// if the entry is corrupt, in which case d.err is set.
+func (d *indexDecoder) next() (rawIndexEntry, bool) {
+	if len(d.buf) == 0 || d.err != nil {
+		return rawIndexEntry{}, false
+	}
+
+	if !d.frontCoded {
+		// Every entry of the plain layout stands on its own
+		key, offset, size, n := decodeIndexEntryBytes(d.buf)
+		if n <= 0 {
+			d.err = fmt.Errorf("%w: truncated index entry", ErrBadFormat)
+			return rawIndexEntry{}, false
+		}
+
+		wl := int(binary.BigEndian.Uint16(d.buf[2+len(key):]))
+		word := d.buf[2+len(key)+2 : 2+len(key)+2+wl]
+		d.buf = d.buf[n:]
+
+		return rawIndexEntry{key: key, word: word, offset: offset, size: size, restart: true}, true
+	}
+
+	e, ok := d.nextFrontCoded()
+	if !ok {
+		d.err = fmt.Errorf("%w: corrupt front coded index entry", ErrBadFormat)
+	}
+
+	return e, ok
+}
+
+func (d *indexDecoder) nextFrontCoded() (rawIndexEntry, bool) {
+	var e rawIndexEntry
+
+	shared, ok := d.uvarint()
+	if !ok {
+		return e, false
+	}
+
+	e.restart = shared == 0
+	if !e.restart {
+		shared--
+		if shared > uint64(len(d.key)) {
+			return e, false
+		}
+	}
+
+	suffix, ok := d.bytes()
+	if !ok {
+		return e, false
+	}
+	d.key = append(d.key[:shared], suffix...)
+	e.key = d.key
+
+	wl, ok := d.uvarint()
+	if !ok {
+		return e, false
+	}
+	if wl == 0 {
+		e.word = e.key
+	} else {
+		if wl-1 > uint64(len(d.buf)) {
+			return e, false
+		}
+		e.word = d.buf[:wl-1]
+		d.buf = d.buf[wl-1:]
+	}
+
+	if e.restart {
+		if len(d.buf) < 8 {
+			return e, false
+		}
+		e.offset = int64(binary.BigEndian.Uint64(d.buf))
+		d.buf = d.buf[8:]
+	} else {
+		gap, ok := d.uvarint()
+		if !ok {
+			return e, false
+		}
+		e.offset = d.end + int64(gap)
+	}
+
+	size, ok := d.uvarint()
+	if !ok {
+		return e, false
+	}
+	e.size = int64(size)
+	d.end = e.offset + e.size
+
+	return e, true
+}
+
+func (d *indexDecoder) uvarint() (uint64, bool) {
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		return 0, false
+	}
+	d.buf = d.buf[n:]
+	return v, true
+}
+
+// bytes reads an uvarint length prefixed byte string
+func (d *indexDecoder) bytes() ([]byte, bool) {
+	n, ok := d.uvarint()
+	if !ok || n > uint64(len(d.buf)) {
+		return nil, false
+	}
+
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b, true
+}
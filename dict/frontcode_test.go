@@ -0,0 +1,160 @@
+package dict
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestFrontCodedEntries(t *testing.T) {
+	entries := []IndexEntry{
+		{Key: "abandon", Word: "Abandon", Offset: 100, Size: 20},
+		{Key: "abandoned", Word: "abandoned", Offset: 121, Size: 300},
+		{Key: "abandonment", Word: "abandonment", Offset: 423, Size: 5},
+		{Key: "ability", Word: "ability", Offset: 429, Size: 7},
+		{Key: "b", Word: "B", Offset: 437, Size: 1},
+		{Key: "ba", Word: "ba", Offset: 440, Size: 1},
+	}
+
+	// Restart points every 4 entries
+	var buf bytes.Buffer
+	var size int64
+	for i, idxe := range entries {
+		var prev *IndexEntry
+		if i%4 != 0 {
+			prev = &entries[i-1]
+		}
+
+		size += frontCodedEntrySize(idxe, prev)
+		encodeFrontCodedEntry(&buf, idxe, prev)
+	}
+
+	if int64(buf.Len()) != size {
+		t.Errorf("frontCodedEntrySize() sums up to %d, encoded %d bytes", size, buf.Len())
+	}
+
+	var plain bytes.Buffer
+	for _, idxe := range entries {
+		encodeIndexEntry(&plain, idxe)
+	}
+	if buf.Len() >= plain.Len() {
+		t.Errorf("front coded index is %d bytes, plain index is %d bytes", buf.Len(), plain.Len())
+	}
+
+	d := newIndexDecoder(buf.Bytes(), FlagFrontCoded)
+	for i, want := range entries {
+		e, ok := d.next()
+		if !ok {
+			t.Fatalf("next() failed at entry %d: %v", i, d.err)
+		}
+
+		if got := e.entry(); got != want {
+			t.Errorf("entry %d = %+v, want %+v", i, got, want)
+		}
+		if e.restart != (i%4 == 0) {
+			t.Errorf("entry %d restart = %v", i, e.restart)
+		}
+	}
+
+	if _, ok := d.next(); ok || d.err != nil {
+		t.Errorf("next() after the last entry = %v, %v", ok, d.err)
+	}
+
+	// A truncated index is reported
+	d = newIndexDecoder(buf.Bytes()[:buf.Len()-3], FlagFrontCoded)
+	for {
+		if _, ok := d.next(); !ok {
+			break
+		}
+	}
+	if d.err == nil {
+		t.Error("truncated index decoded without an error")
+	}
+}
+
+func TestFrontCodedDict(t *testing.T) {
+	dir := t.TempDir()
+	plainPath := buildBenchDict(t, dir, 1000, BuildOptions{SparseInterval: 16})
+
+	plain, err := Open(plainPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	plainIndex, _ := plain.rd.section(sectionIndex)
+
+	for _, opts := range []BuildOptions{
+		{},
+		{Compress: true},
+		{PerfectHash: true},
+		{Compress: true, PerfectHash: true},
+	} {
+		opts.FrontCoding = true
+		opts.SparseInterval = 16
+
+		name := fmt.Sprintf("compress=%v/perfecthash=%v", opts.Compress, opts.PerfectHash)
+		t.Run(name, func(t *testing.T) {
+			dictPath := buildBenchDict(t, t.TempDir(), 1000, opts)
+
+			d, err := Open(dictPath)
+			if err != nil {
+				t.Fatalf("Open() error = %v", err)
+			}
+			defer d.Close()
+
+			index, _ := d.rd.section(sectionIndex)
+			if index.Size >= plainIndex.Size/2 {
+				t.Errorf("front coded index is %d bytes, plain index is %d bytes", index.Size, plainIndex.Size)
+			}
+
+			lowMem, err := Open(dictPath, WithLowMemory(false))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer lowMem.Close()
+
+			m, err := OpenMmap(dictPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.Close()
+
+			for i := 0; i < 1000; i++ {
+				word := fmt.Sprintf("word%06d", i)
+				expected := fmt.Sprintf("definition of the word number %d in the benchmark dictionary", i)
+
+				for name, query := range map[string]func(string) (string, bool){
+					"Dict":     d.QueryWord,
+					"low-mem":  lowMem.QueryWord,
+					"MmapDict": m.QueryWord,
+				} {
+					if def, ok := query(word); !ok || def != expected {
+						t.Fatalf("%s.QueryWord(%s) = %q, %v", name, word, def, ok)
+					}
+				}
+			}
+
+			for _, word := range []string{"a", "word", "word0000001", "word001000", "zzz"} {
+				if _, ok, err := d.rd.Lookup(word); ok || err != nil {
+					t.Errorf("Lookup(%s) = %v, %v", word, ok, err)
+				}
+				if _, ok, err := lowMem.rd.Lookup(word); ok || err != nil {
+					t.Errorf("low-mem Lookup(%s) = %v, %v", word, ok, err)
+				}
+			}
+
+			// Keys are iterated in order
+			n := 0
+			m.Keys(func(key, word []byte) bool {
+				if want := fmt.Sprintf("word%06d", n); string(key) != want || string(word) != want {
+					t.Fatalf("key %d = %s, %s, want %s", n, key, word, want)
+				}
+				n++
+				return true
+			})
+			if n != 1000 {
+				t.Errorf("Keys() visited %d keys, want 1000", n)
+			}
+		})
+	}
+}
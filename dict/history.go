@@ -0,0 +1,495 @@
+package dict
+
+// This file contains the history of the words across the archived versions
+// of dict.dat, see archiveFiles. The history index archive/history.jsonl
+// holds a record for every entry that differs from the one of the previous
+// version, in the order of the versions:
+//
+//	{"key":"abandon","word":"abandon","version":"20240501100000","entry":{...}}
+//	{"key":"abaft","word":"abaft","version":"20240601100000","deleted":true}
+//
+// UpdateDict appends the records of the version it archives, so queries
+// read the index instead of every archived dictionary. Without an index,
+// the first update builds it from all archived versions. The folds of the
+// online edits archive the dictionary they replace as well, see Editor.Fold.
+//
+// The records of encrypted dictionaries are sealed with their key, see
+// crypt.go, and stored base64 encoded instead. The offset of a record is
+// authenticated along with it, so that records can't be swapped.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	// archiveDirname is the directory of the archived versions
+	archiveDirname = "archive"
+	// historyFilename is the history index in the archive directory
+	historyFilename = "history.jsonl"
+	// CurrentVersion is the version of the dictionary in use
+	CurrentVersion = "current"
+)
+
+// HistoryRecord is the entry of a word in the version where it first appeared
+type HistoryRecord struct {
+	Key     string `json:"key"`
+	Word    string `json:"word"`
+	Version string `json:"version"`
+	// Deleted records that the word is not in the version anymore
+	Deleted bool   `json:"deleted,omitempty"`
+	Entry   *Entry `json:"entry,omitempty"`
+}
+
+// sameEntry reports whether the record holds the entry, compared by their encoding
+func (r *HistoryRecord) sameEntry(e *Entry) bool {
+	return !r.Deleted && r.Entry != nil && bytes.Equal(encodeEntry(r.Entry), encodeEntry(e))
+}
+
+// archivedDict is an archived version of the dictionary, a Dict or the
+// ShardedDict of an archived manifest
+type archivedDict interface {
+	Snapshot
+	Close()
+	headerFlags() uint16
+}
+
+// openArchived opens the dictionary of the version archived in dir: its
+// dict.dat, or the shards of its manifest.json for sharded dictionaries, see
+// updateShards
+func openArchived(dir, version string, opts ...Option) (archivedDict, error) {
+	manifestPath := filepath.Join(dir, version, manifestFilename)
+	if _, err := os.Stat(manifestPath); err == nil {
+		sd, err := OpenSharded(manifestPath, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return sd, nil
+	}
+
+	// Archived dictionaries have no segments, they are compacted before an
+	// update
+	d, err := openFile(filepath.Join(dir, version, dictFilename), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// archivedVersions returns the versions archived in dir, the oldest first,
+// the directories holding a dict.dat or a manifest.json
+func archivedVersions(dir string) ([]string, error) {
+	files, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading archive: %v", err)
+	}
+
+	var versions []string
+	for _, f := range files {
+		if !f.IsDir() {
+			continue
+		}
+		for _, name := range []string{dictFilename, manifestFilename} {
+			if _, err := os.Stat(filepath.Join(dir, f.Name(), name)); err == nil {
+				versions = append(versions, f.Name())
+				break
+			}
+		}
+	}
+
+	// Versions are timestamps, YYYYMMDDHHMMSS
+	sort.Strings(versions)
+
+	return versions, nil
+}
+
+// encodeHistoryRecord returns the line of the record at the given offset of
+// the history index, sealed with aead if it's set
+func encodeHistoryRecord(r *HistoryRecord, offset int64, aead cipher.AEAD) ([]byte, error) {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if aead != nil {
+		sealed, err := seal(aead, line, uint64(offset))
+		if err != nil {
+			return nil, err
+		}
+		line = base64.StdEncoding.AppendEncode(nil, sealed)
+	}
+
+	return append(line, '\n'), nil
+}
+
+// decodeHistoryRecord parses the line of a record at the given offset of the
+// history index. Sealed records are opened with aead, the plain ones written
+// before the dictionary was encrypted are read as they are.
+func decodeHistoryRecord(line []byte, offset int64, aead cipher.AEAD) (*HistoryRecord, error) {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+
+	if len(line) > 0 && line[0] != '{' {
+		if aead == nil {
+			return nil, fmt.Errorf("%w, its history needs the key", ErrEncrypted)
+		}
+
+		sealed, err := base64.StdEncoding.AppendDecode(nil, line)
+		if err != nil {
+			return nil, fmt.Errorf("%w: corrupt history record at offset %d: %v", ErrBadFormat, offset, err)
+		}
+
+		line, err = open(aead, sealed, uint64(offset))
+		if err != nil {
+			return nil, fmt.Errorf("corrupt history record at offset %d: %w", offset, err)
+		}
+	}
+
+	var r HistoryRecord
+	err := json.Unmarshal(line, &r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: corrupt history record at offset %d: %v", ErrBadFormat, offset, err)
+	}
+
+	return &r, nil
+}
+
+// historyAEAD returns the cipher of the history records of a dictionary
+// encrypted with key, nil if key is
+func historyAEAD(key []byte) (cipher.AEAD, error) {
+	if key == nil {
+		return nil, nil
+	}
+
+	return newAEAD(key)
+}
+
+// readHistory calls fn with every record of the history index at path along
+// with its offset. A missing index has no records.
+func readHistory(path string, aead cipher.AEAD, fn func(offset int64, r *HistoryRecord)) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error opening history: %v", err)
+	}
+	defer f.Close()
+
+	_, err = scanHistory(f, 0, aead, fn)
+	return err
+}
+
+// scanHistory reads the records of the history index from r, which is at
+// the given offset, opening the sealed ones with aead. It returns the offset
+// following the last record, a torn last line is ignored.
+func scanHistory(r io.Reader, offset int64, aead cipher.AEAD, fn func(offset int64, r *HistoryRecord)) (int64, error) {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("error reading history: %v", err)
+		}
+
+		rec, err := decodeHistoryRecord(line, offset, aead)
+		if err != nil {
+			return 0, err
+		}
+
+		fn(offset, rec)
+		offset += int64(len(line))
+	}
+}
+
+// updateHistory adds the version archived in dir to its history index. The
+// index is built from all archived versions if it doesn't exist yet.
+func updateHistory(dir, version string, encKey []byte) error {
+	path := filepath.Join(dir, historyFilename)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return RebuildHistory(dir, encKey)
+	}
+
+	return appendHistory(path, dir, version, encKey)
+}
+
+// RebuildHistory builds the history index of the versions archived in dir
+// from scratch
+func RebuildHistory(dir string, encKey []byte) error {
+	versions, err := archivedVersions(dir)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, historyFilename)
+	tmpPath := path + ".tmp"
+	os.Remove(tmpPath)
+
+	for _, version := range versions {
+		err = appendHistory(tmpPath, dir, version, encKey)
+		if err != nil {
+			return fmt.Errorf("error indexing version %s: %v", version, err)
+		}
+	}
+
+	if len(versions) == 0 {
+		err = os.WriteFile(tmpPath, nil, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Indexed the history of %d versions", len(versions))
+
+	return os.Rename(tmpPath, path)
+}
+
+// appendHistory appends the records of the entries of the version archived
+// in dir that differ from the latest ones of the history index at path. The
+// records of an encrypted dictionary are sealed with its key.
+func appendHistory(path, dir, version string, encKey []byte) error {
+	aead, err := historyAEAD(encKey)
+	if err != nil {
+		return err
+	}
+
+	latest := make(map[string]*HistoryRecord)
+	err = readHistory(path, aead, func(offset int64, r *HistoryRecord) {
+		latest[r.Key] = r
+	})
+	if err != nil {
+		return err
+	}
+
+	d, err := openArchived(dir, version, WithEncryptionKey(encKey))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	if d.headerFlags()&FlagEncrypted == 0 {
+		aead = nil
+	}
+
+	var records []HistoryRecord
+	seen := make(map[string]bool)
+
+	err = d.Iterate(context.Background(), "", "", func(key string, e *Entry) bool {
+		seen[key] = true
+		if r, ok := latest[key]; !ok || !r.sameEntry(e) {
+			records = append(records, HistoryRecord{Key: key, Word: e.Word, Version: version, Entry: e})
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	// The words gone since the previous version
+	var deleted []string
+	for key, r := range latest {
+		if !seen[key] && !r.Deleted {
+			deleted = append(deleted, key)
+		}
+	}
+	sort.Strings(deleted)
+	for _, key := range deleted {
+		records = append(records, HistoryRecord{Key: key, Word: latest[key].Word, Version: version, Deleted: true})
+	}
+
+	return writeHistory(path, records, aead)
+}
+
+// writeHistory appends the records to the history index at path, sealed
+// with aead if it's set
+func writeHistory(path string, records []HistoryRecord, aead cipher.AEAD) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening history: %v", err)
+	}
+	defer f.Close()
+
+	// The records are sealed along with their offset, the end of the index
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	offset := fi.Size()
+
+	w := bufio.NewWriter(f)
+	for _, r := range records {
+		line, err := encodeHistoryRecord(&r, offset, aead)
+		if err != nil {
+			return err
+		}
+		w.Write(line)
+		offset += int64(len(line))
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return fmt.Errorf("error writing history: %v", err)
+	}
+
+	return f.Sync()
+}
+
+// History answers the history queries of words from the history index. It
+// keeps the offsets of the records of every key in memory, and picks up the
+// records appended to the index since.
+type History struct {
+	path  string
+	flags uint16
+	aead  cipher.AEAD
+
+	mu      sync.Mutex
+	offsets map[string][]int64
+	size    int64
+}
+
+// NewHistory opens the history index of the archived versions of dict.dat,
+// with the encryption key in DICT_ENCRYPTION_KEY or DICT_ENCRYPTION_KEY_FILE
+// if it's set
+func NewHistory() (*History, error) {
+	flags, err := dictFlags()
+	if err != nil {
+		return nil, err
+	}
+
+	encKey, err := EncryptionKeyFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("error reading encryption key: %v", err)
+	}
+
+	return OpenHistory(filepath.Join(archiveDirname, historyFilename), flags, WithEncryptionKey(encKey))
+}
+
+// OpenHistory opens the history index at path, of a dictionary with the
+// given header flags. The index doesn't have to exist yet. The records of
+// encrypted dictionaries need their key, see WithEncryptionKey.
+func OpenHistory(path string, flags uint16, opts ...Option) (*History, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	aead, err := historyAEAD(o.encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &History{
+		path:    path,
+		flags:   flags,
+		aead:    aead,
+		offsets: make(map[string][]int64),
+	}
+
+	err = h.refresh()
+	if err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// refresh loads the offsets of the records appended since the last call.
+// It's called with h.mu held.
+func (h *History) refresh() error {
+	f, err := os.Open(h.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error opening history: %v", err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// The index was rebuilt
+	if fi.Size() < h.size {
+		h.offsets = make(map[string][]int64)
+		h.size = 0
+	}
+	if fi.Size() == h.size {
+		return nil
+	}
+
+	h.size, err = scanHistory(io.NewSectionReader(f, h.size, fi.Size()-h.size), h.size, h.aead, func(offset int64, r *HistoryRecord) {
+		h.offsets[r.Key] = append(h.offsets[r.Key], offset)
+	})
+
+	return err
+}
+
+// Word returns the history of the word, the oldest version first. current is
+// the entry of the word in the dictionary in use, nil if it's not in it; a
+// record of CurrentVersion is added if it differs from the latest version.
+func (h *History) Word(word string, current *Entry) ([]HistoryRecord, error) {
+	key := NormalizeKey(word, h.flags)
+
+	h.mu.Lock()
+	err := h.refresh()
+	offsets := h.offsets[key]
+	h.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	records := []HistoryRecord{}
+
+	if len(offsets) > 0 {
+		f, err := os.Open(h.path)
+		if err != nil {
+			return nil, fmt.Errorf("error opening history: %v", err)
+		}
+		defer f.Close()
+
+		for _, offset := range offsets {
+			line, err := bufio.NewReader(io.NewSectionReader(f, offset, 1<<62)).ReadBytes('\n')
+			if err != nil {
+				return nil, fmt.Errorf("error reading history: %v", err)
+			}
+
+			r, err := decodeHistoryRecord(line, offset, h.aead)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, *r)
+		}
+	}
+
+	var last *HistoryRecord
+	if len(records) > 0 {
+		last = &records[len(records)-1]
+	}
+
+	switch {
+	case current != nil && (last == nil || !last.sameEntry(current)):
+		records = append(records, HistoryRecord{Key: key, Word: current.Word, Version: CurrentVersion, Entry: current})
+	case current == nil && last != nil && !last.Deleted:
+		records = append(records, HistoryRecord{Key: key, Word: last.Word, Version: CurrentVersion, Deleted: true})
+	}
+
+	return records, nil
+}
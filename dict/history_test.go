@@ -0,0 +1,180 @@
+package dict
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	dir := t.TempDir()
+	buildBenchDict(t, dir, 100, BuildOptions{})
+	chdir(t, dir)
+
+	update := func(chglog string) {
+		t.Helper()
+		if err := os.WriteFile(jsonlChglogFilename, []byte(chglog), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := UpdateDict(); err != nil {
+			t.Fatalf("UpdateDict() error = %v", err)
+		}
+	}
+
+	update(`{"word":"word000010","senses":[{"definition":"updated 10"}]}
+{"word":"word000020","deleted":true}
+`)
+
+	// Move the first version back in time so the next update can't land in
+	// the same second, and index it again
+	versions, err := archivedVersions(archiveDirname)
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("archivedVersions() = %v, %v", versions, err)
+	}
+	v1 := "20000101000000"
+	if err := os.Rename(filepath.Join(archiveDirname, versions[0]), filepath.Join(archiveDirname, v1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := RebuildHistory(archiveDirname, nil); err != nil {
+		t.Fatalf("RebuildHistory() error = %v", err)
+	}
+
+	h, err := NewHistory()
+	if err != nil {
+		t.Fatalf("NewHistory() error = %v", err)
+	}
+
+	update(`{"word":"word000010","senses":[{"definition":"updated again"}]}
+{"word":"zebra","senses":[{"definition":"an animal"}]}
+`)
+
+	versions, _ = archivedVersions(archiveDirname)
+	if len(versions) != 2 || versions[0] != v1 {
+		t.Fatalf("archivedVersions() = %v", versions)
+	}
+	v2 := versions[1]
+
+	d, err := Open(dictFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	history := func(word string) []HistoryRecord {
+		t.Helper()
+		current, ok := d.Lookup(word)
+		if !ok {
+			current = nil
+		}
+		records, err := h.Word(word, current)
+		if err != nil {
+			t.Fatalf("Word(%s) error = %v", word, err)
+		}
+		return records
+	}
+
+	// The records appended by the second update are picked up
+	records := history("WORD000010")
+	want := []struct{ version, def string }{
+		{v1, "definition of the word number 10 in the benchmark dictionary"},
+		{v2, "updated 10"},
+		{CurrentVersion, "updated again"},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("Word(WORD000010) = %+v", records)
+	}
+	for i, w := range want {
+		if r := records[i]; r.Version != w.version || r.Deleted || r.Entry.Definition() != w.def {
+			t.Errorf("Word(WORD000010)[%d] = %+v, want %s %q", i, r, w.version, w.def)
+		}
+	}
+
+	records = history("word000020")
+	if len(records) != 2 || records[0].Version != v1 || !records[1].Deleted || records[1].Version != v2 {
+		t.Errorf("Word(word000020) = %+v", records)
+	}
+
+	records = history("zebra")
+	if len(records) != 1 || records[0].Version != CurrentVersion || records[0].Entry.Definition() != "an animal" {
+		t.Errorf("Word(zebra) = %+v", records)
+	}
+
+	// Unchanged words have a single record
+	records = history("word000030")
+	if len(records) != 1 || records[0].Version != v1 {
+		t.Errorf("Word(word000030) = %+v", records)
+	}
+
+	if records := history("unknown"); len(records) != 0 {
+		t.Errorf("Word(unknown) = %+v, want no records", records)
+	}
+
+	// The appended index is the one built from scratch
+	path := filepath.Join(archiveDirname, historyFilename)
+	appended, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RebuildHistory(archiveDirname, nil); err != nil {
+		t.Fatalf("RebuildHistory() error = %v", err)
+	}
+	rebuilt, _ := os.ReadFile(path)
+	if !bytes.Equal(appended, rebuilt) {
+		t.Errorf("appended history differs from the rebuilt one")
+	}
+}
+
+func TestHistoryArchive(t *testing.T) {
+	// A copy of the versions archived in the repository, of the baseline layout
+	dir := filepath.Join(t.TempDir(), archiveDirname)
+	versions, err := archivedVersions(filepath.Join("..", archiveDirname))
+	if err != nil || len(versions) != 3 {
+		t.Fatalf("archivedVersions() = %v, %v", versions, err)
+	}
+	for _, v := range versions {
+		data, err := os.ReadFile(filepath.Join("..", archiveDirname, v, dictFilename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.MkdirAll(filepath.Join(dir, v), 0755)
+		if err := os.WriteFile(filepath.Join(dir, v, dictFilename), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := RebuildHistory(dir, nil); err != nil {
+		t.Fatalf("RebuildHistory() error = %v", err)
+	}
+
+	// A version of the current layout is appended to them
+	v4 := "20250501000000"
+	buildVersion(t, dir, v4, "abandon,to give up completely\n")
+	if err := updateHistory(dir, v4, nil); err != nil {
+		t.Fatalf("updateHistory() error = %v", err)
+	}
+
+	h, err := OpenHistory(filepath.Join(dir, historyFilename), 0)
+	if err != nil {
+		t.Fatalf("OpenHistory() error = %v", err)
+	}
+
+	records, err := h.Word("abandon", nil)
+	if err != nil {
+		t.Fatalf("Word(abandon) error = %v", err)
+	}
+	want := []struct{ version, def string }{
+		{versions[0], "to leave and never return to"},
+		{versions[1], "have been deserted or left"},
+		{versions[2], "desert"},
+		{v4, "to give up completely"},
+	}
+	if len(records) != len(want)+1 || !records[len(want)].Deleted {
+		t.Fatalf("Word(abandon) = %+v", records)
+	}
+	for i, w := range want {
+		if r := records[i]; r.Version != w.version || r.Deleted || r.Entry.Definition() != w.def {
+			t.Errorf("Word(abandon)[%d] = %+v, want %s %q", i, r, w.version, w.def)
+		}
+	}
+}
@@ -0,0 +1,516 @@
+package dict
+
+// This file contains the importers of dictionaries in other formats:
+//
+//  1. StarDict - <name>.ifo, <name>.idx and <name>.dict (or .dict.dz), see stardict.go
+//  2. dictd - <name>.index and <name>.dict (or .dict.dz), see dictd.go
+//  3. JSON lines dumps, one JSON object per entry, whose fields are mapped
+//     to the ones of an Entry by a FieldMap
+//
+// An Importer reads the entries one by one, like a source file, so they go
+// through the same pipeline as words.dat: headwords listed more than once
+// are merged, and the entries are sorted by key. Entries that can't be
+// imported are logged and skipped.
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ImportFormat is the format of an imported dictionary
+type ImportFormat string
+
+const (
+	FormatStarDict ImportFormat = "stardict"
+	FormatDictd    ImportFormat = "dictd"
+	FormatJSONL    ImportFormat = "jsonl"
+)
+
+// ErrUnknownFormat is returned for formats that can't be imported
+var ErrUnknownFormat = errors.New("unknown format")
+
+// FieldMap maps the fields of the objects of a JSON lines dump to the ones
+// of an Entry. Fields are paths of keys separated by dots, e.g.
+// "sounds.ipa"; arrays along a path are walked item by item. Senses is the
+// array of the senses, whose fields are relative to its items; without
+// senses the object itself is the only sense. PartOfSpeech is looked up in
+// the object when a sense doesn't have one.
+type FieldMap struct {
+	Word          string `json:"word"`
+	Pronunciation string `json:"pronunciation"`
+	Etymology     string `json:"etymology"`
+	Tags          string `json:"tags"`
+	Senses        string `json:"senses"`
+	PartOfSpeech  string `json:"pos"`
+	Definition    string `json:"definition"`
+	Examples      string `json:"examples"`
+}
+
+// DefaultFieldMap maps the fields of words.jsonl, see source.go
+var DefaultFieldMap = FieldMap{
+	Word:          "word",
+	Pronunciation: "pronunciation",
+	Etymology:     "etymology",
+	Tags:          "tags",
+	Senses:        "senses",
+	PartOfSpeech:  "pos",
+	Definition:    "definition",
+	Examples:      "examples",
+}
+
+// ParseFieldMap parses "field=path" pairs separated by commas, e.g.
+// "definition=glosses,pronunciation=sounds.ipa", into the fields of
+// DefaultFieldMap they replace
+func ParseFieldMap(s string) (FieldMap, error) {
+	fm := DefaultFieldMap
+	if s == "" {
+		return fm, nil
+	}
+
+	fields := map[string]*string{
+		"word":          &fm.Word,
+		"pronunciation": &fm.Pronunciation,
+		"etymology":     &fm.Etymology,
+		"tags":          &fm.Tags,
+		"senses":        &fm.Senses,
+		"pos":           &fm.PartOfSpeech,
+		"definition":    &fm.Definition,
+		"examples":      &fm.Examples,
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		name, path, ok := strings.Cut(pair, "=")
+		field, known := fields[strings.TrimSpace(name)]
+		if !ok || !known {
+			return FieldMap{}, fmt.Errorf("invalid field mapping %q", pair)
+		}
+		*field = strings.TrimSpace(path)
+	}
+
+	return fm, nil
+}
+
+// ImportOptions controls how a dictionary is imported
+type ImportOptions struct {
+	Format ImportFormat
+	// Fields maps the fields of JSON lines dumps, DefaultFieldMap if it's nil
+	Fields *FieldMap
+}
+
+// ImportStats counts the entries of an import
+type ImportStats struct {
+	Imported int
+	// Skipped entries are logged along with the reason
+	Skipped int
+}
+
+// Importer reads the entries of a dictionary in another format one by one
+type Importer struct {
+	format ImportFormat
+	next   func() (*Entry, error)
+	close  func()
+	stats  ImportStats
+	// skippedFields are the kinds of fields left out, logged once each
+	skippedFields map[string]bool
+}
+
+// OpenImport opens the dictionary at path for import. StarDict and dictd
+// dictionaries are given by the path of any of their files.
+func OpenImport(path string, opts ImportOptions) (*Importer, error) {
+	im := &Importer{
+		format:        opts.Format,
+		skippedFields: make(map[string]bool),
+	}
+
+	var err error
+	switch opts.Format {
+	case FormatStarDict:
+		err = im.openStarDict(path)
+	case FormatDictd:
+		err = im.openDictd(path)
+	case FormatJSONL:
+		fm := DefaultFieldMap
+		if opts.Fields != nil {
+			fm = *opts.Fields
+		}
+		err = im.openJSONL(path, fm)
+	default:
+		return nil, fmt.Errorf("%w %q, expected stardict, dictd or jsonl", ErrUnknownFormat, opts.Format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return im, nil
+}
+
+// Next returns the next entry or io.EOF once all entries are read. The
+// entries that can't be imported are logged and skipped.
+func (im *Importer) Next() (*Entry, error) {
+	e, err := im.next()
+	if err != nil {
+		return nil, err
+	}
+	im.stats.Imported++
+
+	return e, nil
+}
+
+// Stats returns the counts of the entries read so far
+func (im *Importer) Stats() ImportStats {
+	return im.stats
+}
+
+// Close closes the files of the imported dictionary
+func (im *Importer) Close() {
+	if im.close != nil {
+		im.close()
+	}
+}
+
+// skip logs an entry that can't be imported
+func (im *Importer) skip(word string, reason string) {
+	im.stats.Skipped++
+	log.Printf("Skipping %s entry '%s': %s", im.format, word, reason)
+}
+
+// skipField logs the first field of a kind left out of the entries
+func (im *Importer) skipField(kind string) {
+	if !im.skippedFields[kind] {
+		im.skippedFields[kind] = true
+		log.Printf("Skipping %s fields of type %s", im.format, kind)
+	}
+}
+
+// Import builds the dictionary at dictPath from the imported dictionary at
+// path, like Build does from a source file. The intermediate index.dat file
+// is written next to dictPath.
+func Import(path, dictPath string, opts ImportOptions, buildOpts BuildOptions) (ImportStats, error) {
+	flags, aead, err := prepareBuild(&buildOpts)
+	if err != nil {
+		return ImportStats{}, err
+	}
+
+	entries, stats, err := importEntries(path, opts, flags)
+	if err != nil {
+		return stats, err
+	}
+
+	err = writeDict(entries, dictPath, flags, buildOpts, aead)
+	if err != nil {
+		return stats, err
+	}
+
+	return stats, nil
+}
+
+// ImportSource writes the entries of the imported dictionary at path into
+// a words.jsonl source file, sorted by key
+func ImportSource(path, wordsPath string, opts ImportOptions) (ImportStats, error) {
+	entries, stats, err := importEntries(path, opts, 0)
+	if err != nil {
+		return stats, err
+	}
+
+	f, err := os.Create(wordsPath)
+	if err != nil {
+		return stats, fmt.Errorf("error creating source file: %v", err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for _, ke := range entries {
+		err = writeSourceEntry(w, ke.entry)
+		if err != nil {
+			return stats, fmt.Errorf("error writing source file: %v", err)
+		}
+	}
+
+	return stats, w.Flush()
+}
+
+// importEntries reads the entries of the imported dictionary sorted by key
+func importEntries(path string, opts ImportOptions, flags uint16) ([]keyedEntry, ImportStats, error) {
+	im, err := OpenImport(path, opts)
+	if err != nil {
+		return nil, ImportStats{}, err
+	}
+	defer im.Close()
+
+	entries, err := collectEntries(im, flags)
+	if err != nil {
+		return nil, im.Stats(), fmt.Errorf("error importing %s: %v", filepath.Base(path), err)
+	}
+
+	stats := im.Stats()
+	log.Printf("Imported %d entries of %s, skipped %d", stats.Imported, filepath.Base(path), stats.Skipped)
+
+	return entries, stats, nil
+}
+
+// openJSONL reads the objects of a JSON lines dump as entries
+func (im *Importer) openJSONL(path string, fm FieldMap) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %v", path, err)
+	}
+	im.close = func() { f.Close() }
+
+	r := bufio.NewReader(f)
+	line := 0
+
+	im.next = func() (*Entry, error) {
+		for {
+			data, err := r.ReadBytes('\n')
+			if err == io.EOF && len(data) == 0 {
+				return nil, io.EOF
+			}
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			line++
+
+			if strings.TrimSpace(string(data)) == "" {
+				continue
+			}
+
+			var obj map[string]any
+			err = json.Unmarshal(data, &obj)
+			if err != nil {
+				im.skip("line "+strconv.Itoa(line), fmt.Sprintf("invalid JSON: %v", err))
+				continue
+			}
+
+			e := fm.entry(obj)
+			if e.Word == "" {
+				im.skip("line "+strconv.Itoa(line), "missing word")
+				continue
+			}
+			if len(e.Senses) == 0 {
+				im.skip(e.Word, "no definition")
+				continue
+			}
+
+			return e, nil
+		}
+	}
+
+	return nil
+}
+
+// entry maps the fields of a JSON object to an entry
+func (fm FieldMap) entry(obj map[string]any) *Entry {
+	e := &Entry{
+		Word:          first(fieldValues(obj, fm.Word)),
+		Pronunciation: first(fieldValues(obj, fm.Pronunciation)),
+		Etymology:     first(fieldValues(obj, fm.Etymology)),
+		Tags:          fieldValues(obj, fm.Tags),
+	}
+
+	// Objects without senses are a sense themselves
+	senses := fieldObjects(obj, fm.Senses)
+	if len(senses) == 0 {
+		senses = []map[string]any{obj}
+	}
+	pos := first(fieldValues(obj, fm.PartOfSpeech))
+
+	for _, sense := range senses {
+		defs := fieldValues(sense, fm.Definition)
+		if len(defs) == 0 {
+			continue
+		}
+
+		s := Sense{
+			PartOfSpeech: first(fieldValues(sense, fm.PartOfSpeech)),
+			Definition:   strings.Join(defs, "; "),
+			Examples:     fieldValues(sense, fm.Examples),
+		}
+		if s.PartOfSpeech == "" {
+			s.PartOfSpeech = pos
+		}
+
+		e.Senses = append(e.Senses, s)
+	}
+
+	e.numberSenses()
+
+	return e
+}
+
+// fieldValues returns the strings at the path of dot separated keys in v,
+// walking the arrays along the path item by item
+func fieldValues(v any, path string) []string {
+	if path == "" {
+		return nil
+	}
+
+	key, rest, _ := strings.Cut(path, ".")
+
+	var values []string
+	switch t := v.(type) {
+	case map[string]any:
+		child, ok := t[key]
+		if !ok {
+			return nil
+		}
+		if rest == "" {
+			return leafValues(child)
+		}
+		return fieldValues(child, rest)
+	case []any:
+		for _, item := range t {
+			values = append(values, fieldValues(item, path)...)
+		}
+	}
+
+	return values
+}
+
+// fieldObjects returns the objects at the path of dot separated keys in v,
+// the items of the arrays along the path and at its end
+func fieldObjects(v any, path string) []map[string]any {
+	switch t := v.(type) {
+	case map[string]any:
+		if path == "" {
+			return []map[string]any{t}
+		}
+		key, rest, _ := strings.Cut(path, ".")
+		child, ok := t[key]
+		if !ok {
+			return nil
+		}
+		return fieldObjects(child, rest)
+	case []any:
+		var objects []map[string]any
+		for _, item := range t {
+			objects = append(objects, fieldObjects(item, path)...)
+		}
+		return objects
+	}
+
+	return nil
+}
+
+// leafValues returns the strings of a field value, a string, a number or an
+// array of them
+func leafValues(v any) []string {
+	switch t := v.(type) {
+	case string:
+		if t = strings.TrimSpace(t); t != "" {
+			return []string{t}
+		}
+	case float64:
+		return []string{strconv.FormatFloat(t, 'f', -1, 64)}
+	case []any:
+		var values []string
+		for _, item := range t {
+			values = append(values, leafValues(item)...)
+		}
+		return values
+	}
+
+	return nil
+}
+
+// first returns the first value, or an empty string
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+
+	return values[0]
+}
+
+// openData opens the data file of a StarDict or dictd dictionary, base.dict
+// or its dictzip compressed base.dict.dz. Compressed data is decompressed
+// into a temp file, which the returned function removes.
+func openData(base string) (*os.File, func(), error) {
+	f, err := os.Open(base + ".dict")
+	if err == nil {
+		return f, func() { f.Close() }, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	dz, err := os.Open(base + ".dict.dz")
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening %s.dict: %v", filepath.Base(base), err)
+	}
+	defer dz.Close()
+
+	// dictzip files are gzip files with an index of their chunks, which
+	// isn't needed to read them whole
+	zr, err := gzip.NewReader(dz)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading %s.dict.dz: %v", filepath.Base(base), err)
+	}
+
+	tmp, err := os.CreateTemp("", "dict-import-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+
+	_, err = io.Copy(tmp, zr)
+	if err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("error decompressing %s.dict.dz: %v", filepath.Base(base), err)
+	}
+
+	return tmp, cleanup, nil
+}
+
+// basePath strips the extensions of the files of a StarDict or dictd
+// dictionary from path
+func basePath(path string, exts ...string) string {
+	for _, ext := range exts {
+		if base, ok := strings.CutSuffix(path, ext); ok {
+			return base
+		}
+	}
+
+	return path
+}
+
+var (
+	// markupTag matches the tags of HTML, XDXF and Pango markup
+	markupTag = regexp.MustCompile(`<[^>]*>`)
+	// lineBreakTag matches the tags breaking lines
+	lineBreakTag = regexp.MustCompile(`(?i)<br\s*/?>|</?(p|div|li|def)>`)
+)
+
+// stripMarkup turns marked up text into plain text, keeping its line breaks
+func stripMarkup(s string) string {
+	s = lineBreakTag.ReplaceAllString(s, "\n")
+	s = markupTag.ReplaceAllString(s, "")
+
+	return html.UnescapeString(s)
+}
+
+// splitSenses turns the lines of a definition into senses, one per
+// non-empty line
+func splitSenses(text string) []Sense {
+	var senses []Sense
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			senses = append(senses, Sense{Definition: line})
+		}
+	}
+
+	return senses
+}
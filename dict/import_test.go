@@ -0,0 +1,246 @@
+package dict
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeStarDict writes a StarDict dictionary of the entries, raw field data
+// by word, and returns the path of its .ifo file
+func writeStarDict(t *testing.T, dir, seq string, compress bool, words []string, data map[string]string) string {
+	t.Helper()
+
+	var idx, dict bytes.Buffer
+	for _, w := range words {
+		idx.WriteString(w)
+		idx.WriteByte(0)
+		binary.Write(&idx, binary.BigEndian, uint32(dict.Len()))
+		binary.Write(&idx, binary.BigEndian, uint32(len(data[w])))
+		dict.WriteString(data[w])
+	}
+
+	base := filepath.Join(dir, "test")
+	ifo := fmt.Sprintf("StarDict's dict ifo file\nversion=2.4.2\nwordcount=%d\nidxfilesize=%d\nbookname=Test\n", len(words), idx.Len())
+	if seq != "" {
+		ifo += "sametypesequence=" + seq + "\n"
+	}
+
+	dictPath := base + ".dict"
+	dictData := dict.Bytes()
+	if compress {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(dictData)
+		zw.Close()
+		dictPath, dictData = base+".dict.dz", buf.Bytes()
+	}
+
+	for path, content := range map[string][]byte{base + ".ifo": []byte(ifo), base + ".idx": idx.Bytes(), dictPath: dictData} {
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return base + ".ifo"
+}
+
+// readImport returns the entries read by an importer of the dictionary at path
+func readImport(t *testing.T, path string, opts ImportOptions) ([]*Entry, ImportStats) {
+	t.Helper()
+
+	im, err := OpenImport(path, opts)
+	if err != nil {
+		t.Fatalf("OpenImport() error = %v", err)
+	}
+	defer im.Close()
+
+	var entries []*Entry
+	for {
+		e, err := im.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, im.Stats()
+}
+
+// definitions returns the definitions of the senses of an entry
+func definitions(e *Entry) []string {
+	var defs []string
+	for _, s := range e.Senses {
+		defs = append(defs, s.Definition)
+	}
+	return defs
+}
+
+func TestImportStarDict(t *testing.T) {
+	t.Run("sametypesequence", func(t *testing.T) {
+		for _, compress := range []bool{false, true} {
+			dir := t.TempDir()
+			words := []string{"apple", "banana", "empty"}
+			path := writeStarDict(t, dir, "tm", compress, words, map[string]string{
+				"apple":  "/ˈæp.əl/\x00a fruit\nthe tree it grows on",
+				"banana": "\x00a long fruit",
+				"empty":  "/ˈɛmp.ti/\x00\n",
+			})
+
+			entries, stats := readImport(t, path, ImportOptions{Format: FormatStarDict})
+			if len(entries) != 2 || stats.Imported != 2 || stats.Skipped != 1 {
+				t.Fatalf("compress=%v: read %d entries, stats %+v, want 2 imported, 1 skipped", compress, len(entries), stats)
+			}
+			if e := entries[0]; e.Word != "apple" || e.Pronunciation != "/ˈæp.əl/" || fmt.Sprint(definitions(e)) != "[a fruit the tree it grows on]" {
+				t.Errorf("compress=%v: entry = %+v", compress, e)
+			}
+			if e := entries[1]; e.Pronunciation != "" || fmt.Sprint(definitions(e)) != "[a long fruit]" {
+				t.Errorf("compress=%v: entry = %+v", compress, e)
+			}
+		}
+	})
+
+	t.Run("typed fields", func(t *testing.T) {
+		dir := t.TempDir()
+		picture := "W\x00\x00\x00\x03wav"
+		path := writeStarDict(t, dir, "", false, []string{"cat", "dog"}, map[string]string{
+			"cat": "h<b>cat</b><br>a small &amp; furry animal<br/>a jazz musician\x00" + picture,
+			"dog": "m\x00",
+		})
+
+		entries, stats := readImport(t, path, ImportOptions{Format: FormatStarDict})
+		if len(entries) != 1 || stats.Skipped != 1 {
+			t.Fatalf("read %d entries, stats %+v", len(entries), stats)
+		}
+		if got := fmt.Sprint(definitions(entries[0])); got != "[cat a small & furry animal a jazz musician]" {
+			t.Errorf("definitions = %s", got)
+		}
+	})
+
+	t.Run("missing index", func(t *testing.T) {
+		dir := t.TempDir()
+		path := writeStarDict(t, dir, "m", false, []string{"a"}, map[string]string{"a": "b"})
+		os.Remove(filepath.Join(dir, "test.idx"))
+		if _, err := OpenImport(path, ImportOptions{Format: FormatStarDict}); err == nil {
+			t.Error("OpenImport() without .idx succeeded")
+		}
+	})
+}
+
+func TestImportDictd(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "test")
+
+	texts := []struct{ word, text string }{
+		{"00-database-short", "00-database-short\n   Test dictionary\n"},
+		{"Apple", "Apple /ˈæp.əl/\n\n   The fleshy fruit of\n   a tree.\n\n   The tree itself.\n"},
+		{"banana", "  An elongated fruit.\n"},
+		{"blank", "blank\n\n"},
+	}
+
+	var dict, index bytes.Buffer
+	for _, tt := range texts {
+		fmt.Fprintf(&index, "%s\t%s\t%s\n", tt.word, formatDictdNumber(int64(dict.Len())), formatDictdNumber(int64(len(tt.text))))
+		dict.WriteString(tt.text)
+	}
+	index.WriteString("broken\tB\t!\n")
+	index.WriteString("outside\t" + formatDictdNumber(100000) + "\tB\n")
+
+	os.WriteFile(base+".index", index.Bytes(), 0644)
+	os.WriteFile(base+".dict", dict.Bytes(), 0644)
+
+	entries, stats := readImport(t, base+".index", ImportOptions{Format: FormatDictd})
+	if len(entries) != 2 || stats.Skipped != 3 {
+		t.Fatalf("read %d entries, stats %+v, want 2 entries, 3 skipped", len(entries), stats)
+	}
+	if e := entries[0]; e.Word != "Apple" || e.Pronunciation != "/ˈæp.əl/" || fmt.Sprint(definitions(e)) != "[The fleshy fruit of a tree. The tree itself.]" || len(e.Senses) != 2 {
+		t.Errorf("entry = %+v", e)
+	}
+	if e := entries[1]; e.Word != "banana" || fmt.Sprint(definitions(e)) != "[An elongated fruit.]" {
+		t.Errorf("entry = %+v", e)
+	}
+
+	for _, n := range []int64{0, 63, 64, 4096, 1 << 40} {
+		if got, err := parseDictdNumber(formatDictdNumber(n)); err != nil || got != n {
+			t.Errorf("parseDictdNumber(formatDictdNumber(%d)) = %d, %v", n, got, err)
+		}
+	}
+	if n, err := parseDictdNumber("BAA"); err != nil || n != 4096 {
+		t.Errorf("parseDictdNumber(BAA) = %d, %v", n, err)
+	}
+}
+
+func TestImportJSONL(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dump.jsonl")
+
+	// A wiktextract-like dump
+	dump := `{"word":"run","pos":"verb","sounds":[{"ipa":"/ɹʌn/"},{"ipa":"/ɹʊn/"}],"etymology_text":"From Old English","senses":[{"glosses":["To move swiftly"],"examples":[{"text":"I run daily"}]},{"glosses":["To operate"],"tags":["transitive"]}]}
+not json
+{"pos":"noun","senses":[{"glosses":["no word"]}]}
+{"word":"run","pos":"noun","senses":[{"glosses":["An act of running"]}]}
+{"word":"empty","senses":[{"tags":["no gloss"]}]}
+`
+	if err := os.WriteFile(path, []byte(dump), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fm, err := ParseFieldMap("definition=glosses,pronunciation=sounds.ipa,etymology=etymology_text,examples=examples.text")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, stats := readImport(t, path, ImportOptions{Format: FormatJSONL, Fields: &fm})
+	if len(entries) != 2 || stats.Skipped != 3 {
+		t.Fatalf("read %d entries, stats %+v, want 2 entries, 3 skipped", len(entries), stats)
+	}
+	e := entries[0]
+	if e.Pronunciation != "/ɹʌn/" || e.Etymology != "From Old English" || len(e.Senses) != 2 {
+		t.Errorf("entry = %+v", e)
+	}
+	if s := e.Senses[0]; s.PartOfSpeech != "verb" || s.Definition != "To move swiftly" || fmt.Sprint(s.Examples) != "[I run daily]" {
+		t.Errorf("sense = %+v", s)
+	}
+
+	if _, err := ParseFieldMap("meaning=glosses"); err == nil {
+		t.Error("ParseFieldMap() of an unknown field succeeded")
+	}
+
+	// Entries of the same word are merged by the build
+	dictPath := filepath.Join(dir, dictFilename)
+	stats, err = Import(path, dictPath, ImportOptions{Format: FormatJSONL, Fields: &fm}, BuildOptions{})
+	if err != nil || stats.Imported != 2 {
+		t.Fatalf("Import() = %+v, %v", stats, err)
+	}
+	d, err := Open(dictPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if e, ok := d.Lookup("run"); !ok || len(e.Senses) != 3 {
+		t.Errorf("Lookup(run) = %+v, %v", e, ok)
+	}
+
+	// Or written into a source file
+	wordsPath := filepath.Join(dir, jsonlWordsFilename)
+	if _, err := ImportSource(path, wordsPath, ImportOptions{Format: FormatJSONL, Fields: &fm}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(wordsPath); strings.Count(string(data), "\n") != 1 || !strings.Contains(string(data), "An act of running") {
+		t.Errorf("source file = %s", data)
+	}
+
+	if _, err := OpenImport(path, ImportOptions{Format: "xdxf"}); !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("OpenImport() of an unknown format error = %v", err)
+	}
+}
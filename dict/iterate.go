@@ -0,0 +1,203 @@
+package dict
+
+// This file contains the ordered iteration over the dictionary.
+//
+// The index section is sorted by key, so a range scan binary searches the
+// sparse index for the first key and then reads the index one run (up to
+// the next restart point) at a time. The entries of a run are stored next to
+// each other, hence they are fetched with a single read as well.
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// Iterate calls fn with the key and the entry of every word whose key is in
+// [from, to), in key order, until fn returns false. from and to are
+// normalized like the queried words, an empty from or to leaves the range
+// open. Since keys are unique, the key following the last one seen can be
+// used as from to resume the iteration.
+//
+// It returns ctx.Err() if the context is done before the iteration ends.
+func (rd *Reader) Iterate(ctx context.Context, from, to string, fn func(key string, e *Entry) bool) error {
+	if from != "" {
+		from = NormalizeKey(from, rd.header.Flags)
+	}
+	if to != "" {
+		to = NormalizeKey(to, rd.header.Flags)
+	}
+
+	si, err := rd.sortedIndex()
+	if err != nil {
+		return err
+	}
+
+	i, err := si.search(from)
+	if err != nil {
+		return err
+	}
+	if i < 0 {
+		i = 0
+	}
+
+	for ; i < si.slots; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		buf, err := si.run(i)
+		if err != nil {
+			return err
+		}
+
+		// Collect the entries of the run within the range
+		var run []IndexEntry
+		last := false
+
+		d := newIndexDecoder(buf, rd.header.Flags)
+		for {
+			e, ok := d.next()
+			if !ok {
+				break
+			}
+
+			if compareBytesString(e.key, from) < 0 {
+				continue
+			}
+			if to != "" && compareBytesString(e.key, to) >= 0 {
+				last = true
+				break
+			}
+
+			run = append(run, e.entry())
+		}
+		if d.err != nil {
+			return d.err
+		}
+
+		entries, err := rd.readRun(run)
+		if err != nil {
+			return err
+		}
+
+		for j, e := range entries {
+			if !fn(run[j].Key, e) {
+				return nil
+			}
+		}
+
+		if last {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// All returns an iterator over all entries in key order. From Go 1.23 on it
+// can be ranged over:
+//
+//	for key, e := range rd.All() {
+//		...
+//	}
+//
+// Errors end the iteration early and are logged, use Iterate to handle them.
+func (rd *Reader) All() func(yield func(key string, e *Entry) bool) {
+	return func(yield func(key string, e *Entry) bool) {
+		err := rd.Iterate(context.Background(), "", "", yield)
+		if err != nil {
+			log.Printf("error iterating dictionary: %v", err)
+		}
+	}
+}
+
+// sortedIndex returns the sorted index of the dictionary. Readers that
+// loaded the index into memory load the sparse index with its keys on first use.
+func (rd *Reader) sortedIndex() (*sortedIndex, error) {
+	if si, ok := rd.index.(*sortedIndex); ok {
+		return si, nil
+	}
+
+	rd.sortedOnce.Do(func() {
+		ir, index, sparse, err := rd.indexReader()
+		if err != nil {
+			rd.sortedErr = err
+			return
+		}
+
+		rd.sorted, rd.sortedErr = newSortedIndex(ir, index, sparse, rd.header.Flags, true)
+	})
+
+	return rd.sorted, rd.sortedErr
+}
+
+// readRun reads the entries of consecutive index entries
+func (rd *Reader) readRun(run []IndexEntry) ([]*Entry, error) {
+	if len(run) == 0 {
+		return nil, nil
+	}
+
+	entries := make([]*Entry, len(run))
+
+	if rd.blocks != nil {
+		// Consecutive entries mostly share a block, which is only decompressed
+		// once. Like blocksReader, the cache of hot words is left alone.
+		cur := -1
+		var data []byte
+
+		for i, idxe := range run {
+			n, err := rd.findBlock(idxe.Offset)
+			if err != nil {
+				return nil, err
+			}
+
+			if n != cur {
+				data, err = readBlock(rd.r, rd.size, rd.blocks[n], rd.aead)
+				if err != nil {
+					return nil, err
+				}
+				cur = n
+			}
+
+			buf, err := rd.sliceBlock(n, data, idxe.Offset, idxe.Size)
+			if err != nil {
+				return nil, err
+			}
+
+			entries[i], err = decodeEntry(buf)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return entries, nil
+	}
+
+	// The entries are stored one after the other, read them at once
+	st := run[0].Offset
+	en := run[len(run)-1].Offset + run[len(run)-1].Size
+	if st > en || en > rd.size {
+		return nil, fmt.Errorf("%w: entries at %d out of bounds", ErrBadFormat, st)
+	}
+
+	buf := make([]byte, en-st)
+	_, err := rd.r.ReadAt(buf, st)
+	if err != nil {
+		return nil, fmt.Errorf("error reading entries: %v", err)
+	}
+
+	for i, idxe := range run {
+		if idxe.Offset < st || idxe.Offset+idxe.Size > en {
+			return nil, fmt.Errorf("%w: entry at %d out of order", ErrBadFormat, idxe.Offset)
+		}
+
+		var err error
+		entries[i], err = decodeEntry(buf[idxe.Offset-st : idxe.Offset-st+idxe.Size])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,156 @@
+package dict
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestIterate(t *testing.T) {
+	for _, opts := range []BuildOptions{
+		{},
+		{Compress: true, BlockSize: 1024},
+		{FrontCoding: true},
+		{PerfectHash: true},
+	} {
+		opts.SparseInterval = 8
+		dictPath := buildBenchDict(t, t.TempDir(), 200, opts)
+
+		for _, lowMemory := range []bool{false, true} {
+			name := fmt.Sprintf("%+v/lowmemory=%v", opts, lowMemory)
+			t.Run(name, func(t *testing.T) {
+				var ropts []Option
+				if lowMemory {
+					ropts = append(ropts, WithLowMemory(false))
+				}
+
+				d, err := Open(dictPath, ropts...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer d.Close()
+
+				tests := []struct {
+					from, to   string
+					first, end int
+				}{
+					{"", "", 0, 200},
+					{"word000050", "word000060", 50, 60},
+					{"WORD000050", "", 50, 200},
+					{"word00005", "word0001", 50, 100},
+					{"", "word000003", 0, 3},
+					{"a", "b", 0, 0},
+					{"zzz", "", 200, 200},
+				}
+
+				for _, tt := range tests {
+					i := tt.first
+					err := d.Iterate(context.Background(), tt.from, tt.to, func(key string, e *Entry) bool {
+						want := fmt.Sprintf("word%06d", i)
+						if key != want || e.Word != want {
+							t.Fatalf("Iterate(%q, %q) yielded %s, %s, want %s", tt.from, tt.to, key, e.Word, want)
+						}
+						i++
+						return true
+					})
+					if err != nil {
+						t.Fatalf("Iterate(%q, %q) error = %v", tt.from, tt.to, err)
+					}
+					if i != tt.end {
+						t.Errorf("Iterate(%q, %q) ended at %d, want %d", tt.from, tt.to, i, tt.end)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestIteratePages(t *testing.T) {
+	d, err := Open(buildBenchDict(t, t.TempDir(), 100, BuildOptions{SparseInterval: 8}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Pages of 7 entries, resumed from the key following each page
+	var keys []string
+	from := ""
+	for page := 0; ; page++ {
+		if page > 100 {
+			t.Fatal("pagination does not end")
+		}
+
+		n := 0
+		next := ""
+		err := d.Iterate(context.Background(), from, "", func(key string, e *Entry) bool {
+			if n == 7 {
+				next = key
+				return false
+			}
+			keys = append(keys, key)
+			n++
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if next == "" {
+			break
+		}
+		from = next
+	}
+
+	if len(keys) != 100 {
+		t.Fatalf("pages hold %d keys, want 100", len(keys))
+	}
+	for i, key := range keys {
+		if want := fmt.Sprintf("word%06d", i); key != want {
+			t.Errorf("key %d = %s, want %s", i, key, want)
+		}
+	}
+}
+
+func TestIterateCanceled(t *testing.T) {
+	d, err := Open(buildBenchDict(t, t.TempDir(), 100, BuildOptions{SparseInterval: 8}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	n := 0
+	err = d.Iterate(ctx, "", "", func(key string, e *Entry) bool {
+		n++
+		cancel()
+		return true
+	})
+	if err != context.Canceled {
+		t.Errorf("Iterate() error = %v, want %v", err, context.Canceled)
+	}
+	if n != 8 {
+		t.Errorf("Iterate() yielded %d entries after the cancel, want the rest of the run (8)", n)
+	}
+}
+
+func TestAll(t *testing.T) {
+	d, err := Open(buildBenchDict(t, t.TempDir(), 50, BuildOptions{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	n := 0
+	d.All()(func(key string, e *Entry) bool {
+		if want := fmt.Sprintf("word%06d", n); key != want {
+			t.Errorf("key %d = %s, want %s", n, key, want)
+		}
+		n++
+		return n < 20
+	})
+
+	if n != 20 {
+		t.Errorf("All() yielded %d entries after stopping at 20", n)
+	}
+}
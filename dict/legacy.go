@@ -0,0 +1,212 @@
+package dict
+
+// This file contains the reader of the legacy layout of dict.dat, the
+// baseline one without a header:
+//
+//	<index size (8 bytes)><index lines><lines of words.dat>
+//
+// The index lines are "<word>:<offset (8 bytes)>:<size (2 bytes)>\n", the
+// offset of the "<word>,<definition>" line and the size of the definition.
+//
+// NewReader converts a legacy dict.dat into the current layout in memory
+// when it's opened, which takes reading all of it. Migrate rewrites it once
+// and for all.
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Migrate rewrites the dictionary at path, of the legacy layout or of the
+// current one, into the current layout at outPath, which may
+// be path itself, and returns the number of its entries. The dictionary is
+// opened with openOpts and keeps its layout otherwise. The new one is
+// encrypted with encKey and signed with signingKey if set, see BuildOptions.
+// The delta segments of the dictionary are left as they are.
+func Migrate(path, outPath string, encKey []byte, signingKey ed25519.PrivateKey, openOpts ...Option) (int, error) {
+	d, err := openFile(path, openOpts...)
+	if err != nil {
+		return 0, err
+	}
+	defer d.Close()
+
+	var entries []keyedEntry
+	err = d.Iterate(context.Background(), "", "", func(key string, e *Entry) bool {
+		entries = append(entries, keyedEntry{key: key, entry: e})
+		return true
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error reading %s: %v", filepath.Base(path), err)
+	}
+
+	opts := buildOptions(d.Header().Flags)
+	opts.EncryptionKey = encKey
+	opts.SigningKey = signingKey
+
+	flags, aead, err := prepareBuild(&opts)
+	if err != nil {
+		return 0, err
+	}
+
+	// Written in a temp directory like extracts, see Extract
+	tempDir, err := os.MkdirTemp(filepath.Dir(outPath), "tmp-dict-migrate-*")
+	if err != nil {
+		return 0, fmt.Errorf("error creating temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	newPath := filepath.Join(tempDir, dictFilename)
+	err = writeDict(entries, newPath, flags, opts, aead)
+	if err != nil {
+		return 0, fmt.Errorf("error migrating %s: %v", filepath.Base(path), err)
+	}
+
+	err = moveDict(newPath, outPath)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("Migrated %d entries of %s into %s", len(entries), filepath.Base(path), filepath.Base(outPath))
+
+	return len(entries), nil
+}
+
+// isLegacy reports whether the first bytes of a dict.dat are the ones of the
+// legacy layout, i.e. not the magic
+func isLegacy(hbuf []byte) bool {
+	return len(hbuf) < HeaderSize || string(hbuf[:4]) != magic
+}
+
+// newLegacyReader reads the legacy dict.dat image of the given size and
+// returns a reader of the same entries in the current layout
+func newLegacyReader(r io.ReaderAt, size int64, opts ...Option) (*Reader, error) {
+	buf := make([]byte, size)
+	_, err := r.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error reading dictionary: %v", err)
+	}
+
+	entries, err := decodeBaseline(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := legacyImage(entries)
+	if err != nil {
+		return nil, fmt.Errorf("error converting legacy dictionary: %v", err)
+	}
+
+	rd, err := NewReader(bytes.NewReader(img), int64(len(img)), opts...)
+	if err != nil {
+		return nil, err
+	}
+	rd.legacy = true
+
+	return rd, nil
+}
+
+// legacyImage builds the dict.dat image of the entries in the current layout
+func legacyImage(entries []*Entry) ([]byte, error) {
+	opts := BuildOptions{}
+	flags, aead, err := prepareBuild(&opts)
+	if err != nil {
+		return nil, err
+	}
+
+	keyed, err := collectEntries(&entryList{entries: entries}, flags)
+	if err != nil {
+		return nil, err
+	}
+
+	// writeDict writes index.dat next to the dictionary
+	tempDir, err := os.MkdirTemp("", "tmp-dict-legacy-*")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	path := filepath.Join(tempDir, dictFilename)
+	err = writeDict(keyed, path, flags, opts, aead)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.ReadFile(path)
+}
+
+// entryList is an entrySource of the entries in memory
+type entryList struct {
+	entries []*Entry
+}
+
+func (el *entryList) Next() (*Entry, error) {
+	if len(el.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	e := el.entries[0]
+	el.entries = el.entries[1:]
+
+	return e, nil
+}
+
+// decodeBaseline returns the entries of a baseline dict.dat
+func decodeBaseline(buf []byte) ([]*Entry, error) {
+	if len(buf) < 8 {
+		return nil, fmt.Errorf("%w: missing magic, rebuild the dictionary", ErrBadFormat)
+	}
+
+	indexSize := binary.BigEndian.Uint64(buf)
+	if indexSize < 8 || indexSize > uint64(len(buf)) {
+		return nil, fmt.Errorf("%w: missing magic, rebuild the dictionary", ErrBadFormat)
+	}
+
+	var entries []*Entry
+	index := buf[8:indexSize]
+	for len(index) > 0 {
+		// The offset and size are binary, so the separators are found by
+		// position rather than by splitting the line
+		i := bytes.IndexByte(index, ':')
+		if i <= 0 || len(index) < i+13 || index[i+9] != ':' || index[i+12] != '\n' {
+			return nil, fmt.Errorf("%w: corrupt baseline index", ErrBadFormat)
+		}
+
+		word := string(index[:i])
+		offset := binary.BigEndian.Uint64(index[i+1:])
+		size := binary.BigEndian.Uint16(index[i+10:])
+		index = index[i+13:]
+
+		e, err := legacyLine(buf, word, offset, size)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// legacyLine returns the entry of the "<word>,<definition>" line at offset,
+// whose definition is of the given size
+func legacyLine(buf []byte, word string, offset uint64, size uint16) (*Entry, error) {
+	start := offset + uint64(len(word)) + 1
+	if offset > uint64(len(buf)) || start+uint64(size) > uint64(len(buf)) ||
+		string(buf[offset:start-1]) != word || buf[start-1] != ',' {
+		return nil, fmt.Errorf("%w: entry '%s' at offset %d out of range", ErrBadFormat, word, offset)
+	}
+
+	e := &Entry{
+		Word:   word,
+		Senses: []Sense{{Definition: string(buf[start : start+uint64(size)])}},
+	}
+	e.numberSenses()
+
+	return e, nil
+}
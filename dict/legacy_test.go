@@ -0,0 +1,137 @@
+package dict
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// legacyWords are the entries of the legacy test dictionaries, sorted by word
+var legacyWords = [][2]string{
+	{"abandon", "to leave, and never return to"},
+	{"café", "a small restaurant"},
+	{"zoo", "a place: where\nanimals are kept"},
+}
+
+// baselineImage returns a baseline dict.dat of the words
+func baselineImage(words [][2]string) []byte {
+	indexSize := 8
+	for _, w := range words {
+		indexSize += len(w[0]) + 13
+	}
+
+	var index, data bytes.Buffer
+	binary.Write(&index, binary.BigEndian, uint64(indexSize))
+	for _, w := range words {
+		index.WriteString(w[0] + ":")
+		binary.Write(&index, binary.BigEndian, uint64(indexSize+data.Len()))
+		index.WriteString(":")
+		binary.Write(&index, binary.BigEndian, uint16(len(w[1])))
+		index.WriteString("\n")
+		data.WriteString(w[0] + "," + w[1] + "\n")
+	}
+
+	return append(index.Bytes(), data.Bytes()...)
+}
+
+// checkLegacyWords checks the entries of a dictionary of legacyWords
+func checkLegacyWords(t *testing.T, name string, d *Dict, strip bool) {
+	t.Helper()
+
+	if d.Len() != len(legacyWords) {
+		t.Errorf("%s: Len() = %d, want %d", name, d.Len(), len(legacyWords))
+	}
+	for _, w := range legacyWords {
+		e, ok := d.Lookup(w[0])
+		if !ok || e.Word != w[0] || fmt.Sprint(definitions(e)) != fmt.Sprint([]string{w[1]}) {
+			t.Errorf("%s: Lookup(%s) = %+v, %v", name, w[0], e, ok)
+		}
+	}
+	if _, ok := d.Lookup("cafe"); ok != strip {
+		t.Errorf("%s: Lookup(cafe) = %v, want %v", name, ok, strip)
+	}
+}
+
+func TestLegacyFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), dictFilename)
+	if err := os.WriteFile(path, baselineImage(legacyWords), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Converted in memory when opened
+	d, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	checkLegacyWords(t, "baseline", d, false)
+	d.Close()
+
+	// But not mapped
+	if _, err := OpenMmap(path); !errors.Is(err, ErrLegacyFormat) {
+		t.Errorf("OpenMmap() error = %v, want %v", err, ErrLegacyFormat)
+	}
+
+	n, err := Migrate(path, path, nil, nil)
+	if err != nil || n != len(legacyWords) {
+		t.Fatalf("Migrate() = %d, %v", n, err)
+	}
+
+	m, err := OpenMmap(path)
+	if err != nil {
+		t.Fatalf("OpenMmap() of the migrated dictionary error = %v", err)
+	}
+	if h := m.Header(); h.Version != formatVersion || h.Flags&FlagStripDiacritics != 0 {
+		t.Errorf("migrated header = %+v", h)
+	}
+	m.Close()
+}
+
+func TestLegacyArchive(t *testing.T) {
+	// The versions archived in the repository are of the baseline layout
+	d, err := Open(filepath.Join("..", archiveDirname, "20250427165715", dictFilename))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer d.Close()
+
+	if d.Len() != 16 {
+		t.Errorf("Len() = %d, want 16", d.Len())
+	}
+	if def, ok := d.QueryWord("abandon"); !ok || def != "to leave and never return to" {
+		t.Errorf("QueryWord(abandon) = %q, %v", def, ok)
+	}
+}
+
+func TestFormatVersions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), dictFilename)
+	os.WriteFile(path, baselineImage(legacyWords), 0644)
+
+	// Corrupt dictionaries are only verified in the current layout
+	if _, err := VerifyFile(path); !errors.Is(err, ErrLegacyFormat) || !errors.Is(err, ErrBadFormat) {
+		t.Errorf("VerifyFile() of the baseline layout error = %v, want %v", err, ErrLegacyFormat)
+	}
+
+	for _, v := range []uint16{0, formatVersion + 1} {
+		h := encodeHeader(Header{Version: v, IndexSize: HeaderSize})
+		if _, err := decodeHeader(h); !errors.Is(err, ErrBadFormat) || errors.Is(err, ErrLegacyFormat) {
+			t.Errorf("decodeHeader() of version %d error = %v", v, err)
+		}
+	}
+	h := encodeHeader(Header{Version: formatVersion, IndexSize: HeaderSize})
+	if _, err := decodeHeader(h); err != nil {
+		t.Errorf("decodeHeader() of version %d error = %v", formatVersion, err)
+	}
+
+	t.Setenv("DICT_STRIP_DIACRITICS", "true")
+	if strip, err := StripDiacriticsFromEnv(); !strip || err != nil {
+		t.Errorf("StripDiacriticsFromEnv() = %v, %v", strip, err)
+	}
+	t.Setenv("DICT_STRIP_DIACRITICS", "maybe")
+	if _, err := StripDiacriticsFromEnv(); err == nil {
+		t.Error("StripDiacriticsFromEnv() of an invalid value succeeded")
+	}
+}
@@ -1,34 +1,56 @@
 package dict
 
 import (
-	"encoding/binary"
+	"fmt"
+	"io"
 	"log"
 	"os"
-	"strings"
+	"sync"
 )
 
 const (
-	// wordsFilename file containing the words and their definitions
+	// wordsFilename file containing the words and their definitions.
+	// See source.go for the structured words.jsonl alternative.
 	wordsFilename = "words.dat"
 	// indexFilename file containing the index entries. It's a temporary file created
 	// during the build process.
 	indexFilename = "index.dat"
-	// dictFilename file containing the merged words and index. It's used by
+	// dictFilename file containing the merged index and encoded entries. It's used by
 	// API to run queries.
 	dictFilename = "dict.dat"
 )
 
 type Dict struct {
-	f     *os.File
-	index map[string]IndexEntry
+	f  *os.File
+	rd *Reader
+
+	// path and opts are the ones the dictionary was opened with
+	path string
+	opts []Option
+	// segments are the delta segments on top of the dictionary, the newest
+	// first, see segment.go. mu guards them along with the base file, which
+	// compaction replaces.
+	mu       sync.RWMutex
+	segments []*Dict
+	// applyMu and compactMu serialize the writes of segments and compactions
+	applyMu   sync.Mutex
+	compactMu sync.Mutex
 }
 
 type IndexEntry struct {
-	Word    string
-	Offset  int64 // offset of the word in the file
-	DefSize int16 // size of the definition
+	Key  string // normalized lookup key, see NormalizeKey
+	Word string // headword in its original display form
+	// Offset of the encoded entry in the file. For compressed dictionaries
+	// it's the offset in the uncompressed data instead.
+	Offset int64
+	Size   int64 // size of the encoded entry
 }
 
+// New opens dict.dat, building it first if it doesn't exist. If trusted
+// public keys are configured in DICT_PUBLIC_KEYS, dict.dat and its delta
+// segments must be signed by one of them, see WithPublicKeys. Encrypted dictionaries are decrypted with the key
+// in DICT_ENCRYPTION_KEY (or DICT_ENCRYPTION_KEY_FILE), see crypt.go.
+// DICT_LOW_MEMORY keeps the index on disk, see LowMemoryFromEnv.
 func New() (*Dict, error) {
 	// Check if the dictionary file exists
 	if !Exists() {
@@ -39,22 +61,98 @@ func New() (*Dict, error) {
 		}
 	}
 
+	keys, err := PublicKeysFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	encKey, err := EncryptionKeyFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("error reading encryption key: %v", err)
+	}
+
+	lowMemory, err := LowMemoryFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	// The delta segments are signed like dict.dat
+	d, err := Open(dictFilename, WithEncryptionKey(encKey), lowMemory, WithPublicKeys(keys))
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) > 0 {
+		log.Printf("Verified signature of %s and its %d segments", dictFilename, d.Segments())
+	}
+
+	return d, nil
+}
+
+// Open opens the dictionary file at path and reads its index into memory,
+// along with the delta segments on top of it, see segment.go
+func Open(path string, opts ...Option) (*Dict, error) {
+	d, err := openFile(path, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.loadSegments()
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// openFile opens the dictionary file at path, without its segments
+func openFile(path string, opts ...Option) (*Dict, error) {
 	// Open the dictionary file in read only mode
-	f, err := os.OpenFile(dictFilename, os.O_RDONLY, 0644)
+	f, err := os.OpenFile(path, os.O_RDONLY, 0644)
 	if err != nil {
 		return nil, err
 	}
 
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	// The signature, or the digest of a shard, is checked against the
+	// handle the file is read from
+	if len(o.publicKeys) > 0 {
+		err = verifySignature(f, fi.Size(), path, o.publicKeys)
+	}
+	if o.shard != nil && err == nil {
+		var sum []byte
+		sum, err = digest(io.NewSectionReader(f, 0, fi.Size()))
+		if err == nil {
+			err = o.shard.VerifyDigest(sum)
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
 	// Read the index from the file
-	index, err := readIndex(f)
+	rd, err := NewReader(f, fi.Size(), opts...)
 	if err != nil {
 		f.Close()
 		return nil, err
 	}
 
 	d := &Dict{
-		f:     f,
-		index: index,
+		f:    f,
+		rd:   rd,
+		path: path,
+		opts: opts,
 	}
 
 	return d, nil
@@ -69,77 +167,93 @@ func Exists() bool {
 	return true
 }
 
-// QueryWord queries the dictionary for a word and returns its definition
+// QueryWord queries the dictionary for a word and returns its definition.
+// The word is normalized before the lookup, so the query is case insensitive.
+// Entries with several senses are flattened, see Entry.Definition.
 func (d *Dict) QueryWord(word string) (string, bool) {
-	// Find the word in the index
-	idxe, ok := d.index[word]
+	e, ok := d.Lookup(word)
 	if !ok {
-		log.Printf("Error: '%s' word not found", word)
 		return "", false
 	}
 
-	// Read the definition
-	// <word>,<definition>
-	def := make([]byte, idxe.DefSize)
-	defOffset := idxe.Offset + int64(len(idxe.Word)+1) // +1 for the comma
+	return e.Definition(), true
+}
 
-	_, err := d.f.ReadAt(def, defOffset) // +1 for the comma
+// Lookup queries the dictionary for a word and returns its structured entry.
+// The newest delta segment holding the word answers before the base file.
+func (d *Dict) Lookup(word string) (*Entry, bool) {
+	e, ok, err := d.lookup(word)
 	if err != nil {
 		log.Printf("error reading definition: %v", err)
-		return "", false
+		return nil, false
+	}
+	if !ok {
+		log.Printf("Error: '%s' word not found", word)
+		return nil, false
 	}
 
-	return string(def), true
+	return e, true
 }
 
-// Close closes the dictionary file
-func (d *Dict) Close() {
-	if d.f != nil {
-		d.f.Close()
-	}
+// reader returns the reader of the base file, which Compact replaces
+func (d *Dict) reader() *Reader {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.rd
 }
 
-// readIndex reads the serialized index entries from the dict file
-// and returns a map of word to IndexEntry
-func readIndex(f *os.File) (map[string]IndexEntry, error) {
-	// Read the index size from the first 8 bytes
-	var indexSize uint64
-	err := binary.Read(f, binary.BigEndian, &indexSize)
-	if err != nil {
-		return nil, err
-	}
+// Header returns the header of the base file
+func (d *Dict) Header() Header {
+	return d.reader().Header()
+}
 
-	index := make(map[string]IndexEntry)
+// headerFlags returns the header flags of the base file
+func (d *Dict) headerFlags() uint16 {
+	return d.Header().Flags
+}
 
-	// Create a buffer to required size to read all index entries at once
-	buf := make([]byte, indexSize)
-	_, err = f.Read(buf)
-	if err != nil {
-		return nil, err
-	}
+// Len returns the number of entries in the base file, the segments on top of
+// it aside
+func (d *Dict) Len() int {
+	return d.reader().Len()
+}
 
-	// Since each index is separated by a newline, we can split the buffer into lines
-	lines := strings.Split(string(buf), "\n")
+// Stats scans the base file and reports its statistics, see Reader.Stats
+func (d *Dict) Stats() (Stats, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 
-	for _, line := range lines {
-		if line == "" {
-			continue
-		}
-		parts := strings.Split(line, ":")
-		if len(parts) != 3 {
-			continue
-		}
+	return d.rd.Stats()
+}
 
-		word := parts[0]
-		offset := int64(binary.BigEndian.Uint64([]byte(parts[1])))
-		defSize := int16(binary.BigEndian.Uint16([]byte(parts[2])))
+// Verify checks the base file against its checksums, see Reader.Verify
+func (d *Dict) Verify() ([]Corruption, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 
-		index[word] = IndexEntry{
-			Word:    word,
-			Offset:  offset,
-			DefSize: defSize,
-		}
+	return d.rd.Verify()
+}
+
+// entries returns the reader of the entries of the base file in the order
+// they are stored, see Reader.entries. It must not be used concurrently with
+// Compact.
+func (d *Dict) entries() *entryReader {
+	return d.reader().entries()
+}
+
+// Close closes the dictionary file and its segments
+func (d *Dict) Close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, seg := range d.segments {
+		seg.Close()
 	}
+	d.segments = nil
 
-	return index, nil
+	if d.f != nil {
+		d.f.Close()
+		d.f = nil
+	}
 }
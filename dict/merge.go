@@ -0,0 +1,362 @@
+package dict
+
+// This file contains the merge of several dictionaries into a new one. The
+// sources are dict.dat files or words.dat (or words.jsonl) files sorted by
+// key, merged one after the other into the result of the previous ones
+// with mergeSortedFiles, see update.go, and the result is streamed into the
+// new dictionary. The words found in several sources with different entries
+// are conflicts, resolved by a MergeStrategy.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// MergeStrategy resolves the conflicts of a merge
+type MergeStrategy string
+
+const (
+	// PreferLeft keeps the entry of the first source holding the word
+	PreferLeft MergeStrategy = "prefer-left"
+	// PreferRight keeps the entry of the last source holding the word
+	PreferRight MergeStrategy = "prefer-right"
+	// ConcatSenses keeps the senses of all the sources, in source order
+	ConcatSenses MergeStrategy = "concatenate"
+	// ReviewConflicts keeps the entry of the first source and writes the
+	// conflicts to a review file
+	ReviewConflicts MergeStrategy = "review"
+)
+
+// ErrInvalidMerge is returned for merges without enough sources or with an
+// unknown strategy
+var ErrInvalidMerge = errors.New("invalid merge")
+
+// MergeOptions controls how dictionaries are merged
+type MergeOptions struct {
+	Strategy MergeStrategy
+	// ReviewPath is the file the conflicts are written to, one JSON encoded
+	// MergeConflict per line, with ReviewConflicts
+	ReviewPath string
+	// Build are the options the merged dictionary is built with. Its keys
+	// are normalized with them, so the sources must be sorted the same way.
+	// StripDiacritics is taken from the dict.dat sources when there are any.
+	Build BuildOptions
+	// Options are the options the dict.dat sources are opened with, e.g.
+	// their encryption key
+	Options []Option
+}
+
+// MergeConflict is a word whose entry in a source differs from the one
+// merged from the sources before it
+type MergeConflict struct {
+	Word string `json:"word"`
+	// Source is the source of the right entry
+	Source string `json:"source"`
+	Left   *Entry `json:"left"`
+	Right  *Entry `json:"right"`
+}
+
+// Merge stream-merges the sorted sources into a new dictionary at dictPath
+// and returns the number of conflicts. A source repeating a word or out of
+// order is rejected, and so are dict.dat sources whose keys are normalized
+// with different flags. The intermediate files are written in a temp
+// directory next to dictPath.
+func Merge(sources []string, dictPath string, opts MergeOptions) (int, error) {
+	if len(sources) < 2 {
+		return 0, fmt.Errorf("%w: at least 2 sources are needed", ErrInvalidMerge)
+	}
+
+	var review *bufio.Writer
+	switch opts.Strategy {
+	case PreferLeft, PreferRight, ConcatSenses:
+	case ReviewConflicts:
+		if opts.ReviewPath == "" {
+			return 0, fmt.Errorf("%w: missing review file", ErrInvalidMerge)
+		}
+
+		f, err := os.Create(opts.ReviewPath)
+		if err != nil {
+			return 0, fmt.Errorf("error creating review file: %v", err)
+		}
+		defer f.Close()
+
+		review = bufio.NewWriter(f)
+	default:
+		return 0, fmt.Errorf("%w: unknown strategy %q", ErrInvalidMerge, opts.Strategy)
+	}
+
+	flags, err := mergeFlags(sources, opts.Build.StripDiacritics)
+	if err != nil {
+		return 0, err
+	}
+	opts.Build.StripDiacritics = flags&FlagStripDiacritics != 0
+
+	tempDir, err := os.MkdirTemp(filepath.Dir(dictPath), "tmp-dict-merge-*")
+	if err != nil {
+		return 0, fmt.Errorf("error creating temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	left, closeLeft, err := openMergeSource(sources[0], opts.Options)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		closeLeft()
+	}()
+
+	conflicts := 0
+	var mergedPath string
+
+	for i, source := range sources[1:] {
+		right, closeRight, err := openMergeSource(source, opts.Options)
+		if err != nil {
+			return 0, err
+		}
+
+		resolve := func(l *Entry, c *Change) (*Entry, error) {
+			r := &c.Entry
+			if bytes.Equal(encodeEntry(l), encodeEntry(r)) {
+				return l, nil
+			}
+			conflicts++
+
+			switch opts.Strategy {
+			case PreferRight:
+				return r, nil
+			case ConcatSenses:
+				l.merge(r)
+				return l, nil
+			case ReviewConflicts:
+				line, err := json.Marshal(MergeConflict{Word: l.Word, Source: source, Left: l, Right: r})
+				if err != nil {
+					return nil, err
+				}
+				_, err = review.Write(append(line, '\n'))
+				if err != nil {
+					return nil, fmt.Errorf("error writing review file: %v", err)
+				}
+			}
+
+			return l, nil
+		}
+
+		// Every source is merged into the result of the ones before it
+		mergedPath = filepath.Join(tempDir, fmt.Sprintf("merged-%d.jsonl", i+1))
+		err = mergeSource(mergedPath, left, entryChanges{right}, flags, resolve)
+		closeRight()
+		if err != nil {
+			return 0, fmt.Errorf("error merging %s: %v", source, err)
+		}
+
+		closeLeft()
+		left, closeLeft, err = openMergeSource(mergedPath, nil)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if review != nil {
+		err = review.Flush()
+		if err != nil {
+			return 0, fmt.Errorf("error writing review file: %v", err)
+		}
+	}
+
+	// The dictionary is built in the temp directory, so that its index.dat
+	// doesn't replace the one next to dictPath
+	newPath := filepath.Join(tempDir, dictFilename)
+	err = buildSorted(mergedPath, newPath, opts.Build)
+	if err != nil {
+		return 0, fmt.Errorf("error building merged dictionary: %v", err)
+	}
+
+	err = moveDict(newPath, dictPath)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("Merged %d sources into %s with %d conflicts", len(sources), filepath.Base(dictPath), conflicts)
+
+	return conflicts, nil
+}
+
+// mergeFlags returns the flags the keys of the sources are normalized with.
+// They are the ones of the dict.dat sources, which must all agree, and the
+// ones given by strip when all the sources are source files.
+func mergeFlags(sources []string, strip bool) (uint16, error) {
+	var flags uint16
+	if strip {
+		flags = FlagStripDiacritics
+	}
+
+	first := ""
+	for _, source := range sources {
+		h, ok, err := readMergeHeader(source)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			continue
+		}
+
+		keyFlags := h.Flags & FlagStripDiacritics
+		if first == "" {
+			if keyFlags != flags {
+				log.Printf("Normalizing the merged keys with the flags %#x of %s", keyFlags, source)
+			}
+			first, flags = source, keyFlags
+			continue
+		}
+		if keyFlags != flags {
+			return 0, fmt.Errorf("%w: the keys of %s are normalized with the flags %#x, the ones of %s with %#x",
+				ErrInvalidMerge, source, keyFlags, first, flags)
+		}
+	}
+
+	return flags, nil
+}
+
+// readMergeHeader reads the header of a dict.dat source. It returns false
+// for source files.
+func readMergeHeader(path string) (Header, bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Header{}, false, fmt.Errorf("error opening %s: %v", path, err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, HeaderSize)
+	_, err = io.ReadFull(f, buf)
+	if err != nil || string(buf[:len(magic)]) != magic {
+		return Header{}, false, nil
+	}
+
+	h, err := decodeHeader(buf)
+	if err != nil {
+		return Header{}, false, fmt.Errorf("error reading %s: %w", path, err)
+	}
+
+	return h, true, nil
+}
+
+// buildSorted builds the dictionary at dictPath from the source file at
+// path like Build, but the entries of the source are sorted by key and
+// unique, so they are streamed to the dictionary instead of being
+// collected and sorted in memory first
+func buildSorted(path, dictPath string, opts BuildOptions) error {
+	flags, aead, err := prepareBuild(&opts)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %v", filepath.Base(path), err)
+	}
+	defer f.Close()
+
+	dw, err := newDictWriter(dictPath, flags, opts, aead)
+	if err != nil {
+		return err
+	}
+	defer dw.close()
+
+	sr := newSourceReader(f, path)
+	for {
+		e, err := sr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", filepath.Base(path), err)
+		}
+
+		// Keys and headwords are stored with a 2 byte length in the index
+		key := NormalizeKey(e.Word, flags)
+		if len(e.Word) > maxWordLen || len(key) > maxWordLen {
+			log.Printf("Skipping word of %d bytes, longer than %d bytes", len(e.Word), maxWordLen)
+			continue
+		}
+
+		err = dw.add(key, e)
+		if err != nil {
+			return fmt.Errorf("error writing entries: %v", err)
+		}
+	}
+
+	return dw.finish()
+}
+
+// mergeSource writes the entries of left merged with the ones of right
+// into a JSON lines source file
+func mergeSource(path string, left entrySource, right changeReader, flags uint16, resolve func(l *Entry, c *Change) (*Entry, error)) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating source file: %v", err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+
+	err = mergeSortedFiles(w, right, left, flags, resolve, nil)
+	if err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// openMergeSource opens a dict.dat file, told apart by its magic, or a
+// source file for reading its entries in order. It returns the function
+// closing it.
+func openMergeSource(path string, opts []Option) (entrySource, func(), error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening %s: %v", path, err)
+	}
+
+	buf := make([]byte, len(magic))
+	_, err = io.ReadFull(f, buf)
+	if err != nil || string(buf) != magic {
+		// Not a dictionary, read it from the start as a source file
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+
+		return newSourceReader(f, path), func() { f.Close() }, nil
+	}
+	f.Close()
+
+	// Only the base file is read, the segments have to be compacted first
+	d, err := openFile(path, opts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening %s: %v", path, err)
+	}
+
+	return d.entries(), d.Close, nil
+}
+
+// entryChanges reads the entries of a source as changes, for merging them
+// like a changelog
+type entryChanges struct {
+	src entrySource
+}
+
+func (ec entryChanges) NextChange() (*Change, error) {
+	e, err := ec.src.Next()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Change{Entry: *e}, nil
+}
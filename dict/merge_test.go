@@ -0,0 +1,146 @@
+package dict
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	dir := t.TempDir()
+
+	// The first source is a dictionary, the others are sorted source files
+	left := buildVersion(t, dir, "left", "apple,a fruit\nbanana,a yellow fruit\n")
+	middle := filepath.Join(dir, "middle.dat")
+	if err := os.WriteFile(middle, []byte("Apple,a red fruit\ncherry,a small fruit\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	right := filepath.Join(dir, "right.jsonl")
+	if err := os.WriteFile(right, []byte(`{"word":"banana","senses":[{"definition":"a yellow fruit"}]}
+{"word":"date","senses":[{"definition":"a sweet fruit"}]}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sources := []string{left, middle, right}
+
+	tests := []struct {
+		strategy MergeStrategy
+		apple    string
+	}{
+		{PreferLeft, "a fruit"},
+		{PreferRight, "a red fruit"},
+		{ConcatSenses, "1. a fruit; 2. a red fruit"},
+		{ReviewConflicts, "a fruit"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.strategy), func(t *testing.T) {
+			dictPath := filepath.Join(t.TempDir(), dictFilename)
+			reviewPath := filepath.Join(t.TempDir(), "conflicts.jsonl")
+
+			// The identical bananas are no conflict
+			conflicts, err := Merge(sources, dictPath, MergeOptions{Strategy: tt.strategy, ReviewPath: reviewPath})
+			if err != nil || conflicts != 1 {
+				t.Fatalf("Merge() = %d, %v, want 1 conflict", conflicts, err)
+			}
+
+			d, err := Open(dictPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+
+			checkWords(t, d, map[string]string{
+				"apple":  tt.apple,
+				"banana": "a yellow fruit",
+				"cherry": "a small fruit",
+				"date":   "a sweet fruit",
+			})
+
+			if tt.strategy != ReviewConflicts {
+				return
+			}
+
+			f, err := os.Open(reviewPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			var c MergeConflict
+			sc := bufio.NewScanner(f)
+			for sc.Scan() {
+				if err := json.Unmarshal(sc.Bytes(), &c); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if c.Word != "apple" || c.Source != middle || c.Left.Definition() != "a fruit" || c.Right.Definition() != "a red fruit" {
+				t.Errorf("conflict = %+v", c)
+			}
+		})
+	}
+
+	unsorted := filepath.Join(dir, "unsorted.dat")
+	if err := os.WriteFile(unsorted, []byte("zebra,an animal\naardvark,an animal\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, srcs := range [][]string{{left, unsorted}, {unsorted, left}} {
+		if _, err := Merge(srcs, filepath.Join(dir, "unsorted-"+dictFilename), MergeOptions{Strategy: PreferLeft}); err == nil {
+			t.Errorf("Merge(%v) succeeded, want an unsorted source error", srcs)
+		}
+	}
+
+	if _, err := Merge([]string{left}, filepath.Join(dir, "one.dat"), MergeOptions{Strategy: PreferLeft}); !errors.Is(err, ErrInvalidMerge) {
+		t.Errorf("Merge() of a single source error = %v, want ErrInvalidMerge", err)
+	}
+	if _, err := Merge(sources, filepath.Join(dir, "bad.dat"), MergeOptions{Strategy: "newest"}); !errors.Is(err, ErrInvalidMerge) {
+		t.Errorf("Merge() with an unknown strategy error = %v, want ErrInvalidMerge", err)
+	}
+}
+
+func TestMergeFlags(t *testing.T) {
+	dir := t.TempDir()
+
+	plain := buildVersion(t, dir, "plain", "cafe,a coffee house\n")
+	src := filepath.Join(dir, "stripped.dat")
+	if err := os.WriteFile(src, []byte("café,a small restaurant\nécole,a school\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stripped := filepath.Join(dir, "stripped-"+dictFilename)
+	if err := Build(src, stripped, BuildOptions{StripDiacritics: true}); err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+
+	if _, err := Merge([]string{stripped, plain}, filepath.Join(dir, "mixed.dat"), MergeOptions{Strategy: PreferLeft}); !errors.Is(err, ErrInvalidMerge) {
+		t.Errorf("Merge() of sources with different flags error = %v, want ErrInvalidMerge", err)
+	}
+
+	// The keys are normalized like the ones of the dictionary source, so
+	// ecole is merged with école
+	right := filepath.Join(dir, "right.dat")
+	if err := os.WriteFile(right, []byte("ecole,a school\nzebra,an animal\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dictPath := filepath.Join(dir, "merged-"+dictFilename)
+	conflicts, err := Merge([]string{stripped, right}, dictPath, MergeOptions{Strategy: PreferLeft})
+	if err != nil || conflicts != 1 {
+		t.Fatalf("Merge() = %d, %v, want 1 conflict", conflicts, err)
+	}
+
+	d, err := Open(dictPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if d.Header().Flags&FlagStripDiacritics == 0 {
+		t.Errorf("flags = %#x, want FlagStripDiacritics", d.Header().Flags)
+	}
+	checkWords(t, d, map[string]string{
+		"cafe":  "a small restaurant",
+		"ecole": "a school",
+		"zebra": "an animal",
+	})
+}
@@ -0,0 +1,379 @@
+package dict
+
+// This file contains the memory mapped dictionary. The whole dict.dat is
+// mapped into memory and lookups work directly on the mapping: the sparse
+// index is binary searched in place, index keys are compared without being
+// copied into Go strings and definitions are returned as slices of the mapping.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+)
+
+// MmapDict is a dictionary backed by a memory mapped dict.dat
+type MmapDict struct {
+	data []byte
+	rd   *Reader
+
+	index section
+	// slots is the number of restart points of the sparse index
+	slots      int
+	slotsStart int64
+	keysStart  int64
+	// sparseEnd is the end of the sparse index in the mapping
+	sparseEnd int64
+}
+
+// OpenMmap maps the dictionary file at path into memory. Only the header and
+// the section table are parsed, the index stays in the mapping.
+func OpenMmap(path string, opts ...Option) (*MmapDict, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := mapFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("error mapping %s: %v", path, err)
+	}
+
+	m, err := newMmapDict(data, opts...)
+	if err != nil {
+		unmapFile(data)
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func newMmapDict(data []byte, opts ...Option) (*MmapDict, error) {
+	// The index is searched in the mapping, so the reader must not load it.
+	// Blocks of compressed dictionaries are still decompressed and cached by the reader.
+	opts = append(opts, WithLowMemory(false))
+
+	// Legacy dictionaries are converted by the reader, away from the mapping
+	if isLegacy(data[:min(len(data), HeaderSize)]) {
+		return nil, fmt.Errorf("%w: %w, migrate the dictionary to map it", ErrBadFormat, ErrLegacyFormat)
+	}
+
+	rd, err := NewReader(bytes.NewReader(data), int64(len(data)), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if rd.aead != nil {
+		return nil, fmt.Errorf("%w: the index of encrypted dictionaries can't be searched in the mapping, use Open", ErrBadFormat)
+	}
+
+	index, err := mappedSection(rd, data, sectionIndex)
+	if err != nil {
+		return nil, err
+	}
+	sparse, err := mappedSection(rd, data, sectionSparse)
+	if err != nil {
+		return nil, err
+	}
+	if sparse.Size < sparseHeaderSize {
+		return nil, fmt.Errorf("%w: truncated sparse index", ErrBadFormat)
+	}
+
+	m := &MmapDict{
+		data:       data,
+		rd:         rd,
+		index:      index,
+		slots:      int(binary.BigEndian.Uint32(data[sparse.Offset+12:])),
+		slotsStart: sparse.Offset + sparseHeaderSize,
+		sparseEnd:  sparse.Offset + sparse.Size,
+	}
+	m.keysStart = m.slotsStart + int64(m.slots+1)*sparseSlotSize
+
+	if m.keysStart > m.sparseEnd {
+		return nil, fmt.Errorf("%w: truncated sparse index", ErrBadFormat)
+	}
+
+	return m, nil
+}
+
+// mappedSection returns an index section the reader didn't read, checked
+// against the bounds of the index region and its checksum like the ones
+// read by readSection
+func mappedSection(rd *Reader, data []byte, kind uint32) (section, error) {
+	s, ok := rd.section(kind)
+	if !ok {
+		return section{}, fmt.Errorf("%w: missing section %d", ErrBadFormat, kind)
+	}
+
+	if s.Offset < HeaderSize || s.Size < 0 || s.Offset+s.Size > rd.header.IndexSize || s.Offset+s.Size > int64(len(data)) {
+		return section{}, fmt.Errorf("%w: section %d out of bounds", ErrBadFormat, kind)
+	}
+
+	if rd.checked {
+		err := rd.checkSection(kind, data[s.Offset:s.Offset+s.Size])
+		if err != nil {
+			return section{}, err
+		}
+	}
+
+	return s, nil
+}
+
+// Header returns the header of the dictionary
+func (m *MmapDict) Header() Header {
+	return m.rd.Header()
+}
+
+// Len returns the number of entries in the dictionary
+func (m *MmapDict) Len() int {
+	return m.rd.Len()
+}
+
+// slot returns the key and the index offset of restart point i as slices of the mapping
+func (m *MmapDict) slot(i int) ([]byte, int64, error) {
+	s := m.data[m.slotsStart+int64(i)*sparseSlotSize:]
+	offset := int64(binary.BigEndian.Uint64(s))
+	if i == m.slots {
+		return nil, offset, nil
+	}
+
+	st := binary.BigEndian.Uint64(s[8:])
+	en := binary.BigEndian.Uint64(s[8+sparseSlotSize:])
+	if st > en || en > uint64(m.sparseEnd-m.keysStart) {
+		return nil, 0, fmt.Errorf("%w: sparse key %d out of bounds", ErrBadFormat, i)
+	}
+
+	return m.data[m.keysStart+int64(st) : m.keysStart+int64(en)], offset, nil
+}
+
+// find returns the offset and the size of the encoded entry of the normalized key
+func (m *MmapDict) find(key string) (int64, int64, bool, error) {
+	// Last restart point whose key is <= key
+	var err error
+	i := sort.Search(m.slots, func(i int) bool {
+		k, _, kerr := m.slot(i)
+		if kerr != nil {
+			err = kerr
+			return true
+		}
+		return compareBytesString(k, key) > 0
+	}) - 1
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if i < 0 {
+		return 0, 0, false, nil
+	}
+
+	_, st, err := m.slot(i)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	_, en, err := m.slot(i + 1)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if st < 0 || st > en || en > m.index.Size {
+		return 0, 0, false, fmt.Errorf("%w: sparse index offset out of bounds", ErrBadFormat)
+	}
+
+	// Plain keys are compared in place, front coded ones are rebuilt in the decoder
+	d := indexDecoder{
+		buf:        m.data[m.index.Offset+st : m.index.Offset+en],
+		frontCoded: m.rd.header.Flags&FlagFrontCoded != 0,
+	}
+	for {
+		e, ok := d.next()
+		if !ok {
+			return 0, 0, false, d.err
+		}
+
+		switch c := compareBytesString(e.key, key); {
+		case c == 0:
+			return e.offset, e.size, true, nil
+		case c > 0:
+			return 0, 0, false, nil
+		}
+	}
+}
+
+// entryBytes returns the encoded entry of a word
+func (m *MmapDict) entryBytes(word string) ([]byte, bool) {
+	key := NormalizeKey(word, m.rd.header.Flags)
+	if !m.rd.mayContain(key) {
+		return nil, false
+	}
+
+	offset, size, ok, err := m.find(key)
+	if err != nil {
+		log.Printf("error reading definition: %v", err)
+		return nil, false
+	}
+	if !ok {
+		return nil, false
+	}
+
+	if m.rd.blocks != nil {
+		buf, err := m.rd.blockEntry(offset, size)
+		if err != nil {
+			return nil, false
+		}
+		return buf, true
+	}
+
+	if offset < 0 || size < 0 || size > int64(len(m.data))-offset {
+		return nil, false
+	}
+
+	return m.data[offset : offset+size], true
+}
+
+// QueryBytes returns the definition of a word as a slice of the mapping,
+// without copying it. The slice is only valid until Close and must not be
+// modified. Entries with several senses are flattened as by Entry.Definition,
+// which allocates.
+func (m *MmapDict) QueryBytes(word string) ([]byte, bool) {
+	buf, ok := m.entryBytes(word)
+	if !ok {
+		return nil, false
+	}
+
+	def, single, err := singleDefinition(buf)
+	if err != nil {
+		return nil, false
+	}
+	if single {
+		return def, true
+	}
+
+	e, err := decodeEntry(buf)
+	if err != nil {
+		return nil, false
+	}
+
+	return []byte(e.Definition()), true
+}
+
+// QueryWord queries the dictionary for a word and returns its definition
+func (m *MmapDict) QueryWord(word string) (string, bool) {
+	def, ok := m.QueryBytes(word)
+	if !ok {
+		return "", false
+	}
+
+	return string(def), true
+}
+
+// Lookup queries the dictionary for a word and returns its structured entry
+func (m *MmapDict) Lookup(word string) (*Entry, bool) {
+	buf, ok := m.entryBytes(word)
+	if !ok {
+		return nil, false
+	}
+
+	e, err := decodeEntry(buf)
+	if err != nil {
+		return nil, false
+	}
+
+	return e, true
+}
+
+// Keys calls fn with the key and the headword of every index entry in key
+// order, until fn returns false. Both are slices of the mapping, or of a
+// buffer reused for the next key with front coded indexes.
+func (m *MmapDict) Keys(fn func(key, word []byte) bool) {
+	d := newIndexDecoder(m.data[m.index.Offset:m.index.Offset+m.index.Size], m.rd.header.Flags)
+	for {
+		e, ok := d.next()
+		if !ok || !fn(e.key, e.word) {
+			return
+		}
+	}
+}
+
+// Close unmaps the dictionary file. Slices returned by QueryBytes and Keys
+// must not be used afterwards.
+func (m *MmapDict) Close() error {
+	if m.data == nil {
+		return nil
+	}
+
+	err := unmapFile(m.data)
+	m.data = nil
+
+	return err
+}
+
+// decodeIndexEntryBytes is the zero-copy variant of decodeIndexEntry. It
+// returns the key as a slice of buf along with the offset and the size of the
+// entry and the number of bytes the index entry takes, or 0 if it's corrupt.
+func decodeIndexEntryBytes(buf []byte) ([]byte, int64, int64, int) {
+	if len(buf) < 2 {
+		return nil, 0, 0, 0
+	}
+	kl := int(binary.BigEndian.Uint16(buf))
+
+	if len(buf) < 2+kl+2 {
+		return nil, 0, 0, 0
+	}
+	wl := int(binary.BigEndian.Uint16(buf[2+kl:]))
+
+	p := 2 + kl + 2 + wl
+	if len(buf) < p+8 {
+		return nil, 0, 0, 0
+	}
+	offset := int64(binary.BigEndian.Uint64(buf[p:]))
+
+	size, n := binary.Uvarint(buf[p+8:])
+	if n <= 0 {
+		return nil, 0, 0, 0
+	}
+
+	return buf[2 : 2+kl], offset, int64(size), p + 8 + n
+}
+
+// singleDefinition returns the definition of an encoded entry with a single
+// sense as a slice of buf. It reports false for entries with several senses.
+func singleDefinition(buf []byte) ([]byte, bool, error) {
+	d := entryDecoder{buf: buf}
+
+	// Skip the word, the pronunciation and the etymology
+	d.skip()
+	d.skip()
+	d.skip()
+
+	if n := d.count(); n != 1 || d.err != nil {
+		return nil, false, d.err
+	}
+
+	// Skip the part of speech
+	d.skip()
+
+	return d.bytes(), true, d.err
+}
+
+// compareBytesString compares b and s without converting b to a string
+func compareBytesString(b []byte, s string) int {
+	n := min(len(b), len(s))
+	for i := 0; i < n; i++ {
+		if b[i] != s[i] {
+			if b[i] < s[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	switch {
+	case len(b) < len(s):
+		return -1
+	case len(b) > len(s):
+		return 1
+	}
+
+	return 0
+}
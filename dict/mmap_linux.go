@@ -0,0 +1,25 @@
+package dict
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps the whole file into memory, read only
+func mapFile(f *os.File) ([]byte, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.Size() == 0 {
+		return nil, ErrBadFormat
+	}
+
+	return syscall.Mmap(int(f.Fd()), 0, int(fi.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// unmapFile releases a mapping created by mapFile
+func unmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
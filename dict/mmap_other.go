@@ -0,0 +1,19 @@
+//go:build !linux
+
+package dict
+
+import (
+	"io"
+	"os"
+)
+
+// mapFile reads the whole file into memory on platforms without mmap support.
+// Lookups are still zero-copy with respect to the buffer.
+func mapFile(f *os.File) ([]byte, error) {
+	return io.ReadAll(f)
+}
+
+// unmapFile is a no-op, the buffer is garbage collected
+func unmapFile(data []byte) error {
+	return nil
+}
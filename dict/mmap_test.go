@@ -0,0 +1,243 @@
+package dict
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// buildBenchDict builds a dictionary of n words into dir and returns its path
+func buildBenchDict(tb testing.TB, dir string, n int, opts BuildOptions) string {
+	tb.Helper()
+
+	var sb strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&sb, "word%06d,definition of the word number %d in the benchmark dictionary\n", i, i)
+	}
+
+	wordsPath := filepath.Join(dir, wordsFilename)
+	if err := os.WriteFile(wordsPath, []byte(sb.String()), 0644); err != nil {
+		tb.Fatal(err)
+	}
+
+	dictPath := filepath.Join(dir, dictFilename)
+	if err := Build(wordsPath, dictPath, opts); err != nil {
+		tb.Fatalf("Build() error = %v", err)
+	}
+
+	return dictPath
+}
+
+func TestMmapDict(t *testing.T) {
+	for _, opts := range []BuildOptions{{}, {Compress: true, BlockSize: 4096}} {
+		t.Run(fmt.Sprintf("compress=%v", opts.Compress), func(t *testing.T) {
+			dictPath := buildBenchDict(t, t.TempDir(), 500, opts)
+
+			m, err := OpenMmap(dictPath)
+			if err != nil {
+				t.Fatalf("OpenMmap() error = %v", err)
+			}
+			defer m.Close()
+
+			for _, i := range []int{0, 1, 250, 498, 499} {
+				word := fmt.Sprintf("WORD%06d", i)
+				expected := fmt.Sprintf("definition of the word number %d in the benchmark dictionary", i)
+
+				def, ok := m.QueryBytes(word)
+				if !ok || string(def) != expected {
+					t.Errorf("QueryBytes(%s) = %q, %v", word, def, ok)
+				}
+
+				e, ok := m.Lookup(word)
+				if !ok || e.Word != strings.ToLower(word) {
+					t.Errorf("Lookup(%s) = %v, %v", word, e, ok)
+				}
+			}
+
+			for _, word := range []string{"a", "word000500", "zzz"} {
+				if _, ok := m.QueryBytes(word); ok {
+					t.Errorf("QueryBytes(%s) found a missing word", word)
+				}
+			}
+
+			n := 0
+			prev := ""
+			m.Keys(func(key, word []byte) bool {
+				if string(key) <= prev {
+					t.Errorf("key %s is not after %s", key, prev)
+				}
+				prev = string(key)
+				n++
+				return true
+			})
+			if n != 500 {
+				t.Errorf("Keys() visited %d keys, want 500", n)
+			}
+		})
+	}
+}
+
+func TestMmapDictMultipleSenses(t *testing.T) {
+	dir := t.TempDir()
+	wordsPath := filepath.Join(dir, wordsFilename)
+	if err := os.WriteFile(wordsPath, []byte("abandon,to leave\nabandon,to give up\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dictPath := filepath.Join(dir, dictFilename)
+	if err := Build(wordsPath, dictPath, BuildOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := OpenMmap(dictPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	if def, ok := m.QueryWord("abandon"); !ok || def != "1. to leave; 2. to give up" {
+		t.Errorf("QueryWord() = %q, %v", def, ok)
+	}
+}
+
+// The benchmarks compare the ReadAt backed Dict with the memory mapped one:
+//
+//	go test ./dict -run XXX -bench Query -benchmem
+func benchmarkWords(n int) []string {
+	words := make([]string, 1024)
+	for i := range words {
+		words[i] = fmt.Sprintf("word%06d", (i*7919)%n)
+	}
+	return words
+}
+
+const benchDictSize = 100000
+
+func BenchmarkQueryWordReadAt(b *testing.B) {
+	dictPath := buildBenchDict(b, b.TempDir(), benchDictSize, BuildOptions{})
+	words := benchmarkWords(benchDictSize)
+
+	d, err := Open(dictPath)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer d.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := d.QueryWord(words[i%len(words)]); !ok {
+			b.Fatal("word not found")
+		}
+	}
+}
+
+func BenchmarkQueryWordMmap(b *testing.B) {
+	dictPath := buildBenchDict(b, b.TempDir(), benchDictSize, BuildOptions{})
+	words := benchmarkWords(benchDictSize)
+
+	m, err := OpenMmap(dictPath)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer m.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := m.QueryWord(words[i%len(words)]); !ok {
+			b.Fatal("word not found")
+		}
+	}
+}
+
+func BenchmarkQueryBytesMmap(b *testing.B) {
+	dictPath := buildBenchDict(b, b.TempDir(), benchDictSize, BuildOptions{})
+	words := benchmarkWords(benchDictSize)
+
+	m, err := OpenMmap(dictPath)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer m.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := m.QueryBytes(words[i%len(words)]); !ok {
+			b.Fatal("word not found")
+		}
+	}
+}
+
+func BenchmarkOpenReadAt(b *testing.B) {
+	dictPath := buildBenchDict(b, b.TempDir(), benchDictSize, BuildOptions{})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d, err := Open(dictPath)
+		if err != nil {
+			b.Fatal(err)
+		}
+		d.Close()
+	}
+}
+
+func BenchmarkOpenMmap(b *testing.B) {
+	dictPath := buildBenchDict(b, b.TempDir(), benchDictSize, BuildOptions{})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m, err := OpenMmap(dictPath)
+		if err != nil {
+			b.Fatal(err)
+		}
+		m.Close()
+	}
+}
+
+func TestMmapDictCorrupt(t *testing.T) {
+	dictPath := buildBenchDict(t, t.TempDir(), 500, BuildOptions{})
+	data, err := os.ReadFile(dictPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := newMmapDict(data)
+	if err != nil {
+		t.Fatalf("newMmapDict() error = %v", err)
+	}
+
+	// The index and sparse sections are checked when mapped
+	for _, kind := range []uint32{sectionIndex, sectionSparse} {
+		s, _ := m.rd.section(kind)
+		corrupt := append([]byte(nil), data...)
+		corrupt[s.Offset+s.Size-1] ^= 0xff
+		if _, err := newMmapDict(corrupt); !errors.Is(err, ErrChecksum) {
+			t.Errorf("newMmapDict() of a corrupt %s error = %v, want %v", checksumName(kind), err, ErrChecksum)
+		}
+	}
+
+	// Sparse keys out of bounds are reported rather than sliced
+	for i := 1; i <= m.slots; i++ {
+		binary.BigEndian.PutUint64(m.data[m.slotsStart+int64(i)*sparseSlotSize+8:], 1<<40)
+	}
+	if _, _, err := m.slot(1); !errors.Is(err, ErrBadFormat) {
+		t.Errorf("slot(1) error = %v, want %v", err, ErrBadFormat)
+	}
+	if _, _, err := m.slot(0); !errors.Is(err, ErrBadFormat) {
+		t.Errorf("slot(0) error = %v, want %v", err, ErrBadFormat)
+	}
+	if _, _, _, err := m.find("word000100"); !errors.Is(err, ErrBadFormat) {
+		t.Errorf("find() error = %v, want %v", err, ErrBadFormat)
+	}
+	if _, ok := m.Lookup("word000100"); ok {
+		t.Error("Lookup() through a corrupt sparse index succeeded")
+	}
+}
@@ -0,0 +1,287 @@
+package dict
+
+// This file contains the minimal perfect hash index, selected by
+// FlagPerfectHash in the header.
+//
+// The perfect hash function maps each of the n keys of the dictionary to a
+// distinct slot in [0, n), following BBHash: every key is hashed into a bit
+// array of the first level, keys colliding with another key move on to the
+// next level and so on. The slot of a key is the rank of its bit across the
+// concatenated levels. Since the function maps any string to some slot,
+// each slot stores a fingerprint of its key to reject most misses and the
+// offset of the index entry to confirm the rest.
+//
+// The hash section is stored as:
+//
+//	<key count (8 bytes)><level count (4 bytes)><level count x <words (4 bytes)>>
+//	<bits of all levels (8 bytes per word)>
+//	<key count x <fingerprint (4 bytes)><index entry offset (4 bytes)>>
+//
+// Index entry offsets are relative to the index section. Front coded entries
+// can't be decoded on their own, their slots hold the offset of the restart
+// point of their run instead. Keeping the raw
+// index section and the hash in memory takes a fraction of the memory of a
+// map and needs no decoding at startup.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+const (
+	// mphGamma trades space for build time, BBHash uses 2 by default
+	mphGamma = 2.0
+	// mphMaxLevels bounds the levels, about 40% of the keys move on to the
+	// next level so few dictionaries need more than 30
+	mphMaxLevels = 64
+
+	mphSlotSize = 8
+)
+
+// errHashCollision is returned when two keys have the same 64 bit hash and
+// can't be told apart by the perfect hash function
+var errHashCollision = errors.New("keys with colliding hashes")
+
+// mphf is a minimal perfect hash function
+type mphf struct {
+	n int
+	// levels holds the bit array of every level
+	levels [][]uint64
+	// ranks holds the number of bits set before every word of every level
+	ranks [][]uint64
+}
+
+// mphPos returns the position of a key hash in a level of the given number of bits
+func mphPos(h uint64, level int, m uint64) uint64 {
+	// Each level needs an independent hash, mix the key hash with the level
+	h ^= uint64(level+1) * 0x9e3779b97f4a7c15
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	return h % m
+}
+
+// buildMphf builds the perfect hash function of the key hashes
+func buildMphf(hashes []uint64) (*mphf, error) {
+	f := &mphf{n: len(hashes)}
+
+	keys := hashes
+	for level := 0; len(keys) > 0; level++ {
+		if level == mphMaxLevels {
+			return nil, errHashCollision
+		}
+
+		words := uint64(math.Ceil(mphGamma * float64(len(keys)) / 64))
+		m := words * 64
+
+		set := make([]uint64, words)
+		collided := make([]uint64, words)
+
+		for _, h := range keys {
+			p := mphPos(h, level, m)
+			w, b := p/64, uint64(1)<<(p%64)
+
+			if set[w]&b != 0 {
+				collided[w] |= b
+			}
+			set[w] |= b
+		}
+
+		// Keys colliding at this level move on to the next one
+		var next []uint64
+		for _, h := range keys {
+			p := mphPos(h, level, m)
+			if collided[p/64]&(1<<(p%64)) != 0 {
+				next = append(next, h)
+			}
+		}
+
+		for i := range set {
+			set[i] &^= collided[i]
+		}
+
+		f.levels = append(f.levels, set)
+		keys = next
+	}
+
+	f.computeRanks()
+
+	return f, nil
+}
+
+// computeRanks counts the bits set before every word
+func (f *mphf) computeRanks() {
+	var rank uint64
+
+	f.ranks = make([][]uint64, len(f.levels))
+	for l, level := range f.levels {
+		f.ranks[l] = make([]uint64, len(level))
+		for i, w := range level {
+			f.ranks[l][i] = rank
+			rank += uint64(bits.OnesCount64(w))
+		}
+	}
+}
+
+// slot returns the slot of a key hash. Keys that were not part of the build
+// either get false or the slot of some other key.
+func (f *mphf) slot(h uint64) (int, bool) {
+	for l, level := range f.levels {
+		m := uint64(len(level)) * 64
+		p := mphPos(h, l, m)
+		w, b := p/64, p%64
+
+		if level[w]&(1<<b) != 0 {
+			// Bits set before p in this word
+			below := level[w] & (1<<b - 1)
+			return int(f.ranks[l][w]) + bits.OnesCount64(below), true
+		}
+	}
+
+	return 0, false
+}
+
+// mphFingerprint returns the fingerprint stored in the slot of a key
+func mphFingerprint(h2 uint64) uint32 {
+	return uint32(h2 >> 32)
+}
+
+// encodeHashIndex builds the hash section for the index entries. offsets
+// holds the offset of every index entry relative to the index section.
+func encodeHashIndex(entries []IndexEntry, offsets []int64) ([]byte, error) {
+	hashes := make([]uint64, len(entries))
+	for i, idxe := range entries {
+		hashes[i], _ = bloomHash(idxe.Key)
+	}
+
+	f, err := buildMphf(hashes)
+	if err != nil {
+		return nil, err
+	}
+
+	slots := make([]byte, len(entries)*mphSlotSize)
+	for i, idxe := range entries {
+		if offsets[i] > math.MaxUint32 {
+			return nil, fmt.Errorf("index entry at %d is out of reach of the perfect hash index", offsets[i])
+		}
+
+		h1, h2 := bloomHash(idxe.Key)
+		s, _ := f.slot(h1)
+
+		slot := slots[s*mphSlotSize:]
+		binary.BigEndian.PutUint32(slot, mphFingerprint(h2))
+		binary.BigEndian.PutUint32(slot[4:], uint32(offsets[i]))
+	}
+
+	buf := binary.BigEndian.AppendUint64(nil, uint64(len(entries)))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(f.levels)))
+	for _, level := range f.levels {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(level)))
+	}
+	for _, level := range f.levels {
+		for _, w := range level {
+			buf = binary.BigEndian.AppendUint64(buf, w)
+		}
+	}
+
+	return append(buf, slots...), nil
+}
+
+// hashIndex looks keys up with the perfect hash function in the raw index section
+type hashIndex struct {
+	f     *mphf
+	slots []byte
+	index []byte
+	flags uint16
+}
+
+// newHashIndex parses the hash section over the raw index section
+func newHashIndex(index, buf []byte, flags uint16) (*hashIndex, error) {
+	errCorrupt := fmt.Errorf("%w: corrupt perfect hash index", ErrBadFormat)
+
+	if len(buf) < 12 {
+		return nil, errCorrupt
+	}
+
+	n := binary.BigEndian.Uint64(buf)
+	levels := int(binary.BigEndian.Uint32(buf[8:]))
+	buf = buf[12:]
+
+	if levels > mphMaxLevels || len(buf) < 4*levels {
+		return nil, errCorrupt
+	}
+
+	f := &mphf{n: int(n), levels: make([][]uint64, levels)}
+
+	words := make([]int, levels)
+	for l := range words {
+		words[l] = int(binary.BigEndian.Uint32(buf[4*l:]))
+	}
+	buf = buf[4*levels:]
+
+	for l := range f.levels {
+		if len(buf) < 8*words[l] || words[l] == 0 {
+			return nil, errCorrupt
+		}
+
+		f.levels[l] = make([]uint64, words[l])
+		for i := range f.levels[l] {
+			f.levels[l][i] = binary.BigEndian.Uint64(buf[8*i:])
+		}
+		buf = buf[8*words[l]:]
+	}
+
+	if uint64(len(buf)) != n*mphSlotSize {
+		return nil, errCorrupt
+	}
+
+	f.computeRanks()
+
+	return &hashIndex{f: f, slots: buf, index: index, flags: flags}, nil
+}
+
+func (hi *hashIndex) lookup(key string) (IndexEntry, bool, error) {
+	h1, h2 := bloomHash(key)
+
+	s, ok := hi.f.slot(h1)
+	if !ok || s >= hi.f.n {
+		return IndexEntry{}, false, nil
+	}
+
+	slot := hi.slots[s*mphSlotSize:]
+	if binary.BigEndian.Uint32(slot) != mphFingerprint(h2) {
+		return IndexEntry{}, false, nil
+	}
+
+	// The fingerprint matches, compare the key itself
+	offset := int(binary.BigEndian.Uint32(slot[4:]))
+	if offset >= len(hi.index) {
+		return IndexEntry{}, false, fmt.Errorf("%w: corrupt perfect hash index", ErrBadFormat)
+	}
+
+	// Decode the entry, or its run up to the next restart point
+	d := newIndexDecoder(hi.index[offset:], hi.flags)
+	for first := true; ; first = false {
+		e, ok := d.next()
+		if !ok || (e.restart && !first) {
+			break
+		}
+
+		c := compareBytesString(e.key, key)
+		if c == 0 {
+			return e.entry(), true, nil
+		}
+		if c > 0 {
+			break
+		}
+	}
+
+	return IndexEntry{}, false, d.err
+}
+
+func (hi *hashIndex) len() int {
+	return hi.f.n
+}
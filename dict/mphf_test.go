@@ -0,0 +1,113 @@
+package dict
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMphf(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 100, 10000} {
+		t.Run(fmt.Sprintf("n=%d", n), func(t *testing.T) {
+			hashes := make([]uint64, n)
+			for i := range hashes {
+				hashes[i], _ = bloomHash(fmt.Sprintf("word%d", i))
+			}
+
+			f, err := buildMphf(hashes)
+			if err != nil {
+				t.Fatalf("buildMphf() error = %v", err)
+			}
+
+			// Every key gets a distinct slot in [0, n)
+			seen := make([]bool, n)
+			for _, h := range hashes {
+				s, ok := f.slot(h)
+				if !ok || s < 0 || s >= n {
+					t.Fatalf("slot() = %d, %v, want a slot below %d", s, ok, n)
+				}
+				if seen[s] {
+					t.Fatalf("slot %d is taken twice", s)
+				}
+				seen[s] = true
+			}
+		})
+	}
+}
+
+func TestBuildMphfCollision(t *testing.T) {
+	if _, err := buildMphf([]uint64{42, 42}); err != errHashCollision {
+		t.Errorf("buildMphf() error = %v, want %v", err, errHashCollision)
+	}
+}
+
+func TestPerfectHashDict(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%v", compress), func(t *testing.T) {
+			dictPath := buildBenchDict(t, t.TempDir(), 2000, BuildOptions{Compress: compress, PerfectHash: true})
+
+			d, err := Open(dictPath)
+			if err != nil {
+				t.Fatalf("Open() error = %v", err)
+			}
+			defer d.Close()
+
+			if d.Header().Flags&FlagPerfectHash == 0 {
+				t.Fatal("FlagPerfectHash is not set")
+			}
+			if _, ok := d.rd.index.(*hashIndex); !ok {
+				t.Fatalf("index is a %T, want a *hashIndex", d.rd.index)
+			}
+			if d.Len() != 2000 {
+				t.Errorf("Len() = %d, want 2000", d.Len())
+			}
+
+			for i := 0; i < 2000; i++ {
+				word := fmt.Sprintf("Word%06d", i)
+				expected := fmt.Sprintf("definition of the word number %d in the benchmark dictionary", i)
+				if def, ok := d.QueryWord(word); !ok || def != expected {
+					t.Fatalf("QueryWord(%s) = %q, %v", word, def, ok)
+				}
+			}
+
+			// Misses land in the slot of some other key
+			for i := 0; i < 2000; i++ {
+				word := fmt.Sprintf("missing%06d", i)
+				if _, ok, err := d.rd.Lookup(word); ok || err != nil {
+					t.Fatalf("Lookup(%s) = %v, %v", word, ok, err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkOpenPerfectHash(b *testing.B) {
+	dictPath := buildBenchDict(b, b.TempDir(), benchDictSize, BuildOptions{PerfectHash: true})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d, err := Open(dictPath)
+		if err != nil {
+			b.Fatal(err)
+		}
+		d.Close()
+	}
+}
+
+func BenchmarkQueryWordPerfectHash(b *testing.B) {
+	dictPath := buildBenchDict(b, b.TempDir(), benchDictSize, BuildOptions{PerfectHash: true})
+	words := benchmarkWords(benchDictSize)
+
+	d, err := Open(dictPath)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer d.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := d.QueryWord(words[i%len(words)]); !ok {
+			b.Fatal("word not found")
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package dict
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// NormalizeKey returns the lookup key for a headword. Keys are NFC
+// normalized and case folded, so that "Abandon", "ABANDON" and decomposed
+// accented spellings all map to the same key. If flags has
+// FlagStripDiacritics set, combining marks are removed as well ("café" -> "cafe").
+//
+// The same function is applied at build time and at query time, hence
+// callers should pass the flags from the dictionary header.
+func NormalizeKey(word string, flags uint16) string {
+	// Fast path for ASCII words, which are already in NFC and have no diacritics
+	if isASCII(word) {
+		return strings.ToLower(word)
+	}
+
+	key := word
+
+	if flags&FlagStripDiacritics != 0 {
+		// Decompose so that accents become separate combining marks, then drop them
+		t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)))
+		stripped, _, err := transform.String(t, key)
+		if err == nil {
+			key = stripped
+		}
+	}
+
+	// Casers are stateful, so a new one is created for every call
+	key = cases.Fold().String(norm.NFC.String(key))
+
+	// Folding may produce decomposed sequences, normalize once more
+	return norm.NFC.String(key)
+}
+
+// isASCII reports whether s only holds ASCII characters
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
+}
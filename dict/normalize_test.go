@@ -0,0 +1,84 @@
+package dict
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNormalizeKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		word     string
+		flags    uint16
+		expected string
+	}{
+		{name: "lower case", word: "abandon", expected: "abandon"},
+		{name: "title case", word: "Abandon", expected: "abandon"},
+		{name: "upper case", word: "ABANDON", expected: "abandon"},
+		{name: "composed accent", word: "Caf\u00e9", expected: "caf\u00e9"},
+		{name: "decomposed accent", word: "Cafe\u0301", expected: "caf\u00e9"},
+		{name: "sharp s folds", word: "Straße", expected: "strasse"},
+		{name: "greek", word: "ΣΟΦΙΑ", expected: "σοφια"},
+		{name: "strip diacritics", word: "Café", flags: FlagStripDiacritics, expected: "cafe"},
+		{name: "strip diacritics composed", word: "Naïve", flags: FlagStripDiacritics, expected: "naive"},
+		{name: "colon is kept", word: "re:Invent", expected: "re:invent"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := NormalizeKey(tt.word, tt.flags)
+			if result != tt.expected {
+				t.Errorf("NormalizeKey(%q) = %q, want %q", tt.word, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestQueryNonASCIIWords(t *testing.T) {
+	dir := t.TempDir()
+	wordsPath := filepath.Join(dir, wordsFilename)
+	dictPath := filepath.Join(dir, dictFilename)
+
+	words := "Abandon,to desert something or someplace\n" +
+		"caf\u00e9,a small restaurant\n" +
+		"re:Invent,a conference, held yearly\n" +
+		"über,above\n"
+
+	if err := os.WriteFile(wordsPath, []byte(words), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		opts     BuildOptions
+		query    string
+		expected string
+		found    bool
+	}{
+		{name: "case insensitive", query: "ABANDON", expected: "to desert something or someplace", found: true},
+		{name: "decomposed query", query: "CAFE\u0301", expected: "a small restaurant", found: true},
+		{name: "colon in key", query: "re:invent", expected: "a conference, held yearly", found: true},
+		{name: "accents required", query: "uber", found: false},
+		{name: "accents stripped", opts: BuildOptions{StripDiacritics: true}, query: "UBER", expected: "above", found: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Build(wordsPath, dictPath, tt.opts); err != nil {
+				t.Fatalf("Build() error = %v", err)
+			}
+
+			d, err := Open(dictPath)
+			if err != nil {
+				t.Fatalf("Open() error = %v", err)
+			}
+			defer d.Close()
+
+			def, ok := d.QueryWord(tt.query)
+			if ok != tt.found || def != tt.expected {
+				t.Errorf("QueryWord(%q) = %q, %v, want %q, %v", tt.query, def, ok, tt.expected, tt.found)
+			}
+		})
+	}
+}
@@ -0,0 +1,388 @@
+package dict
+
+// This file contains the editorial review of changes. Lexicographers submit
+// proposals to add, update or delete a word, reviewers comment on them and
+// approve or reject them. Proposals are stored as JSON files, one per
+// proposal, in the proposals directory:
+//
+//	proposals/3f2a9c1e0b7d4a6f.json
+//
+// The approved proposals are batched into a sorted changelog.jsonl and
+// applied with UpdateDict, see ApplyProposals.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proposalsDirname is the directory of the proposal store in the root directory
+const proposalsDirname = "proposals"
+
+// ProposalOp is the change a proposal makes
+type ProposalOp string
+
+const (
+	OpAdd    ProposalOp = "add"
+	OpUpdate ProposalOp = "update"
+	OpDelete ProposalOp = "delete"
+)
+
+// ProposalStatus is the state of a proposal in the review
+type ProposalStatus string
+
+const (
+	StatusPending  ProposalStatus = "pending"
+	StatusApproved ProposalStatus = "approved"
+	StatusRejected ProposalStatus = "rejected"
+	// StatusApplied proposals were approved and applied by ApplyProposals
+	StatusApplied ProposalStatus = "applied"
+)
+
+var (
+	// ErrProposalNotFound is returned for unknown proposal ids
+	ErrProposalNotFound = errors.New("proposal not found")
+	// ErrProposalClosed is returned when reviewing a proposal that's no longer pending
+	ErrProposalClosed = errors.New("proposal is not pending")
+)
+
+// Proposal is a proposed change along with its review
+type Proposal struct {
+	ID string     `json:"id"`
+	Op ProposalOp `json:"op"`
+	// Entry is the proposed entry, only its word is set for deletes
+	Entry    Entry          `json:"entry"`
+	Author   string         `json:"author"`
+	Reason   string         `json:"reason,omitempty"`
+	Status   ProposalStatus `json:"status"`
+	Reviewer string         `json:"reviewer,omitempty"`
+	Comments []Comment      `json:"comments,omitempty"`
+	Created  time.Time      `json:"created"`
+	Updated  time.Time      `json:"updated"`
+	// Reviewed is the time of the approval or the rejection
+	Reviewed *time.Time `json:"reviewed,omitempty"`
+}
+
+// Comment is a remark on a proposal
+type Comment struct {
+	Author string    `json:"author"`
+	Text   string    `json:"text"`
+	Time   time.Time `json:"time"`
+}
+
+// Change returns the change the proposal makes, audited with its author
+// and reason at the time it was approved
+func (p *Proposal) Change() Change {
+	return Change{
+		Entry:   p.Entry,
+		Deleted: p.Op == OpDelete,
+		Audit:   Audit{Author: p.Author, Reason: p.Reason, Timestamp: p.Reviewed},
+	}
+}
+
+// ProposalStore keeps the proposals as JSON files in a directory
+type ProposalStore struct {
+	dir string
+	// mu serializes the updates of the proposals
+	mu sync.Mutex
+}
+
+// NewProposalStore opens the proposal store in the proposals directory
+func NewProposalStore() (*ProposalStore, error) {
+	return OpenProposalStore(proposalsDirname)
+}
+
+// OpenProposalStore opens the proposal store in dir, creating it if needed
+func OpenProposalStore(dir string) (*ProposalStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("error creating proposals directory: %v", err)
+	}
+
+	return &ProposalStore{dir: dir}, nil
+}
+
+// path returns the path of the file of a proposal
+func (ps *ProposalStore) path(id string) string {
+	return filepath.Join(ps.dir, id+".json")
+}
+
+// write writes the proposal, replacing the old file at once
+func (ps *ProposalStore) write(p *Proposal) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := ps.path(p.ID)
+	tmpPath := path + ".tmp"
+	err = os.WriteFile(tmpPath, append(data, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing proposal: %v", err)
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// Get returns the proposal with the given id
+func (ps *ProposalStore) Get(id string) (*Proposal, error) {
+	// Ids are hex, anything else could point out of the directory
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		return nil, ErrProposalNotFound
+	}
+
+	data, err := os.ReadFile(ps.path(id))
+	if os.IsNotExist(err) {
+		return nil, ErrProposalNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading proposal: %v", err)
+	}
+
+	var p Proposal
+	err = json.Unmarshal(data, &p)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed proposal %s: %v", ErrBadFormat, id, err)
+	}
+
+	return &p, nil
+}
+
+// List returns the proposals with the given status, all of them if it's
+// empty, the oldest first
+func (ps *ProposalStore) List(status ProposalStatus) ([]*Proposal, error) {
+	files, err := os.ReadDir(ps.dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading proposals: %v", err)
+	}
+
+	proposals := []*Proposal{}
+	for _, f := range files {
+		id, ok := strings.CutSuffix(f.Name(), ".json")
+		if !ok {
+			continue
+		}
+
+		p, err := ps.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		if status == "" || p.Status == status {
+			proposals = append(proposals, p)
+		}
+	}
+
+	sort.Slice(proposals, func(i, j int) bool {
+		return proposals[i].Created.Before(proposals[j].Created)
+	})
+
+	return proposals, nil
+}
+
+// Submit validates the proposal and stores it as pending. It sets the id,
+// the status and the times of the proposal.
+func (ps *ProposalStore) Submit(p *Proposal) error {
+	switch p.Op {
+	case OpAdd, OpUpdate, OpDelete:
+	default:
+		return fmt.Errorf("%w: unknown op %q", ErrInvalidChange, p.Op)
+	}
+	if p.Author == "" {
+		return fmt.Errorf("%w: missing author", ErrInvalidChange)
+	}
+	if p.Op == OpDelete {
+		p.Entry = Entry{Word: p.Entry.Word}
+	}
+
+	c := p.Change()
+	err := c.validate()
+	if err != nil {
+		return err
+	}
+	p.Entry.numberSenses()
+
+	id := make([]byte, 8)
+	_, err = rand.Read(id)
+	if err != nil {
+		return fmt.Errorf("error generating proposal id: %v", err)
+	}
+
+	p.ID = hex.EncodeToString(id)
+	p.Status = StatusPending
+	p.Reviewer = ""
+	p.Reviewed = nil
+	p.Comments = nil
+	p.Created = time.Now().UTC()
+	p.Updated = p.Created
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	return ps.write(p)
+}
+
+// update applies fn to the proposal with the given id and stores it
+func (ps *ProposalStore) update(id string, fn func(p *Proposal) error) (*Proposal, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	p, err := ps.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fn(p)
+	if err != nil {
+		return nil, err
+	}
+	p.Updated = time.Now().UTC()
+
+	err = ps.write(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Comment adds a comment to the proposal with the given id
+func (ps *ProposalStore) Comment(id, author, text string) (*Proposal, error) {
+	if author == "" || text == "" {
+		return nil, fmt.Errorf("%w: comments need an author and a text", ErrInvalidChange)
+	}
+
+	return ps.update(id, func(p *Proposal) error {
+		p.Comments = append(p.Comments, Comment{Author: author, Text: text, Time: time.Now().UTC()})
+		return nil
+	})
+}
+
+// Approve approves the pending proposal with the given id
+func (ps *ProposalStore) Approve(id, reviewer string) (*Proposal, error) {
+	return ps.review(id, reviewer, StatusApproved)
+}
+
+// Reject rejects the pending proposal with the given id
+func (ps *ProposalStore) Reject(id, reviewer string) (*Proposal, error) {
+	return ps.review(id, reviewer, StatusRejected)
+}
+
+// review closes the review of the pending proposal with the given status
+func (ps *ProposalStore) review(id, reviewer string, status ProposalStatus) (*Proposal, error) {
+	if reviewer == "" {
+		return nil, fmt.Errorf("%w: missing reviewer", ErrInvalidChange)
+	}
+
+	return ps.update(id, func(p *Proposal) error {
+		if p.Status != StatusPending {
+			return fmt.Errorf("%w: %s is %s", ErrProposalClosed, p.ID, p.Status)
+		}
+
+		p.Status = status
+		p.Reviewer = reviewer
+		now := time.Now().UTC()
+		p.Reviewed = &now
+		return nil
+	})
+}
+
+// ApplyProposals batches the approved proposals into a changelog.jsonl
+// sorted by word and applies it with UpdateDict. Of several proposals for
+// the same word, the last approved one wins. The applied proposals are
+// marked as such. It returns the number of applied proposals.
+func ApplyProposals(ps *ProposalStore) (int, error) {
+	approved, err := ps.List(StatusApproved)
+	if err != nil {
+		return 0, err
+	}
+	if len(approved) == 0 {
+		return 0, nil
+	}
+
+	if _, err := os.Stat(changelogFilename()); err == nil {
+		return 0, fmt.Errorf("%s exists, apply it with UpdateDict first", changelogFilename())
+	}
+
+	flags, err := dictFlags()
+	if err != nil {
+		return 0, err
+	}
+
+	// The last approved proposal of a word wins. Keys are normalized like
+	// the ones of the dictionary.
+	sort.Slice(approved, func(i, j int) bool {
+		return approved[i].Reviewed.Before(*approved[j].Reviewed)
+	})
+
+	byKey := make(map[string]Change)
+	for _, p := range approved {
+		byKey[NormalizeKey(p.Entry.Word, flags)] = p.Change()
+	}
+
+	keys := make([]string, 0, len(byKey))
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	changes := make([]Change, len(keys))
+	for i, key := range keys {
+		changes[i] = byKey[key]
+	}
+
+	err = writeChangelog(jsonlChglogFilename, changes)
+	if err != nil {
+		return 0, err
+	}
+
+	err = UpdateDict()
+	if err != nil {
+		// Leave nothing behind for the next attempt
+		os.Remove(jsonlChglogFilename)
+		return 0, err
+	}
+
+	for _, p := range approved {
+		_, err = ps.update(p.ID, func(p *Proposal) error {
+			p.Status = StatusApplied
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	log.Printf("Applied %d proposals", len(approved))
+
+	return len(approved), nil
+}
+
+// dictFlags returns the header flags of dict.dat, or of the shards of
+// manifest.json if the dictionary is sharded
+func dictFlags() (uint16, error) {
+	path := dictFilename
+	if ManifestExists() {
+		m, err := ReadManifest(manifestFilename)
+		if err != nil {
+			return 0, err
+		}
+		path = m.Shards[0].Path
+	}
+
+	f, rd, err := openRaw(path)
+	if err != nil {
+		return 0, fmt.Errorf("error opening %s: %v", path, err)
+	}
+	f.Close()
+
+	return rd.header.Flags, nil
+}
@@ -0,0 +1,135 @@
+package dict
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+// chdir changes the working directory for the rest of the test
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+	})
+}
+
+func TestProposals(t *testing.T) {
+	dir := t.TempDir()
+	buildBenchDict(t, dir, 100, BuildOptions{})
+	chdir(t, dir)
+
+	ps, err := NewProposalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	submit := func(op ProposalOp, word, def string) *Proposal {
+		t.Helper()
+
+		p := &Proposal{Op: op, Author: "lex", Entry: Entry{Word: word}}
+		if def != "" {
+			p.Entry.Senses = []Sense{{Definition: def}}
+		}
+		if err := ps.Submit(p); err != nil {
+			t.Fatalf("Submit() error = %v", err)
+		}
+		return p
+	}
+
+	update := submit(OpUpdate, "word000010", "updated 10")
+	add := submit(OpAdd, "aardvark", "an animal")
+	del := submit(OpDelete, "word000020", "")
+	rejected := submit(OpUpdate, "word000030", "rejected 30")
+	pending := submit(OpUpdate, "word000040", "pending 40")
+
+	for _, p := range []*Proposal{
+		{Op: "rename", Author: "lex", Entry: Entry{Word: "a", Senses: []Sense{{Definition: "a"}}}},
+		{Op: OpAdd, Entry: Entry{Word: "a", Senses: []Sense{{Definition: "a"}}}},
+		{Op: OpUpdate, Author: "lex", Entry: Entry{Word: "a"}},
+	} {
+		if err := ps.Submit(p); !errors.Is(err, ErrInvalidChange) {
+			t.Errorf("Submit(%+v) error = %v, want %v", p, err, ErrInvalidChange)
+		}
+	}
+
+	if _, err := ps.Comment(update.ID, "rev", "looks good"); err != nil {
+		t.Fatalf("Comment() error = %v", err)
+	}
+	for _, p := range []*Proposal{update, add, del} {
+		if _, err := ps.Approve(p.ID, "rev"); err != nil {
+			t.Fatalf("Approve() error = %v", err)
+		}
+	}
+	if _, err := ps.Reject(rejected.ID, "rev"); err != nil {
+		t.Fatalf("Reject() error = %v", err)
+	}
+	if _, err := ps.Approve(rejected.ID, "rev"); !errors.Is(err, ErrProposalClosed) {
+		t.Errorf("Approve() of a rejected proposal error = %v, want %v", err, ErrProposalClosed)
+	}
+	if _, err := ps.Get("../dict"); !errors.Is(err, ErrProposalNotFound) {
+		t.Errorf("Get(../dict) error = %v, want %v", err, ErrProposalNotFound)
+	}
+
+	p, err := ps.Get(update.ID)
+	if err != nil || len(p.Comments) != 1 || p.Status != StatusApproved || p.Reviewer != "rev" {
+		t.Errorf("Get() = %+v, %v", p, err)
+	}
+
+	all, _ := ps.List("")
+	if len(all) != 5 || all[0].ID != update.ID {
+		t.Errorf("List() = %d proposals", len(all))
+	}
+
+	n, err := ApplyProposals(ps)
+	if err != nil || n != 3 {
+		t.Fatalf("ApplyProposals() = %d, %v, want 3", n, err)
+	}
+
+	d, err := Open(dictFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	checkWords(t, d, map[string]string{
+		"word000010": "updated 10",
+		"aardvark":   "an animal",
+		"word000020": "",
+		"word000030": "definition of the word number 30 in the benchmark dictionary",
+		"word000040": "definition of the word number 40 in the benchmark dictionary",
+	})
+	if d.Len() != 100 {
+		t.Errorf("Len() = %d, want 100", d.Len())
+	}
+
+	// The audit trail names the author of the proposal
+	trail, err := AuditTrail("aardvark")
+	if err != nil || len(trail) != 1 || trail[0].Author != "lex" || trail[0].Op != OpAdd {
+		t.Errorf("AuditTrail(aardvark) = %+v, %v", trail, err)
+	}
+
+	applied, _ := ps.List(StatusApplied)
+	left, _ := ps.List(StatusPending)
+	if len(applied) != 3 || len(left) != 1 || left[0].ID != pending.ID {
+		t.Errorf("%d applied and %d pending proposals, want 3 and 1", len(applied), len(left))
+	}
+
+	// Deleting a word that's gone fails without touching the dictionary
+	again := submit(OpDelete, "word000020", "")
+	ps.Approve(again.ID, "rev")
+	if _, err := ApplyProposals(ps); err == nil {
+		t.Errorf("ApplyProposals() deleting a missing word succeeded")
+	}
+	if _, err := os.Stat(jsonlChglogFilename); !os.IsNotExist(err) {
+		t.Errorf("changelog left behind by a failed ApplyProposals()")
+	}
+}
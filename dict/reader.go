@@ -0,0 +1,503 @@
+package dict
+
+// This file contains the reader shared by the local and the S3 backed
+// dictionaries. It only needs an io.ReaderAt over the dict.dat image.
+
+import (
+	"crypto/cipher"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Option configures a Reader
+type Option func(*options)
+
+type options struct {
+	blockCacheSize int
+	lowMemory      bool
+	sparseSample   bool
+	// raw skips the checksums and the index, for corrupt dictionaries
+	raw bool
+	// encryptionKey decrypts encrypted dictionaries, see crypt.go
+	encryptionKey []byte
+	// publicKeys verify the signatures of the files opened, see sign.go
+	publicKeys []ed25519.PublicKey
+	// shard is checked against the digest of the shard file opened, see
+	// OpenSharded
+	shard *ShardInfo
+}
+
+// WithBlockCacheSize sets the number of decompressed blocks kept in memory
+// for dictionaries built with compression. Zero disables the cache.
+func WithBlockCacheSize(n int) Option {
+	return func(o *options) {
+		o.blockCacheSize = n
+	}
+}
+
+// WithLowMemory keeps the index on disk (or in S3) instead of loading it into
+// a map. Lookups binary search the sparse index with ReadAt calls, so memory
+// stays small no matter how big the dictionary is, at the cost of a few reads
+// per lookup. With sample set, the keys of the sparse index are loaded into
+// memory, which leaves a single read of the index per lookup.
+func WithLowMemory(sample bool) Option {
+	return func(o *options) {
+		o.lowMemory = true
+		o.sparseSample = sample
+	}
+}
+
+// LowMemoryFromEnv returns the option of the low-memory mode selected by
+// DICT_LOW_MEMORY: WithLowMemory(false) for a true boolean, WithLowMemory(true)
+// for "sample". The index is loaded into memory when it's unset or false.
+func LowMemoryFromEnv() (Option, error) {
+	s := os.Getenv("DICT_LOW_MEMORY")
+	if s == "sample" {
+		return WithLowMemory(true), nil
+	}
+	if s == "" {
+		return func(o *options) {}, nil
+	}
+
+	low, err := strconv.ParseBool(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DICT_LOW_MEMORY %q, expected a boolean or sample", s)
+	}
+	if !low {
+		return func(o *options) {}, nil
+	}
+
+	return WithLowMemory(false), nil
+}
+
+// withoutIndex opens a dictionary without checking it or loading its index,
+// so that corrupt dictionaries can be verified and repaired
+func withoutIndex() Option {
+	return func(o *options) {
+		o.raw = true
+	}
+}
+
+// index finds the index entry of a normalized key
+type index interface {
+	lookup(key string) (IndexEntry, bool, error)
+	len() int
+}
+
+// mapIndex is the index loaded into memory
+type mapIndex map[string]IndexEntry
+
+func (m mapIndex) lookup(key string) (IndexEntry, bool, error) {
+	idxe, ok := m[key]
+	return idxe, ok, nil
+}
+
+func (m mapIndex) len() int {
+	return len(m)
+}
+
+// Reader looks up entries in a dict.dat image
+type Reader struct {
+	r        io.ReaderAt
+	size     int64
+	header   Header
+	sections []section
+	index    index
+	// bloom answers most misses without touching the index, nil if the
+	// dictionary was built without it
+	bloom *bloomFilter
+	// sums holds the checksums of the file, checked by readSection unless
+	// checked is false
+	sums    []checksumRange
+	checked bool
+	// blocks and cache are only set for compressed dictionaries
+	blocks []blockRef
+	cache  *blockCache
+	// aead decrypts the blocks and the index of encrypted dictionaries
+	// with key, both are nil for plain dictionaries
+	aead cipher.AEAD
+	key  []byte
+	// legacy is set for the dictionaries of the legacy layout, which are
+	// read from a copy converted into the current one, see legacy.go
+	legacy bool
+
+	// sorted is the sorted index used for iteration, loaded on first use
+	// unless the index is already sorted, see Reader.sortedIndex
+	sortedOnce sync.Once
+	sorted     *sortedIndex
+	sortedErr  error
+}
+
+// NewReader reads the header and the index of the dict.dat image of the
+// given size into memory. Images of the legacy layout are converted into the
+// current one in memory, see legacy.go.
+func NewReader(r io.ReaderAt, size int64, opts ...Option) (*Reader, error) {
+	o := options{blockCacheSize: defaultBlockCacheSize}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	// Read the header along with the section count
+	hbuf := make([]byte, HeaderSize+4)
+	_, err := r.ReadAt(hbuf, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error reading header: %v", err)
+	}
+
+	// Corrupt dictionaries are only verified and repaired in the current layout
+	if isLegacy(hbuf) && !o.raw {
+		return newLegacyReader(r, size, opts...)
+	}
+
+	h, err := decodeHeader(hbuf)
+	if err != nil {
+		return nil, err
+	}
+
+	n := int(binary.BigEndian.Uint32(hbuf[HeaderSize:]))
+	if HeaderSize+sectionTableSize(n) > h.IndexSize {
+		return nil, fmt.Errorf("%w: truncated section table", ErrBadFormat)
+	}
+
+	tbuf := make([]byte, n*sectionSize)
+	_, err = r.ReadAt(tbuf, HeaderSize+4)
+	if err != nil {
+		return nil, fmt.Errorf("error reading section table: %v", err)
+	}
+
+	sections, err := decodeSectionTable(tbuf, n)
+	if err != nil {
+		return nil, err
+	}
+
+	rd := &Reader{
+		r:        r,
+		size:     size,
+		header:   h,
+		sections: sections,
+	}
+
+	if _, ok := rd.section(sectionChecksums); ok {
+		buf, err := rd.readSection(sectionChecksums)
+		if err != nil {
+			return nil, err
+		}
+
+		// A damaged checksum section is reported by Verify in raw mode
+		rd.sums, err = decodeChecksums(buf)
+		if err != nil && !(o.raw && errors.Is(err, ErrChecksum)) {
+			return nil, err
+		}
+
+		// Check the header and the size of the file up front, the sections as
+		// they are read. The data is only checked by Verify, as that means
+		// reading the whole file.
+		if !o.raw {
+			err = rd.checkHeader(append(hbuf, tbuf...))
+			if err != nil {
+				return nil, err
+			}
+
+			err = rd.checkSize()
+			if err != nil {
+				return nil, err
+			}
+
+			rd.checked = true
+		}
+	}
+
+	// Corrupt dictionaries can be verified without the key
+	if h.Flags&FlagEncrypted != 0 && (!o.raw || o.encryptionKey != nil) {
+		err = rd.loadEncryption(o.encryptionKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if h.Flags&FlagCompressed != 0 {
+		buf, err := rd.readSection(sectionBlocks)
+		if err != nil {
+			return nil, err
+		}
+
+		rd.blocks, err = decodeBlockTable(buf)
+		if err != nil {
+			return nil, err
+		}
+		rd.cache = newBlockCache(o.blockCacheSize)
+	}
+
+	if o.raw {
+		return rd, nil
+	}
+
+	if _, ok := rd.section(sectionBloom); ok {
+		buf, err := rd.readSection(sectionBloom)
+		if err != nil {
+			return nil, err
+		}
+
+		rd.bloom, err = decodeBloom(buf)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if o.lowMemory {
+		// The index of encrypted dictionaries is decrypted into memory
+		ir, index, sparse, err := rd.indexReader()
+		if err != nil {
+			return nil, err
+		}
+
+		rd.index, err = newSortedIndex(ir, index, sparse, h.Flags, o.sparseSample)
+		if err != nil {
+			return nil, err
+		}
+
+		return rd, nil
+	}
+
+	// Read all index entries at once. Dictionaries with a perfect hash index
+	// keep them serialized, the others decode them into a map.
+	buf, err := rd.readSection(sectionIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.Flags&FlagPerfectHash != 0 {
+		hbuf, err := rd.readSection(sectionHash)
+		if err != nil {
+			return nil, err
+		}
+
+		rd.index, err = newHashIndex(buf, hbuf, h.Flags)
+		if err != nil {
+			return nil, err
+		}
+
+		return rd, nil
+	}
+
+	idx, err := decodeIndex(buf, h.Flags)
+	if err != nil {
+		return nil, err
+	}
+	rd.index = mapIndex(idx)
+
+	return rd, nil
+}
+
+// section returns the section of the given kind
+func (rd *Reader) section(kind uint32) (section, bool) {
+	for _, s := range rd.sections {
+		if s.Kind == kind {
+			return s, true
+		}
+	}
+
+	return section{}, false
+}
+
+// readSection reads the whole section of the given kind
+func (rd *Reader) readSection(kind uint32) ([]byte, error) {
+	s, ok := rd.section(kind)
+	if !ok {
+		return nil, fmt.Errorf("%w: missing section %d", ErrBadFormat, kind)
+	}
+
+	if s.Offset < HeaderSize || s.Size < 0 || s.Size > min(rd.header.IndexSize, rd.size)-s.Offset {
+		return nil, fmt.Errorf("%w: section %d out of bounds", ErrBadFormat, kind)
+	}
+
+	buf := make([]byte, s.Size)
+	if len(buf) > 0 {
+		_, err := rd.r.ReadAt(buf, s.Offset)
+		if err != nil {
+			return nil, fmt.Errorf("error reading section %d: %v", kind, err)
+		}
+	}
+
+	if rd.checked {
+		err := rd.checkSection(kind, buf)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if rd.aead != nil && encryptedSection(kind) {
+		if chunkedSection(kind) {
+			return openChunks(rd.aead, buf, kind, 0)
+		}
+		return open(rd.aead, buf, uint64(kind))
+	}
+
+	return buf, nil
+}
+
+// Header returns the header of the dictionary
+func (rd *Reader) Header() Header {
+	return rd.header
+}
+
+// Len returns the number of entries in the dictionary
+func (rd *Reader) Len() int {
+	return rd.index.len()
+}
+
+// Lookup normalizes the word and returns its entry.
+// It returns false if the word is not in the dictionary.
+func (rd *Reader) Lookup(word string) (*Entry, bool, error) {
+	key := NormalizeKey(word, rd.header.Flags)
+	if !rd.mayContain(key) {
+		return nil, false, nil
+	}
+
+	idxe, ok, err := rd.index.lookup(key)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	e, err := rd.readEntry(idxe)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return e, true, nil
+}
+
+// mayContain reports false if the normalized key is definitely not in the dictionary
+func (rd *Reader) mayContain(key string) bool {
+	return rd.bloom == nil || rd.bloom.mayContain(key)
+}
+
+// readEntry reads and decodes the entry idxe points to
+func (rd *Reader) readEntry(idxe IndexEntry) (*Entry, error) {
+	if idxe.Offset < 0 || idxe.Size < 0 {
+		return nil, fmt.Errorf("%w: entry %q at %d of size %d", ErrBadFormat, idxe.Word, idxe.Offset, idxe.Size)
+	}
+
+	if rd.blocks == nil {
+		// Checked before allocating, the size comes from the file
+		if idxe.Size > rd.size-idxe.Offset {
+			return nil, fmt.Errorf("%w: entry %q at %d exceeds the file", ErrBadFormat, idxe.Word, idxe.Offset)
+		}
+
+		buf := make([]byte, idxe.Size)
+
+		_, err := rd.r.ReadAt(buf, idxe.Offset)
+		if err != nil {
+			return nil, fmt.Errorf("error reading entry: %v", err)
+		}
+
+		return decodeEntry(buf)
+	}
+
+	buf, err := rd.blockEntry(idxe.Offset, idxe.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeEntry(buf)
+}
+
+// blockEntry returns the encoded entry at the offset in the uncompressed data
+// of a compressed dictionary. The returned slice points into the (cached)
+// decompressed block and must not be modified.
+func (rd *Reader) blockEntry(offset, size int64) ([]byte, error) {
+	n, err := rd.findBlock(offset)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := rd.block(n)
+	if err != nil {
+		return nil, err
+	}
+
+	return rd.sliceBlock(n, data, offset, size)
+}
+
+// findBlock returns the block holding the offset in the uncompressed data,
+// i.e. the last block starting at or before it
+func (rd *Reader) findBlock(offset int64) (int, error) {
+	n := sort.Search(len(rd.blocks), func(i int) bool {
+		return rd.blocks[i].Start > offset
+	}) - 1
+	if n < 0 {
+		return 0, fmt.Errorf("%w: no block for offset %d", ErrBadFormat, offset)
+	}
+
+	return n, nil
+}
+
+// sliceBlock returns the entry at offset out of the decompressed block n
+func (rd *Reader) sliceBlock(n int, data []byte, offset, size int64) ([]byte, error) {
+	st := offset - rd.blocks[n].Start
+	if size < 0 || size > int64(len(data))-st {
+		return nil, fmt.Errorf("%w: entry at %d exceeds its block", ErrBadFormat, offset)
+	}
+
+	return data[st : st+size], nil
+}
+
+// block returns the decompressed block n, from the cache if possible
+func (rd *Reader) block(n int) ([]byte, error) {
+	if data, ok := rd.cache.get(n); ok {
+		return data, nil
+	}
+
+	data, err := readBlock(rd.r, rd.size, rd.blocks[n], rd.aead)
+	if err != nil {
+		return nil, err
+	}
+
+	rd.cache.add(n, data)
+
+	return data, nil
+}
+
+// entries returns a reader over all entries in the order they are stored
+func (rd *Reader) entries() *entryReader {
+	if rd.blocks == nil {
+		return newEntryReader(io.NewSectionReader(rd.r, rd.header.IndexSize, rd.size-rd.header.IndexSize))
+	}
+
+	return newEntryReader(&blocksReader{rd: rd})
+}
+
+// blocksReader reads the decompressed blocks one after the other
+type blocksReader struct {
+	rd   *Reader
+	n    int
+	data []byte
+}
+
+func (br *blocksReader) Read(p []byte) (int, error) {
+	for len(br.data) == 0 {
+		if br.n >= len(br.rd.blocks) {
+			return 0, io.EOF
+		}
+
+		// Sequential reads bypass the cache to not evict the blocks of hot words
+		data, err := readBlock(br.rd.r, br.rd.size, br.rd.blocks[br.n], br.rd.aead)
+		if err != nil {
+			return 0, err
+		}
+		br.data = data
+		br.n++
+	}
+
+	n := copy(p, br.data)
+	br.data = br.data[n:]
+
+	return n, nil
+}
@@ -0,0 +1,236 @@
+package dict
+
+// This file contains the verification and the repair of dict.dat files
+// using their checksums, see checksum.go.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// openRaw opens the dictionary file at path without checking it or loading its index
+func openRaw(path string, opts ...Option) (*os.File, *Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	rd, err := NewReader(f, fi.Size(), append(opts, withoutIndex())...)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return f, rd, nil
+}
+
+// VerifyFile checks the whole dictionary file at path against its checksums
+// and returns the corrupted ranges. Unlike Open, it also works on files with
+// a corrupt index.
+func VerifyFile(path string) ([]Corruption, error) {
+	f, rd, err := openRaw(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return rd.Verify()
+}
+
+// Repair rebuilds the dictionary file at path into outPath from the entries
+// stored in intact ranges, with the same build options. The entries are
+// located through the index if it's intact, otherwise the data region is
+// scanned. A raw data region can only be scanned up to its first corrupted
+// chunk, whereas compressed blocks are independent of each other.
+//
+// Encrypted dictionaries need their key (WithEncryptionKey), the repaired
+// dictionary is encrypted with it as well.
+//
+// It returns the number of entries kept and of the ones dropped because
+// they are corrupted.
+func Repair(path, outPath string, opts ...Option) (int, int, error) {
+	f, rd, err := openRaw(path, opts...)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	if rd.header.Flags&FlagEncrypted != 0 && rd.aead == nil {
+		return 0, 0, fmt.Errorf("%w, can't repair without the key", ErrEncrypted)
+	}
+
+	corrupt, err := rd.Verify()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// overlaps reports whether the range overlaps a corrupted one
+	overlaps := func(offset, size int64) bool {
+		for _, c := range corrupt {
+			if offset < c.Offset+c.Size && c.Offset < offset+size {
+				return true
+			}
+		}
+		return false
+	}
+
+	if overlaps(0, HeaderSize) {
+		return 0, 0, fmt.Errorf("%w: header is corrupt, can't repair", ErrChecksum)
+	}
+	if s, ok := rd.section(sectionBlocks); ok && overlaps(s.Offset, s.Size) {
+		return 0, 0, fmt.Errorf("%w: block table is corrupt, can't repair", ErrChecksum)
+	}
+
+	var idxes []IndexEntry
+	if s, ok := rd.section(sectionIndex); ok && !overlaps(s.Offset, s.Size) {
+		buf, err := rd.readSection(sectionIndex)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		d := newIndexDecoder(buf, rd.header.Flags)
+		for {
+			e, ok := d.next()
+			if !ok {
+				break
+			}
+			idxes = append(idxes, e.entry())
+		}
+		if d.err != nil {
+			return 0, 0, d.err
+		}
+	} else {
+		log.Printf("Index is corrupt, scanning the data for entries")
+
+		idxes, err = rd.scanEntries(overlaps)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	// Write the intact entries into a source file to build the new dictionary from
+	src, err := os.CreateTemp(filepath.Dir(outPath), "repair-*.jsonl")
+	if err != nil {
+		return 0, 0, fmt.Errorf("error creating source file: %v", err)
+	}
+	defer os.Remove(src.Name())
+	defer src.Close()
+
+	w := bufio.NewWriter(src)
+	kept, dropped := 0, 0
+
+	for _, idxe := range idxes {
+		offset, size := idxe.Offset, idxe.Size
+		if rd.blocks != nil {
+			// Compressed entries are intact if their block is
+			n, err := rd.findBlock(idxe.Offset)
+			if err != nil {
+				dropped++
+				continue
+			}
+			offset, size = rd.blocks[n].Offset, rd.blocks[n].Size
+		}
+
+		if overlaps(offset, size) {
+			dropped++
+			continue
+		}
+
+		e, err := rd.readEntry(idxe)
+		if err != nil {
+			log.Printf("Dropping entry at %d: %v", idxe.Offset, err)
+			dropped++
+			continue
+		}
+
+		err = writeSourceEntry(w, e)
+		if err != nil {
+			return 0, 0, err
+		}
+		kept++
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	bopts := buildOptions(rd.header.Flags)
+	bopts.EncryptionKey = rd.key
+
+	err = Build(src.Name(), outPath, bopts)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error rebuilding dictionary: %v", err)
+	}
+
+	return kept, dropped, nil
+}
+
+// scanEntries locates the entries by reading the data region, without the
+// index. corrupt reports whether a byte range of the file is corrupted.
+func (rd *Reader) scanEntries(corrupt func(offset, size int64) bool) ([]IndexEntry, error) {
+	var idxes []IndexEntry
+
+	// parse appends the entries of buf, whose first entry starts at offset
+	parse := func(buf []byte, offset int64) {
+		for len(buf) > 0 {
+			size, n := binary.Uvarint(buf)
+			if n <= 0 || size > uint64(len(buf)-n) {
+				return
+			}
+
+			idxes = append(idxes, IndexEntry{Offset: offset + int64(n), Size: int64(size)})
+			offset += int64(n) + int64(size)
+			buf = buf[n+int(size):]
+		}
+	}
+
+	if rd.blocks != nil {
+		// Entries never straddle blocks, so every intact block can be parsed
+		for _, b := range rd.blocks {
+			if corrupt(b.Offset, b.Size) {
+				continue
+			}
+
+			data, err := readBlock(rd.r, rd.size, b, rd.aead)
+			if err != nil {
+				continue
+			}
+			parse(data, b.Start)
+		}
+
+		return idxes, nil
+	}
+
+	// The raw data is parsed up to the first corrupted chunk, where the
+	// boundaries of the entries are lost
+	end := rd.size
+	for _, r := range rd.sums {
+		if r.Kind == checksumData && corrupt(r.Offset, r.Size) {
+			end = min(end, r.Offset)
+		}
+	}
+
+	if end <= rd.header.IndexSize {
+		return nil, nil
+	}
+
+	buf := make([]byte, end-rd.header.IndexSize)
+	_, err := rd.r.ReadAt(buf, rd.header.IndexSize)
+	if err != nil {
+		return nil, fmt.Errorf("error reading data: %v", err)
+	}
+	parse(buf, rd.header.IndexSize)
+
+	return idxes, nil
+}
@@ -0,0 +1,545 @@
+package dict
+
+// This file contains the delta segments of a dictionary. Instead of
+// rebuilding dict.dat, small updates are written as immutable segments, each
+// a dict.dat of its own built with the layout and the keys of the base file,
+// in the directory next to it:
+//
+//	dict.dat.segments/000001.dat
+//	dict.dat.segments/000002.dat
+//
+// A segment holds the entries added or updated by a batch of changes, and a
+// tombstone - an entry without senses - for every deleted word. Lookups ask
+// the newest segment first and fall back to the base file, iteration merges
+// them all. Compaction merges the segments into a new base file and removes
+// them, see Dict.Compact.
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// segmentsExt is appended to the path of a dictionary to get its segments directory
+const segmentsExt = ".segments"
+
+// Change adds, updates or deletes a word. It's an entry along with the
+// deleted flag in the changes files, e.g.
+//
+//	{"word":"abandon","senses":[{"definition":"to leave"}]}
+//	{"word":"abaft","deleted":true}
+//
+// The audit metadata is recorded by UpdateDict and Editor.Fold, see audit.go.
+type Change struct {
+	Entry
+	Deleted bool `json:"deleted,omitempty"`
+	Audit
+}
+
+// ErrInvalidChange is returned for changes that can't be applied
+var ErrInvalidChange = errors.New("invalid change")
+
+// validate checks that the change can be stored
+func (c *Change) validate() error {
+	if c.Word == "" {
+		return fmt.Errorf("%w: missing word", ErrInvalidChange)
+	}
+	if len(c.Word) > maxWordLen {
+		return fmt.Errorf("%w: word of %d bytes, longer than %d bytes", ErrInvalidChange, len(c.Word), maxWordLen)
+	}
+	if !c.Deleted && len(c.Senses) == 0 {
+		return fmt.Errorf("%w: %s without senses", ErrInvalidChange, c.Word)
+	}
+
+	return nil
+}
+
+// isTombstone reports whether a segment entry marks a deleted word
+func isTombstone(e *Entry) bool {
+	return len(e.Senses) == 0
+}
+
+// ReadChanges reads the changes file at path, one JSON encoded Change per line
+func ReadChanges(path string) ([]Change, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var changes []Change
+
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := r.ReadString('\n')
+		if strings.TrimSpace(line) != "" {
+			var c Change
+			if jerr := json.Unmarshal([]byte(line), &c); jerr != nil {
+				return nil, fmt.Errorf("%s:%d: invalid change: %v", path, n, jerr)
+			}
+			changes = append(changes, c)
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	return changes, nil
+}
+
+// segmentsDir returns the directory of the segments of the dictionary at path
+func segmentsDir(path string) string {
+	return path + segmentsExt
+}
+
+// segmentSeq returns the sequence number of a segment file name
+func segmentSeq(name string) (int, bool) {
+	base, ok := strings.CutSuffix(name, ".dat")
+	if !ok {
+		return 0, false
+	}
+
+	seq, err := strconv.Atoi(base)
+	if err != nil || seq <= 0 {
+		return 0, false
+	}
+
+	return seq, true
+}
+
+// listSegments returns the paths of the segments of the dictionary at path,
+// the newest first
+func listSegments(path string) ([]string, error) {
+	files, err := os.ReadDir(segmentsDir(path))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading segments: %v", err)
+	}
+
+	type seqPath struct {
+		seq  int
+		path string
+	}
+
+	var segs []seqPath
+	for _, f := range files {
+		if seq, ok := segmentSeq(f.Name()); ok && !f.IsDir() {
+			segs = append(segs, seqPath{seq, filepath.Join(segmentsDir(path), f.Name())})
+		}
+	}
+
+	sort.Slice(segs, func(i, j int) bool {
+		return segs[i].seq > segs[j].seq
+	})
+
+	paths := make([]string, len(segs))
+	for i, s := range segs {
+		paths[i] = s.path
+	}
+
+	return paths, nil
+}
+
+// loadSegments opens the segments of the dictionary
+func (d *Dict) loadSegments() error {
+	paths, err := listSegments(d.path)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		seg, err := openFile(path, d.opts...)
+		if err != nil {
+			return fmt.Errorf("error opening segment %s: %w", filepath.Base(path), err)
+		}
+		d.segments = append(d.segments, seg)
+	}
+
+	return nil
+}
+
+// Segments returns the number of delta segments on top of the dictionary
+func (d *Dict) Segments() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return len(d.segments)
+}
+
+// lookup returns the entry of the word from the newest segment holding it,
+// or from the base file. Deleted words are not found.
+func (d *Dict) lookup(word string) (*Entry, bool, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, seg := range d.segments {
+		e, ok, err := seg.rd.Lookup(word)
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			return e, !isTombstone(e), nil
+		}
+	}
+
+	return d.rd.Lookup(word)
+}
+
+// Iterate calls fn with the key and the entry of every word whose key is in
+// [from, to), in key order, see Reader.Iterate. The segments are merged
+// with the base file, the newest entry of a key wins.
+func (d *Dict) Iterate(ctx context.Context, from, to string, fn func(key string, e *Entry) bool) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.iterate(ctx, from, to, fn)
+}
+
+// iterate is Iterate with d.mu held
+func (d *Dict) iterate(ctx context.Context, from, to string, fn func(key string, e *Entry) bool) error {
+	if len(d.segments) == 0 {
+		return d.rd.Iterate(ctx, from, to, fn)
+	}
+
+	readers := make([]*Reader, 0, len(d.segments)+1)
+	for _, seg := range d.segments {
+		readers = append(readers, seg.rd)
+	}
+	readers = append(readers, d.rd)
+
+	return mergeIterate(ctx, readers, from, to, func(i int, key string, e *Entry) bool {
+		if i < len(d.segments) && isTombstone(e) {
+			return true
+		}
+		return fn(key, e)
+	})
+}
+
+// All returns an iterator over all entries in key order, see Reader.All
+func (d *Dict) All() func(yield func(key string, e *Entry) bool) {
+	return func(yield func(key string, e *Entry) bool) {
+		err := d.Iterate(context.Background(), "", "", yield)
+		if err != nil {
+			log.Printf("error iterating dictionary: %v", err)
+		}
+	}
+}
+
+// WriteSegment writes the changes as a new segment of the dictionary at
+// path, built with its layout. The options must hold the key of encrypted
+// dictionaries. The segment is signed with the key in DICT_SIGNING_KEY_FILE
+// if set. It returns the path of the segment.
+func WriteSegment(path string, changes []Change, opts ...Option) (string, error) {
+	f, rd, err := openRaw(path, opts...)
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+
+	return writeSegment(path, changes, rd.header.Flags, rd.key)
+}
+
+// Apply writes the changes as a new segment, see WriteSegment, and adds it
+// on top of the dictionary
+func (d *Dict) Apply(changes []Change) error {
+	d.applyMu.Lock()
+	defer d.applyMu.Unlock()
+
+	d.mu.RLock()
+	flags, key := d.rd.header.Flags, d.rd.key
+	d.mu.RUnlock()
+
+	segPath, err := writeSegment(d.path, changes, flags, key)
+	if err != nil {
+		return err
+	}
+
+	seg, err := openFile(segPath, d.opts...)
+	if err != nil {
+		return fmt.Errorf("error opening segment %s: %v", filepath.Base(segPath), err)
+	}
+
+	d.mu.Lock()
+	d.segments = append([]*Dict{seg}, d.segments...)
+	d.mu.Unlock()
+
+	return nil
+}
+
+// writeSegment builds the changes into the next segment of the dictionary
+// at path, with the given header flags and encryption key
+func writeSegment(path string, changes []Change, flags uint16, encKey []byte) (string, error) {
+	if len(changes) == 0 {
+		return "", fmt.Errorf("no changes to write")
+	}
+	if flags&FlagEncrypted != 0 && encKey == nil {
+		return "", fmt.Errorf("%w, its segments need the key", ErrEncrypted)
+	}
+
+	// The last change of a word wins
+	byKey := make(map[string]int)
+	var entries []keyedEntry
+	for _, c := range changes {
+		err := c.validate()
+		if err != nil {
+			return "", err
+		}
+
+		e := &Entry{Word: c.Word}
+		if !c.Deleted {
+			e = &c.Entry
+			e.numberSenses()
+		}
+
+		key := NormalizeKey(c.Word, flags)
+		if i, ok := byKey[key]; ok {
+			entries[i].entry = e
+			continue
+		}
+		byKey[key] = len(entries)
+		entries = append(entries, keyedEntry{key: key, entry: e})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+
+	dir := segmentsDir(path)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", fmt.Errorf("error creating segments directory: %v", err)
+	}
+
+	seq := 1
+	paths, err := listSegments(path)
+	if err != nil {
+		return "", err
+	}
+	if len(paths) > 0 {
+		last, _ := segmentSeq(filepath.Base(paths[0]))
+		seq = last + 1
+	}
+
+	tempDir, err := os.MkdirTemp(dir, "tmp-segment-*")
+	if err != nil {
+		return "", fmt.Errorf("error creating temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	srcPath := filepath.Join(tempDir, jsonlWordsFilename)
+	err = writeSource(srcPath, entries)
+	if err != nil {
+		return "", err
+	}
+
+	opts := buildOptions(flags)
+	if flags&FlagEncrypted != 0 {
+		opts.EncryptionKey = encKey
+	}
+	opts.SigningKey, err = SigningKeyFromEnv()
+	if err != nil {
+		return "", fmt.Errorf("error reading signing key: %v", err)
+	}
+
+	name := fmt.Sprintf("%06d.dat", seq)
+	err = Build(srcPath, filepath.Join(tempDir, name), opts)
+	if err != nil {
+		return "", fmt.Errorf("error building segment: %v", err)
+	}
+
+	segPath := filepath.Join(dir, name)
+	err = moveDict(filepath.Join(tempDir, name), segPath)
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("Wrote segment %s with %d changes", name, len(entries))
+
+	return segPath, nil
+}
+
+// Compact merges the segments of the dictionary at path into a new base
+// file, see Dict.Compact
+func Compact(path string, opts ...Option) error {
+	d, err := Open(path, opts...)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Compact()
+}
+
+// Compact merges the segments into a new base file built with the same
+// layout and keys, and removes them. Lookups keep being served while the
+// new base file is built; segments added meanwhile stay on top of it.
+// The reader of the base file is swapped under d.mu, which the methods of
+// Dict read it with.
+func (d *Dict) Compact() error {
+	d.compactMu.Lock()
+	defer d.compactMu.Unlock()
+
+	d.mu.RLock()
+	segs := append([]*Dict(nil), d.segments...)
+	d.mu.RUnlock()
+
+	if len(segs) == 0 {
+		return nil
+	}
+
+	err := d.buildMerged(d.path, len(segs))
+	if err != nil {
+		return err
+	}
+
+	base, err := openFile(d.path, d.opts...)
+	if err != nil {
+		return fmt.Errorf("error opening compacted dictionary: %v", err)
+	}
+
+	// Swap the base file, keeping the segments added since the snapshot
+	d.mu.Lock()
+	d.f.Close()
+	d.f, d.rd = base.f, base.rd
+	d.segments = d.segments[:len(d.segments)-len(segs)]
+	d.mu.Unlock()
+
+	for _, seg := range segs {
+		seg.Close()
+
+		err = os.Remove(seg.path)
+		if err != nil {
+			return fmt.Errorf("error removing segment: %v", err)
+		}
+		os.Remove(seg.path + SignatureExt)
+	}
+
+	log.Printf("Compacted %d segments into %s", len(segs), filepath.Base(d.path))
+
+	return nil
+}
+
+// buildMerged builds the base file merged with its oldest n segments into a
+// new dictionary at path, with the same layout and keys, signed with the key
+// in DICT_SIGNING_KEY_FILE if set. The dictionary is built in a temp
+// directory next to path and moved there.
+func (d *Dict) buildMerged(path string, n int) error {
+	d.mu.RLock()
+	flags, key := d.rd.header.Flags, d.rd.key
+	d.mu.RUnlock()
+
+	tempDir, err := os.MkdirTemp(filepath.Dir(path), "tmp-dict-build-*")
+	if err != nil {
+		return fmt.Errorf("error creating temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	srcPath := filepath.Join(tempDir, jsonlWordsFilename)
+	err = d.writeMerged(srcPath, n)
+	if err != nil {
+		return err
+	}
+
+	opts := buildOptions(flags)
+	if flags&FlagEncrypted != 0 {
+		opts.EncryptionKey = key
+	}
+	opts.SigningKey, err = SigningKeyFromEnv()
+	if err != nil {
+		return fmt.Errorf("error reading signing key: %v", err)
+	}
+
+	newPath := filepath.Join(tempDir, filepath.Base(path))
+	err = Build(srcPath, newPath, opts)
+	if err != nil {
+		return fmt.Errorf("error building dictionary: %v", err)
+	}
+
+	return moveDict(newPath, path)
+}
+
+// writeMerged writes the entries of the base file merged with its oldest n
+// segments into a JSON lines source file
+func (d *Dict) writeMerged(path string, n int) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating source file: %v", err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+
+	// The newer segments are left out of the merge
+	merged := &Dict{rd: d.rd, segments: d.segments[len(d.segments)-n:]}
+
+	var werr error
+	err = merged.iterate(context.Background(), "", "", func(key string, e *Entry) bool {
+		werr = writeSourceEntry(w, e)
+		return werr == nil
+	})
+	if err == nil {
+		err = werr
+	}
+	if err != nil {
+		return fmt.Errorf("error merging segments: %v", err)
+	}
+
+	return w.Flush()
+}
+
+// StartCompaction compacts the dictionary in the background every interval
+// once it has at least minSegments segments. It returns the function that
+// stops it. It fails if trusted public keys are configured without their
+// signing key, as the compacted dictionary would be rejected.
+func (d *Dict) StartCompaction(interval time.Duration, minSegments int) (func(), error) {
+	err := checkSigningKey()
+	if err != nil {
+		return nil, fmt.Errorf("error starting compaction: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if d.Segments() < max(minSegments, 1) {
+				continue
+			}
+
+			err := d.Compact()
+			if err != nil {
+				log.Printf("error compacting dictionary: %v", err)
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}, nil
+}
@@ -0,0 +1,213 @@
+package dict
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// change returns the change setting the definition of a word
+func change(word, definition string) Change {
+	return Change{Entry: Entry{Word: word, Senses: []Sense{{Definition: definition}}}}
+}
+
+// checkWords checks the definitions of the words, an empty one for a missing word
+func checkWords(t *testing.T, d *Dict, expected map[string]string) {
+	t.Helper()
+
+	for word, def := range expected {
+		got, ok := d.QueryWord(word)
+		if ok != (def != "") || got != def {
+			t.Errorf("QueryWord(%s) = %q, %v, want %q", word, got, ok, def)
+		}
+	}
+}
+
+func TestSegments(t *testing.T) {
+	for _, opts := range []BuildOptions{{}, {Compress: true, BlockSize: 4096, PerfectHash: true}} {
+		dictPath := buildBenchDict(t, t.TempDir(), 100, opts)
+
+		d, err := Open(dictPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+
+		err = d.Apply([]Change{
+			change("word000010", "updated 10"),
+			change("new", "added"),
+			{Entry: Entry{Word: "word000020"}, Deleted: true},
+		})
+		if err != nil {
+			t.Fatalf("Apply() error = %v", err)
+		}
+
+		// The newest segment wins, even over a deletion
+		err = d.Apply([]Change{
+			change("word000010", "updated again"),
+			{Entry: Entry{Word: "new"}, Deleted: true},
+			change("word000020", "restored 20"),
+			change("word000020", "restored 20 twice"),
+		})
+		if err != nil {
+			t.Fatalf("Apply() error = %v", err)
+		}
+
+		expected := map[string]string{
+			"word000010": "updated again",
+			"word000020": "restored 20 twice",
+			"word000030": "definition of the word number 30 in the benchmark dictionary",
+			"new":        "",
+		}
+		checkWords(t, d, expected)
+
+		// The segments are loaded along with the base file
+		d2, err := Open(dictPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d2.Segments() != 2 || d2.Header().Flags != d.Header().Flags {
+			t.Errorf("Open() loaded %d segments, flags %#x", d2.Segments(), d2.Header().Flags)
+		}
+		checkWords(t, d2, expected)
+		d2.Close()
+
+		err = d.Apply([]Change{{Entry: Entry{Word: "word000050"}, Deleted: true}})
+		if err != nil {
+			t.Fatalf("Apply() error = %v", err)
+		}
+
+		keys := iterateKeys(t, d, "word000048", "word000053")
+		if fmt.Sprint(keys) != "[word000048 word000049 word000051 word000052]" {
+			t.Errorf("Iterate() = %v", keys)
+		}
+
+		if err := d.Compact(); err != nil {
+			t.Fatalf("Compact() error = %v", err)
+		}
+		if d.Segments() != 0 || d.Len() != 99 {
+			t.Errorf("compacted dictionary has %d segments and %d entries, want 0 and 99", d.Segments(), d.Len())
+		}
+		if paths, _ := listSegments(dictPath); len(paths) != 0 {
+			t.Errorf("segments left after compaction: %v", paths)
+		}
+
+		expected["word000050"] = ""
+		checkWords(t, d, expected)
+
+		d3, err := Open(dictPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkWords(t, d3, expected)
+		d3.Close()
+	}
+}
+
+// iterateKeys returns the keys of the dictionary in [from, to)
+func iterateKeys(t *testing.T, d *Dict, from, to string) []string {
+	t.Helper()
+
+	var keys []string
+	err := d.Iterate(context.Background(), from, to, func(key string, e *Entry) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Iterate() error = %v", err)
+	}
+
+	return keys
+}
+
+func TestEncryptedSegments(t *testing.T) {
+	key, _ := NewEncryptionKey()
+	dictPath := buildBenchDict(t, t.TempDir(), 100, BuildOptions{EncryptionKey: key})
+
+	if _, err := WriteSegment(dictPath, []Change{change("word000001", "updated 1")}); err == nil {
+		t.Errorf("WriteSegment() without the key succeeded")
+	}
+
+	segPath, err := WriteSegment(dictPath, []Change{change("word000001", "updated 1")}, WithEncryptionKey(key))
+	if err != nil {
+		t.Fatalf("WriteSegment() error = %v", err)
+	}
+
+	if _, err := Open(segPath, WithEncryptionKey(key)); err != nil {
+		t.Errorf("Open() of the segment error = %v", err)
+	}
+
+	if err := Compact(dictPath, WithEncryptionKey(key)); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+
+	d, err := Open(dictPath, WithEncryptionKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if d.Header().Flags&FlagEncrypted == 0 {
+		t.Errorf("compacted dictionary is not encrypted")
+	}
+	checkWords(t, d, map[string]string{"word000001": "updated 1"})
+}
+
+func TestStartCompaction(t *testing.T) {
+	dictPath := buildBenchDict(t, t.TempDir(), 100, BuildOptions{})
+
+	d, err := Open(dictPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	stop, err := d.StartCompaction(10*time.Millisecond, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	for i := 0; i < 2; i++ {
+		err = d.Apply([]Change{change(fmt.Sprintf("word%06d", i), "updated")})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The base file is read while the compaction swaps it
+	for deadline := time.Now().Add(5 * time.Second); d.Segments() > 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("segments were not compacted")
+		}
+		if d.Len() != 100 || d.Header().Version != formatVersion {
+			t.Errorf("Len() = %d, Header() = %+v", d.Len(), d.Header())
+		}
+		if _, err := d.Stats(); err != nil {
+			t.Errorf("Stats() error = %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	checkWords(t, d, map[string]string{"word000000": "updated", "word000001": "updated"})
+}
+
+func TestReadChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "changes.jsonl")
+	os.WriteFile(path, []byte(`{"word":"a","senses":[{"definition":"first"}]}
+
+{"word":"b","deleted":true}`), 0644)
+
+	changes, err := ReadChanges(path)
+	if err != nil || len(changes) != 2 || changes[0].Word != "a" || !changes[1].Deleted {
+		t.Errorf("ReadChanges() = %+v, %v", changes, err)
+	}
+
+	os.WriteFile(path, []byte("not json\n"), 0644)
+	if _, err := ReadChanges(path); err == nil {
+		t.Errorf("ReadChanges() of a malformed file succeeded")
+	}
+}
@@ -0,0 +1,915 @@
+package dict
+
+// This file contains the sharded dictionaries. A dictionary can be split
+// into shards, each a dict.dat of its own, described by a JSON manifest:
+//
+//	{"version":1,"partition":"range","shards":[{"path":"dict-000.dat","from":"","entries":5000,"sha256":"..."},...],"signature":{...}}
+//
+// Shards are partitioned by the normalized key, either by range - shard i
+// holds the keys in [from i, from i+1) - or by hash - shard i holds the keys
+// whose FNV-1a hash modulo the number of shards is i. Shard paths are
+// relative to the manifest. Updates only rebuild the shards a changelog
+// touches, see updateShards.
+//
+// The manifest holds the SHA-256 digest of every shard. It's signed like a
+// dictionary, see sign.go, the signature covering the manifest without its
+// signature field, so verifying the manifest verifies the shards it lists.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// manifestFilename is the manifest of a sharded dictionary in the root directory
+	manifestFilename = "manifest.json"
+	manifestVersion  = 1
+	// shardsDirname is the directory of the shards rebuilt by the updates,
+	// in a directory named after the version each, see updateShards
+	shardsDirname = "shards"
+)
+
+// Partition is the way the keys are split across the shards
+type Partition string
+
+const (
+	// PartitionRange splits the sorted keys into contiguous ranges of about
+	// the same number of keys
+	PartitionRange Partition = "range"
+	// PartitionHash spreads the keys by their hash, so related keys (e.g.
+	// sharing a prefix) don't end up in the same shard
+	PartitionHash Partition = "hash"
+)
+
+// Manifest describes the shards of a sharded dictionary
+type Manifest struct {
+	Version   int         `json:"version"`
+	Partition Partition   `json:"partition"`
+	Shards    []ShardInfo `json:"shards"`
+	// Signature signs the manifest without it, nil if it's unsigned
+	Signature *Signature `json:"signature,omitempty"`
+}
+
+// ShardInfo describes a shard of a sharded dictionary
+type ShardInfo struct {
+	// Path is the path of the shard relative to the manifest
+	Path string `json:"path"`
+	// From is the first key of a range shard, empty for the first one and
+	// for hash shards
+	From    string `json:"from,omitempty"`
+	Entries int    `json:"entries"`
+	// SHA256 is the hex encoded SHA-256 digest of the shard file
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// VerifyDigest checks that the SHA-256 digest of the shard file matches the
+// one of the manifest
+func (s *ShardInfo) VerifyDigest(sum []byte) error {
+	if s.SHA256 == "" {
+		return fmt.Errorf("%w: no digest of %s in the manifest", ErrSignature, s.Path)
+	}
+	if hex.EncodeToString(sum) != s.SHA256 {
+		return fmt.Errorf("%w: digest %x of %s doesn't match the manifest's %s", ErrSignature, sum, s.Path, s.SHA256)
+	}
+
+	return nil
+}
+
+// ParseManifest parses and validates a manifest
+func ParseManifest(data []byte) (*Manifest, error) {
+	var m Manifest
+
+	err := json.Unmarshal(data, &m)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed manifest: %v", ErrBadFormat, err)
+	}
+
+	if m.Version != manifestVersion {
+		return nil, fmt.Errorf("%w: manifest version %d, expected %d", ErrBadFormat, m.Version, manifestVersion)
+	}
+	if m.Partition != PartitionRange && m.Partition != PartitionHash {
+		return nil, fmt.Errorf("%w: unknown partition %q", ErrBadFormat, m.Partition)
+	}
+	if len(m.Shards) == 0 {
+		return nil, fmt.Errorf("%w: manifest without shards", ErrBadFormat)
+	}
+
+	if m.Partition == PartitionRange {
+		for i := 1; i < len(m.Shards); i++ {
+			if m.Shards[i].From <= m.Shards[i-1].From {
+				return nil, fmt.Errorf("%w: shard ranges out of order at %s", ErrBadFormat, m.Shards[i].Path)
+			}
+		}
+	}
+
+	return &m, nil
+}
+
+// ReadManifest reads the manifest file at path
+func ReadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseManifest(data)
+}
+
+// withShard checks the digest of the shard file opened against the one of
+// its manifest, see OpenSharded
+func withShard(s *ShardInfo) Option {
+	return func(o *options) {
+		o.shard = s
+	}
+}
+
+// signedData returns the data the signature of the manifest covers, its
+// encoding without the signature
+func (m *Manifest) signedData() ([]byte, error) {
+	unsigned := *m
+	unsigned.Signature = nil
+
+	return json.Marshal(&unsigned)
+}
+
+// Verify checks that the manifest is signed by one of the trusted keys and
+// holds the digest of every shard, see ShardInfo.VerifyDigest
+func (m *Manifest) Verify(keys []ed25519.PublicKey) error {
+	if m.Signature == nil {
+		return fmt.Errorf("%w: unsigned manifest", ErrSignature)
+	}
+
+	data, err := m.signedData()
+	if err != nil {
+		return err
+	}
+
+	err = m.Signature.Verify(bytes.NewReader(data), keys)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range m.Shards {
+		if s.SHA256 == "" {
+			return fmt.Errorf("%w: no digest of %s in the manifest", ErrSignature, s.Path)
+		}
+	}
+
+	return nil
+}
+
+// writeManifest writes the manifest to path, replacing the old one at once.
+// It's signed with signingKey if it's set.
+func writeManifest(m *Manifest, path string, signingKey ed25519.PrivateKey) error {
+	m.Signature = nil
+	if signingKey != nil {
+		data, err := m.signedData()
+		if err != nil {
+			return err
+		}
+
+		m.Signature, err = Sign(bytes.NewReader(data), signingKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	err = os.WriteFile(tmpPath, append(data, '\n'), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// SignManifest signs the manifest at path with the private key, recording
+// the digests of its shards first
+func SignManifest(path string, priv ed25519.PrivateKey) error {
+	m, err := ReadManifest(path)
+	if err != nil {
+		return err
+	}
+
+	for i, s := range m.Shards {
+		m.Shards[i].SHA256, err = fileDigest(filepath.Join(filepath.Dir(path), s.Path))
+		if err != nil {
+			return fmt.Errorf("error hashing shard %s: %v", s.Path, err)
+		}
+	}
+
+	return writeManifest(m, path, priv)
+}
+
+// shardHash returns the hash of a normalized key for PartitionHash
+func shardHash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// shardFor returns the shard holding the normalized key
+func (m *Manifest) shardFor(key string) int {
+	if m.Partition == PartitionHash {
+		return int(shardHash(key) % uint32(len(m.Shards)))
+	}
+
+	// The last shard starting at or before the key
+	i := sort.Search(len(m.Shards), func(i int) bool {
+		return m.Shards[i].From > key
+	}) - 1
+
+	return max(i, 0)
+}
+
+// ManifestExists checks if the manifest of a sharded dictionary - manifest.json exists
+func ManifestExists() bool {
+	_, err := os.Stat(manifestFilename)
+	return err == nil
+}
+
+// BuildSharded splits the dictionary built from the source file at wordsPath
+// into n shards, partitioned by p, and writes their manifest to manifestPath.
+// The shards are written next to the manifest and built with opts.
+func BuildSharded(wordsPath, manifestPath string, n int, p Partition, opts BuildOptions) error {
+	if n <= 0 {
+		return fmt.Errorf("invalid number of shards %d", n)
+	}
+	if p != PartitionRange && p != PartitionHash {
+		return fmt.Errorf("unknown partition %q", p)
+	}
+
+	wordsFile, err := os.Open(wordsPath)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %v", filepath.Base(wordsPath), err)
+	}
+	defer wordsFile.Close()
+
+	var flags uint16
+	if opts.StripDiacritics {
+		flags |= FlagStripDiacritics
+	}
+
+	entries, err := collectEntries(newSourceReader(wordsFile, wordsPath), flags)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", filepath.Base(wordsPath), err)
+	}
+
+	m := &Manifest{Version: manifestVersion, Partition: p}
+
+	// Split the sorted entries into the shards, which stay sorted
+	var groups [][]keyedEntry
+	if p == PartitionRange {
+		n = max(min(n, len(entries)), 1)
+		for i := 0; i < n; i++ {
+			group := entries[i*len(entries)/n : (i+1)*len(entries)/n]
+			groups = append(groups, group)
+
+			from := ""
+			if i > 0 {
+				from = group[0].key
+			}
+			m.Shards = append(m.Shards, ShardInfo{From: from})
+		}
+	} else {
+		groups = make([][]keyedEntry, n)
+		m.Shards = make([]ShardInfo, n)
+		for _, ke := range entries {
+			i := shardHash(ke.key) % uint32(n)
+			groups[i] = append(groups[i], ke)
+		}
+	}
+
+	dir := filepath.Dir(manifestPath)
+	tempDir, err := os.MkdirTemp(dir, "tmp-dict-shards-*")
+	if err != nil {
+		return fmt.Errorf("error creating temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	for i, group := range groups {
+		m.Shards[i].Path = fmt.Sprintf("dict-%03d.dat", i)
+		m.Shards[i].Entries = len(group)
+
+		// Every shard is built from a source of its own, like the repaired dictionaries
+		srcPath := filepath.Join(tempDir, fmt.Sprintf("words-%03d.jsonl", i))
+		err = writeSource(srcPath, group)
+		if err != nil {
+			return err
+		}
+
+		// Shards are built in the temp directory, which holds their index.dat
+		shardPath := filepath.Join(tempDir, m.Shards[i].Path)
+		err = Build(srcPath, shardPath, opts)
+		if err != nil {
+			return fmt.Errorf("error building shard %d: %v", i, err)
+		}
+
+		m.Shards[i].SHA256, err = fileDigest(shardPath)
+		if err != nil {
+			return err
+		}
+
+		err = moveDict(shardPath, filepath.Join(dir, m.Shards[i].Path))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = writeManifest(m, manifestPath, opts.SigningKey)
+	if err != nil {
+		return fmt.Errorf("error writing manifest: %v", err)
+	}
+
+	log.Printf("Built %d shards partitioned by %s", len(m.Shards), p)
+
+	return nil
+}
+
+// fileDigest returns the hex encoded SHA-256 digest of the file at path
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	sum, err := digest(f)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(sum), nil
+}
+
+// writeSource writes the entries into a JSON lines source file
+func writeSource(path string, entries []keyedEntry) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating source file: %v", err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for _, ke := range entries {
+		err = writeSourceEntry(w, ke.entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return w.Flush()
+}
+
+// moveDict moves the dictionary file at from, along with its signature if
+// it's signed, to to
+func moveDict(from, to string) error {
+	err := os.Rename(from, to)
+	if err != nil {
+		return fmt.Errorf("error moving %s: %v", filepath.Base(from), err)
+	}
+
+	os.Remove(to + SignatureExt)
+	err = os.Rename(from+SignatureExt, to+SignatureExt)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error moving %s: %v", filepath.Base(from)+SignatureExt, err)
+	}
+
+	return nil
+}
+
+// ShardedReader routes the lookups to the readers of the shards. It's shared
+// by the local and the S3 backed sharded dictionaries.
+type ShardedReader struct {
+	manifest *Manifest
+	readers  []*Reader
+	// flags are the header flags of the shards, which are built alike
+	flags uint16
+}
+
+// NewShardedReader creates the reader of a sharded dictionary from the
+// readers of its shards, in the order of the manifest
+func NewShardedReader(m *Manifest, readers []*Reader) (*ShardedReader, error) {
+	if len(readers) != len(m.Shards) {
+		return nil, fmt.Errorf("got %d shards, the manifest has %d", len(readers), len(m.Shards))
+	}
+
+	return &ShardedReader{
+		manifest: m,
+		readers:  readers,
+		flags:    readers[0].Header().Flags,
+	}, nil
+}
+
+// Manifest returns the manifest of the dictionary
+func (sr *ShardedReader) Manifest() *Manifest {
+	return sr.manifest
+}
+
+// Len returns the number of entries of all shards
+func (sr *ShardedReader) Len() int {
+	n := 0
+	for _, rd := range sr.readers {
+		n += rd.Len()
+	}
+	return n
+}
+
+// Lookup normalizes the word and returns its entry from the shard holding it.
+// It returns false if the word is not in the dictionary.
+func (sr *ShardedReader) Lookup(word string) (*Entry, bool, error) {
+	key := NormalizeKey(word, sr.flags)
+	return sr.readers[sr.manifest.shardFor(key)].Lookup(word)
+}
+
+// Iterate calls fn with the key and the entry of every word whose key is in
+// [from, to), in key order, see Reader.Iterate. Range shards are iterated
+// one after the other, hash shards are merged.
+func (sr *ShardedReader) Iterate(ctx context.Context, from, to string, fn func(key string, e *Entry) bool) error {
+	if sr.manifest.Partition == PartitionHash {
+		return sr.merge(ctx, from, to, fn)
+	}
+
+	fromKey, toKey := NormalizeKey(from, sr.flags), NormalizeKey(to, sr.flags)
+
+	stopped := false
+	for i := sr.manifest.shardFor(fromKey); i < len(sr.readers) && !stopped; i++ {
+		// This and the following shards start at or after to
+		if to != "" && i > 0 && sr.manifest.Shards[i].From >= toKey {
+			break
+		}
+
+		err := sr.readers[i].Iterate(ctx, from, to, func(key string, e *Entry) bool {
+			stopped = !fn(key, e)
+			return !stopped
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// All returns an iterator over all entries in key order, see Reader.All
+func (sr *ShardedReader) All() func(yield func(key string, e *Entry) bool) {
+	return func(yield func(key string, e *Entry) bool) {
+		err := sr.Iterate(context.Background(), "", "", yield)
+		if err != nil {
+			log.Printf("error iterating dictionary: %v", err)
+		}
+	}
+}
+
+// merge iterates the shards concurrently and merges their entries in key order
+func (sr *ShardedReader) merge(ctx context.Context, from, to string, fn func(key string, e *Entry) bool) error {
+	return mergeIterate(ctx, sr.readers, from, to, func(i int, key string, e *Entry) bool {
+		return fn(key, e)
+	})
+}
+
+// shardItem is an entry sent by the iteration of a reader
+type shardItem struct {
+	key string
+	e   *Entry
+}
+
+// mergeIterate iterates the readers concurrently and merges their entries in
+// key order. fn is also given the index of the reader of the entry. A key
+// found in several readers is only passed on once, from the first of them.
+func mergeIterate(ctx context.Context, readers []*Reader, from, to string, fn func(i int, key string, e *Entry) bool) error {
+	mctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(readers))
+	chans := make([]chan shardItem, len(readers))
+
+	for i, rd := range readers {
+		chans[i] = make(chan shardItem, 64)
+
+		wg.Add(1)
+		go func(i int, rd *Reader) {
+			defer wg.Done()
+			defer close(chans[i])
+
+			errs[i] = rd.Iterate(mctx, from, to, func(key string, e *Entry) bool {
+				select {
+				case chans[i] <- shardItem{key, e}:
+					return true
+				case <-mctx.Done():
+					return false
+				}
+			})
+		}(i, rd)
+	}
+
+	// heads holds the next entry of every reader, ok is false once it's done
+	heads := make([]shardItem, len(chans))
+	ok := make([]bool, len(chans))
+	for i, ch := range chans {
+		heads[i], ok[i] = <-ch
+	}
+
+	for {
+		next := -1
+		for i := range heads {
+			if ok[i] && (next < 0 || heads[i].key < heads[next].key) {
+				next = i
+			}
+		}
+		if next < 0 || !fn(next, heads[next].key, heads[next].e) {
+			break
+		}
+
+		// Skip the same key in the other readers
+		key := heads[next].key
+		for i := range heads {
+			for ok[i] && heads[i].key == key {
+				heads[i], ok[i] = <-chans[i]
+			}
+		}
+	}
+
+	// Stop the readers still running
+	cancel()
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ShardedDict is a sharded dictionary of local files
+type ShardedDict struct {
+	*ShardedReader
+	dicts []*Dict
+}
+
+// NewSharded opens the sharded dictionary of manifest.json. Like New, it
+// checks the signature of the manifest, and the shards against the digests
+// it holds, if trusted public keys are configured, decrypts encrypted shards with the configured key and keeps their index on
+// disk with DICT_LOW_MEMORY.
+func NewSharded() (*ShardedDict, error) {
+	keys, err := PublicKeysFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	encKey, err := EncryptionKeyFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("error reading encryption key: %v", err)
+	}
+
+	lowMemory, err := LowMemoryFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	sd, err := OpenSharded(manifestFilename, WithEncryptionKey(encKey), lowMemory, WithPublicKeys(keys))
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) > 0 {
+		log.Printf("Verified signatures of %d shards", len(sd.dicts))
+	}
+
+	return sd, nil
+}
+
+// OpenSharded opens the shards of the manifest at path and reads their
+// indexes into memory. The options are passed on to every shard. With
+// WithPublicKeys, the manifest is verified before any shard is opened, and
+// every shard is checked against its digest in the manifest instead of its
+// own signature.
+func OpenSharded(path string, opts ...Option) (*ShardedDict, error) {
+	m, err := ReadManifest(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if len(o.publicKeys) > 0 {
+		err = m.Verify(o.publicKeys)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	sd := &ShardedDict{}
+	readers := make([]*Reader, len(m.Shards))
+
+	for i, s := range m.Shards {
+		shardOpts := opts
+		if len(o.publicKeys) > 0 {
+			shardOpts = append(opts[:len(opts):len(opts)], WithPublicKeys(nil), withShard(&m.Shards[i]))
+		}
+
+		d, err := Open(filepath.Join(filepath.Dir(path), s.Path), shardOpts...)
+		if err != nil {
+			sd.Close()
+			return nil, fmt.Errorf("error opening shard %s: %w", s.Path, err)
+		}
+
+		sd.dicts = append(sd.dicts, d)
+		readers[i] = d.rd
+	}
+
+	sd.ShardedReader, err = NewShardedReader(m, readers)
+	if err != nil {
+		sd.Close()
+		return nil, err
+	}
+
+	return sd, nil
+}
+
+// QueryWord queries the dictionary for a word and returns its definition, see Dict.QueryWord
+func (sd *ShardedDict) QueryWord(word string) (string, bool) {
+	e, ok := sd.Lookup(word)
+	if !ok {
+		return "", false
+	}
+
+	return e.Definition(), true
+}
+
+// Lookup queries the dictionary for a word and returns its structured entry
+func (sd *ShardedDict) Lookup(word string) (*Entry, bool) {
+	e, ok, err := sd.ShardedReader.Lookup(word)
+	if err != nil {
+		log.Printf("error reading definition: %v", err)
+		return nil, false
+	}
+	if !ok {
+		log.Printf("Error: '%s' word not found", word)
+		return nil, false
+	}
+
+	return e, true
+}
+
+// headerFlags returns the header flags of the shards, which are built alike
+func (sd *ShardedDict) headerFlags() uint16 {
+	return sd.flags
+}
+
+// Close closes the shard files
+func (sd *ShardedDict) Close() {
+	for _, d := range sd.dicts {
+		d.Close()
+	}
+}
+
+// updateShards applies the changelog at chglogPath to the sharded dictionary
+// of the manifest at manifestPath. Only the shards holding words of the
+// changelog are rebuilt, into the directory shards/<version> next to the
+// manifest, and the new manifest listing them replaces the old one with a
+// single rename. The shard files are never modified after that: the old
+// manifest is archived as archive/<version>/manifest.json, its paths
+// pointing to the shards it lists, along with the changelog. Like UpdateDict,
+// the archived version is then recorded in the history index.
+func updateShards(manifestPath, chglogPath string) error {
+	m, err := ReadManifest(manifestPath)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(manifestPath)
+
+	encKey, err := EncryptionKeyFromEnv()
+	if err != nil {
+		return fmt.Errorf("error reading encryption key: %v", err)
+	}
+	signingKey, err := SigningKeyFromEnv()
+	if err != nil {
+		return fmt.Errorf("error reading signing key: %v", err)
+	}
+
+	// The keys are normalized like the ones of the shards
+	f, rd, err := openRaw(filepath.Join(dir, m.Shards[0].Path))
+	if err != nil {
+		return fmt.Errorf("error opening shard %s: %v", m.Shards[0].Path, err)
+	}
+	flags := rd.header.Flags
+	f.Close()
+
+	// Route the changelog entries to their shards, keeping their order
+	chglogFile, err := os.Open(chglogPath)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %v", chglogPath, err)
+	}
+	defer chglogFile.Close()
+
+	touched := make(map[int][]Change)
+	chglog := newSourceReader(chglogFile, chglogPath)
+	for {
+		c, err := chglog.NextChange()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading changelog: %v", err)
+		}
+
+		i := m.shardFor(NormalizeKey(c.Word, flags))
+		touched[i] = append(touched[i], *c)
+	}
+
+	// The version names the directory of the new shards and the archive
+	// directory of the old manifest
+	now := time.Now()
+	version := now.Format("20060102150405")
+	var records []AuditRecord
+	applied := func(op ProposalOp, c *Change) {
+		records = append(records, newAuditRecord(op, c, flags, version, now.UTC()))
+	}
+
+	shardsDir := filepath.Join(dir, shardsDirname, version)
+	archiveDir := filepath.Join(dir, archiveDirname, version)
+	for _, d := range []string{shardsDir, archiveDir} {
+		if _, err := os.Stat(d); err == nil {
+			return fmt.Errorf("version %s is already archived", version)
+		}
+	}
+
+	err = os.MkdirAll(shardsDir, 0755)
+	if err != nil {
+		return fmt.Errorf("error creating shards directory: %v", err)
+	}
+
+	// The new shards are dropped unless the manifest is switched to them
+	switched := false
+	defer func() {
+		if !switched {
+			os.RemoveAll(shardsDir)
+		}
+	}()
+
+	tempDir, err := os.MkdirTemp(shardsDir, "tmp-dict-update-*")
+	if err != nil {
+		return fmt.Errorf("error creating temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Rebuild the touched shards into the directory of the version
+	updated := *m
+	updated.Shards = append([]ShardInfo(nil), m.Shards...)
+	for i, group := range touched {
+		s := m.Shards[i]
+		name := filepath.Base(s.Path)
+
+		chglogShard := filepath.Join(tempDir, fmt.Sprintf("changelog-%03d.jsonl", i))
+		err = writeChangelog(chglogShard, group)
+		if err != nil {
+			return err
+		}
+
+		newPath := filepath.Join(tempDir, name)
+		err = updateShard(filepath.Join(dir, s.Path), chglogShard, newPath, encKey, signingKey, applied)
+		if err != nil {
+			return fmt.Errorf("error updating shard %s: %v", s.Path, err)
+		}
+
+		// The changelog can add and delete words
+		d, err := Open(newPath, WithEncryptionKey(encKey))
+		if err != nil {
+			return fmt.Errorf("error opening shard %s: %v", s.Path, err)
+		}
+		updated.Shards[i].Entries = d.Len()
+		d.Close()
+
+		updated.Shards[i].SHA256, err = fileDigest(newPath)
+		if err != nil {
+			return err
+		}
+
+		err = moveDict(newPath, filepath.Join(shardsDir, name))
+		if err != nil {
+			return err
+		}
+		updated.Shards[i].Path = filepath.ToSlash(filepath.Join(shardsDirname, version, name))
+	}
+
+	// Archive the old manifest, which points to the old shards from the
+	// archive directory, along with the changelog
+	err = os.MkdirAll(archiveDir, 0755)
+	if err != nil {
+		return fmt.Errorf("error creating archive directory: %v", err)
+	}
+
+	archived := *m
+	archived.Shards = append([]ShardInfo(nil), m.Shards...)
+	for i, s := range archived.Shards {
+		rel, err := filepath.Rel(archiveDir, filepath.Join(dir, s.Path))
+		if err != nil {
+			return err
+		}
+		archived.Shards[i].Path = filepath.ToSlash(rel)
+	}
+
+	err = writeManifest(&archived, filepath.Join(archiveDir, manifestFilename), signingKey)
+	if err != nil {
+		os.RemoveAll(archiveDir)
+		return fmt.Errorf("error archiving manifest: %v", err)
+	}
+
+	// Switch to the new shards at once
+	err = writeManifest(&updated, manifestPath, signingKey)
+	if err != nil {
+		os.RemoveAll(archiveDir)
+		return fmt.Errorf("error writing manifest: %v", err)
+	}
+	switched = true
+
+	err = archiveChangelog(chglogPath, archiveDir, flags&FlagEncrypted != 0)
+	if err != nil {
+		return err
+	}
+
+	err = appendAudit(filepath.Join(dir, auditFilename), records)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Rebuilt %d of %d shards", len(touched), len(m.Shards))
+
+	// Index the archived version for the history queries, see history.go.
+	// The update itself is done, a failure only leaves the index behind.
+	err = updateHistory(filepath.Join(dir, archiveDirname), version, encKey)
+	if err != nil {
+		log.Printf("error indexing history, rebuild it with the history -rebuild command: %v", err)
+	}
+
+	return nil
+}
+
+// updateShard merges the changelog into the shard at path and builds the
+// result at outPath with the same layout. applied is called with every
+// change applied, see mergeSortedFiles.
+func updateShard(path, chglogPath, outPath string, encKey []byte, signingKey ed25519.PrivateKey, applied func(op ProposalOp, c *Change)) error {
+	d, err := Open(path, WithEncryptionKey(encKey))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	chglogFile, err := os.Open(chglogPath)
+	if err != nil {
+		return err
+	}
+	defer chglogFile.Close()
+
+	srcPath := outPath + ".jsonl"
+	src, err := os.Create(srcPath)
+	if err != nil {
+		return fmt.Errorf("error creating source file: %v", err)
+	}
+	defer src.Close()
+
+	w := bufio.NewWriter(src)
+	err = mergeSortedFiles(w, newSourceReader(chglogFile, chglogPath), d.entries(), d.Header().Flags, nil, applied)
+	if err != nil {
+		return err
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	opts := buildOptions(d.Header().Flags)
+	if d.Header().Flags&FlagEncrypted != 0 {
+		opts.EncryptionKey = encKey
+	}
+	opts.SigningKey = signingKey
+
+	return Build(srcPath, outPath, opts)
+}
@@ -0,0 +1,327 @@
+package dict
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// buildShardedDict writes a source of n words and splits it into shards
+func buildShardedDict(t *testing.T, n, shards int, p Partition) string {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	var sb strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&sb, "word%06d,definition number %d\n", i, i)
+	}
+
+	wordsPath := filepath.Join(dir, wordsFilename)
+	if err := os.WriteFile(wordsPath, []byte(sb.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	manifestPath := filepath.Join(dir, manifestFilename)
+	if err := BuildSharded(wordsPath, manifestPath, shards, p, BuildOptions{}); err != nil {
+		t.Fatalf("BuildSharded() error = %v", err)
+	}
+
+	return manifestPath
+}
+
+func TestShardedDict(t *testing.T) {
+	for _, p := range []Partition{PartitionRange, PartitionHash} {
+		t.Run(string(p), func(t *testing.T) {
+			manifestPath := buildShardedDict(t, 1000, 4, p)
+
+			m, err := ReadManifest(manifestPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(m.Shards) != 4 || m.Partition != p {
+				t.Fatalf("manifest = %+v, want 4 %s shards", m, p)
+			}
+
+			total := 0
+			for _, s := range m.Shards {
+				if s.Entries == 0 || s.Entries == 1000 {
+					t.Errorf("shard %s has %d entries, want a part of them", s.Path, s.Entries)
+				}
+				total += s.Entries
+			}
+			if total != 1000 {
+				t.Errorf("shards hold %d entries, want 1000", total)
+			}
+
+			d, err := OpenSharded(manifestPath)
+			if err != nil {
+				t.Fatalf("OpenSharded() error = %v", err)
+			}
+			defer d.Close()
+
+			if d.Len() != 1000 {
+				t.Errorf("Len() = %d, want 1000", d.Len())
+			}
+
+			for _, i := range []int{0, 249, 250, 500, 999} {
+				word := fmt.Sprintf("WORD%06d", i)
+				expected := fmt.Sprintf("definition number %d", i)
+
+				def, ok := d.QueryWord(word)
+				if !ok || def != expected {
+					t.Errorf("QueryWord(%s) = %q, %v, want %q", word, def, ok, expected)
+				}
+			}
+
+			if _, ok := d.QueryWord("missing"); ok {
+				t.Errorf("QueryWord(missing) found a definition")
+			}
+
+			// Iteration is in key order across the shards
+			var keys []string
+			err = d.Iterate(context.Background(), "word000240", "word000760", func(key string, e *Entry) bool {
+				keys = append(keys, key)
+				return true
+			})
+			if err != nil || len(keys) != 520 || keys[0] != "word000240" || keys[519] != "word000759" {
+				t.Fatalf("Iterate() = %d keys, %v", len(keys), err)
+			}
+			for i := 1; i < len(keys); i++ {
+				if keys[i-1] >= keys[i] {
+					t.Fatalf("Iterate() keys out of order: %s, %s", keys[i-1], keys[i])
+				}
+			}
+
+			// Stopping early stops all shards
+			n := 0
+			err = d.Iterate(context.Background(), "", "", func(key string, e *Entry) bool {
+				n++
+				return n < 10
+			})
+			if err != nil || n != 10 {
+				t.Errorf("Iterate() stopped after %d entries, %v, want 10", n, err)
+			}
+		})
+	}
+}
+
+func TestShardedDictEmptyShards(t *testing.T) {
+	// Hash shards of a few words can be empty, range shards are capped
+	for _, p := range []Partition{PartitionRange, PartitionHash} {
+		manifestPath := buildShardedDict(t, 3, 8, p)
+
+		d, err := OpenSharded(manifestPath)
+		if err != nil {
+			t.Fatalf("OpenSharded() error = %v", err)
+		}
+
+		for i := 0; i < 3; i++ {
+			if _, ok := d.QueryWord(fmt.Sprintf("word%06d", i)); !ok {
+				t.Errorf("%s: QueryWord(word%06d) not found", p, i)
+			}
+		}
+
+		n := 0
+		d.All()(func(key string, e *Entry) bool {
+			n++
+			return true
+		})
+		if n != 3 {
+			t.Errorf("%s: All() = %d entries, want 3", p, n)
+		}
+
+		d.Close()
+	}
+}
+
+func TestUpdateShards(t *testing.T) {
+	manifestPath := buildShardedDict(t, 1000, 4, PartitionRange)
+	dir := filepath.Dir(manifestPath)
+
+	before := make(map[string]os.FileInfo)
+	m, _ := ReadManifest(manifestPath)
+	for _, s := range m.Shards {
+		before[s.Path], _ = os.Stat(filepath.Join(dir, s.Path))
+	}
+
+	// Both words are in the first shard
+	chglogPath := filepath.Join(dir, jsonlChglogFilename)
+	chglog := `{"word":"word000010","senses":[{"definition":"updated 10"}]}
+{"word":"word000020","senses":[{"definition":"updated 20"}]}
+`
+	if err := os.WriteFile(chglogPath, []byte(chglog), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := updateShards(manifestPath, chglogPath); err != nil {
+		t.Fatalf("updateShards() error = %v", err)
+	}
+
+	// Only the first shard is rebuilt, into the directory of the version.
+	// The old shard files are left as they are.
+	updated, err := ReadManifest(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := filepath.Base(filepath.Dir(updated.Shards[0].Path))
+	if updated.Shards[0].Path != "shards/"+version+"/"+m.Shards[0].Path {
+		t.Errorf("rebuilt shard path = %s", updated.Shards[0].Path)
+	}
+	for i, s := range m.Shards {
+		fi, err := os.Stat(filepath.Join(dir, s.Path))
+		if err != nil || !os.SameFile(fi, before[s.Path]) {
+			t.Errorf("shard %s modified, %v", s.Path, err)
+		}
+		if i > 0 && updated.Shards[i] != s {
+			t.Errorf("shard %d = %+v, want %+v", i, updated.Shards[i], s)
+		}
+	}
+
+	if _, err := os.Stat(chglogPath); !os.IsNotExist(err) {
+		t.Errorf("changelog was not archived")
+	}
+
+	d, err := OpenSharded(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	for word, expected := range map[string]string{
+		"word000010": "updated 10",
+		"word000020": "updated 20",
+		"word000030": "definition number 30",
+		"word000900": "definition number 900",
+	} {
+		def, ok := d.QueryWord(word)
+		if !ok || def != expected {
+			t.Errorf("QueryWord(%s) = %q, %v, want %q", word, def, ok, expected)
+		}
+	}
+
+	// The old manifest is archived, so the version before the update is
+	// served and indexed in the history like an unsharded one
+	archiveDir := filepath.Join(dir, archiveDirname)
+	vs := OpenVersions(archiveDir, d, 2)
+	defer vs.Close()
+	if def, v, ok, err := vs.QueryWord(version, "word000010"); err != nil || !ok || v != version || def != "definition number 10" {
+		t.Errorf("QueryWord(%s, word000010) = %q, %s, %v, %v", version, def, v, ok, err)
+	}
+
+	h, err := OpenHistory(filepath.Join(archiveDir, historyFilename), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, _ := d.Lookup("word000010")
+	records, err := h.Word("word000010", current)
+	if err != nil || len(records) != 2 || records[0].Version != version || records[0].Entry.Definition() != "definition number 10" {
+		t.Errorf("history of word000010 = %+v, %v", records, err)
+	}
+}
+
+func TestSignedManifest(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	otherPub, _, _ := ed25519.GenerateKey(nil)
+	keys := []ed25519.PublicKey{pub}
+
+	manifestPath := buildShardedDict(t, 100, 2, PartitionRange)
+	dir := filepath.Dir(manifestPath)
+
+	// An unsigned manifest is rejected before any shard is opened
+	if _, err := OpenSharded(manifestPath, WithPublicKeys(keys)); !errors.Is(err, ErrSignature) {
+		t.Errorf("OpenSharded() of an unsigned manifest error = %v, want %v", err, ErrSignature)
+	}
+
+	if err := SignManifest(manifestPath, priv); err != nil {
+		t.Fatalf("SignManifest() error = %v", err)
+	}
+	d, err := OpenSharded(manifestPath, WithPublicKeys(keys))
+	if err != nil {
+		t.Fatalf("OpenSharded() of a signed manifest error = %v", err)
+	}
+	d.Close()
+	if _, err := OpenSharded(manifestPath, WithPublicKeys([]ed25519.PublicKey{otherPub})); !errors.Is(err, ErrSignature) {
+		t.Errorf("OpenSharded() with an unknown key error = %v, want %v", err, ErrSignature)
+	}
+
+	// The manifest can't be edited without breaking its signature
+	m, _ := ReadManifest(manifestPath)
+	m.Shards[1].From = "word000010"
+	data, _ := json.Marshal(m)
+	tampered := filepath.Join(dir, "tampered.json")
+	os.WriteFile(tampered, data, 0644)
+	if _, err := OpenSharded(tampered, WithPublicKeys(keys)); !errors.Is(err, ErrSignature) {
+		t.Errorf("OpenSharded() of a tampered manifest error = %v, want %v", err, ErrSignature)
+	}
+
+	// Nor can a shard be replaced
+	m, _ = ReadManifest(manifestPath)
+	shardPath := filepath.Join(dir, m.Shards[1].Path)
+	other := buildVersion(t, dir, "other", "zebra,an animal\n")
+	if err := moveDict(other, shardPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenSharded(manifestPath, WithPublicKeys(keys)); !errors.Is(err, ErrSignature) {
+		t.Errorf("OpenSharded() with a replaced shard error = %v, want %v", err, ErrSignature)
+	}
+}
+
+func TestUpdateSignedShards(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	keys := []ed25519.PublicKey{pub}
+
+	manifestPath := buildShardedDict(t, 100, 2, PartitionRange)
+	dir := filepath.Dir(manifestPath)
+	if err := SignManifest(manifestPath, priv); err != nil {
+		t.Fatal(err)
+	}
+
+	keyPath := filepath.Join(dir, "dict.key")
+	os.WriteFile(keyPath, []byte(base64.StdEncoding.EncodeToString(priv.Seed())), 0600)
+	t.Setenv("DICT_SIGNING_KEY_FILE", keyPath)
+
+	chglogPath := filepath.Join(dir, jsonlChglogFilename)
+	os.WriteFile(chglogPath, []byte(`{"word":"word000090","senses":[{"definition":"updated 90"}]}`+"\n"), 0644)
+	if err := updateShards(manifestPath, chglogPath); err != nil {
+		t.Fatalf("updateShards() error = %v", err)
+	}
+
+	// Both the new and the archived manifests are signed
+	d, err := OpenSharded(manifestPath, WithPublicKeys(keys))
+	if err != nil {
+		t.Fatalf("OpenSharded() error = %v", err)
+	}
+	defer d.Close()
+
+	versions, _ := archivedVersions(filepath.Join(dir, archiveDirname))
+	if len(versions) != 1 {
+		t.Fatalf("archived versions = %v", versions)
+	}
+	vs := OpenVersions(filepath.Join(dir, archiveDirname), d, 2, WithPublicKeys(keys))
+	defer vs.Close()
+	if def, _, ok, err := vs.QueryWord(versions[0], "word000090"); err != nil || !ok || def != "definition number 90" {
+		t.Errorf("QueryWord(%s, word000090) = %q, %v, %v", versions[0], def, ok, err)
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+	for _, data := range []string{
+		`not json`,
+		`{"version":2,"partition":"range","shards":[{"path":"a.dat"}]}`,
+		`{"version":1,"partition":"modulo","shards":[{"path":"a.dat"}]}`,
+		`{"version":1,"partition":"hash","shards":[]}`,
+		`{"version":1,"partition":"range","shards":[{"path":"a.dat"},{"path":"b.dat","from":"m"},{"path":"c.dat","from":"c"}]}`,
+	} {
+		if _, err := ParseManifest([]byte(data)); err == nil {
+			t.Errorf("ParseManifest(%s) succeeded", data)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package dict
+
+// This file contains the signing of dictionary images with Ed25519.
+//
+// The signature is detached, stored next to the image as <dict.dat>.sig:
+//
+//	{"key_id":"...","sha256":"...","signature":"..."}
+//
+// It signs the SHA-256 digest of the whole image. The key id names the
+// public key the signature verifies with, so that several keys can be
+// trusted at once while signing keys are rotated: add the new public key to
+// DICT_PUBLIC_KEYS, sign with the new private key, then drop the old public key.
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	// SignatureExt is appended to the path (or S3 key) of a dictionary to get its signature's
+	SignatureExt = ".sig"
+
+	// signatureContext is prepended to the signed digest, so that the keys
+	// can't be used to forge signatures of anything else
+	signatureContext = "word-dict dict.dat v1\n"
+)
+
+// ErrSignature is returned when a dictionary isn't signed by a trusted key
+var ErrSignature = errors.New("signature verification failed")
+
+// Signature is the detached signature of a dictionary image
+type Signature struct {
+	KeyID     string `json:"key_id"`
+	SHA256    string `json:"sha256"`
+	Signature []byte `json:"signature"`
+}
+
+// KeyID returns the id of a public key, the hex encoded first 8 bytes of its SHA-256
+func KeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// digest returns the SHA-256 digest of the image read from r
+func digest(r io.Reader) ([]byte, error) {
+	h := sha256.New()
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return nil, fmt.Errorf("error hashing dictionary: %v", err)
+	}
+
+	return h.Sum(nil), nil
+}
+
+// Sign signs the image read from r with the private key
+func Sign(r io.Reader, priv ed25519.PrivateKey) (*Signature, error) {
+	sum, err := digest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Signature{
+		KeyID:     KeyID(priv.Public().(ed25519.PublicKey)),
+		SHA256:    hex.EncodeToString(sum),
+		Signature: ed25519.Sign(priv, append([]byte(signatureContext), sum...)),
+	}, nil
+}
+
+// publicKey returns the trusted key the signature is made by
+func (s *Signature) publicKey(keys []ed25519.PublicKey) (ed25519.PublicKey, error) {
+	for _, k := range keys {
+		if KeyID(k) == s.KeyID {
+			return k, nil
+		}
+	}
+
+	ids := make([]string, len(keys))
+	for i, k := range keys {
+		ids[i] = KeyID(k)
+	}
+
+	return nil, fmt.Errorf("%w: signed by unknown key %s, trusted keys are %s", ErrSignature, s.KeyID, strings.Join(ids, ", "))
+}
+
+// Verify checks that the signature is made by one of the trusted keys and
+// matches the image read from r
+func (s *Signature) Verify(r io.Reader, keys []ed25519.PublicKey) error {
+	// The key is checked first, so that an unknown key fails without hashing the image
+	_, err := s.publicKey(keys)
+	if err != nil {
+		return err
+	}
+
+	sum, err := digest(r)
+	if err != nil {
+		return err
+	}
+
+	return s.VerifyDigest(sum, keys)
+}
+
+// VerifyDigest checks that the signature is made by one of the trusted keys
+// and matches the SHA-256 digest of an image, e.g. the checksum kept by the
+// storage of the image
+func (s *Signature) VerifyDigest(sum []byte, keys []ed25519.PublicKey) error {
+	pub, err := s.publicKey(keys)
+	if err != nil {
+		return err
+	}
+
+	if hex.EncodeToString(sum) != s.SHA256 {
+		return fmt.Errorf("%w: image digest %x doesn't match the signed digest %s", ErrSignature, sum, s.SHA256)
+	}
+
+	if !ed25519.Verify(pub, append([]byte(signatureContext), sum...), s.Signature) {
+		return fmt.Errorf("%w: invalid signature by key %s", ErrSignature, s.KeyID)
+	}
+
+	return nil
+}
+
+// ParseSignature parses a signature file
+func ParseSignature(data []byte) (*Signature, error) {
+	var s Signature
+
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature: %v", ErrSignature, err)
+	}
+
+	return &s, nil
+}
+
+// SignFile signs the dictionary file at path and writes the signature to path + SignatureExt
+func SignFile(path string, priv ed25519.PrivateKey) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s, err := Sign(f, priv)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path+SignatureExt, append(data, '\n'), 0644)
+}
+
+// VerifySignatureFile checks the dictionary file at path against its
+// signature at path + SignatureExt
+func VerifySignatureFile(path string, keys []ed25519.PublicKey) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	return verifySignature(f, fi.Size(), path, keys)
+}
+
+// verifySignature checks the image of size bytes read from r against the
+// signature at path + SignatureExt. The file is verified through the handle
+// it's then read from, so that a file replaced meanwhile isn't read instead.
+func verifySignature(r io.ReaderAt, size int64, path string, keys []ed25519.PublicKey) error {
+	data, err := os.ReadFile(path + SignatureExt)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrSignature, err)
+	}
+
+	s, err := ParseSignature(data)
+	if err != nil {
+		return err
+	}
+
+	return s.Verify(io.NewSectionReader(r, 0, size), keys)
+}
+
+// WithPublicKeys checks the dictionary files against their signatures, see
+// VerifySignatureFile, when they are opened. Files not signed by one of the
+// keys fail to open with ErrSignature. No keys disable the check.
+func WithPublicKeys(keys []ed25519.PublicKey) Option {
+	return func(o *options) {
+		o.publicKeys = keys
+	}
+}
+
+// ParsePublicKeys parses a comma separated list of base64 encoded public keys
+func ParsePublicKeys(s string) ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+
+	for _, k := range strings.Split(s, ",") {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+
+		buf, err := base64.StdEncoding.DecodeString(k)
+		if err != nil || len(buf) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid public key %q", k)
+		}
+
+		keys = append(keys, ed25519.PublicKey(buf))
+	}
+
+	return keys, nil
+}
+
+// PublicKeysFromEnv returns the trusted public keys configured in
+// DICT_PUBLIC_KEYS. Signatures are only checked if keys are configured.
+func PublicKeysFromEnv() ([]ed25519.PublicKey, error) {
+	return ParsePublicKeys(os.Getenv("DICT_PUBLIC_KEYS"))
+}
+
+// ReadPrivateKey reads a base64 encoded private key (or its 32 byte seed) from a file
+func ReadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key in %s: %v", path, err)
+	}
+
+	switch len(buf) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(buf), nil
+	case ed25519.PrivateKeySize:
+		// The second half is the public key, derive it from the seed instead
+		return ed25519.NewKeyFromSeed(buf[:ed25519.SeedSize]), nil
+	}
+
+	return nil, fmt.Errorf("invalid private key in %s: %d bytes", path, len(buf))
+}
+
+// SigningKeyFromEnv returns the private key in the file DICT_SIGNING_KEY_FILE,
+// nil if it's not set. The dictionaries, segments and manifests written by
+// this package and by the CLI subcommands are signed with it, so that they
+// pass the checks of DICT_PUBLIC_KEYS.
+func SigningKeyFromEnv() (ed25519.PrivateKey, error) {
+	path := os.Getenv("DICT_SIGNING_KEY_FILE")
+	if path == "" {
+		return nil, nil
+	}
+
+	return ReadPrivateKey(path)
+}
+
+// checkSigningKey returns an error if trusted public keys are configured
+// and the signing key is missing or not one of them, as the files written
+// by the background jobs would be rejected the next time they are opened
+func checkSigningKey() error {
+	keys, err := PublicKeysFromEnv()
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	priv, err := SigningKeyFromEnv()
+	if err != nil {
+		return fmt.Errorf("error reading signing key: %v", err)
+	}
+	if priv == nil {
+		return fmt.Errorf("%w: DICT_PUBLIC_KEYS is set without DICT_SIGNING_KEY_FILE, the files written would be unsigned", ErrSignature)
+	}
+
+	pub := priv.Public().(ed25519.PublicKey)
+	for _, k := range keys {
+		if k.Equal(pub) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: the signing key %s isn't one of DICT_PUBLIC_KEYS", ErrSignature, KeyID(pub))
+}
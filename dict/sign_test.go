@@ -0,0 +1,156 @@
+package dict
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignatures(t *testing.T) {
+	oldPub, oldPriv, _ := ed25519.GenerateKey(nil)
+	newPub, newPriv, _ := ed25519.GenerateKey(nil)
+
+	// Build signs the dictionary with the signing key
+	dictPath := buildBenchDict(t, t.TempDir(), 1000, BuildOptions{SigningKey: oldPriv})
+
+	if err := VerifySignatureFile(dictPath, []ed25519.PublicKey{oldPub}); err != nil {
+		t.Fatalf("VerifySignatureFile() error = %v", err)
+	}
+
+	// During a rotation both keys are trusted
+	if err := VerifySignatureFile(dictPath, []ed25519.PublicKey{newPub, oldPub}); err != nil {
+		t.Errorf("VerifySignatureFile() with rotated keys error = %v", err)
+	}
+
+	// Once the old key is dropped, the dictionary has to be signed again
+	err := VerifySignatureFile(dictPath, []ed25519.PublicKey{newPub})
+	if !errors.Is(err, ErrSignature) || !strings.Contains(err.Error(), "unknown key "+KeyID(oldPub)) {
+		t.Errorf("VerifySignatureFile() with an unknown key error = %v", err)
+	}
+
+	if err := SignFile(dictPath, newPriv); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifySignatureFile(dictPath, []ed25519.PublicKey{newPub}); err != nil {
+		t.Errorf("VerifySignatureFile() after signing with the new key error = %v", err)
+	}
+
+	// A modified dictionary doesn't match its signature
+	tampered := corruptFile(t, dictPath, 100)
+	sig, _ := os.ReadFile(dictPath + SignatureExt)
+	os.WriteFile(tampered+SignatureExt, sig, 0644)
+
+	if err := VerifySignatureFile(tampered, []ed25519.PublicKey{newPub}); !errors.Is(err, ErrSignature) {
+		t.Errorf("VerifySignatureFile() of a tampered file error = %v, want %v", err, ErrSignature)
+	}
+
+	// Nor does a forged signature of the right digest
+	s, _ := ParseSignature(sig)
+	s.Signature[0] ^= 0xff
+	data, _ := os.Open(dictPath)
+	defer data.Close()
+	if err := s.Verify(data, []ed25519.PublicKey{newPub}); !errors.Is(err, ErrSignature) {
+		t.Errorf("Verify() of a forged signature error = %v, want %v", err, ErrSignature)
+	}
+
+	// The digest can be checked on its own, e.g. against the checksum of S3
+	sum, _ := os.ReadFile(dictPath)
+	good, _ := ParseSignature(sig)
+	if err := good.VerifyDigest(sha256Sum(sum), []ed25519.PublicKey{newPub}); err != nil {
+		t.Errorf("VerifyDigest() error = %v", err)
+	}
+	if err := good.VerifyDigest(make([]byte, 32), []ed25519.PublicKey{newPub}); !errors.Is(err, ErrSignature) {
+		t.Errorf("VerifyDigest() of another digest error = %v, want %v", err, ErrSignature)
+	}
+
+	// Opening with the trusted keys verifies the file it reads
+	d, err := Open(dictPath, WithPublicKeys([]ed25519.PublicKey{newPub}))
+	if err != nil {
+		t.Fatalf("Open() of a signed file error = %v", err)
+	}
+	d.Close()
+	if _, err := Open(tampered, WithPublicKeys([]ed25519.PublicKey{newPub})); !errors.Is(err, ErrSignature) {
+		t.Errorf("Open() of a tampered file error = %v, want %v", err, ErrSignature)
+	}
+
+	// Rebuilding without a key removes the stale signature
+	dir := filepath.Dir(dictPath)
+	buildBenchDict(t, dir, 1000, BuildOptions{})
+	if err := VerifySignatureFile(dictPath, []ed25519.PublicKey{newPub}); !errors.Is(err, ErrSignature) {
+		t.Errorf("VerifySignatureFile() of an unsigned file error = %v, want %v", err, ErrSignature)
+	}
+}
+
+// sha256Sum returns the SHA-256 digest of data
+func sha256Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+func TestParseKeys(t *testing.T) {
+	pub1, priv, _ := ed25519.GenerateKey(nil)
+	pub2, _, _ := ed25519.GenerateKey(nil)
+
+	keys, err := ParsePublicKeys(base64.StdEncoding.EncodeToString(pub1) + ", " + base64.StdEncoding.EncodeToString(pub2))
+	if err != nil || len(keys) != 2 || !keys[0].Equal(pub1) || !keys[1].Equal(pub2) {
+		t.Errorf("ParsePublicKeys() = %v, %v", keys, err)
+	}
+
+	if _, err := ParsePublicKeys("not a key"); err == nil {
+		t.Errorf("ParsePublicKeys() of an invalid key succeeded")
+	}
+
+	// Both the seed and the full private key are accepted
+	for _, buf := range [][]byte{priv.Seed(), priv} {
+		path := filepath.Join(t.TempDir(), "dict.key")
+		os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(buf)+"\n"), 0600)
+
+		got, err := ReadPrivateKey(path)
+		if err != nil || !got.Equal(priv) {
+			t.Errorf("ReadPrivateKey() of %d bytes = %v, want the private key", len(buf), err)
+		}
+	}
+}
+
+func TestBackgroundJobsNeedSigningKey(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	_, otherPriv, _ := ed25519.GenerateKey(nil)
+
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "dict.key")
+	otherPath := filepath.Join(dir, "other.key")
+	os.WriteFile(keyPath, []byte(base64.StdEncoding.EncodeToString(priv.Seed())), 0600)
+	os.WriteFile(otherPath, []byte(base64.StdEncoding.EncodeToString(otherPriv.Seed())), 0600)
+
+	d, err := Open(buildBenchDict(t, dir, 10, BuildOptions{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	e := &Editor{d: d}
+
+	t.Setenv("DICT_PUBLIC_KEYS", base64.StdEncoding.EncodeToString(pub))
+	for _, path := range []string{"", otherPath} {
+		t.Setenv("DICT_SIGNING_KEY_FILE", path)
+
+		if _, err := d.StartCompaction(time.Hour, 1); !errors.Is(err, ErrSignature) {
+			t.Errorf("StartCompaction() with signing key %q error = %v, want %v", path, err, ErrSignature)
+		}
+		if _, err := e.StartFolding(time.Hour); !errors.Is(err, ErrSignature) {
+			t.Errorf("StartFolding() with signing key %q error = %v, want %v", path, err, ErrSignature)
+		}
+	}
+
+	t.Setenv("DICT_SIGNING_KEY_FILE", keyPath)
+	stop, err := d.StartCompaction(time.Hour, 1)
+	if err != nil {
+		t.Fatalf("StartCompaction() error = %v", err)
+	}
+	stop()
+}
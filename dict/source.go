@@ -0,0 +1,148 @@
+package dict
+
+// This file contains the readers and writers for the source files
+// the dictionary is built from.
+//
+// Two formats are supported:
+//  1. words.dat - one "<word>,<definition>" per line. Every line becomes an
+//     entry with a single sense.
+//  2. words.jsonl - one JSON encoded Entry per line, e.g.
+//     {"word":"abandon","pronunciation":"/əˈbændən/","senses":[{"pos":"verb","definition":"to leave","examples":["they abandoned the car"]}]}
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// jsonlWordsFilename is the structured source file. It takes precedence
+	// over words.dat when both exist.
+	jsonlWordsFilename = "words.jsonl"
+)
+
+// changeReader reads the changes of a changelog one by one, returning io.EOF
+// once they are all read, see sourceReader.NextChange
+type changeReader interface {
+	NextChange() (*Change, error)
+}
+
+// sourceReader reads entries from a source file line by line.
+// Lines are read with a bufio.Reader rather than a bufio.Scanner, so that
+// definitions are not limited by the scanner's maximum token size.
+type sourceReader struct {
+	r     *bufio.Reader
+	jsonl bool
+	line  int
+}
+
+func newSourceReader(r io.Reader, path string) *sourceReader {
+	return &sourceReader{
+		r:     bufio.NewReader(r),
+		jsonl: isJSONL(path),
+	}
+}
+
+// Next returns the next entry or io.EOF once the source is exhausted.
+// Malformed lines are logged and skipped.
+func (sr *sourceReader) Next() (*Entry, error) {
+	c, err := sr.NextChange()
+	if err != nil {
+		return nil, err
+	}
+
+	return &c.Entry, nil
+}
+
+// NextChange returns the next line of a changelog as a change, see Change.
+// Only the lines of changelog.jsonl can delete words.
+func (sr *sourceReader) NextChange() (*Change, error) {
+	for {
+		line, err := sr.r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil, io.EOF
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		sr.line++
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		c, err := parseSourceLine(line, sr.jsonl)
+		if err != nil {
+			log.Printf("Skipping line %d: %v", sr.line, err)
+			continue
+		}
+
+		return c, nil
+	}
+}
+
+// parseSourceLine parses a single line of words.dat or words.jsonl, or of
+// the changelogs of the same formats
+func parseSourceLine(line string, jsonl bool) (*Change, error) {
+	var c Change
+	e := &c.Entry
+
+	if jsonl {
+		err := json.Unmarshal([]byte(line), &c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry: %v", err)
+		}
+	} else {
+		// Only the first comma separates the word, definitions may contain commas
+		word, definition, ok := strings.Cut(line, ",")
+		if !ok {
+			return nil, fmt.Errorf("missing definition")
+		}
+
+		*e = Entry{
+			Word:   word,
+			Senses: []Sense{{Definition: definition}},
+		}
+	}
+
+	if e.Word == "" {
+		return nil, fmt.Errorf("missing word")
+	}
+
+	e.numberSenses()
+
+	return &c, nil
+}
+
+// writeSourceEntry writes an entry as a line of words.jsonl
+func writeSourceEntry(w io.Writer, e *Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(line, '\n'))
+
+	return err
+}
+
+// isJSONL reports whether the source file at path holds JSON lines
+func isJSONL(path string) bool {
+	return filepath.Ext(path) == ".jsonl"
+}
+
+// sourceFilename returns the source file the dictionary is built from,
+// words.jsonl if it exists and words.dat otherwise
+func sourceFilename() string {
+	if _, err := os.Stat(jsonlWordsFilename); err == nil {
+		return jsonlWordsFilename
+	}
+
+	return wordsFilename
+}
@@ -0,0 +1,268 @@
+package dict
+
+// This file contains the sparse index used by the low-memory mode.
+//
+// Since the index entries are sorted by key, a lookup only needs every n-th
+// key (a restart point) to find the run of entries that may hold a key.
+// The sparse section stores those keys:
+//
+//	<interval (4 bytes)><entry count (8 bytes)><slot count (4 bytes)>
+//	<slot count + 1 x <index offset (8 bytes)><key offset (8 bytes)>>
+//	<keys>
+//
+// Index offsets are relative to the index section and key offsets relative to
+// the keys. The extra last slot marks the end of both, so the key of slot i
+// spans [key offset i, key offset i+1). Slots have a fixed size, so they can
+// be binary searched with ReadAt calls (or range requests) without loading
+// the section.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	// DefaultSparseInterval is the number of index entries between two restart points
+	DefaultSparseInterval = 32
+
+	sparseHeaderSize = 16
+	sparseSlotSize   = 16
+)
+
+// encodeSparse builds the sparse section for the index entries. offsets
+// holds the offset of every index entry relative to the index section and
+// indexSize is the size of the index section.
+func encodeSparse(entries []IndexEntry, offsets []int64, indexSize int64, interval int) []byte {
+	var slots, keys bytes.Buffer
+
+	n := 0
+	for i := 0; i < len(entries); i += interval {
+		binary.Write(&slots, binary.BigEndian, offsets[i])
+		binary.Write(&slots, binary.BigEndian, int64(keys.Len()))
+		keys.WriteString(entries[i].Key)
+		n++
+	}
+
+	// End of the index entries and the keys
+	binary.Write(&slots, binary.BigEndian, indexSize)
+	binary.Write(&slots, binary.BigEndian, int64(keys.Len()))
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(interval))
+	binary.Write(&buf, binary.BigEndian, uint64(len(entries)))
+	binary.Write(&buf, binary.BigEndian, uint32(n))
+	buf.Write(slots.Bytes())
+	buf.Write(keys.Bytes())
+
+	return buf.Bytes()
+}
+
+// sparseSlot is a restart point of the index
+type sparseSlot struct {
+	key    string
+	offset int64 // offset of the index entry relative to the index section
+}
+
+// sortedIndex looks keys up in the sorted index section on disk.
+// Only the sparse section header, and optionally its keys (the sample), are
+// kept in memory, so memory does not grow with the size of the dictionary.
+type sortedIndex struct {
+	r      io.ReaderAt
+	index  section
+	sparse section
+	flags  uint16
+
+	entries int
+	slots   int
+
+	// sample holds all restart points including the end marker, nil if the
+	// sparse section is searched on disk
+	sample []sparseSlot
+}
+
+func newSortedIndex(r io.ReaderAt, index, sparse section, flags uint16, loadSample bool) (*sortedIndex, error) {
+	if sparse.Size < sparseHeaderSize {
+		return nil, fmt.Errorf("%w: truncated sparse index", ErrBadFormat)
+	}
+
+	var buf []byte
+	if loadSample {
+		// The whole section is read at once, the keys are a fraction of the index
+		buf = make([]byte, sparse.Size)
+	} else {
+		buf = make([]byte, sparseHeaderSize)
+	}
+
+	_, err := r.ReadAt(buf, sparse.Offset)
+	if err != nil {
+		return nil, fmt.Errorf("error reading sparse index: %v", err)
+	}
+
+	si := &sortedIndex{
+		r:       r,
+		index:   index,
+		sparse:  sparse,
+		flags:   flags,
+		entries: int(binary.BigEndian.Uint64(buf[4:])),
+		slots:   int(binary.BigEndian.Uint32(buf[12:])),
+	}
+
+	if sparseHeaderSize+int64(si.slots+1)*sparseSlotSize > sparse.Size {
+		return nil, fmt.Errorf("%w: truncated sparse index", ErrBadFormat)
+	}
+
+	if loadSample {
+		si.sample, err = decodeSparseSample(buf[sparseHeaderSize:], si.slots)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return si, nil
+}
+
+// decodeSparseSample parses the slots and keys of the sparse section
+func decodeSparseSample(buf []byte, slots int) ([]sparseSlot, error) {
+	keys := buf[(slots+1)*sparseSlotSize:]
+
+	sample := make([]sparseSlot, slots+1)
+	for i := range sample {
+		slot := buf[i*sparseSlotSize:]
+		sample[i].offset = int64(binary.BigEndian.Uint64(slot))
+
+		if i == slots {
+			break
+		}
+
+		st := binary.BigEndian.Uint64(slot[8:])
+		en := binary.BigEndian.Uint64(slot[8+sparseSlotSize:])
+		if st > en || en > uint64(len(keys)) {
+			return nil, fmt.Errorf("%w: corrupt sparse index", ErrBadFormat)
+		}
+		sample[i].key = string(keys[st:en])
+	}
+
+	return sample, nil
+}
+
+func (si *sortedIndex) len() int {
+	return si.entries
+}
+
+// slot returns restart point i. i == slots returns the end marker, which has no key.
+func (si *sortedIndex) slot(i int) (sparseSlot, error) {
+	if si.sample != nil {
+		return si.sample[i], nil
+	}
+
+	// Read slot i and the next one to get the length of the key
+	buf := make([]byte, 2*sparseSlotSize)
+	if i == si.slots {
+		buf = buf[:sparseSlotSize]
+	}
+
+	slotsOffset := si.sparse.Offset + sparseHeaderSize
+	_, err := si.r.ReadAt(buf, slotsOffset+int64(i)*sparseSlotSize)
+	if err != nil {
+		return sparseSlot{}, fmt.Errorf("error reading sparse index: %v", err)
+	}
+
+	s := sparseSlot{offset: int64(binary.BigEndian.Uint64(buf))}
+	if i == si.slots {
+		return s, nil
+	}
+
+	st := int64(binary.BigEndian.Uint64(buf[8:]))
+	en := int64(binary.BigEndian.Uint64(buf[8+sparseSlotSize:]))
+	keysOffset := slotsOffset + int64(si.slots+1)*sparseSlotSize
+	if st > en || keysOffset+en > si.sparse.Offset+si.sparse.Size {
+		return sparseSlot{}, fmt.Errorf("%w: corrupt sparse index", ErrBadFormat)
+	}
+
+	key := make([]byte, en-st)
+	_, err = si.r.ReadAt(key, keysOffset+st)
+	if err != nil {
+		return sparseSlot{}, fmt.Errorf("error reading sparse index: %v", err)
+	}
+	s.key = string(key)
+
+	return s, nil
+}
+
+// search returns the last restart point whose key is <= key, or -1 if key
+// sorts before the first entry
+func (si *sortedIndex) search(key string) (int, error) {
+	var err error
+
+	i := sort.Search(si.slots, func(i int) bool {
+		if err != nil {
+			return true
+		}
+
+		var s sparseSlot
+		s, err = si.slot(i)
+
+		return s.key > key
+	})
+
+	return i - 1, err
+}
+
+// run reads the index entries from restart point i up to the next one at once
+func (si *sortedIndex) run(i int) ([]byte, error) {
+	st, err := si.slot(i)
+	if err != nil {
+		return nil, err
+	}
+
+	en, err := si.slot(i + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	if st.offset > en.offset || en.offset > si.index.Size {
+		return nil, fmt.Errorf("%w: corrupt sparse index", ErrBadFormat)
+	}
+
+	buf := make([]byte, en.offset-st.offset)
+	_, err = si.r.ReadAt(buf, si.index.Offset+st.offset)
+	if err != nil {
+		return nil, fmt.Errorf("error reading index: %v", err)
+	}
+
+	return buf, nil
+}
+
+func (si *sortedIndex) lookup(key string) (IndexEntry, bool, error) {
+	i, err := si.search(key)
+	if err != nil || i < 0 {
+		return IndexEntry{}, false, err
+	}
+
+	buf, err := si.run(i)
+	if err != nil {
+		return IndexEntry{}, false, err
+	}
+
+	// The run starts at a restart point, so it can be decoded on its own
+	d := newIndexDecoder(buf, si.flags)
+	for {
+		e, ok := d.next()
+		if !ok {
+			break
+		}
+
+		c := compareBytesString(e.key, key)
+		if c == 0 {
+			return e.entry(), true, nil
+		}
+		if c > 0 {
+			break
+		}
+	}
+
+	return IndexEntry{}, false, d.err
+}
@@ -0,0 +1,118 @@
+package dict
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// countingReaderAt counts the bytes read through it
+type countingReaderAt struct {
+	f *os.File
+	n int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.f.ReadAt(p, off)
+	c.n += int64(n)
+	return n, err
+}
+
+func TestLowMemoryLookup(t *testing.T) {
+	dir := t.TempDir()
+	wordsPath := filepath.Join(dir, wordsFilename)
+
+	var sb strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&sb, "word%04d,definition %d\n", i*2, i*2)
+	}
+	if err := os.WriteFile(wordsPath, []byte(sb.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, compress := range []bool{false, true} {
+		dictPath := filepath.Join(dir, fmt.Sprintf("dict-%v.dat", compress))
+		if err := Build(wordsPath, dictPath, BuildOptions{Compress: compress, SparseInterval: 8}); err != nil {
+			t.Fatalf("Build() error = %v", err)
+		}
+
+		for _, sample := range []bool{false, true} {
+			t.Run(fmt.Sprintf("compress=%v/sample=%v", compress, sample), func(t *testing.T) {
+				f, err := os.Open(dictPath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+				fi, _ := f.Stat()
+
+				cr := &countingReaderAt{f: f}
+				rd, err := NewReader(cr, fi.Size(), WithLowMemory(sample))
+				if err != nil {
+					t.Fatalf("NewReader() error = %v", err)
+				}
+
+				// Without the sample only the headers are read at startup
+				index, _ := rd.section(sectionIndex)
+				if !sample && cr.n >= index.Size/10 {
+					t.Errorf("read %d bytes at startup, index is %d bytes", cr.n, index.Size)
+				}
+
+				if rd.Len() != 1000 {
+					t.Errorf("Len() = %d, want 1000", rd.Len())
+				}
+
+				for i := 0; i < 2000; i++ {
+					word := fmt.Sprintf("word%04d", i)
+					e, ok, err := rd.Lookup(word)
+					if err != nil {
+						t.Fatalf("Lookup(%s) error = %v", word, err)
+					}
+
+					// Only even words exist
+					if ok != (i%2 == 0) {
+						t.Fatalf("Lookup(%s) found = %v", word, ok)
+					}
+					if ok && e.Definition() != fmt.Sprintf("definition %d", i) {
+						t.Errorf("Lookup(%s) = %q", word, e.Definition())
+					}
+				}
+
+				for _, word := range []string{"a", "word", "word1999", "zebra"} {
+					if _, ok, err := rd.Lookup(word); ok || err != nil {
+						t.Errorf("Lookup(%s) = %v, %v, want not found", word, ok, err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestLowMemoryFromEnv(t *testing.T) {
+	for s, want := range map[string]options{
+		"":       {},
+		"false":  {},
+		"true":   {lowMemory: true},
+		"1":      {lowMemory: true},
+		"sample": {lowMemory: true, sparseSample: true},
+	} {
+		t.Setenv("DICT_LOW_MEMORY", s)
+
+		opt, err := LowMemoryFromEnv()
+		if err != nil {
+			t.Fatalf("LowMemoryFromEnv() of %q error = %v", s, err)
+		}
+
+		var o options
+		opt(&o)
+		if o.lowMemory != want.lowMemory || o.sparseSample != want.sparseSample {
+			t.Errorf("LowMemoryFromEnv() of %q = %+v, want %+v", s, o, want)
+		}
+	}
+
+	t.Setenv("DICT_LOW_MEMORY", "maybe")
+	if _, err := LowMemoryFromEnv(); err == nil {
+		t.Error("LowMemoryFromEnv() of an invalid value succeeded")
+	}
+}
@@ -0,0 +1,401 @@
+package dict
+
+// This file contains the StarDict format, a dictionary of three files:
+//
+//	<name>.ifo - "StarDict's dict ifo file" followed by key=value lines
+//	<name>.idx - <word>\0<offset><size> for every entry, offset and size as
+//	             big endian uint32 (offset as uint64 with idxoffsetbits=64)
+//	<name>.dict - the data of the entries, optionally dictzip compressed
+//
+// The data of an entry is a list of fields of a type given by a letter.
+// Lowercase types are text ended by \0, uppercase types are binary data
+// prefixed by their size as a big endian uint32. With sametypesequence in
+// the .ifo the types are left out of the data, and so is the end of the
+// last field.
+//
+// Text (m, l, y, k, w) and marked up (g, h, x) fields become the senses,
+// one per line, and phonetics (t) the pronunciation. Other fields, e.g.
+// sounds and pictures, are left out.
+//
+// Exported dictionaries have a sametypesequence of tm, the pronunciation
+// followed by the senses and the etymology, one per line.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// starDictMagic is the first line of a .ifo file
+const starDictMagic = "StarDict's dict ifo file"
+
+// maxStarDictWordLen is the longest headword of a .idx file
+const maxStarDictWordLen = 255
+
+// readStarDictInfo parses the key=value lines of a .ifo file
+func readStarDictInfo(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", filepath.Base(path), err)
+	}
+
+	lines := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	if strings.TrimSpace(lines[0]) != starDictMagic {
+		return nil, fmt.Errorf("%w: %s is not a StarDict .ifo file", ErrBadFormat, filepath.Base(path))
+	}
+
+	info := make(map[string]string)
+	for _, line := range lines[1:] {
+		if key, value, ok := strings.Cut(line, "="); ok {
+			info[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+
+	return info, nil
+}
+
+// openStarDict reads the entries of the StarDict dictionary of path in the
+// order of its .idx file
+func (im *Importer) openStarDict(path string) error {
+	base := basePath(path, ".ifo", ".idx.gz", ".idx", ".dict.dz", ".dict")
+
+	info, err := readStarDictInfo(base + ".ifo")
+	if err != nil {
+		return err
+	}
+
+	offsetSize := 4
+	if info["idxoffsetbits"] == "64" {
+		offsetSize = 8
+	}
+	seq := info["sametypesequence"]
+
+	// The index may be gzip compressed as .idx.gz
+	var idx io.Reader
+	idxFile, err := os.Open(base + ".idx")
+	if os.IsNotExist(err) {
+		idxFile, err = os.Open(base + ".idx.gz")
+		if err == nil {
+			idx, err = gzip.NewReader(idxFile)
+		}
+	} else {
+		idx = idxFile
+	}
+	if err != nil {
+		if idxFile != nil {
+			idxFile.Close()
+		}
+		return fmt.Errorf("error opening %s.idx: %v", filepath.Base(base), err)
+	}
+
+	data, closeData, err := openData(base)
+	if err != nil {
+		idxFile.Close()
+		return err
+	}
+
+	im.close = func() {
+		idxFile.Close()
+		closeData()
+	}
+
+	r := bufio.NewReader(idx)
+	read := 0
+
+	im.next = func() (*Entry, error) {
+		for {
+			word, err := r.ReadString(0)
+			if err == io.EOF && word == "" {
+				if n, _ := strconv.Atoi(info["wordcount"]); n > 0 && n != read {
+					return nil, fmt.Errorf("%w: %s.idx has %d words, %s.ifo %d", ErrBadFormat, filepath.Base(base), read, filepath.Base(base), n)
+				}
+				return nil, io.EOF
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%w: truncated %s.idx", ErrBadFormat, filepath.Base(base))
+			}
+			word = strings.TrimSuffix(word, "\x00")
+			read++
+
+			buf := make([]byte, offsetSize+4)
+			_, err = io.ReadFull(r, buf)
+			if err != nil {
+				return nil, fmt.Errorf("%w: truncated %s.idx", ErrBadFormat, filepath.Base(base))
+			}
+
+			var offset int64
+			if offsetSize == 8 {
+				offset = int64(binary.BigEndian.Uint64(buf))
+			} else {
+				offset = int64(binary.BigEndian.Uint32(buf))
+			}
+			size := binary.BigEndian.Uint32(buf[offsetSize:])
+
+			raw := make([]byte, size)
+			_, err = data.ReadAt(raw, offset)
+			if err != nil {
+				im.skip(word, fmt.Sprintf("data at offset %d out of range", offset))
+				continue
+			}
+
+			e, err := im.starDictEntry(word, raw, seq)
+			if err != nil {
+				im.skip(word, err.Error())
+				continue
+			}
+			if len(e.Senses) == 0 {
+				im.skip(word, "no definition")
+				continue
+			}
+
+			return e, nil
+		}
+	}
+
+	return nil
+}
+
+// starDictEntry maps the fields of the data of an entry to an entry
+func (im *Importer) starDictEntry(word string, data []byte, seq string) (*Entry, error) {
+	e := &Entry{Word: word}
+
+	// field reads the next field of the type, last is the last field of a
+	// sametypesequence, whose end is left out
+	field := func(t byte, last bool) ([]byte, error) {
+		if last {
+			value := data
+			data = nil
+			return value, nil
+		}
+
+		if t >= 'a' && t <= 'z' {
+			value, rest, ok := bytes.Cut(data, []byte{0})
+			if !ok && len(seq) > 0 {
+				return nil, fmt.Errorf("unterminated field of type %c", t)
+			}
+			data = rest
+			return value, nil
+		}
+
+		if len(data) < 4 {
+			return nil, fmt.Errorf("truncated field of type %c", t)
+		}
+		size := binary.BigEndian.Uint32(data)
+		if uint64(size) > uint64(len(data)-4) {
+			return nil, fmt.Errorf("truncated field of type %c", t)
+		}
+		value := data[4 : 4+size]
+		data = data[4+size:]
+		return value, nil
+	}
+
+	add := func(t byte, value []byte) {
+		switch t {
+		case 'm', 'l', 'y', 'k', 'w':
+			e.Senses = append(e.Senses, splitSenses(string(value))...)
+		case 'g', 'h', 'x':
+			e.Senses = append(e.Senses, splitSenses(stripMarkup(string(value)))...)
+		case 't':
+			if e.Pronunciation == "" {
+				e.Pronunciation = strings.TrimSpace(string(value))
+			}
+		default:
+			im.skipField(string(t))
+		}
+	}
+
+	if seq != "" {
+		for i := 0; i < len(seq); i++ {
+			value, err := field(seq[i], i == len(seq)-1)
+			if err != nil {
+				return nil, err
+			}
+			add(seq[i], value)
+		}
+	} else {
+		for len(data) > 0 {
+			t := data[0]
+			data = data[1:]
+
+			value, err := field(t, false)
+			if err != nil {
+				return nil, err
+			}
+			add(t, value)
+		}
+	}
+
+	e.numberSenses()
+
+	return e, nil
+}
+
+// starDictRecord is an entry of a .idx file
+type starDictRecord struct {
+	word   string
+	offset int64
+	size   int
+}
+
+// exportStarDict writes the entries as a StarDict dictionary
+func exportStarDict(ctx context.Context, src Iterator, name string, create createFunc) (int, error) {
+	dictFile, err := create(name + ".dict")
+	if err != nil {
+		return 0, fmt.Errorf("error creating %s.dict: %v", name, err)
+	}
+	defer dictFile.Close()
+
+	w := bufio.NewWriter(dictFile)
+
+	var index []starDictRecord
+	var offset int64
+	var werr error
+	err = src.Iterate(ctx, "", "", func(key string, e *Entry) bool {
+		if len(e.Word) > maxStarDictWordLen || strings.ContainsRune(e.Word, 0) {
+			log.Printf("Skipping stardict entry '%s': invalid headword", e.Word)
+			return true
+		}
+
+		data := starDictData(e)
+		_, werr = w.Write(data)
+		if werr != nil {
+			return false
+		}
+
+		index = append(index, starDictRecord{word: e.Word, offset: offset, size: len(data)})
+		offset += int64(len(data))
+		return true
+	})
+	if err == nil {
+		err = werr
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = dictFile.Close()
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error exporting entries: %v", err)
+	}
+
+	// Readers binary search the index, sorted by the case-insensitive
+	// comparison of StarDict rather than by key
+	slices.SortStableFunc(index, func(a, b starDictRecord) int {
+		return compareStarDict(a.word, b.word)
+	})
+
+	offsetBits := 32
+	if offset > math.MaxUint32 {
+		offsetBits = 64
+	}
+
+	idxFile, err := create(name + ".idx")
+	if err != nil {
+		return 0, fmt.Errorf("error creating %s.idx: %v", name, err)
+	}
+	defer idxFile.Close()
+
+	w = bufio.NewWriter(idxFile)
+	idxSize := 0
+	for _, r := range index {
+		buf := append([]byte(r.word), 0)
+		if offsetBits == 64 {
+			buf = binary.BigEndian.AppendUint64(buf, uint64(r.offset))
+		} else {
+			buf = binary.BigEndian.AppendUint32(buf, uint32(r.offset))
+		}
+		buf = binary.BigEndian.AppendUint32(buf, uint32(r.size))
+
+		_, err = w.Write(buf)
+		if err != nil {
+			return 0, fmt.Errorf("error writing %s.idx: %v", name, err)
+		}
+		idxSize += len(buf)
+	}
+	err = w.Flush()
+	if err == nil {
+		err = idxFile.Close()
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error writing %s.idx: %v", name, err)
+	}
+
+	ifoFile, err := create(name + ".ifo")
+	if err != nil {
+		return 0, fmt.Errorf("error creating %s.ifo: %v", name, err)
+	}
+	defer ifoFile.Close()
+
+	version := "2.4.2"
+	if offsetBits == 64 {
+		version = "3.0.0"
+	}
+	ifo := fmt.Sprintf("%s\nversion=%s\nbookname=%s\nwordcount=%d\nidxfilesize=%d\nsametypesequence=tm\n",
+		starDictMagic, version, strings.Join(strings.Fields(name), " "), len(index), idxSize)
+	if offsetBits == 64 {
+		ifo += "idxoffsetbits=64\n"
+	}
+
+	_, err = io.WriteString(ifoFile, ifo)
+	if err == nil {
+		err = ifoFile.Close()
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error writing %s.ifo: %v", name, err)
+	}
+
+	return len(index), nil
+}
+
+// starDictData returns the data of an entry, its pronunciation as a t field
+// and its senses and etymology as the lines of an m field. The m field is
+// the last one, so it isn't ended by \0.
+func starDictData(e *Entry) []byte {
+	data := append([]byte(e.Pronunciation), 0)
+
+	lines := make([]string, 0, len(e.Senses)+1)
+	for _, s := range e.Senses {
+		lines = append(lines, senseText(s))
+	}
+	if e.Etymology != "" {
+		lines = append(lines, "Etymology: "+strings.Join(strings.Fields(e.Etymology), " "))
+	}
+
+	return append(data, strings.Join(lines, "\n")...)
+}
+
+// compareStarDict compares headwords the way StarDict sorts its index, by
+// their ASCII case-insensitive bytes and then by their bytes
+func compareStarDict(a, b string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		ca, cb := asciiLower(a[i]), asciiLower(b[i])
+		if ca != cb {
+			return int(ca) - int(cb)
+		}
+	}
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+
+	return strings.Compare(a, b)
+}
+
+// asciiLower lowercases an ASCII letter
+func asciiLower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
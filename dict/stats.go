@@ -0,0 +1,291 @@
+package dict
+
+// This file contains the statistics of a dictionary and the inspection of
+// dict.dat files for debugging.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+)
+
+// Stats describes the contents of a dictionary
+type Stats struct {
+	Version uint16
+	Flags   uint16
+	Entries int
+	// IndexBytes is the size of the header and the index region, i.e. all
+	// sections, and DataBytes the size of the (compressed) entries
+	IndexBytes int64
+	DataBytes  int64
+	// Sizes in bytes of the definitions as returned by QueryWord
+	MinDefinition int
+	MaxDefinition int
+	AvgDefinition float64
+	// LongestWord is the headword with the longest definition
+	LongestWord string
+}
+
+// Stats scans the index and all entries of the dictionary. It reads the
+// whole file, which for the S3 backed dictionary means the whole object.
+func (rd *Reader) Stats() (Stats, error) {
+	st := Stats{
+		Version:    rd.header.Version,
+		Flags:      rd.header.Flags,
+		IndexBytes: rd.header.IndexSize,
+		DataBytes:  rd.size - rd.header.IndexSize,
+	}
+
+	buf, err := rd.readSection(sectionIndex)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	d := newIndexDecoder(buf, rd.header.Flags)
+	for {
+		_, ok := d.next()
+		if !ok {
+			break
+		}
+		st.Entries++
+	}
+	if d.err != nil {
+		return Stats{}, d.err
+	}
+
+	var total int64
+	var n int
+
+	er := rd.entries()
+	for {
+		e, err := er.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Stats{}, err
+		}
+
+		size := len(e.Definition())
+		if n == 0 || size < st.MinDefinition {
+			st.MinDefinition = size
+		}
+		if size > st.MaxDefinition {
+			st.MaxDefinition = size
+			st.LongestWord = e.Word
+		}
+
+		total += int64(size)
+		n++
+	}
+
+	if n > 0 {
+		st.AvgDefinition = float64(total) / float64(n)
+	}
+
+	return st, nil
+}
+
+// sectionNames names the section kinds for Inspect
+var sectionNames = map[uint32]string{
+	sectionIndex:      "index",
+	sectionSparse:     "sparse",
+	sectionBlocks:     "blocks",
+	sectionBloom:      "bloom",
+	sectionHash:       "hash",
+	sectionChecksums:  "checksums",
+	sectionEncryption: "encryption",
+}
+
+// Inspect writes the header, the section table and the decoded index
+// records of the dictionary file at path to w. The raw header fields and
+// sections are written before they are validated, each with the problems
+// found in it, so it also works on files Open rejects. The index is decoded
+// from the file as is: it stops at the first record it can't decode and
+// reports its offset. limit bounds the number of records written, 0 writes
+// all of them. The records of encrypted dictionaries are not written.
+func Inspect(w io.Writer, path string, limit int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "file:       %s (%d bytes)\n", path, fi.Size())
+
+	hbuf := make([]byte, HeaderSize+4)
+	_, err = f.ReadAt(hbuf, 0)
+	if err != nil {
+		return fmt.Errorf("%w: truncated header: %v", ErrBadFormat, err)
+	}
+
+	raw := Header{
+		Version:   binary.BigEndian.Uint16(hbuf[4:]),
+		Flags:     binary.BigEndian.Uint16(hbuf[6:]),
+		IndexSize: int64(binary.BigEndian.Uint64(hbuf[8:])),
+	}
+	n := int(binary.BigEndian.Uint32(hbuf[HeaderSize:]))
+	tableEnd := HeaderSize + sectionTableSize(n)
+
+	hasMagic := string(hbuf[:4]) == magic
+	versionProblem := ""
+	if hasMagic && raw.Version != formatVersion {
+		versionProblem = fmt.Sprintf("expected %d", formatVersion)
+	}
+	indexProblem := ""
+	switch {
+	case raw.IndexSize < HeaderSize:
+		indexProblem = "smaller than the header"
+	case raw.IndexSize > fi.Size():
+		indexProblem = "exceeds the file"
+	}
+
+	fmt.Fprintf(w, "magic:      %q%s\n", hbuf[:4], problem(!hasMagic, "expected "+magic))
+	fmt.Fprintf(w, "version:    %d%s\n", raw.Version, problem(versionProblem != "", versionProblem))
+	fmt.Fprintf(w, "flags:      %#04x%s\n", raw.Flags, flagNames(raw.Flags))
+	fmt.Fprintf(w, "index size: %d%s\n", raw.IndexSize, problem(indexProblem != "", indexProblem))
+
+	// Files without the magic, of the legacy layout, have no section table
+	h, herr := decodeHeader(hbuf)
+	if !hasMagic {
+		return herr
+	}
+
+	fmt.Fprintf(w, "sections:   %d%s\n", n, problem(tableEnd > raw.IndexSize, "table exceeds the index"))
+
+	// The sections that fit in the file are written all the same
+	if maxN := (fi.Size() - HeaderSize - 4) / sectionSize; int64(n) > maxN {
+		n = int(max(maxN, 0))
+	}
+
+	tbuf := make([]byte, n*sectionSize)
+	_, err = f.ReadAt(tbuf, HeaderSize+4)
+	if err != nil {
+		return fmt.Errorf("error reading section table: %v", err)
+	}
+
+	sections, err := decodeSectionTable(tbuf, n)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\n")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "kind\tname\toffset\tsize\tproblem")
+
+	var index *section
+	var serr error
+	for i, s := range sections {
+		name, ok := sectionNames[s.Kind]
+		if !ok {
+			name = "unknown"
+		}
+
+		p := ""
+		if s.Offset < tableEnd || s.Size < 0 || s.Offset+s.Size > raw.IndexSize {
+			p = "out of bounds"
+			if serr == nil {
+				serr = fmt.Errorf("%w: section %d out of bounds", ErrBadFormat, s.Kind)
+			}
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%d\t%s\n", s.Kind, name, s.Offset, s.Size, p)
+
+		if s.Kind == sectionIndex {
+			index = &sections[i]
+		}
+	}
+	tw.Flush()
+
+	if herr != nil {
+		return herr
+	}
+	if tableEnd > h.IndexSize {
+		return fmt.Errorf("%w: section table of %d sections exceeds the index", ErrBadFormat, len(sections))
+	}
+	if serr != nil {
+		return serr
+	}
+
+	if index == nil {
+		return fmt.Errorf("%w: missing index section", ErrBadFormat)
+	}
+
+	// Inspect works without the key, which the index records need
+	if h.Flags&FlagEncrypted != 0 {
+		fmt.Fprintf(w, "\nindex records: encrypted\n")
+		return nil
+	}
+	buf := make([]byte, index.Size)
+	_, err = f.ReadAt(buf, index.Offset)
+	if err != nil {
+		return fmt.Errorf("error reading index: %v", err)
+	}
+
+	fmt.Fprintf(w, "\nindex records:\n")
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\trecord offset\tkey\tword\tentry offset\tentry size")
+
+	count := 0
+	d := newIndexDecoder(buf, h.Flags)
+	for limit <= 0 || count < limit {
+		at := index.Offset + index.Size - int64(len(d.buf))
+
+		e, ok := d.next()
+		if !ok {
+			if d.err != nil {
+				tw.Flush()
+				return fmt.Errorf("record %d at %d: %v", count, at, d.err)
+			}
+			break
+		}
+
+		fmt.Fprintf(tw, "%d\t%d\t%q\t%q\t%d\t%d\n", count, at, e.key, e.word, e.offset, e.size)
+		count++
+	}
+	tw.Flush()
+
+	if len(d.buf) > 0 {
+		fmt.Fprintf(w, "... (limited to %d records)\n", limit)
+	}
+
+	return nil
+}
+
+// problem returns the note of a problem of a field written by Inspect, if bad
+func problem(bad bool, note string) string {
+	if !bad {
+		return ""
+	}
+
+	return "  (invalid: " + note + ")"
+}
+
+// flagNames lists the names of the header flags set in flags
+func flagNames(flags uint16) string {
+	names := []struct {
+		flag uint16
+		name string
+	}{
+		{FlagStripDiacritics, "strip-diacritics"},
+		{FlagCompressed, "compressed"},
+		{FlagPerfectHash, "perfect-hash"},
+		{FlagFrontCoded, "front-coded"},
+		{FlagEncrypted, "encrypted"},
+	}
+
+	s := ""
+	for _, n := range names {
+		if flags&n.flag != 0 {
+			s += " " + n.name
+		}
+	}
+
+	return s
+}
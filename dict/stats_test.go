@@ -0,0 +1,132 @@
+package dict
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	dir := t.TempDir()
+	wordsPath := filepath.Join(dir, wordsFilename)
+	words := "a,x\nabandon,to leave\nabandon,to give up\nzoo,animals\n"
+	if err := os.WriteFile(wordsPath, []byte(words), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range []BuildOptions{{}, {Compress: true, FrontCoding: true}} {
+		dictPath := filepath.Join(dir, dictFilename)
+		if err := Build(wordsPath, dictPath, opts); err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := Open(dictPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		st, err := d.Stats()
+		d.Close()
+		if err != nil {
+			t.Fatalf("Stats() error = %v", err)
+		}
+
+		fi, _ := os.Stat(dictPath)
+
+		// "1. to leave; 2. to give up" is the longest definition
+		want := Stats{
+			Version:       formatVersion,
+			Flags:         d.Header().Flags,
+			Entries:       3,
+			IndexBytes:    d.Header().IndexSize,
+			DataBytes:     fi.Size() - d.Header().IndexSize,
+			MinDefinition: 1,
+			MaxDefinition: 26,
+			AvgDefinition: 34.0 / 3,
+			LongestWord:   "abandon",
+		}
+		if st != want {
+			t.Errorf("Stats() = %+v, want %+v", st, want)
+		}
+	}
+}
+
+func TestInspect(t *testing.T) {
+	dictPath := buildBenchDict(t, t.TempDir(), 10, BuildOptions{FrontCoding: true})
+
+	var out bytes.Buffer
+	if err := Inspect(&out, dictPath, 0); err != nil {
+		t.Fatalf("Inspect() error = %v", err)
+	}
+
+	for _, s := range []string{fmt.Sprintf("version:    %d", formatVersion), "front-coded", "index", "sparse", `"word000000"`, `"word000009"`} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("Inspect() output is missing %s:\n%s", s, out.String())
+		}
+	}
+
+	// Cut the suffix of the 4th record short
+	data, err := os.ReadFile(dictPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := Open(dictPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, _ := d.rd.section(sectionIndex)
+	d.Close()
+
+	d4 := newIndexDecoder(data[index.Offset:index.Offset+index.Size], FlagFrontCoded)
+	for i := 0; i < 3; i++ {
+		d4.next()
+	}
+	at := index.Offset + index.Size - int64(len(d4.buf))
+	data[at+1] = 0xff
+
+	corruptPath := filepath.Join(t.TempDir(), "corrupt.dat")
+	if err := os.WriteFile(corruptPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out.Reset()
+	err = Inspect(&out, corruptPath, 0)
+	if err == nil {
+		t.Fatal("Inspect() of a corrupt index succeeded")
+	}
+	if !strings.Contains(err.Error(), "record 3 at") {
+		t.Errorf("Inspect() error = %v, want the offset of record 3", err)
+	}
+	if !strings.Contains(out.String(), `"word000002"`) {
+		t.Errorf("Inspect() did not write the records before the corrupt one:\n%s", out.String())
+	}
+
+	// The raw header fields and sections are written along with their problems
+	data, _ = os.ReadFile(dictPath)
+	binary.BigEndian.PutUint16(data[4:], formatVersion+1)
+	binary.BigEndian.PutUint64(data[HeaderSize+4+4:], uint64(len(data)))
+	os.WriteFile(corruptPath, data, 0644)
+
+	out.Reset()
+	err = Inspect(&out, corruptPath, 0)
+	if !errors.Is(err, ErrBadFormat) {
+		t.Errorf("Inspect() of version %d error = %v, want %v", formatVersion+1, err, ErrBadFormat)
+	}
+	for _, s := range []string{fmt.Sprintf("version:    %d  (invalid: expected %d)", formatVersion+1, formatVersion), "out of bounds", "sparse"} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("Inspect() output is missing %s:\n%s", s, out.String())
+		}
+	}
+
+	os.WriteFile(corruptPath, baselineImage(legacyWords), 0644)
+	out.Reset()
+	if err := Inspect(&out, corruptPath, 0); !errors.Is(err, ErrLegacyFormat) || !strings.Contains(out.String(), "(invalid: expected "+magic+")") {
+		t.Errorf("Inspect() of the baseline layout = %v:\n%s", err, out.String())
+	}
+}
@@ -2,12 +2,12 @@ package dict
 
 import (
 	"bufio"
-	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
-	"strings"
 	"time"
 )
 
@@ -16,17 +16,27 @@ This file contains the code to update the dictionary based on the changelog
 Requirements:
 1. The changelog file should be present in root directory
 Constraints on changelog:
-1. Is of the same format as words.dat
+1. Is of the same format as words.dat (changelog.dat) or words.jsonl (changelog.jsonl)
 2. Is sorted in ascending order of word
-3. Contains updated definition of only existing version of dict.dat. No new words
+A changelog entry replaces all senses of the existing entry, or adds the word
+if it's not in dict.dat. Entries of changelog.jsonl with "deleted":true delete
+the word, which must be in dict.dat, see Change.
 */
 
 const (
 	chglogFilename = "changelog.dat"
+	// jsonlChglogFilename is the structured changelog, see source.go
+	jsonlChglogFilename = "changelog.jsonl"
 )
 
+// UpdateDict applies the changelog to dict.dat, or to the shards of
+// manifest.json if the dictionary is sharded, see shard.go
 func UpdateDict() error {
-	// Create a temp directory and words.dat file inside if does not exist
+	if ManifestExists() {
+		return updateShards(manifestFilename, changelogFilename())
+	}
+
+	// Create a temp directory and words.jsonl file inside if does not exist
 	tempDir, err := os.MkdirTemp(".", "tmp-dict-update-*")
 	if err != nil {
 		return fmt.Errorf("error creating temp directory: %v", err)
@@ -39,141 +49,261 @@ func UpdateDict() error {
 		}
 	}()
 
-	// Create/Open the words.dat file for writing
-	newWordsFile, err := os.OpenFile(filepath.Join(tempDir, wordsFilename), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	// Create/Open the words.jsonl file for writing. The merged entries
+	// can have several senses, hence they are always written as JSON lines.
+	newWordsFile, err := os.OpenFile(filepath.Join(tempDir, jsonlWordsFilename), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
-		return fmt.Errorf("error creating/opening words.dat: %v", err)
+		return fmt.Errorf("error creating/opening words.jsonl: %v", err)
 	}
 	defer newWordsFile.Close()
 
 	// Open the changelog file for reading
-	chglogFile, err := os.OpenFile(chglogFilename, os.O_RDONLY, 0644)
+	chglogPath := changelogFilename()
+	chglogFile, err := os.OpenFile(chglogPath, os.O_RDONLY, 0644)
 	if err != nil {
-		return fmt.Errorf("error opening changelog.dat: %v", err)
+		return fmt.Errorf("error opening %s: %v", chglogPath, err)
 	}
 	defer chglogFile.Close()
 
-	// Open dict.dat file for reading
-	dictFile, err := os.OpenFile(dictFilename, os.O_RDONLY, 0644)
+	encKey, err := EncryptionKeyFromEnv()
 	if err != nil {
-		return fmt.Errorf("error opening dict file: %v", err)
+		return fmt.Errorf("error reading encryption key: %v", err)
 	}
-	defer dictFile.Close()
 
-	// Get the first word offset in the dict file
-	err = seekToFirstWordOffsetInDict(dictFile)
+	// The changelog is merged with the entries of dict.dat, so the delta
+	// segments on top of it are compacted into it first, see segment.go
+	segs, err := listSegments(dictFilename)
 	if err != nil {
-		return fmt.Errorf("error seeking to first word offset in dict: %v", err)
+		return err
+	}
+	if len(segs) > 0 {
+		err = Compact(dictFilename, WithEncryptionKey(encKey))
+		if err != nil {
+			return fmt.Errorf("error compacting segments: %v", err)
+		}
 	}
 
-	err = mergeSortedFiles(newWordsFile, chglogFile, dictFile)
+	// Open dict.dat file for reading
+	d, err := Open(dictFilename, WithEncryptionKey(encKey))
+	if err != nil {
+		return fmt.Errorf("error opening dict file: %v", err)
+	}
+	defer d.Close()
+
+	header := d.Header()
+
+	// The version is the name of the archive directory of the old files
+	now := time.Now()
+	version := now.Format("20060102150405")
+	var records []AuditRecord
+
+	// Read the entries in the order they are stored, i.e. sorted by key
+	err = mergeSortedFiles(newWordsFile, newSourceReader(chglogFile, chglogPath), d.entries(), header.Flags, nil, func(op ProposalOp, c *Change) {
+		records = append(records, newAuditRecord(op, c, header.Flags, version, now.UTC()))
+	})
 	if err != nil {
 		return fmt.Errorf("error merging files: %v", err)
 	}
 
+	// The dict file has to be closed before it's moved to the archive
+	d.Close()
+
 	// Archive the existing words, index and dict file
-	err = archiveFiles()
+	encrypted := header.Flags&FlagEncrypted != 0
+	err = archiveFiles(version, chglogPath, encrypted)
 	if err != nil {
 		return fmt.Errorf("error archiving files: %v", err)
 	}
 
-	// Move the new words.dat file from temp to the current directory
-	err = os.Rename(filepath.Join(tempDir, wordsFilename), wordsFilename)
-	if err != nil {
-		return fmt.Errorf("error moving words.dat to current directory: %v", err)
+	// Move the new words.jsonl file from temp to the current directory. The
+	// words of an encrypted dictionary aren't kept in plain text, it's built
+	// from the temp directory instead.
+	srcPath := jsonlWordsFilename
+	if encrypted {
+		srcPath = filepath.Join(tempDir, jsonlWordsFilename)
+	} else {
+		err = os.Rename(filepath.Join(tempDir, jsonlWordsFilename), jsonlWordsFilename)
+		if err != nil {
+			return fmt.Errorf("error moving words.jsonl to current directory: %v", err)
+		}
 	}
 
-	// Rebuild the dictionary
-	err = BuildNewDict()
+	// Rebuild the dictionary with the same layout and keys
+	opts := buildOptions(header.Flags)
+	if encrypted {
+		opts.EncryptionKey = encKey
+	}
+	opts.SigningKey, err = SigningKeyFromEnv()
 	if err != nil {
-		return fmt.Errorf("error rebuilding dictionary: %v", err)
+		return fmt.Errorf("error reading signing key: %v", err)
 	}
 
-	return nil
-}
-
-func seekToFirstWordOffsetInDict(dictFile *os.File) error {
-	// Read the index size from the first 8 bytes
-	var indexSize int64
-	// Reading 8 bytes move the offset forward by 8 bytes
-	err := binary.Read(dictFile, binary.BigEndian, &indexSize)
+	err = Build(srcPath, dictFilename, opts)
 	if err != nil {
-		return fmt.Errorf("error reading index size from dict file: %v", err)
+		return fmt.Errorf("error rebuilding dictionary: %v", err)
 	}
 
-	// Seek to the index size offset since first word comes after the index
-	_, err = dictFile.Seek(indexSize, 0)
+	// Record who changed what, see audit.go
+	err = appendAudit(auditFilename, records)
 	if err != nil {
 		return err
 	}
 
-	log.Println("Seeked to first word offset in dict file:", indexSize)
+	// Index the archived version for the history queries, see history.go.
+	// The update itself is done, a failure only leaves the index behind.
+	err = updateHistory(archiveDirname, version, encKey)
+	if err != nil {
+		log.Printf("error indexing history, rebuild it with the history -rebuild command: %v", err)
+	}
 
 	return nil
 }
 
-// mergeSortedFiles writes the merged the dict.dat and changelog.dat files into
-// a single file - ./<temp-folder>/words.dat
-// This file can then be used to build the new dictionary
-func mergeSortedFiles(newWordsFile, chglogFile, dictFile *os.File) error {
-	// Read files line by line and write to the new words file
+// changelogFilename returns changelog.jsonl if it exists and changelog.dat otherwise
+func changelogFilename() string {
+	if _, err := os.Stat(jsonlChglogFilename); err == nil {
+		return jsonlChglogFilename
+	}
+
+	return chglogFilename
+}
+
+// mergeSortedFiles writes the merged the dict.dat entries and changelog entries into
+// a single file - ./<temp-folder>/words.jsonl
+// This file can then be used to build the new dictionary.
+// Words are compared by their normalized keys, the order entries are stored in dict.dat.
+// resolve returns the entry of a word found in both, nil to drop it; if it's nil
+// the changelog entry replaces the dict entry, or deletes it. Merges resolving
+// the conflicts themselves, see Merge, aren't logged word by word.
+// applied is called with every change applied, if it's not nil.
+func mergeSortedFiles(newWordsFile io.Writer, chglog changeReader, dictEntries entrySource, flags uint16, resolve func(dictEntry *Entry, c *Change) (*Entry, error), applied func(op ProposalOp, c *Change)) error {
+	// Read entries one by one and write to the new words file
+
+	var chglogEntry *Change
+	var chglogKey, prevKey, prevDictKey string
+	chglogEOF := false
+
+	// nextChange reads the next entry from the changelog file
+	nextChange := func() error {
+		var err error
+		chglogEntry, err = chglog.NextChange()
+		if err == io.EOF {
+			chglogEntry = nil
+			chglogEOF = true
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading changelog: %v", err)
+		}
+
+		chglogKey = NormalizeKey(chglogEntry.Word, flags)
+		if prevKey != "" && chglogKey <= prevKey {
+			return fmt.Errorf("error: changelog is not sorted or repeats word %s", chglogEntry.Word)
+		}
+		prevKey = chglogKey
+
+		return nil
+	}
+
+	// addChange writes a changelog entry of a word not in the dict file
+	addChange := func() error {
+		if chglogEntry.Deleted {
+			return fmt.Errorf("error: changelog deletes word %s not found in dict file", chglogEntry.Word)
+		}
+
+		if resolve == nil {
+			log.Println("Adding word:", chglogEntry.Word)
+		}
+		if applied != nil {
+			applied(OpAdd, chglogEntry)
+		}
 
-	dictFileScanner := bufio.NewScanner(dictFile)
-	chglogFileScanner := bufio.NewScanner(chglogFile)
+		err := writeSourceEntry(newWordsFile, &chglogEntry.Entry)
+		if err != nil {
+			return fmt.Errorf("error writing changelog entry to new words file: %v", err)
+		}
 
-	chglogLine := ""
-	chglogEOL := false
+		return nextChange()
+	}
 
-	for dictFileScanner.Scan() {
-		dictLine := dictFileScanner.Text()
+	err := nextChange()
+	if err != nil {
+		return err
+	}
 
-		if !chglogEOL && chglogLine == "" {
-			// Read the next line from the changelog file
-			if chglogFileScanner.Scan() {
-				chglogLine = chglogFileScanner.Text()
-			} else {
-				chglogEOL = true
+	for {
+		dictEntry, err := dictEntries.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading dict entry: %v", err)
+		}
+
+		dictKey := NormalizeKey(dictEntry.Word, flags)
+		if prevDictKey != "" && dictKey <= prevDictKey {
+			return fmt.Errorf("error: dict entries are not sorted or repeat word %s", dictEntry.Word)
+		}
+		prevDictKey = dictKey
+
+		// compare words from both files, the changelog words sorting
+		// first are new words
+		for !chglogEOF && chglogKey < dictKey {
+			err = addChange()
+			if err != nil {
+				return err
 			}
 		}
 
-		if chglogEOL {
-			// Write the dict line to the new words file as it is
-			_, err := newWordsFile.WriteString(dictLine + "\n")
+		if chglogEOF || dictKey < chglogKey {
+			// Write the dict entry to the new words file as it is
+			err := writeSourceEntry(newWordsFile, dictEntry)
 			if err != nil {
-				return fmt.Errorf("error writing dict line to new words file: %v", err)
+				return fmt.Errorf("error writing dict entry to new words file: %v", err)
 			}
 
 			continue
 		}
 
-		// changelog file is not EOL
-		// compare words from both files
-		dictWord := strings.Split(dictLine, ",")[0]
-		chglogWord := strings.Split(chglogLine, ",")[0]
-
-		if dictWord == chglogWord {
-			log.Println("Updating word:", dictWord)
-
-			// Write the changelog line to the new words file
-			_, err := newWordsFile.WriteString(chglogLine + "\n")
+		entry := &chglogEntry.Entry
+		switch {
+		case resolve != nil:
+			entry, err = resolve(dictEntry, chglogEntry)
 			if err != nil {
-				return fmt.Errorf("error writing changelog line to new words file: %v", err)
+				return err
 			}
+		case chglogEntry.Deleted:
+			log.Println("Deleting word:", dictEntry.Word)
+			if applied != nil {
+				applied(OpDelete, chglogEntry)
+			}
+			entry = nil
+		default:
+			log.Println("Updating word:", dictEntry.Word)
+			if applied != nil {
+				applied(OpUpdate, chglogEntry)
+			}
+		}
 
-			// Reset the changelog line
-			chglogLine = ""
-
-		} else if dictWord < chglogWord {
-			// Write the dict line to the new words file as it is
-			_, err := newWordsFile.WriteString(dictLine + "\n")
+		// Write the resolved entry to the new words file
+		if entry != nil {
+			err := writeSourceEntry(newWordsFile, entry)
 			if err != nil {
-				return fmt.Errorf("error writing dict line to new words file: %v", err)
+				return fmt.Errorf("error writing changelog entry to new words file: %v", err)
 			}
+		}
+
+		err = nextChange()
+		if err != nil {
+			return err
+		}
+	}
 
-		} else {
-			// This means that the changelog word is not in the dict file
-			// this should not happen as per the constraints
-			return fmt.Errorf("error: changelog word %s not found in dict file", chglogWord)
+	// Any changelog entry left over sorts after the last word in the dict file
+	for !chglogEOF {
+		err := addChange()
+		if err != nil {
+			return err
 		}
 	}
 
@@ -182,27 +312,62 @@ func mergeSortedFiles(newWordsFile, chglogFile, dictFile *os.File) error {
 	return nil
 }
 
-// archiveFiles moves the old words.dat, index.dat, dict.dat and changelog.dat files to an archive directory
-// with the current timestamp - YYYYMMDDHHMMSS
-func archiveFiles() error {
+// writeChangelog writes the changes into a changelog.jsonl file
+func writeChangelog(path string, changes []Change) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating changelog: %v", err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for _, c := range changes {
+		line, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(append(line, '\n'))
+		if err != nil {
+			return err
+		}
+	}
+
+	return w.Flush()
+}
+
+// archiveFiles moves the old source, index.dat, dict.dat (and its signature) and changelog files to an archive directory
+// named after the version, the current timestamp - YYYYMMDDHHMMSS.
+// The plain text source and changelog of an encrypted dictionary are removed
+// instead, see archiveChangelog.
+func archiveFiles(version, chglogPath string, encrypted bool) error {
 	// Create a new acrchive directory
-	dir := filepath.Join("archive", time.Now().Format("20060102150405"))
+	dir := filepath.Join(archiveDirname, version)
 
 	err := os.MkdirAll(dir, 0755) // Create the archive directory if it does not exist
 	if err != nil {
 		return fmt.Errorf("error creating archive directory: %v", err)
 	}
 
-	// Move the old words.dat, index.dat and dict.dat files to the archive directory
+	// Move the old source, index.dat and dict.dat files to the archive directory.
+	// Encrypted dictionaries are updated without a source, see UpdateDict.
 
-	err = os.Rename(wordsFilename, filepath.Join(dir, wordsFilename))
-	if err != nil {
-		return fmt.Errorf("error moving words.dat to archive: %v", err)
+	srcPath := sourceFilename()
+	if encrypted {
+		err = os.Remove(srcPath)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing %s: %v", srcPath, err)
+		}
+	} else {
+		err = os.Rename(srcPath, filepath.Join(dir, srcPath))
+		if err != nil {
+			return fmt.Errorf("error moving %s to archive: %v", srcPath, err)
+		}
 	}
 
 	err = os.Rename(indexFilename, filepath.Join(dir, indexFilename))
 	if err != nil {
-		return fmt.Errorf("error moving words.dat to archive: %v", err)
+		return fmt.Errorf("error moving index.dat to archive: %v", err)
 	}
 
 	err = os.Rename(dictFilename, filepath.Join(dir, dictFilename))
@@ -210,14 +375,40 @@ func archiveFiles() error {
 		return fmt.Errorf("error moving dict.dat to archive: %v", err)
 	}
 
-	// Move the changelog file to the archive directory
+	// The signature of dict.dat, if it's signed
+	sigPath := dictFilename + SignatureExt
+	err = os.Rename(sigPath, filepath.Join(dir, sigPath))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error moving %s to archive: %v", sigPath, err)
+	}
 
-	err = os.Rename(chglogFilename, filepath.Join(dir, chglogFilename))
+	err = archiveChangelog(chglogPath, dir, encrypted)
 	if err != nil {
-		return fmt.Errorf("error moving changelog.dat to archive: %v", err)
+		return err
 	}
 
 	log.Println("Archived old files successfully")
 
 	return nil
 }
+
+// archiveChangelog moves the changelog file to the archive directory dir.
+// The changelog of an encrypted dictionary is removed instead, its changes
+// are only kept encrypted in the archived and the new dictionaries.
+func archiveChangelog(chglogPath, dir string, encrypted bool) error {
+	if encrypted {
+		err := os.Remove(chglogPath)
+		if err != nil {
+			return fmt.Errorf("error removing %s: %v", chglogPath, err)
+		}
+
+		return nil
+	}
+
+	err := os.Rename(chglogPath, filepath.Join(dir, filepath.Base(chglogPath)))
+	if err != nil {
+		return fmt.Errorf("error moving %s to archive: %v", chglogPath, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,271 @@
+package dict
+
+// This file contains the point-in-time queries against the archived versions
+// of dict.dat, see archiveFiles. A version is named after the time it was
+// archived, YYYYMMDDHHMMSS, so archive/20240501100000/dict.dat is the
+// dictionary in use until then. Queries name a version, "current", or a
+// point in time as a prefix of a version, e.g. 20240415, which is answered
+// by the version in use at that time.
+//
+// The archived dictionaries are opened on their first query and the most
+// recently used ones are kept open.
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// ErrVersionNotFound is returned for versions that aren't archived
+var ErrVersionNotFound = errors.New("version not found")
+
+// Snapshot is a version of the dictionary queries are served from, a Dict
+// or an Editor
+type Snapshot interface {
+	QueryWord(word string) (string, bool)
+	Lookup(word string) (*Entry, bool)
+	Iterate(ctx context.Context, from, to string, fn func(key string, e *Entry) bool) error
+}
+
+// Versions serves queries against the archived versions of the dictionary
+// along with the current one. It's safe for concurrent use.
+type Versions struct {
+	dir     string
+	current Snapshot
+	opts    []Option
+
+	// mu guards the LRU of open versions
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+// openVersion is an open archived dictionary. It's closed once it's evicted
+// and not in use by any query.
+type openVersion struct {
+	version string
+	d       archivedDict
+	refs    int
+	evicted bool
+}
+
+// NewVersions serves the versions archived in the archive directory along
+// with current, keeping up to size of them open. Like New, the archived
+// dictionaries are verified against DICT_PUBLIC_KEYS, decrypted with
+// DICT_ENCRYPTION_KEY and opened in the low-memory mode of DICT_LOW_MEMORY.
+func NewVersions(current Snapshot, size int) (*Versions, error) {
+	keys, err := PublicKeysFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	encKey, err := EncryptionKeyFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("error reading encryption key: %v", err)
+	}
+
+	lowMemory, err := LowMemoryFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	return OpenVersions(archiveDirname, current, size, WithEncryptionKey(encKey), lowMemory, WithPublicKeys(keys)), nil
+}
+
+// OpenVersions serves the versions archived in dir along with current,
+// keeping up to size of them open. The archived dictionaries are opened
+// with opts.
+func OpenVersions(dir string, current Snapshot, size int, opts ...Option) *Versions {
+	if size < 1 {
+		size = 1
+	}
+
+	return &Versions{
+		dir:     dir,
+		current: current,
+		opts:    opts,
+		size:    size,
+		ll:      list.New(),
+		items:   make(map[string]*list.Element),
+	}
+}
+
+// Resolve returns the version that answers the queries of version: the
+// archived version of that name, the version in use at the point in time
+// it's a prefix of, or CurrentVersion for "current" and the points in time
+// after the last archived version.
+func (vs *Versions) Resolve(version string) (string, error) {
+	if version == "" || version == CurrentVersion {
+		return CurrentVersion, nil
+	}
+
+	if len(version) > len("20060102150405") || strings.Trim(version, "0123456789") != "" {
+		return "", fmt.Errorf("%w: %q is not a version or a point in time", ErrVersionNotFound, version)
+	}
+
+	versions, err := archivedVersions(vs.dir)
+	if err != nil {
+		return "", err
+	}
+
+	// The versions are sorted, so is the point in time padded to a full
+	// timestamp. The version in use then is the first one archived after it.
+	t := version + strings.Repeat("0", len("20060102150405")-len(version))
+	for _, v := range versions {
+		if v == version || v > t {
+			return v, nil
+		}
+	}
+
+	return CurrentVersion, nil
+}
+
+// QueryWord queries the version for a word and returns its definition along
+// with the version that answered, see Resolve
+func (vs *Versions) QueryWord(version, word string) (string, string, bool, error) {
+	e, answered, ok, err := vs.Lookup(version, word)
+	if err != nil || !ok {
+		return "", answered, false, err
+	}
+
+	return e.Definition(), answered, true, nil
+}
+
+// Lookup queries the version for a word and returns its structured entry
+// along with the version that answered, see Resolve
+func (vs *Versions) Lookup(version, word string) (*Entry, string, bool, error) {
+	var e *Entry
+	var ok bool
+
+	answered, err := vs.with(version, func(s Snapshot) error {
+		e, ok = s.Lookup(word)
+		return nil
+	})
+
+	return e, answered, ok, err
+}
+
+// Iterate calls fn with the key and the entry of every word of the version
+// whose key is in [from, to), in key order, see Dict.Iterate. It returns
+// the version that answered, see Resolve.
+func (vs *Versions) Iterate(ctx context.Context, version, from, to string, fn func(key string, e *Entry) bool) (string, error) {
+	return vs.with(version, func(s Snapshot) error {
+		return s.Iterate(ctx, from, to, fn)
+	})
+}
+
+// with calls fn with the snapshot of the version, which stays open until fn
+// returns, and returns the version that answered
+func (vs *Versions) with(version string, fn func(s Snapshot) error) (string, error) {
+	version, err := vs.Resolve(version)
+	if err != nil {
+		return "", err
+	}
+
+	if version == CurrentVersion {
+		return version, fn(vs.current)
+	}
+
+	ov, err := vs.acquire(version)
+	if err != nil {
+		return "", err
+	}
+	defer vs.release(ov)
+
+	return version, fn(ov.d)
+}
+
+// acquire returns the open archived version, opening it if needed. It's
+// released with release.
+func (vs *Versions) acquire(version string) (*openVersion, error) {
+	vs.mu.Lock()
+	if el, ok := vs.items[version]; ok {
+		vs.ll.MoveToFront(el)
+		ov := el.Value.(*openVersion)
+		ov.refs++
+		vs.mu.Unlock()
+		return ov, nil
+	}
+	vs.mu.Unlock()
+
+	// Versions are opened without holding the lock, the first one of
+	// concurrent opens is kept
+	d, err := vs.open(version)
+	if err != nil {
+		return nil, err
+	}
+
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	if el, ok := vs.items[version]; ok {
+		d.Close()
+		vs.ll.MoveToFront(el)
+		ov := el.Value.(*openVersion)
+		ov.refs++
+		return ov, nil
+	}
+
+	ov := &openVersion{version: version, d: d, refs: 1}
+	vs.items[version] = vs.ll.PushFront(ov)
+
+	for vs.ll.Len() > vs.size {
+		oldest := vs.ll.Back()
+		vs.ll.Remove(oldest)
+		evicted := oldest.Value.(*openVersion)
+		delete(vs.items, evicted.version)
+
+		evicted.evicted = true
+		if evicted.refs == 0 {
+			evicted.d.Close()
+		}
+	}
+
+	return ov, nil
+}
+
+// release releases a version returned by acquire, closing it if it was
+// evicted in the meantime
+func (vs *Versions) release(ov *openVersion) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	ov.refs--
+	if ov.evicted && ov.refs == 0 {
+		ov.d.Close()
+	}
+}
+
+// open opens the archived dictionary of the version
+func (vs *Versions) open(version string) (archivedDict, error) {
+	d, err := openArchived(vs.dir, version, vs.opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error opening version %s: %w", version, err)
+	}
+
+	log.Printf("Opened version %s", version)
+
+	return d, nil
+}
+
+// Close closes the open archived versions. The current one is left open.
+func (vs *Versions) Close() {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	for el := vs.ll.Front(); el != nil; el = el.Next() {
+		ov := el.Value.(*openVersion)
+		ov.evicted = true
+		if ov.refs == 0 {
+			ov.d.Close()
+		}
+	}
+
+	vs.ll.Init()
+	vs.items = make(map[string]*list.Element)
+}
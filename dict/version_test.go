@@ -0,0 +1,137 @@
+package dict
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// buildVersion builds a dictionary from the words.dat lines into dir/version
+func buildVersion(t *testing.T, dir, version, words string) string {
+	t.Helper()
+
+	vdir := filepath.Join(dir, version)
+	if err := os.MkdirAll(vdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(vdir, wordsFilename)
+	if err := os.WriteFile(src, []byte(words), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(vdir, dictFilename)
+	if err := Build(src, path, BuildOptions{}); err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+
+	return path
+}
+
+func TestVersions(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, archiveDirname)
+	buildVersion(t, archive, "20240101000000", "apple,a fruit\nbanana,a yellow fruit\n")
+	buildVersion(t, archive, "20240201000000", "apple,a red fruit\nbanana,a yellow fruit\n")
+
+	current, err := Open(buildVersion(t, dir, "current", "apple,a red or green fruit\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer current.Close()
+
+	vs := OpenVersions(archive, current, 1)
+	defer vs.Close()
+
+	tests := []struct {
+		version  string
+		answered string
+		def      string
+	}{
+		{"", CurrentVersion, "a red or green fruit"},
+		{CurrentVersion, CurrentVersion, "a red or green fruit"},
+		{"20240101000000", "20240101000000", "a fruit"},
+		{"20240201000000", "20240201000000", "a red fruit"},
+		// Points in time are answered by the version in use then
+		{"2023", "20240101000000", "a fruit"},
+		{"20240115", "20240201000000", "a red fruit"},
+		{"202403", CurrentVersion, "a red or green fruit"},
+	}
+	for _, tt := range tests {
+		def, answered, ok, err := vs.QueryWord(tt.version, "Apple")
+		if err != nil || !ok || answered != tt.answered || def != tt.def {
+			t.Errorf("QueryWord(%q, Apple) = %q, %q, %v, %v, want %q, %q", tt.version, def, answered, ok, err, tt.def, tt.answered)
+		}
+	}
+
+	// Words gone since are still found in the old versions
+	if _, answered, ok, err := vs.QueryWord("20240115", "banana"); err != nil || !ok || answered != "20240201000000" {
+		t.Errorf("QueryWord(20240115, banana) = %q, %v, %v", answered, ok, err)
+	}
+	if _, answered, ok, err := vs.QueryWord("", "banana"); err != nil || ok || answered != CurrentVersion {
+		t.Errorf("QueryWord(current, banana) = %q, %v, %v, want not found", answered, ok, err)
+	}
+
+	for _, version := range []string{"latest", "202401010000001", "2024-01-01"} {
+		if _, _, _, err := vs.QueryWord(version, "apple"); !errors.Is(err, ErrVersionNotFound) {
+			t.Errorf("QueryWord(%q) error = %v, want ErrVersionNotFound", version, err)
+		}
+	}
+
+	var keys []string
+	answered, err := vs.Iterate(context.Background(), "20240101000000", "", "", func(key string, e *Entry) bool {
+		// A version in use isn't closed when another one evicts it
+		if _, _, ok, err := vs.QueryWord("20240201000000", "apple"); !ok || err != nil {
+			t.Errorf("QueryWord(20240201000000) while iterating = %v, %v", ok, err)
+		}
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil || answered != "20240101000000" || len(keys) != 2 {
+		t.Errorf("Iterate(20240101000000) = %v, %q, %v", keys, answered, err)
+	}
+
+	if _, _, ok, err := vs.QueryWord("20240101000000", "banana"); !ok || err != nil {
+		t.Errorf("QueryWord(20240101000000) after eviction = %v, %v", ok, err)
+	}
+}
+
+func TestVersionsArchive(t *testing.T) {
+	dir := t.TempDir()
+	current, err := Open(buildVersion(t, dir, "current", "abandon,to give up completely\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer current.Close()
+
+	// The versions archived in the repository are of the baseline layout
+	vs := OpenVersions(filepath.Join("..", archiveDirname), current, 2)
+	defer vs.Close()
+
+	tests := []struct {
+		version  string
+		answered string
+		def      string
+	}{
+		{"20250427165715", "20250427165715", "to leave and never return to"},
+		{"20250427170000", "20250427170059", "have been deserted or left"},
+		{"20250427170539", "20250427170539", "desert"},
+		{"2026", CurrentVersion, "to give up completely"},
+	}
+	for _, tt := range tests {
+		def, answered, ok, err := vs.QueryWord(tt.version, "abandon")
+		if err != nil || !ok || answered != tt.answered || def != tt.def {
+			t.Errorf("QueryWord(%q, abandon) = %q, %q, %v, %v, want %q, %q", tt.version, def, answered, ok, err, tt.def, tt.answered)
+		}
+	}
+
+	n := 0
+	_, err = vs.Iterate(context.Background(), "20250427165715", "", "", func(key string, e *Entry) bool {
+		n++
+		return true
+	})
+	if err != nil || n != 16 {
+		t.Errorf("Iterate(20250427165715) = %d entries, %v, want 16", n, err)
+	}
+}
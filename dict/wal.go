@@ -0,0 +1,540 @@
+package dict
+
+// This file contains the online editing of a dictionary. Edits are appended
+// to a write-ahead log and synced before they are acknowledged, then served
+// from an in-memory overlay on top of the Dict. The log holds one JSON
+// encoded Change per line:
+//
+//	{"word":"abandon","senses":[{"definition":"to leave"}]}
+//	{"word":"abaft","deleted":true}
+//
+// Folding writes the overlay as a delta segment of the Dict, see segment.go,
+// and drops the folded edits from the log. The log is replayed into the
+// overlay when the editor is opened, so edits survive a restart.
+//
+// Like UpdateDict, a fold archives the dictionary it replaces, under the
+// time of the fold as its version, and records the folded edits in the audit
+// log and the archived entries in the history index next to the Dict. Only
+// the dictionary is rebuilt into the archive, the Dict itself gets a segment.
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// walFilename is the write-ahead log of the edits of dict.dat
+const walFilename = "edits.wal"
+
+// edit is a change in the overlay along with its position in the log
+type edit struct {
+	seq    uint64
+	change Change
+}
+
+// Editor serves a Dict along with the edits not folded into it yet
+type Editor struct {
+	d     *Dict
+	flags uint16
+
+	// mu guards the overlay and the log
+	mu      sync.RWMutex
+	walPath string
+	wal     *os.File
+	overlay map[string]edit
+	seq     uint64
+
+	// foldMu serializes the folds
+	foldMu sync.Mutex
+}
+
+// NewEditor opens the write-ahead log edits.wal of the dictionary
+func NewEditor(d *Dict) (*Editor, error) {
+	return OpenEditor(d, walFilename)
+}
+
+// OpenEditor opens the write-ahead log at walPath, creating it if needed, and
+// replays its edits into the overlay on top of the dictionary
+func OpenEditor(d *Dict, walPath string) (*Editor, error) {
+	e := &Editor{
+		d:       d,
+		flags:   d.Header().Flags,
+		walPath: walPath,
+		overlay: make(map[string]edit),
+	}
+
+	err := e.replay()
+	if err != nil {
+		return nil, err
+	}
+
+	e.wal, err = os.OpenFile(walPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %v", walPath, err)
+	}
+
+	if len(e.overlay) > 0 {
+		log.Printf("Replayed %d edits from %s", len(e.overlay), walPath)
+	}
+
+	return e, nil
+}
+
+// replay reads the log into the overlay. A torn last line, left by a crash
+// in the middle of a write, is truncated.
+func (e *Editor) replay() error {
+	f, err := os.OpenFile(e.walPath, os.O_RDWR, 0644)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error opening %s: %v", e.walPath, err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) > 0 {
+			log.Printf("Truncating torn edit at offset %d of %s", offset, e.walPath)
+			return f.Truncate(offset)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", e.walPath, err)
+		}
+
+		var c Change
+		err = json.Unmarshal(line, &c)
+		if err != nil {
+			return fmt.Errorf("%w: corrupt edit at offset %d of %s: %v", ErrBadFormat, offset, e.walPath, err)
+		}
+
+		e.add(c)
+		offset += int64(len(line))
+	}
+}
+
+// add puts the change into the overlay
+func (e *Editor) add(c Change) {
+	e.seq++
+	e.overlay[NormalizeKey(c.Word, e.flags)] = edit{seq: e.seq, change: c}
+}
+
+// record appends the change to the log, syncs it and adds it to the overlay.
+// The change is stamped with the time it's made, for the audit log.
+func (e *Editor) record(c Change) error {
+	err := c.validate()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	c.Timestamp = &now
+
+	line, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	_, err = e.wal.Write(append(line, '\n'))
+	if err != nil {
+		return fmt.Errorf("error writing edit: %v", err)
+	}
+
+	err = e.wal.Sync()
+	if err != nil {
+		return fmt.Errorf("error syncing edit: %v", err)
+	}
+
+	e.add(c)
+
+	return nil
+}
+
+// Put adds or replaces the entry of a word, numbering its senses. The author
+// and the reason of audit are recorded in the audit log once the edit is
+// folded, its timestamp is the time of the edit.
+func (e *Editor) Put(entry *Entry, audit Audit) error {
+	entry.numberSenses()
+
+	return e.record(Change{Entry: *entry, Audit: audit})
+}
+
+// Delete deletes a word, audited like Put. It returns false if the word is
+// not in the dictionary.
+func (e *Editor) Delete(word string, audit Audit) (bool, error) {
+	if _, ok, err := e.lookup(word); err != nil || !ok {
+		return false, err
+	}
+
+	return true, e.record(Change{Entry: Entry{Word: word}, Deleted: true, Audit: audit})
+}
+
+// Pending returns the number of edits not folded into the dictionary yet
+func (e *Editor) Pending() int {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return len(e.overlay)
+}
+
+// lookup returns the entry of the word from the overlay or the dictionary
+func (e *Editor) lookup(word string) (*Entry, bool, error) {
+	e.mu.RLock()
+	ed, ok := e.overlay[NormalizeKey(word, e.flags)]
+	e.mu.RUnlock()
+
+	if ok {
+		if ed.change.Deleted {
+			return nil, false, nil
+		}
+		entry := ed.change.Entry
+		return &entry, true, nil
+	}
+
+	return e.d.lookup(word)
+}
+
+// QueryWord queries the dictionary for a word and returns its definition, see Dict.QueryWord
+func (e *Editor) QueryWord(word string) (string, bool) {
+	entry, ok := e.Lookup(word)
+	if !ok {
+		return "", false
+	}
+
+	return entry.Definition(), true
+}
+
+// Lookup queries the dictionary for a word and returns its structured
+// entry. Edits not folded into the dictionary yet take precedence.
+func (e *Editor) Lookup(word string) (*Entry, bool) {
+	entry, ok, err := e.lookup(word)
+	if err != nil {
+		log.Printf("error reading definition: %v", err)
+		return nil, false
+	}
+	if !ok {
+		log.Printf("Error: '%s' word not found", word)
+		return nil, false
+	}
+
+	return entry, true
+}
+
+// Iterate calls fn with the key and the entry of every word whose key is in
+// [from, to), in key order, see Dict.Iterate. The edits are merged with the
+// entries of the dictionary.
+func (e *Editor) Iterate(ctx context.Context, from, to string, fn func(key string, entry *Entry) bool) error {
+	fromKey, toKey := NormalizeKey(from, e.flags), NormalizeKey(to, e.flags)
+
+	// Snapshot the edits within the range
+	e.mu.RLock()
+	var keys []string
+	edits := make(map[string]Change)
+	for key, ed := range e.overlay {
+		if (from == "" || key >= fromKey) && (to == "" || key < toKey) {
+			keys = append(keys, key)
+			edits[key] = ed.change
+		}
+	}
+	e.mu.RUnlock()
+
+	sort.Strings(keys)
+
+	// emit passes on the edit of keys[i], deleted words are skipped
+	emit := func(i int) bool {
+		c := edits[keys[i]]
+		if c.Deleted {
+			return true
+		}
+		return fn(keys[i], &c.Entry)
+	}
+
+	i := 0
+	stopped := false
+	err := e.d.Iterate(ctx, from, to, func(key string, entry *Entry) bool {
+		for ; i < len(keys) && keys[i] < key; i++ {
+			if !emit(i) {
+				stopped = true
+				return false
+			}
+		}
+
+		// The edit replaces the entry
+		if i < len(keys) && keys[i] == key {
+			c := edits[key]
+			i++
+			if c.Deleted {
+				return true
+			}
+			entry = &c.Entry
+		}
+
+		stopped = !fn(key, entry)
+		return !stopped
+	})
+	if err != nil || stopped {
+		return err
+	}
+
+	// The edits sorting after the last entry
+	for ; i < len(keys); i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !emit(i) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// Fold writes the edits as a delta segment of the dictionary and drops them
+// from the log and the overlay. Edits made while folding stay in both. The
+// dictionary as it was before the fold is archived first, along with the
+// folded edits, see Editor.archive. The edits are then recorded in the audit
+// log and the archived version in the history index, see audit.go and
+// history.go. Only the last edit of a word is folded, and audited.
+func (e *Editor) Fold() error {
+	e.foldMu.Lock()
+	defer e.foldMu.Unlock()
+
+	e.mu.RLock()
+	seq := e.seq
+	changes := make([]Change, 0, len(e.overlay))
+	for _, ed := range e.overlay {
+		changes = append(changes, ed.change)
+	}
+	e.mu.RUnlock()
+
+	if len(changes) == 0 {
+		return nil
+	}
+
+	// The version is the time of the fold, like the one of an update
+	now := time.Now()
+	version := now.Format("20060102150405")
+	records := make([]AuditRecord, 0, len(changes))
+	for i := range changes {
+		c := &changes[i]
+
+		_, ok, err := e.d.lookup(c.Word)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", c.Word, err)
+		}
+
+		op := OpAdd
+		switch {
+		case c.Deleted:
+			op = OpDelete
+		case ok:
+			op = OpUpdate
+		}
+		records = append(records, newAuditRecord(op, c, e.flags, version, now.UTC()))
+	}
+
+	archiveDir := filepath.Join(filepath.Dir(e.d.path), archiveDirname)
+	versionDir := filepath.Join(archiveDir, version)
+	err := e.archive(versionDir, changes)
+	if err != nil {
+		return fmt.Errorf("error archiving dictionary: %v", err)
+	}
+
+	err = e.d.Apply(changes)
+	if err != nil {
+		// The version was never in use
+		os.RemoveAll(versionDir)
+		return fmt.Errorf("error applying edits: %v", err)
+	}
+
+	err = e.dropFolded(seq)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Folded %d edits into %s", len(changes), e.d.path)
+
+	err = appendAudit(filepath.Join(filepath.Dir(e.d.path), auditFilename), records)
+	if err != nil {
+		return err
+	}
+
+	// The edits are folded, a failure only leaves the history index behind
+	err = updateHistory(archiveDir, version, e.d.reader().key)
+	if err != nil {
+		log.Printf("error indexing history, rebuild it with the history -rebuild command: %v", err)
+	}
+
+	return nil
+}
+
+// archive builds the dictionary with its segments into dict.dat in dir, the
+// archive directory of the version replaced by the fold, see archiveFiles.
+// The changes are written next to it as changelog.jsonl, sorted by key,
+// unless the dictionary is encrypted. A version is archived only once, so a
+// second fold within the same second fails and is retried later.
+func (e *Editor) archive(dir string, changes []Change) error {
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("version %s is already archived", filepath.Base(dir))
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("error creating archive directory: %v", err)
+	}
+
+	// The segments can't be compacted while they are merged
+	e.d.compactMu.Lock()
+	err = e.d.buildMerged(filepath.Join(dir, dictFilename), e.d.Segments())
+	e.d.compactMu.Unlock()
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	if e.flags&FlagEncrypted != 0 {
+		return nil
+	}
+
+	sorted := append([]Change(nil), changes...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return NormalizeKey(sorted[i].Word, e.flags) < NormalizeKey(sorted[j].Word, e.flags)
+	})
+
+	err = writeChangelog(filepath.Join(dir, jsonlChglogFilename), sorted)
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	return nil
+}
+
+// dropFolded drops the edits up to seq from the overlay and the log
+func (e *Editor) dropFolded(seq uint64) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for key, ed := range e.overlay {
+		if ed.seq <= seq {
+			delete(e.overlay, key)
+		}
+	}
+
+	return e.rewriteLog()
+}
+
+// rewriteLog replaces the log with the edits left in the overlay, in the
+// order they were made. It's called with e.mu held.
+func (e *Editor) rewriteLog() error {
+	left := make([]edit, 0, len(e.overlay))
+	for _, ed := range e.overlay {
+		left = append(left, ed)
+	}
+	sort.Slice(left, func(i, j int) bool {
+		return left[i].seq < left[j].seq
+	})
+
+	tmpPath := e.walPath + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %v", tmpPath, err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for _, ed := range left {
+		line, err := json.Marshal(ed.change)
+		if err != nil {
+			return err
+		}
+		w.Write(append(line, '\n'))
+	}
+
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("error writing %s: %v", tmpPath, err)
+	}
+
+	err = os.Rename(tmpPath, e.walPath)
+	if err != nil {
+		return fmt.Errorf("error replacing %s: %v", e.walPath, err)
+	}
+
+	e.wal.Close()
+	e.wal, err = os.OpenFile(e.walPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %v", e.walPath, err)
+	}
+
+	return nil
+}
+
+// StartFolding folds the edits into the dictionary in the background every
+// interval. It returns the function that stops it. It fails if trusted
+// public keys are configured without their signing key, as the segments
+// written would be rejected.
+func (e *Editor) StartFolding(interval time.Duration) (func(), error) {
+	err := checkSigningKey()
+	if err != nil {
+		return nil, fmt.Errorf("error starting folding: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			err := e.Fold()
+			if err != nil {
+				log.Printf("error folding edits: %v", err)
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}, nil
+}
+
+// Close closes the log. The dictionary is left open.
+func (e *Editor) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.wal != nil {
+		e.wal.Close()
+		e.wal = nil
+	}
+}
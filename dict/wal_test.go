@@ -0,0 +1,194 @@
+package dict
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openEditor opens the editor of a dictionary of 100 words with its log in dir
+func openEditor(t *testing.T, dictPath string) *Editor {
+	t.Helper()
+
+	d, err := Open(dictPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(d.Close)
+
+	e, err := OpenEditor(d, filepath.Join(filepath.Dir(dictPath), walFilename))
+	if err != nil {
+		t.Fatalf("OpenEditor() error = %v", err)
+	}
+	t.Cleanup(e.Close)
+
+	return e
+}
+
+func TestEditor(t *testing.T) {
+	dictPath := buildBenchDict(t, t.TempDir(), 100, BuildOptions{})
+	e := openEditor(t, dictPath)
+
+	if err := e.Put(&Entry{Word: "word000010", Senses: []Sense{{Definition: "edited 10"}}}, Audit{Author: "ana", Reason: "clearer"}); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if err := e.Put(&Entry{Word: "new", Senses: []Sense{{Definition: "added"}}}, Audit{}); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if ok, err := e.Delete("word000020", Audit{}); !ok || err != nil {
+		t.Fatalf("Delete() = %v, %v", ok, err)
+	}
+	if ok, err := e.Delete("missing", Audit{}); ok || err != nil {
+		t.Errorf("Delete(missing) = %v, %v, want false", ok, err)
+	}
+	if err := e.Put(&Entry{Word: "empty"}, Audit{}); err == nil {
+		t.Errorf("Put() of an entry without senses succeeded")
+	}
+
+	expected := map[string]string{
+		"word000010": "edited 10",
+		"new":        "added",
+		"word000020": "",
+		"word000030": "definition of the word number 30 in the benchmark dictionary",
+	}
+	checkEdits := func(e *Editor) {
+		t.Helper()
+		for word, def := range expected {
+			got, ok := e.QueryWord(word)
+			if ok != (def != "") || got != def {
+				t.Errorf("QueryWord(%s) = %q, %v, want %q", word, got, ok, def)
+			}
+		}
+	}
+	checkEdits(e)
+
+	// The edits are merged into the iteration
+	var keys []string
+	e.Iterate(context.Background(), "word000019", "word000022", func(key string, entry *Entry) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if fmt.Sprint(keys) != "[word000019 word000021]" {
+		t.Errorf("Iterate() = %v", keys)
+	}
+
+	n := 0
+	e.Iterate(context.Background(), "", "", func(key string, entry *Entry) bool {
+		n++
+		return true
+	})
+	if n != 100 {
+		t.Errorf("Iterate() = %d entries, want 100", n)
+	}
+
+	// The log is replayed on restart
+	e.Close()
+	e2 := openEditor(t, dictPath)
+	if e2.Pending() != 3 {
+		t.Errorf("replayed %d edits, want 3", e2.Pending())
+	}
+	checkEdits(e2)
+
+	// Folding moves the edits into a segment and empties the log
+	if err := e2.Fold(); err != nil {
+		t.Fatalf("Fold() error = %v", err)
+	}
+	if e2.Pending() != 0 || e2.d.Segments() != 1 {
+		t.Errorf("after Fold() %d edits pending, %d segments", e2.Pending(), e2.d.Segments())
+	}
+	if fi, _ := os.Stat(e2.walPath); fi.Size() != 0 {
+		t.Errorf("log holds %d bytes after Fold()", fi.Size())
+	}
+	checkEdits(e2)
+
+	// The folded edits are audited, and the entries they replaced kept in the history
+	dir := filepath.Dir(dictPath)
+	var version string
+	for word, op := range map[string]ProposalOp{"word000010": OpUpdate, "new": OpAdd, "word000020": OpDelete} {
+		records, err := readAuditTrail(filepath.Join(dir, auditFilename), word)
+		if err != nil || len(records) != 1 || records[0].Op != op || records[0].Timestamp.IsZero() {
+			t.Fatalf("audit trail of %s = %+v, %v, want %s", word, records, err, op)
+		}
+		if word == "word000010" && (records[0].Author != "ana" || records[0].Reason != "clearer") {
+			t.Errorf("audit record of %s = %+v, want its author and reason", word, records[0])
+		}
+		version = records[0].Version
+	}
+
+	// The dictionary replaced by the fold is archived along with the edits
+	vs := OpenVersions(filepath.Join(dir, archiveDirname), e2, 2)
+	defer vs.Close()
+	if def, v, ok, err := vs.QueryWord(version, "word000010"); err != nil || !ok || v != version || def != "definition of the word number 10 in the benchmark dictionary" {
+		t.Errorf("QueryWord(%s, word000010) = %q, %s, %v, %v", version, def, v, ok, err)
+	}
+	if _, err := ReadChanges(filepath.Join(dir, archiveDirname, version, jsonlChglogFilename)); err != nil {
+		t.Errorf("archived changelog error = %v", err)
+	}
+
+	// The history survives a rebuild from the archives
+	for _, rebuild := range []bool{false, true} {
+		if rebuild {
+			if err := RebuildHistory(filepath.Join(dir, archiveDirname), nil); err != nil {
+				t.Fatalf("RebuildHistory() error = %v", err)
+			}
+		}
+
+		h, err := OpenHistory(filepath.Join(dir, archiveDirname, historyFilename), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		current, _ := e2.Lookup("word000010")
+		records, err := h.Word("word000010", current)
+		if err != nil || len(records) != 2 || records[0].Entry.Definition() != "definition of the word number 10 in the benchmark dictionary" || records[1].Version != CurrentVersion {
+			t.Errorf("history of word000010 = %+v, %v", records, err)
+		}
+		if records, err := h.Word("word000020", nil); err != nil || len(records) != 2 || !records[1].Deleted {
+			t.Errorf("history of word000020 = %+v, %v", records, err)
+		}
+	}
+
+	// Edits after the fold are appended to the new log
+	if err := e2.Put(&Entry{Word: "later", Senses: []Sense{{Definition: "after fold"}}}, Audit{}); err != nil {
+		t.Fatal(err)
+	}
+	e2.Close()
+
+	expected["later"] = "after fold"
+	e3 := openEditor(t, dictPath)
+	if e3.Pending() != 1 {
+		t.Errorf("replayed %d edits, want 1", e3.Pending())
+	}
+	checkEdits(e3)
+}
+
+func TestEditorTornLog(t *testing.T) {
+	dictPath := buildBenchDict(t, t.TempDir(), 10, BuildOptions{})
+	walPath := filepath.Join(filepath.Dir(dictPath), walFilename)
+
+	log := `{"word":"word000001","senses":[{"definition":"edited"}]}
+{"word":"word000002","sen`
+	os.WriteFile(walPath, []byte(log), 0644)
+
+	e := openEditor(t, dictPath)
+	if def, ok := e.QueryWord("word000001"); !ok || def != "edited" {
+		t.Errorf("QueryWord(word000001) = %q, %v", def, ok)
+	}
+
+	// The torn edit is dropped, the next one is appended after the good ones
+	e.Put(&Entry{Word: "word000003", Senses: []Sense{{Definition: "edited 3"}}}, Audit{})
+	e.Close()
+
+	e2 := openEditor(t, dictPath)
+	if e2.Pending() != 2 {
+		t.Errorf("replayed %d edits, want 2", e2.Pending())
+	}
+
+	os.WriteFile(walPath, []byte("not json\n"), 0644)
+	d, _ := Open(dictPath)
+	defer d.Close()
+	if _, err := OpenEditor(d, walPath); err == nil {
+		t.Errorf("OpenEditor() of a corrupt log succeeded")
+	}
+}
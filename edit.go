@@ -0,0 +1,133 @@
+package main
+
+// This file contains the online editing endpoints of the local dictionary:
+//
+//	PUT /dict/:word     {"senses":[{"definition":"..."}],"author":"...","reason":"..."}
+//	DELETE /dict/:word  {"author":"...","reason":"..."}
+//
+// They require the bearer token in DICT_ADMIN_TOKEN and are disabled
+// without it. Edits are logged and served at once, see dict.Editor. The
+// optional author and reason are recorded in the audit log, the body of a
+// delete is optional.
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/harshjoeyit/word-dict/dict"
+)
+
+// registerEditRoutes adds the edit endpoints if an admin token is configured
+func registerEditRoutes(ge *gin.Engine, editor *dict.Editor) {
+	token := os.Getenv("DICT_ADMIN_TOKEN")
+	if token == "" {
+		log.Printf("DICT_ADMIN_TOKEN is not set, editing is disabled")
+		return
+	}
+
+	admin := ge.Group("/", requireToken(token))
+	admin.PUT("/dict/:word", putHandler(editor))
+	admin.DELETE("/dict/:word", deleteHandler(editor))
+}
+
+// requireToken rejects the requests without one of the bearer tokens,
+// empty tokens are ignored
+func requireToken(tokens ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		got, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if ok {
+			for _, token := range tokens {
+				if token != "" && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1 {
+					c.Next()
+					return
+				}
+			}
+		}
+
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+	}
+}
+
+// putHandler adds or replaces the entry of the word with the entry in the body
+func putHandler(editor *dict.Editor) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			dict.Entry
+			Author string `json:"author"`
+			Reason string `json:"reason"`
+		}
+		err := c.ShouldBindJSON(&body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid entry: " + err.Error(),
+			})
+			return
+		}
+
+		// The word of the path wins over the one of the body
+		e := body.Entry
+		e.Word = c.Param("word")
+
+		err = editor.Put(&e, dict.Audit{Author: body.Author, Reason: body.Reason})
+		if errors.Is(err, dict.ErrInvalidChange) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		if err != nil {
+			log.Printf("error editing %s: %v", e.Word, err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Failed to save the entry",
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, entryResponse(&e))
+	}
+}
+
+// deleteHandler deletes the word
+func deleteHandler(editor *dict.Editor) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Author string `json:"author"`
+			Reason string `json:"reason"`
+		}
+		if c.Request.ContentLength != 0 {
+			err := c.ShouldBindJSON(&body)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": "Invalid request: " + err.Error(),
+				})
+				return
+			}
+		}
+
+		word := c.Param("word")
+
+		ok, err := editor.Delete(word, dict.Audit{Author: body.Author, Reason: body.Reason})
+		if err != nil {
+			log.Printf("error deleting %s: %v", word, err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Failed to delete the word",
+			})
+			return
+		}
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "Word not found",
+			})
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
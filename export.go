@@ -0,0 +1,65 @@
+package main
+
+// This file contains the export endpoint:
+//
+//	GET /export?format=stardict|dictd|jsonl|csv
+//
+// It streams the whole dictionary in the format, StarDict and dictd
+// dictionaries as a tar archive of their files, see dict.Export. It takes
+// DICT_ADMIN_TOKEN as bearer token.
+
+import (
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/harshjoeyit/word-dict/dict"
+)
+
+// exportContentTypes are the content types of the export formats
+var exportContentTypes = map[dict.ExportFormat]string{
+	dict.ExportStarDict: "application/x-tar",
+	dict.ExportDictd:    "application/x-tar",
+	dict.ExportJSONL:    "application/x-ndjson",
+	dict.ExportCSV:      "text/csv; charset=utf-8",
+}
+
+// registerExportRoutes adds the export endpoint if an admin token is configured
+func registerExportRoutes(ge *gin.Engine, d dictionary) {
+	token := os.Getenv("DICT_ADMIN_TOKEN")
+	if token == "" {
+		log.Printf("DICT_ADMIN_TOKEN is not set, exports are disabled")
+		return
+	}
+
+	ge.GET("/export", requireToken(token), exportHandler(d))
+}
+
+// exportHandler streams the dictionary in the format of ?format=
+func exportHandler(d dictionary) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		format, err := dict.ParseExportFormat(c.Query("format"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		filename := "dict." + string(format)
+		if format.Archive() {
+			filename = "dict-" + string(format) + ".tar"
+		}
+		c.Header("Content-Type", exportContentTypes[format])
+		c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+		c.Status(http.StatusOK)
+
+		// The response is streamed, so errors past this point can only be
+		// logged, leaving the export truncated
+		n, err := dict.Export(c.Request.Context(), c.Writer, d, format, "dict")
+		if err != nil {
+			log.Printf("error exporting %s after %d entries: %v", format, n, err)
+		}
+	}
+}
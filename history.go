@@ -0,0 +1,61 @@
+package main
+
+// This file contains the history endpoint:
+//
+//	GET /dict/:word/history
+//
+// It returns every distinct entry of the word across the archived versions
+// of the dictionary along with the version where it first appeared, the oldest
+// first, see dict.History. The entry of the dictionary in use is reported
+// as the "current" version if it differs from the latest archived one.
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/harshjoeyit/word-dict/dict"
+)
+
+// registerHistoryRoutes adds the history endpoint of the dictionary
+func registerHistoryRoutes(ge *gin.Engine, d dictionary) {
+	h, err := dict.NewHistory()
+	if err != nil {
+		log.Printf("error opening history, the history endpoint is disabled: %v", err)
+		return
+	}
+
+	ge.GET("/dict/:word/history", historyHandler(h, d))
+}
+
+// historyHandler returns the history of the word
+func historyHandler(h *dict.History, d dictionary) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		word := c.Param("word")
+
+		current, ok := d.Lookup(word)
+		if !ok {
+			current = nil
+		}
+
+		records, err := h.Word(word, current)
+		if err != nil {
+			log.Printf("error reading history of %s: %v", word, err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Failed to read the history",
+			})
+			return
+		}
+		if len(records) == 0 {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "Word not found",
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"word":    word,
+			"history": records,
+		})
+	}
+}
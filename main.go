@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"io/fs"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/harshjoeyit/word-dict/dict"
@@ -11,12 +17,23 @@ import (
 )
 
 func main() {
-	// Load .env file
+	// Load .env file. Subcommands read their keys and options from it too,
+	// but don't need it.
 	err := godotenv.Load(".env")
-	if err != nil {
+	cli := len(os.Args) > 1
+	if err != nil && !(cli && errors.Is(err, fs.ErrNotExist)) {
 		log.Fatalf("Error loading .env file: %v", err)
 	}
 
+	// Subcommands run without the server, see cli.go
+	if cli {
+		err := runCommand(os.Args[1:])
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
+
 	// Uncomment the following lines to build a new dictionary
 	//
 	// err := dict.BuildNewDict()
@@ -24,11 +41,59 @@ func main() {
 	// 	log.Fatalf("Error building new dictionary: %v", err)
 	// }
 
-	d, err := dict.New()
-	if err != nil {
-		log.Fatalf("Error creating new dictionary: %v", err)
+	// A sharded dictionary is used instead if manifest.json exists. The
+	// local one is edited online, see edit.go.
+	var d dictionary
+	var editor *dict.Editor
+	var versions *dict.Versions
+	if dict.ManifestExists() {
+		sd, err := dict.NewSharded()
+		if err != nil {
+			log.Fatalf("Error opening sharded dictionary: %v", err)
+		}
+		defer sd.Close()
+		d = sd
+
+		// The updates archive the manifests of the sharded versions too
+		versions, err = dict.NewVersions(sd, versionCacheSize)
+		if err != nil {
+			log.Fatalf("Error opening versions: %v", err)
+		}
+		defer versions.Close()
+	} else {
+		dd, err := dict.New()
+		if err != nil {
+			log.Fatalf("Error creating new dictionary: %v", err)
+		}
+		defer dd.Close()
+
+		// Merge the delta segments into dict.dat in the background
+		stopCompaction, err := dd.StartCompaction(compactionInterval, compactionSegments)
+		if err != nil {
+			log.Fatalf("Error opening dictionary: %v", err)
+		}
+		defer stopCompaction()
+
+		editor, err = dict.NewEditor(dd)
+		if err != nil {
+			log.Fatalf("Error opening edits: %v", err)
+		}
+		defer editor.Close()
+
+		stopFolding, err := editor.StartFolding(foldInterval)
+		if err != nil {
+			log.Fatalf("Error opening edits: %v", err)
+		}
+		defer stopFolding()
+		d = editor
+
+		// The archived versions answer the queries with ?version=, see version.go
+		versions, err = dict.NewVersions(editor, versionCacheSize)
+		if err != nil {
+			log.Fatalf("Error opening versions: %v", err)
+		}
+		defer versions.Close()
 	}
-	defer d.Close()
 
 	// Query the dictionary for a word
 	// def, ok := d.QueryWord("abandon")
@@ -55,7 +120,13 @@ func main() {
 	// 	log.Printf("Definition: %s", def)
 	// }
 
-	s3d, err := s3dict.New()
+	// Likewise the S3 dictionary is sharded if DICT_MANIFEST_KEY is set
+	var s3d dictionary
+	if os.Getenv("DICT_MANIFEST_KEY") != "" {
+		s3d, err = s3dict.NewSharded()
+	} else {
+		s3d, err = s3dict.New()
+	}
 	if err != nil {
 		log.Fatalf("Error creating new S3 dictionary: %v", err)
 	}
@@ -68,35 +139,128 @@ func main() {
 
 	// Setup a simple Gin server with 2 API endpoints - one for dict other for s3dict
 	ge := gin.Default()
-	ge.GET("/dict/:word", func(c *gin.Context) {
-		word := c.Param("word")
-		def, ok := d.QueryWord(word)
-		if ok {
-			c.JSON(http.StatusOK, gin.H{
-				"word":       word,
-				"definition": def,
-			})
-		} else {
-			c.JSON(http.StatusNotFound, gin.H{
-				"error": "Word not found",
-			})
+	ge.GET("/dict", listHandler(d.Iterate, versions))
+	ge.GET("/dict/:word", lookupHandler(d.Lookup, versions))
+
+	if editor != nil {
+		registerEditRoutes(ge, editor)
+	}
+
+	proposals, err := dict.NewProposalStore()
+	if err != nil {
+		log.Fatalf("Error opening proposals: %v", err)
+	}
+	registerProposalRoutes(ge, proposals)
+	registerAuditRoutes(ge)
+	registerExportRoutes(ge, d)
+
+	// The history covers the archived versions of the local dictionary
+	registerHistoryRoutes(ge, d)
+
+	ge.GET("/s3dict", listHandler(s3d.Iterate, nil))
+	ge.GET("/s3dict/:word", lookupHandler(s3d.Lookup, nil))
+
+	ge.Run(":9090")
+}
+
+// Bounds of the number of entries of a listing page
+const (
+	defaultPageSize = 50
+	maxPageSize     = 1000
+)
+
+// The local dictionary is compacted once it has compactionSegments delta
+// segments, the online edits are folded into a segment every foldInterval
+const (
+	compactionInterval = 10 * time.Minute
+	compactionSegments = 4
+	foldInterval       = time.Minute
+	// versionCacheSize is the number of archived versions kept open
+	versionCacheSize = 4
+)
+
+// dictionary is a local or S3 backed dictionary, sharded or not
+type dictionary interface {
+	Lookup(word string) (*dict.Entry, bool)
+	Iterate(ctx context.Context, from, to string, fn func(key string, e *dict.Entry) bool) error
+}
+
+// iterateFunc walks a dictionary in key order, see dict.Reader.Iterate
+type iterateFunc func(ctx context.Context, from, to string, fn func(key string, e *dict.Entry) bool) error
+
+// listHandler serves a page of up to ?limit= entries in key order, starting
+// at the cursor ?from=. The response holds the cursor of the next page - the
+// key of its first entry - unless it's the last page. Since keys are unique
+// and sorted, a cursor stays valid across dictionary updates. With
+// ?version= the page is read from that version, see version.go.
+func listHandler(iterate iterateFunc, versions *dict.Versions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		iter := iterate
+		version := c.Query("version")
+		if version != "" {
+			if versions == nil {
+				versionsUnavailable(c)
+				return
+			}
+			iter = func(ctx context.Context, from, to string, fn func(key string, e *dict.Entry) bool) (err error) {
+				version, err = versions.Iterate(ctx, version, from, to, fn)
+				return err
+			}
 		}
-	})
-
-	ge.GET("/s3dict/:word", func(c *gin.Context) {
-		word := c.Param("word")
-		def, ok := s3d.QueryWord(word)
-		if ok {
-			c.JSON(http.StatusOK, gin.H{
-				"word":       word,
-				"definition": def,
-			})
-		} else {
-			c.JSON(http.StatusNotFound, gin.H{
-				"error": "Word not found",
+
+		limit := defaultPageSize
+		if l := c.Query("limit"); l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil || n <= 0 || n > maxPageSize {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": "limit must be between 1 and " + strconv.Itoa(maxPageSize),
+				})
+				return
+			}
+			limit = n
+		}
+
+		entries := []any{}
+		next := ""
+
+		err := iter(c.Request.Context(), c.Query("from"), "", func(key string, e *dict.Entry) bool {
+			if len(entries) == limit {
+				next = key
+				return false
+			}
+
+			entries = append(entries, entryResponse(e))
+			return true
+		})
+		if c.Query("version") != "" && err != nil {
+			versionError(c, err)
+			return
+		}
+		if err != nil {
+			log.Printf("error listing dictionary: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Failed to list words",
 			})
+			return
 		}
-	})
 
-	ge.Run(":9090")
+		resp := gin.H{"entries": entries}
+		if next != "" {
+			resp["next"] = next
+		}
+		if version != "" {
+			resp["version"] = version
+		}
+
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+// entryResponse is the JSON shape of a found word. It carries the structured
+// entry along with the flattened definition for older clients.
+func entryResponse(e *dict.Entry) any {
+	return struct {
+		*dict.Entry
+		Definition string `json:"definition"`
+	}{e, e.Definition()}
 }
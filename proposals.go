@@ -0,0 +1,150 @@
+package main
+
+// This file contains the editorial review endpoints:
+//
+//	POST /proposals                {"op":"update","entry":{...},"author":"...","reason":"..."}
+//	GET  /proposals?status=pending
+//	GET  /proposals/:id
+//	POST /proposals/:id/comments   {"author":"...","text":"..."}
+//	POST /proposals/:id/approve    {"reviewer":"..."}
+//	POST /proposals/:id/reject     {"reviewer":"..."}
+//
+// Lexicographers need DICT_EDITOR_TOKEN (or DICT_ADMIN_TOKEN) as bearer
+// token, approving and rejecting needs DICT_ADMIN_TOKEN. The approved
+// proposals are applied offline by the apply-proposals command.
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/harshjoeyit/word-dict/dict"
+)
+
+// registerProposalRoutes adds the review endpoints if the tokens are configured
+func registerProposalRoutes(ge *gin.Engine, store *dict.ProposalStore) {
+	adminToken := os.Getenv("DICT_ADMIN_TOKEN")
+	editorToken := os.Getenv("DICT_EDITOR_TOKEN")
+	if adminToken == "" {
+		log.Printf("DICT_ADMIN_TOKEN is not set, proposals are disabled")
+		return
+	}
+
+	editors := ge.Group("/proposals", requireToken(editorToken, adminToken))
+	editors.POST("", submitProposalHandler(store))
+	editors.GET("", listProposalsHandler(store))
+	editors.GET("/:id", getProposalHandler(store))
+	editors.POST("/:id/comments", commentProposalHandler(store))
+
+	reviewers := ge.Group("/proposals", requireToken(adminToken))
+	reviewers.POST("/:id/approve", reviewProposalHandler(store.Approve))
+	reviewers.POST("/:id/reject", reviewProposalHandler(store.Reject))
+}
+
+// proposalError writes the response of a failed proposal operation
+func proposalError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, dict.ErrProposalNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Proposal not found"})
+	case errors.Is(err, dict.ErrProposalClosed):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, dict.ErrInvalidChange):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		log.Printf("error handling proposal: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to handle the proposal"})
+	}
+}
+
+// submitProposalHandler stores the proposal in the body as pending
+func submitProposalHandler(store *dict.ProposalStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var p dict.Proposal
+		err := c.ShouldBindJSON(&p)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid proposal: " + err.Error()})
+			return
+		}
+
+		err = store.Submit(&p)
+		if err != nil {
+			proposalError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusCreated, &p)
+	}
+}
+
+// listProposalsHandler lists the proposals, optionally of a ?status=
+func listProposalsHandler(store *dict.ProposalStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		proposals, err := store.List(dict.ProposalStatus(c.Query("status")))
+		if err != nil {
+			proposalError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"proposals": proposals})
+	}
+}
+
+// getProposalHandler returns a proposal along with its comments
+func getProposalHandler(store *dict.ProposalStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p, err := store.Get(c.Param("id"))
+		if err != nil {
+			proposalError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, p)
+	}
+}
+
+// commentProposalHandler adds the comment in the body to a proposal
+func commentProposalHandler(store *dict.ProposalStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Author string `json:"author"`
+			Text   string `json:"text"`
+		}
+		err := c.ShouldBindJSON(&body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid comment: " + err.Error()})
+			return
+		}
+
+		p, err := store.Comment(c.Param("id"), body.Author, body.Text)
+		if err != nil {
+			proposalError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, p)
+	}
+}
+
+// reviewProposalHandler approves or rejects a proposal with review
+func reviewProposalHandler(review func(id, reviewer string) (*dict.Proposal, error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Reviewer string `json:"reviewer"`
+		}
+		err := c.ShouldBindJSON(&body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid review: " + err.Error()})
+			return
+		}
+
+		p, err := review(c.Param("id"), body.Reviewer)
+		if err != nil {
+			proposalError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, p)
+	}
+}
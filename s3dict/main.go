@@ -6,16 +6,20 @@ package s3dict
 import (
 	"bytes"
 	"context"
-	"encoding/binary"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
+	"io"
 	"log"
 	"os"
-	"strings"
+	"path"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/harshjoeyit/word-dict/dict"
 )
 
@@ -23,11 +27,20 @@ type S3Dict struct {
 	// key is dictonary file's relative path in S3 bucket
 	key string
 	s3b *S3Bucket
-	// in-memory index of the dictionary
-	index map[string]dict.IndexEntry
+	// rd holds the in-memory index of the dictionary and fetches
+	// entries (or compressed blocks) with range requests
+	rd *dict.Reader
 }
 
-func New() (*S3Dict, error) {
+// New creates a dictionary backed by the S3 object DICT_KEY.
+// The options are passed on to dict.NewReader. If trusted public keys are
+// configured in DICT_PUBLIC_KEYS, the object must be signed by one of them,
+// the signature being the object DICT_KEY + dict.SignatureExt, and the
+// object is then read at the version verified, see openObject. Encrypted
+// objects are decrypted block by block with the key in DICT_ENCRYPTION_KEY
+// (or DICT_ENCRYPTION_KEY_FILE). DICT_LOW_MEMORY keeps the index in S3
+// unless the options say otherwise, see dict.LowMemoryFromEnv.
+func New(opts ...dict.Option) (*S3Dict, error) {
 	s3b, err := NewS3Bucket()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create S3 bucket client: %v", err)
@@ -35,41 +48,212 @@ func New() (*S3Dict, error) {
 
 	key := os.Getenv("DICT_KEY")
 
+	keys, err := dict.PublicKeysFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	encKey, err := dict.EncryptionKeyFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("error reading encryption key: %v", err)
+	}
+	opts = append(opts, dict.WithEncryptionKey(encKey))
+
+	// The options passed in win over DICT_LOW_MEMORY
+	lowMemory, err := dict.LowMemoryFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	opts = append([]dict.Option{lowMemory}, opts...)
+
 	// Read the index from key file
-	index, err := readIndex(s3b, key)
+	var verify func(obj *objectVersion) error
+	if len(keys) > 0 {
+		verify = func(obj *objectVersion) error {
+			return verifySignature(s3b, obj, keys)
+		}
+	}
+
+	rd, err := openObject(s3b, key, verify, opts...)
 	if err != nil {
 		log.Fatalf("failed to read index: %v", err)
 	}
 
 	s3d := &S3Dict{
-		key:   key,
-		s3b:   s3b,
-		index: index,
+		key: key,
+		s3b: s3b,
+		rd:  rd,
 	}
 
 	return s3d, nil
 }
 
-// QueryWord queries the dictionary for a word and returns its definition
+// QueryWord queries the dictionary for a word and returns its definition.
+// The word is normalized the same way as the keys were at build time.
 func (d *S3Dict) QueryWord(word string) (string, bool) {
-	// Find the word in the index
-	idxe, ok := d.index[word]
+	e, ok := d.Lookup(word)
 	if !ok {
-		log.Printf("Error: '%s' word not found", word)
 		return "", false
 	}
 
-	// Read the definition - <word>,<definition>
-	defOffsetSt := idxe.Offset + int64(len(idxe.Word)+1) // +1 for the comma
-	defOffsetEn := defOffsetSt + int64(idxe.DefSize) - 1
+	return e.Definition(), true
+}
+
+// Iterate calls fn with the key and the entry of every word in [from, to)
+// in key order, see dict.Reader.Iterate. The index and the entries are
+// fetched with a range request per run of the sparse index.
+func (d *S3Dict) Iterate(ctx context.Context, from, to string, fn func(key string, e *dict.Entry) bool) error {
+	return d.rd.Iterate(ctx, from, to, fn)
+}
+
+// All returns an iterator over all entries in key order, see dict.Reader.All
+func (d *S3Dict) All() func(yield func(key string, e *dict.Entry) bool) {
+	return d.rd.All()
+}
 
-	data, err := d.s3b.GetObjectByteRange(d.key, defOffsetSt, defOffsetEn) // +1 for the comma
+// Stats returns the statistics of the dictionary, see dict.Reader.Stats.
+// It downloads the whole object.
+func (d *S3Dict) Stats() (dict.Stats, error) {
+	return d.rd.Stats()
+}
+
+// Verify checks the whole object against its checksums and returns the
+// corrupted ranges, see dict.Reader.Verify. It downloads the whole object.
+func (d *S3Dict) Verify() ([]dict.Corruption, error) {
+	return d.rd.Verify()
+}
+
+// Lookup queries the dictionary for a word and returns its structured entry
+func (d *S3Dict) Lookup(word string) (*dict.Entry, bool) {
+	// Read the entry (or its block) with a single range request
+	e, ok, err := d.rd.Lookup(word)
 	if err != nil {
 		log.Printf("error reading definition: %v", err)
+		return nil, false
+	}
+	if !ok {
+		log.Printf("Error: '%s' word not found", word)
+		return nil, false
+	}
+
+	return e, true
+}
+
+// S3ShardedDict is a sharded dictionary whose manifest and shards are S3
+// objects, see dict.ShardedReader
+type S3ShardedDict struct {
+	*dict.ShardedReader
+}
+
+// NewSharded creates a sharded dictionary backed by the S3 manifest object
+// DICT_MANIFEST_KEY. The keys of the shards are relative to the manifest's.
+// If trusted public keys are configured, the manifest must be signed by one
+// of them and the shards match its digests, see dict.Manifest.Verify.
+// Encrypted shards are decrypted with the configured key.
+// The options are passed on to every shard's dict.NewReader.
+func NewSharded(opts ...dict.Option) (*S3ShardedDict, error) {
+	s3b, err := NewS3Bucket()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 bucket client: %v", err)
+	}
+
+	manifestKey := os.Getenv("DICT_MANIFEST_KEY")
+
+	body, err := s3b.GetObject(manifestKey)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s, %v", manifestKey, err)
+	}
+
+	m, err := dict.ParseManifest(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", manifestKey, err)
+	}
+
+	// The manifest is verified before any shard is read, the shards are
+	// then checked against its digests
+	keys, err := dict.PublicKeysFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) > 0 {
+		err = m.Verify(keys)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", manifestKey, err)
+		}
+		log.Printf("Verified signature of %s", manifestKey)
+	}
+
+	encKey, err := dict.EncryptionKeyFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("error reading encryption key: %v", err)
+	}
+	opts = append(opts, dict.WithEncryptionKey(encKey))
+
+	// The options passed in win over DICT_LOW_MEMORY
+	lowMemory, err := dict.LowMemoryFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	opts = append([]dict.Option{lowMemory}, opts...)
+
+	readers := make([]*dict.Reader, len(m.Shards))
+	for i := range m.Shards {
+		s := &m.Shards[i]
+		key := path.Join(path.Dir(manifestKey), s.Path)
+
+		var verify func(obj *objectVersion) error
+		if len(keys) > 0 {
+			verify = func(obj *objectVersion) error {
+				sum, err := s3b.objectDigest(obj)
+				if err != nil {
+					return err
+				}
+				return s.VerifyDigest(sum)
+			}
+		}
+
+		readers[i], err = openObject(s3b, key, verify, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read index of %s: %w", key, err)
+		}
+	}
+
+	sr, err := dict.NewShardedReader(m, readers)
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3ShardedDict{ShardedReader: sr}, nil
+}
+
+// QueryWord queries the dictionary for a word and returns its definition
+func (d *S3ShardedDict) QueryWord(word string) (string, bool) {
+	e, ok := d.Lookup(word)
+	if !ok {
 		return "", false
 	}
 
-	return string(data), true
+	return e.Definition(), true
+}
+
+// Lookup queries the shard holding the word and returns its structured entry
+func (d *S3ShardedDict) Lookup(word string) (*dict.Entry, bool) {
+	e, ok, err := d.ShardedReader.Lookup(word)
+	if err != nil {
+		log.Printf("error reading definition: %v", err)
+		return nil, false
+	}
+	if !ok {
+		log.Printf("Error: '%s' word not found", word)
+		return nil, false
+	}
+
+	return e, true
 }
 
 type S3Bucket struct {
@@ -105,69 +289,218 @@ func NewS3Bucket() (*S3Bucket, error) {
 	return s3b, nil
 }
 
-func readIndex(s3b *S3Bucket, key string) (map[string]dict.IndexEntry, error) {
-	// Read the constant sized index header - 8 bytes
-	const indexHeaderSize int64 = 8
-	data, err := s3b.GetObjectByteRange(key, 0, indexHeaderSize-1)
+// objectVersion is the version of an object a dictionary is read from. The
+// range requests are made against that version, so that an object replaced
+// after its signature was verified fails them instead of being read.
+type objectVersion struct {
+	key       string
+	etag      string
+	versionID string
+	size      int64
+	// sha256 is the SHA-256 checksum S3 keeps of the whole object, if it was
+	// uploaded with one, e.g. with --checksum-algorithm SHA256
+	sha256 []byte
+}
+
+// openObject verifies the object with verify, if it's set, then reads its
+// index. The object's version is recorded first and every request after
+// that is made against it.
+func openObject(s3b *S3Bucket, key string, verify func(obj *objectVersion) error, opts ...dict.Option) (*dict.Reader, error) {
+	obj, err := s3b.headObject(key)
 	if err != nil {
-		return nil, fmt.Errorf("unable to get index header, %v", err)
+		return nil, err
 	}
 
-	// Convert byte slice to int64
-	indexSize := int64(binary.BigEndian.Uint64(data))
+	if verify != nil {
+		err = verify(obj)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		log.Printf("Verified %s", key)
+	}
 
-	log.Println("Index size:", indexSize)
+	return readIndex(s3b, obj, opts...)
+}
 
-	// Read the index
-	indexOffsetSt := indexHeaderSize
-	indexOffsetEn := indexOffsetSt + indexSize - 1
+// objectDigest returns the SHA-256 digest of the object: the checksum S3
+// keeps of it if there's one, otherwise the whole object is downloaded and
+// hashed
+func (s3b *S3Bucket) objectDigest(obj *objectVersion) ([]byte, error) {
+	if obj.sha256 != nil {
+		return obj.sha256, nil
+	}
 
-	data, err = s3b.GetObjectByteRange(key, indexOffsetSt, indexOffsetEn)
+	body, err := s3b.getObject(obj)
 	if err != nil {
-		return nil, fmt.Errorf("unable to get index data, %v", err)
+		return nil, err
 	}
+	defer body.Close()
 
-	index := make(map[string]dict.IndexEntry)
+	h := sha256.New()
+	_, err = io.Copy(h, body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s, %v", obj.key, err)
+	}
 
-	// Convert byte slice to string and split by new line
-	// Each line is of the format <word>:<offset>:<defSize>
-	lines := strings.Split(string(data), "\n")
+	return h.Sum(nil), nil
+}
 
-	for _, line := range lines {
-		if line == "" {
-			continue
-		}
+// verifySignature checks the object against its signature, see objectDigest
+func verifySignature(s3b *S3Bucket, obj *objectVersion, keys []ed25519.PublicKey) error {
+	sigKey := obj.key + dict.SignatureExt
+	body, err := s3b.GetObject(sigKey)
+	if err != nil {
+		return fmt.Errorf("%w: %v", dict.ErrSignature, err)
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return fmt.Errorf("unable to read %s, %v", sigKey, err)
+	}
 
-		parts := strings.Split(line, ":")
-		if len(parts) != 3 {
-			continue
-		}
+	sig, err := dict.ParseSignature(data)
+	if err != nil {
+		return err
+	}
+
+	sum, err := s3b.objectDigest(obj)
+	if err != nil {
+		return err
+	}
+
+	return sig.VerifyDigest(sum, keys)
+}
+
+func readIndex(s3b *S3Bucket, obj *objectVersion, opts ...dict.Option) (*dict.Reader, error) {
+	// The header and the section table are fetched with a range request
+	// each, and so is every section loaded up front: the checksums, the key
+	// ID, the block table, the Bloom filter and the index, which is only
+	// sampled in the low-memory mode
+	rd, err := dict.NewReader(&objectReader{s3b: s3b, obj: obj}, obj.size, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read index, %v", err)
+	}
+
+	log.Println("Index size:", rd.Header().IndexSize)
+	log.Println("Total index entries:", rd.Len())
+
+	return rd, nil
+}
+
+// objectReader implements io.ReaderAt over a version of an S3 object using
+// range requests
+type objectReader struct {
+	s3b *S3Bucket
+	obj *objectVersion
+}
+
+func (r *objectReader) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	data, err := r.s3b.getObjectRange(r.obj, off, off+int64(len(p))-1)
+	if err != nil {
+		return 0, err
+	}
+
+	n := copy(p, data)
+	if n < len(p) {
+		return n, io.ErrUnexpectedEOF
+	}
+
+	return n, nil
+}
 
-		word := parts[0]
-		offset := int64(binary.BigEndian.Uint64([]byte(parts[1])))
-		defSize := int16(binary.BigEndian.Uint16([]byte(parts[2])))
+// GetObjectSize returns the size of an object in bytes
+func (s3b *S3Bucket) GetObjectSize(key string) (int64, error) {
+	result, err := s3b.client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: aws.String(s3b.bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get object metadata from s3, %v", err)
+	}
 
-		index[word] = dict.IndexEntry{
-			Word:    word,
-			Offset:  offset,
-			DefSize: defSize,
+	return aws.ToInt64(result.ContentLength), nil
+}
+
+// headObject returns the current version of an object, along with the
+// SHA-256 checksum of the whole object if S3 keeps one
+func (s3b *S3Bucket) headObject(key string) (*objectVersion, error) {
+	result, err := s3b.client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket:       aws.String(s3b.bucketName),
+		Key:          aws.String(key),
+		ChecksumMode: types.ChecksumModeEnabled,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object metadata from s3, %v", err)
+	}
+
+	obj := &objectVersion{
+		key:       key,
+		etag:      aws.ToString(result.ETag),
+		versionID: aws.ToString(result.VersionId),
+		size:      aws.ToInt64(result.ContentLength),
+	}
+
+	// The checksums of multipart uploads are checksums of the parts' unless
+	// they are of the full object type
+	if result.ChecksumSHA256 != nil && result.ChecksumType == types.ChecksumTypeFullObject {
+		obj.sha256, err = base64.StdEncoding.DecodeString(*result.ChecksumSHA256)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SHA-256 checksum of %s, %v", key, err)
 		}
 	}
 
-	log.Println("Total index entries:", len(index))
+	return obj, nil
+}
 
-	return index, nil
+// GetObject retrieves a whole object from S3, the caller has to close the body
+func (s3b *S3Bucket) GetObject(key string) (io.ReadCloser, error) {
+	return s3b.getObject(&objectVersion{key: key})
+}
+
+// getObject retrieves a whole version of an object from S3, see GetObject
+func (s3b *S3Bucket) getObject(obj *objectVersion) (io.ReadCloser, error) {
+	result, err := s3b.client.GetObject(context.TODO(), s3b.objectInput(obj, nil))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object %s from s3, %v", obj.key, err)
+	}
+
+	return result.Body, nil
+}
+
+// objectInput returns the request of a byte range of a version of an object,
+// the whole object if rng is nil. The request fails if the object doesn't
+// have the recorded version id or ETag anymore.
+func (s3b *S3Bucket) objectInput(obj *objectVersion, rng *string) *s3.GetObjectInput {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s3b.bucketName),
+		Key:    aws.String(obj.key),
+		Range:  rng,
+	}
+	if obj.versionID != "" {
+		input.VersionId = aws.String(obj.versionID)
+	}
+	if obj.etag != "" {
+		input.IfMatch = aws.String(obj.etag)
+	}
+
+	return input
 }
 
 // GetObjectByteRange retrieves an object from S3 for byte range [rangeSt, rangeEn]
 // (both inclusive) and returns the data as a byte slice.
 func (s3b *S3Bucket) GetObjectByteRange(key string, rangeSt, rangeEn int64) ([]byte, error) {
+	return s3b.getObjectRange(&objectVersion{key: key}, rangeSt, rangeEn)
+}
+
+// getObjectRange retrieves a byte range of a version of an object from S3,
+// see GetObjectByteRange
+func (s3b *S3Bucket) getObjectRange(obj *objectVersion, rangeSt, rangeEn int64) ([]byte, error) {
 	// Create the GetObjectInput with Range parameter
-	input := &s3.GetObjectInput{
-		Bucket: aws.String(s3b.bucketName),
-		Key:    aws.String(key),
-		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", rangeSt, rangeEn)),
-	}
+	input := s3b.objectInput(obj, aws.String(fmt.Sprintf("bytes=%d-%d", rangeSt, rangeEn)))
 
 	// Perform the request
 	result, err := s3b.client.GetObject(context.TODO(), input)
@@ -187,7 +520,7 @@ func (s3b *S3Bucket) GetObjectByteRange(key string, rangeSt, rangeEn int64) ([]b
 		return nil, fmt.Errorf("no data returned for range %d-%d", rangeSt, rangeEn)
 	}
 
-	fmt.Printf("Downloaded bytes %d-%d from %s/%s\n", rangeSt, rangeEn, s3b.bucketName, key)
+	fmt.Printf("Downloaded bytes %d-%d from %s/%s\n", rangeSt, rangeEn, s3b.bucketName, obj.key)
 
 	return data, nil
 }
@@ -0,0 +1,105 @@
+package main
+
+// This file contains the point-in-time queries of the local dictionary:
+//
+//	GET /dict/:word?version=20240501100000
+//	GET /dict?version=20240415
+//
+// ?version= names an archived version, "current", or a point in time as a
+// prefix of a version, see dict.Versions. The response reports the version
+// that answered in "version".
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/harshjoeyit/word-dict/dict"
+)
+
+// lookupFunc queries a dictionary for a word, see dict.Dict.Lookup
+type lookupFunc func(word string) (*dict.Entry, bool)
+
+// lookupHandler serves the entry of a word, from ?version= if it's given
+func lookupHandler(lookup lookupFunc, versions *dict.Versions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		word := c.Param("word")
+
+		var e *dict.Entry
+		var ok bool
+		version := c.Query("version")
+		if version != "" {
+			if versions == nil {
+				versionsUnavailable(c)
+				return
+			}
+
+			var err error
+			e, version, ok, err = versions.Lookup(version, word)
+			if err != nil {
+				versionError(c, err)
+				return
+			}
+		} else {
+			e, ok = lookup(word)
+		}
+
+		if !ok {
+			resp := gin.H{"error": "Word not found"}
+			if version != "" {
+				resp["version"] = version
+			}
+			c.JSON(http.StatusNotFound, resp)
+			return
+		}
+
+		if version != "" {
+			c.JSON(http.StatusOK, versionedEntryResponse(e, version))
+			return
+		}
+
+		c.JSON(http.StatusOK, entryResponse(e))
+	}
+}
+
+// versionedEntryResponse is the JSON shape of a word found in a version
+func versionedEntryResponse(e *dict.Entry, version string) any {
+	return struct {
+		*dict.Entry
+		Definition string `json:"definition"`
+		Version    string `json:"version"`
+	}{e, e.Definition(), version}
+}
+
+// versionsUnavailable rejects ?version= for the dictionaries without archived versions
+func versionsUnavailable(c *gin.Context) {
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error": "Versions are not available for this dictionary",
+	})
+}
+
+// versionError responds to a failed version query, see dict.ErrVersionNotFound.
+// Versions of a layout this build can't read, e.g. newer ones, are rejected
+// as such rather than as a server error.
+func versionError(c *gin.Context, err error) {
+	if errors.Is(err, dict.ErrVersionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Version not found",
+		})
+		return
+	}
+
+	if errors.Is(err, dict.ErrBadFormat) {
+		log.Printf("error opening version: %v", err)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": "Version is in a dictionary format this server can't read, migrate it with the migrate command",
+		})
+		return
+	}
+
+	log.Printf("error opening version: %v", err)
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"error": "Failed to open the version",
+	})
+}